@@ -67,6 +67,7 @@ import (
 	"time"
 
 	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/units"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -112,6 +113,8 @@ type cmdGlobal struct {
 	flagDisableOverlay bool
 	flagSourcesDir     string
 	flagKeepSources    bool
+	flagDownloadLimit  string
+	flagVerifyLock     bool
 
 	definition     *shared.Definition
 	sourceDir      string
@@ -174,6 +177,16 @@ func main() {
 				}
 			}()
 
+			if globalCmd.flagDownloadLimit != "" {
+				limit, err := units.ParseByteSizeString(globalCmd.flagDownloadLimit)
+				if err != nil || limit <= 0 {
+					fmt.Fprintf(os.Stderr, "Invalid download rate limit %q\n", globalCmd.flagDownloadLimit)
+					os.Exit(1)
+				}
+
+				sources.SetDownloadRateLimit(limit)
+			}
+
 			// No need to create cache directory if we're only validating.
 			if cmd.CalledAs() == "validate" {
 				return
@@ -205,6 +218,8 @@ func main() {
 	app.PersistentFlags().BoolVar(&globalCmd.flagVersion, "version", false, "Print version number")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDebug, "debug", false, "Enable debug output")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDisableOverlay, "disable-overlay", false, "Disable the use of filesystem overlays")
+	app.PersistentFlags().StringVar(&globalCmd.flagDownloadLimit, "download-rate-limit", "", "Limit the combined download rate of sources (bytes per second, e.g. 10MB)"+"``")
+	app.PersistentFlags().BoolVar(&globalCmd.flagVerifyLock, "verify-lock", false, "Fail if downloaded sources differ from the ones recorded in "+sources.LockFileName+" in the target directory")
 
 	// Version handling
 	app.SetVersionTemplate("{{.Version}}\n")
@@ -338,6 +353,31 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to render source URL: %w", err)
 	}
 
+	// Record downloaded sources in a lock file, and verify them against the
+	// existing lock file if requested. The lock file is not written when
+	// running build-dir, as the target directory is the rootfs itself.
+	var lock *sources.Lock
+
+	if isRunningBuildDir && c.flagVerifyLock {
+		return errors.New("Verifying sources lock file is not supported by build-dir")
+	}
+
+	if !isRunningBuildDir {
+		var locked *sources.Lock
+
+		lockPath := filepath.Join(c.targetDir, sources.LockFileName)
+
+		if c.flagVerifyLock {
+			locked, err = sources.ReadLockFile(lockPath)
+			if err != nil {
+				return fmt.Errorf("Failed to read lock file: %w", err)
+			}
+		}
+
+		lock = &sources.Lock{}
+		sources.SetLock(lock, locked)
+	}
+
 	// Load and run downloader
 	downloader, err := sources.Load(c.ctx, c.definition.Source.Downloader, c.logger, *c.definition, c.sourceDir, c.flagCacheDir, c.flagSourcesDir)
 	if err != nil {
@@ -351,6 +391,13 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error while downloading source: %w", err)
 	}
 
+	if lock != nil {
+		err = lock.WriteFile(filepath.Join(c.targetDir, sources.LockFileName))
+		if err != nil {
+			return fmt.Errorf("Failed to write lock file: %w", err)
+		}
+	}
+
 	// Setup the mounts and chroot into the rootfs
 	exitChroot, err := shared.SetupChroot(c.sourceDir, *c.definition, nil)
 	if err != nil {
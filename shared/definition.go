@@ -3,13 +3,16 @@ package shared
 import (
 	"errors"
 	"fmt"
+	"path"
 	"reflect"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/canonical/lxd/shared/osarch"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // ImageTarget represents the image target.
@@ -167,6 +170,11 @@ type DefinitionSource struct {
 	SameAs           string   `yaml:"same_as,omitempty"`
 	SkipVerification bool     `yaml:"skip_verification,omitempty"`
 	Components       []string `yaml:"components,omitempty"`
+	Build            string   `yaml:"build,omitempty"`
+
+	// Headers are additional HTTP headers sent with the requests to the
+	// host of the source URL (e.g. Authorization for a private mirror).
+	Headers map[string]string `yaml:"headers,omitempty"`
 }
 
 // A DefinitionTargetLXCConfig represents the config part of the metadata.
@@ -272,6 +280,18 @@ type DefinitionSimplestream struct {
 	// is a comma delimited string of additional release aliases.
 	ReleaseAliases map[string]string `yaml:"release_aliases,omitempty"`
 
+	// Map of variant aliases. Key represents the variant name and value
+	// is a comma delimited string of additional variant aliases.
+	VariantAliases map[string]string `yaml:"variant_aliases,omitempty"`
+
+	// ArchAliases enables additional architecture qualified aliases in
+	// format distro/release/variant/arch.
+	ArchAliases bool `yaml:"arch_aliases,omitempty"`
+
+	// RequireBothRootfs requires both container (squashfs) and VM (qcow2)
+	// root file systems for the version to be considered complete.
+	RequireBothRootfs bool `yaml:"require_both_rootfs,omitempty"`
+
 	// List of the image requirements.
 	Requirements []DefinitionSimplestreamRequirements `yaml:"requirements,omitempty"`
 }
@@ -289,6 +309,66 @@ type Definition struct {
 	Simplestream DefinitionSimplestream `yaml:"simplestream,omitempty"`
 }
 
+// ErrDefinitionInvalidSimplestream indicates that the simplestream section of
+// the definition contains unknown or misplaced keys.
+var ErrDefinitionInvalidSimplestream = errors.New("Invalid simplestream section")
+
+// simplestreamKeyPaths maps the types used within the simplestream section to
+// their location in the definition.
+var simplestreamKeyPaths = map[string]string{
+	"shared.DefinitionSimplestream":             "simplestream",
+	"shared.DefinitionSimplestreamRequirements": "simplestream.requirements",
+}
+
+// unknownFieldRegex matches unknown field errors reported by the strict YAML
+// decoder.
+var unknownFieldRegex = regexp.MustCompile(`field (\S+) not found in type (\S+)`)
+
+// LoadDefinition decodes the YAML content into a definition. Unlike plain
+// decoding, unknown or misplaced keys within the simplestream section are
+// reported as an error. Other sections are decoded leniently.
+func LoadDefinition(content []byte) (*Definition, error) {
+	def := &Definition{}
+
+	err := yaml.Unmarshal(content, def)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding YAML: %w", err)
+	}
+
+	// Decode the simplestream section strictly, while ignoring all other
+	// top-level keys.
+	strict := struct {
+		Simplestream DefinitionSimplestream `yaml:"simplestream,omitempty"`
+		Other        map[string]any         `yaml:",inline"`
+	}{}
+
+	err = yaml.UnmarshalStrict(content, &strict)
+	if err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("Error decoding YAML: %w", err)
+		}
+
+		// Translate decoder errors into more descriptive ones.
+		msgs := make([]string, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			match := unknownFieldRegex.FindStringSubmatch(msg)
+			if match != nil {
+				path, ok := simplestreamKeyPaths[match[2]]
+				if ok {
+					msg = strings.Replace(msg, match[0], fmt.Sprintf("unknown key %q in %q", match[1], path), 1)
+				}
+			}
+
+			msgs = append(msgs, msg)
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrDefinitionInvalidSimplestream, strings.Join(msgs, "; "))
+	}
+
+	return def, nil
+}
+
 // SetValue writes the provided value to a field represented by the yaml tag 'key'.
 func (d *Definition) SetValue(key string, value string) error {
 	// Walk through the definition and find the field with the given key
@@ -665,17 +745,56 @@ func getFieldByTag(v reflect.Value, t reflect.Type, tag string) (reflect.Value,
 	return v, nil
 }
 
+// matchFilterValues returns true if the value matches the filter values.
+// Filter values may contain shell patterns (e.g. "arm*"), and values prefixed
+// with "!" exclude matching values (e.g. "!arm64"). A value matches if it
+// matches none of the excluding values and either matches one of the
+// remaining values or there are no remaining values. An empty list matches
+// any value.
+func matchFilterValues(values []string, value string) bool {
+	match := func(pattern string) bool {
+		ok, err := path.Match(pattern, value)
+		if err != nil {
+			// Treat malformed patterns as literal values.
+			return pattern == value
+		}
+
+		return ok
+	}
+
+	included := false
+	hasIncludes := false
+
+	for _, v := range values {
+		exclude, ok := strings.CutPrefix(v, "!")
+		if ok {
+			if match(exclude) {
+				return false
+			}
+
+			continue
+		}
+
+		hasIncludes = true
+		if match(v) {
+			included = true
+		}
+	}
+
+	return included || !hasIncludes
+}
+
 // ApplyFilter returns true if the filter matches.
 func ApplyFilter(filter Filter, release string, architecture string, variant string, targetType DefinitionFilterType, acceptedImageTargets ImageTarget) bool {
-	if len(filter.GetReleases()) > 0 && !slices.Contains(filter.GetReleases(), release) {
+	if !matchFilterValues(filter.GetReleases(), release) {
 		return false
 	}
 
-	if len(filter.GetArchitectures()) > 0 && !slices.Contains(filter.GetArchitectures(), architecture) {
+	if !matchFilterValues(filter.GetArchitectures(), architecture) {
 		return false
 	}
 
-	if len(filter.GetVariants()) > 0 && !slices.Contains(filter.GetVariants(), variant) {
+	if !matchFilterValues(filter.GetVariants(), variant) {
 		return false
 	}
 
@@ -586,3 +586,149 @@ func TestDefinitionFilterTypeUnmarshalYAML(t *testing.T) {
 	err = yaml.Unmarshal([]byte(data), &out)
 	require.EqualError(t, err, `Invalid filter type "vms"`)
 }
+
+func TestLoadDefinition(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name: "Valid simplestream section",
+			content: `image:
+  distribution: ubuntu
+simplestream:
+  distro_name: Ubuntu
+  requirements:
+  - requirements:
+      secure_boot: "false"
+    architectures:
+    - amd64
+`,
+		},
+		{
+			name: "Unknown keys outside simplestream section",
+			content: `requirements:
+  secure_boot: false
+simplestream:
+  distro_name: Ubuntu
+`,
+		},
+		{
+			name: "Unknown key in simplestream section",
+			content: `simplestream:
+  distro: Ubuntu
+`,
+			wantErr: `unknown key "distro" in "simplestream"`,
+		},
+		{
+			name: "Misplaced key in simplestream requirements",
+			content: `simplestream:
+  requirements:
+  - secure_boot: false
+`,
+			wantErr: `unknown key "secure_boot" in "simplestream.requirements"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := LoadDefinition([]byte(tt.content))
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, ErrDefinitionInvalidSimplestream)
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "Ubuntu", def.Simplestream.DistroName)
+		})
+	}
+}
+
+func TestApplyFilterPatterns(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Releases      []string
+		Architectures []string
+		Variants      []string
+		Release       string
+		Architecture  string
+		Variant       string
+		Want          bool
+	}{
+		{
+			Name:         "Empty filter matches",
+			Release:      "noble",
+			Architecture: "amd64",
+			Variant:      "default",
+			Want:         true,
+		},
+		{
+			Name:          "Negated architecture excludes it",
+			Architectures: []string{"!arm64"},
+			Architecture:  "arm64",
+			Want:          false,
+		},
+		{
+			Name:          "Negated architecture matches other architectures",
+			Architectures: []string{"!arm64"},
+			Architecture:  "amd64",
+			Want:          true,
+		},
+		{
+			Name:          "Negation takes precedence over wildcard",
+			Architectures: []string{"*", "!arm64"},
+			Architecture:  "arm64",
+			Want:          false,
+		},
+		{
+			Name:     "Variant wildcard matches",
+			Variants: []string{"cloud*"},
+			Variant:  "cloud-minimal",
+			Want:     true,
+		},
+		{
+			Name:     "Variant wildcard does not match",
+			Variants: []string{"cloud*"},
+			Variant:  "default",
+			Want:     false,
+		},
+		{
+			Name:     "Variant wildcard with negation",
+			Variants: []string{"cloud*", "!cloud-minimal"},
+			Variant:  "cloud-minimal",
+			Want:     false,
+		},
+		{
+			Name:     "Release single character wildcard",
+			Releases: []string{"2?.04"},
+			Release:  "24.04",
+			Want:     true,
+		},
+		{
+			Name:     "Multiple negations",
+			Releases: []string{"!focal", "!jammy"},
+			Release:  "jammy",
+			Want:     false,
+		},
+		{
+			Name:     "Malformed pattern is matched literally",
+			Releases: []string{"[noble"},
+			Release:  "[noble",
+			Want:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filter := DefinitionFilter{
+				Releases:      test.Releases,
+				Architectures: test.Architectures,
+				Variants:      test.Variants,
+			}
+
+			require.Equal(t, test.Want, ApplyFilter(&filter, test.Release, test.Architecture, test.Variant, "", 0))
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket rate limiter that limits the number of bytes
+// per second. A single rate limiter can be shared by multiple readers, in which
+// case the limit applies to their combined throughput.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a new rate limiter that allows the given number of
+// bytes per second. The bucket holds at most one second worth of tokens.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// burst returns the maximum number of bytes that can be read at once.
+func (l *RateLimiter) burst() int {
+	return max(int(l.rate), 1)
+}
+
+// wait consumes n tokens and blocks until the consumed tokens are available.
+func (l *RateLimiter) wait(n int) {
+	l.mu.Lock()
+
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Reader wraps the given reader so that reads are limited by the rate limiter.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &rateLimitedReader{r: r, limiter: l}
+}
+
+// ReadCloser wraps the given read closer so that reads are limited by the rate
+// limiter.
+func (l *RateLimiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: l.Reader(rc),
+		Closer: rc,
+	}
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Do not read more than the bucket can hold at once.
+	if len(p) > r.limiter.burst() {
+		p = p[:r.limiter.burst()]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,44 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1500)
+
+	// Single reader. The initial bucket covers the first 1000 bytes,
+	// therefore, reading 1500 bytes takes at least half a second.
+	limiter := NewRateLimiter(1000)
+	start := time.Now()
+
+	out, err := io.ReadAll(limiter.Reader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	// Multiple readers share the limit.
+	limiter = NewRateLimiter(2000)
+	start = time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			out, err := io.ReadAll(limiter.Reader(bytes.NewReader(data)))
+			require.NoError(t, err)
+			require.Equal(t, data, out)
+		}()
+	}
+
+	wg.Wait()
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+}
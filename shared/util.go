@@ -2,6 +2,7 @@ package shared
 
 import (
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"context"
 	"encoding/hex"
@@ -10,8 +11,10 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
@@ -32,7 +35,8 @@ type EnvVariable struct {
 // Environment represents a set of environment variables.
 type Environment map[string]EnvVariable
 
-// Copy copies a file.
+// Copy copies a file. The modification time of the source file is preserved,
+// so that age-based decisions (e.g. pruning) are not affected by the copy.
 func Copy(src, dest string) error {
 	var err error
 
@@ -43,6 +47,11 @@ func Copy(src, dest string) error {
 
 	defer srcFile.Close()
 
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to stat file %q: %w", src, err)
+	}
+
 	destFile, err := os.Create(dest)
 	if err != nil {
 		return fmt.Errorf("Failed to create file %q: %w", dest, err)
@@ -55,7 +64,18 @@ func Copy(src, dest string) error {
 		return fmt.Errorf("Failed to copy file: %w", err)
 	}
 
-	return destFile.Sync()
+	err = destFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	// Zero access time leaves it unchanged.
+	err = os.Chtimes(dest, time.Time{}, srcInfo.ModTime())
+	if err != nil {
+		return fmt.Errorf("Failed to set modification time of file %q: %w", dest, err)
+	}
+
+	return nil
 }
 
 // RunCommand runs a command. Stdout is written to the given io.Writer. If nil, it's written to the real stdout. Stderr is always written to the real stderr.
@@ -180,6 +200,30 @@ func compressTarball(ctx context.Context, filename, compression string) (string,
 	return fmt.Sprintf("%s.%s", filename, fileExtension), nil
 }
 
+// Now returns the current time. It is used for timestamps written into the
+// generated metadata, and can be replaced (e.g. in tests) to make them
+// deterministic. By default, the time from the SOURCE_DATE_EPOCH environment
+// variable is returned if set. Note that it affects only the timestamps within
+// the serialized metadata, not modification times of files on disk.
+var Now = sourceDateEpochNow
+
+// sourceDateEpochNow returns the time from the SOURCE_DATE_EPOCH environment
+// variable (seconds since Unix epoch) in UTC. If the variable is not set or
+// cannot be parsed, the current time is returned.
+func sourceDateEpochNow() time.Time {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now()
+	}
+
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+
+	return time.Unix(sec, 0).UTC()
+}
+
 // GetExpiryDate returns an expiry date based on the creationDate and format.
 func GetExpiryDate(creationDate time.Time, format string) time.Time {
 	regex := regexp.MustCompile(`(?:(\d+)(s|m|h|d|w))*`)
@@ -418,6 +462,35 @@ func AppendToFile(path string, content string) error {
 	return nil
 }
 
+// LockFile acquires an exclusive advisory lock on the existing file or
+// directory on the given path. The call blocks until the lock is acquired.
+// The returned function releases the lock.
+func LockFile(path string) (unlock func() error, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("Failed to lock file %q: %w", path, err)
+	}
+
+	unlock = func() error {
+		// Closing the file releases the lock.
+		return file.Close()
+	}
+
+	return unlock, nil
+}
+
 // FileHash calculates the combined hash for the given files using the provided
 // hash function.
 func FileHash(hash hash.Hash, paths ...string) (string, error) {
@@ -442,10 +515,65 @@ func FileHash(hash hash.Hash, paths ...string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
+// DirSize returns the total size of regular files within the directory tree
+// on the given path. Symbolic links are not followed, so the files they point
+// to are not counted twice.
+func DirSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(filepath.Clean(path), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// ErrChecksumMismatch indicates that the file hash does not match the expected
+// checksum.
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+// VerifyChecksum calculates the hash of the file on the given path using the
+// provided hash function and compares it with the expected checksum.
+func VerifyChecksum(path string, hash hash.Hash, expected string) error {
+	actual, err := FileHash(hash, path)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: File %q: expected %q, actual %q", ErrChecksumMismatch, path, expected, actual)
+	}
+
+	return nil
+}
+
 // GZipFile compresses the file on the source path and writes the compressed
 // content to the destination path. If destination path is empty, the source
 // file name is used with .gz suffix.
 func GZipFile(srcPath string, dstPath string) error {
+	return GZipFileLevel(srcPath, dstPath, gzip.BestCompression)
+}
+
+// GZipFileLevel is like GZipFile, but compresses the file using the given
+// compression level.
+func GZipFileLevel(srcPath string, dstPath string, level int) error {
 	if dstPath == "" {
 		dstPath = fmt.Sprintf("%s.gz", srcPath)
 	}
@@ -464,7 +592,7 @@ func GZipFile(srcPath string, dstPath string) error {
 
 	defer dstFile.Close()
 
-	writer, err := gzip.NewWriterLevel(dstFile, gzip.BestCompression)
+	writer, err := gzip.NewWriterLevel(dstFile, level)
 	if err != nil {
 		return err
 	}
@@ -478,11 +606,18 @@ func GZipFile(srcPath string, dstPath string) error {
 		return err
 	}
 
-	return nil
+	return writer.Close()
 }
 
+// ErrGZipCorrupted indicates that the gzip file is truncated or its content
+// does not match the checksum or size recorded in its trailer.
+var ErrGZipCorrupted = errors.New("Corrupted gzip file")
+
 // ReadGZipFile opens the GZ file on the given path and decompresses it
-// decode into an array of bytes.
+// decode into an array of bytes. The file is read until EOF, which ensures
+// the CRC and size of the decompressed content are verified against the
+// gzip trailer. Truncated or corrupted file results in an error wrapping
+// ErrGZipCorrupted.
 func ReadGZipFile(path string) ([]byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -491,18 +626,30 @@ func ReadGZipFile(path string) ([]byte, error) {
 
 	defer file.Close()
 
+	// corrupted wraps errors caused by malformed gzip data.
+	corrupted := func(err error) error {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			return fmt.Errorf("%w %q: %w", ErrGZipCorrupted, path, err)
+		}
+
+		return err
+	}
+
 	reader, err := gzip.NewReader(file)
 	if err != nil {
-		return nil, err
+		return nil, corrupted(err)
 	}
 
 	defer reader.Close()
 
 	buf := &bytes.Buffer{}
 
+	// The gzip reader verifies the trailer only once the end of the
+	// compressed stream is reached, therefore, reading it till EOF is
+	// essential.
 	_, err = io.Copy(buf, reader)
 	if err != nil {
-		return nil, err
+		return nil, corrupted(err)
 	}
 
 	return buf.Bytes(), nil
@@ -565,6 +712,43 @@ func WriteJSONFile(path string, obj any) error {
 	return nil
 }
 
+// WriteJSONTempFileIn encodes the given structure into JSON format and writes
+// it to a new hidden temporary file within the given directory. The directory
+// should be the one of the final file, so that the temporary file can be
+// atomically renamed without crossing file systems. The temporary file is
+// readable by everyone and its path is returned. It is the caller's
+// responsibility to remove the file if it is not renamed.
+func WriteJSONTempFileIn(dir string, obj any) (string, error) {
+	file, err := os.CreateTemp(dir, ".*.json.tmp")
+	if err != nil {
+		return "", fmt.Errorf("Failed creating temporary file: %w", err)
+	}
+
+	path := file.Name()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(obj)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return "", fmt.Errorf("Error encoding JSON: %w", err)
+	}
+
+	err = file.Close()
+	if err == nil {
+		err = os.Chmod(path, 0644)
+	}
+
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
 // MapKeys returns map keys as a list.
 func MapKeys[K comparable, V any](m map[K]V) []K {
 	keys := make([]K, 0, len(m))
@@ -575,6 +759,14 @@ func MapKeys[K comparable, V any](m map[K]V) []K {
 	return keys
 }
 
+// MapKeysSorted returns map keys as a sorted list.
+func MapKeysSorted[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := MapKeys(m)
+	slices.Sort(keys)
+
+	return keys
+}
+
 // HasSuffix returns true if the key matches any of the given suffixes.
 func HasSuffix(key string, suffixes ...string) bool {
 	for _, suffix := range suffixes {
@@ -1,9 +1,15 @@
 package shared
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/flosch/pongo2/v4"
 	"github.com/stretchr/testify/require"
@@ -217,3 +223,223 @@ func TestSquashfsParseCompression(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, []byte("test-content"), 0644)
+	require.NoError(t, err)
+
+	// SHA256 of "test-content".
+	checksum := "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	err = VerifyChecksum(path, sha256.New(), checksum)
+	require.NoError(t, err)
+
+	err = VerifyChecksum(path, sha256.New(), "invalid")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	err = VerifyChecksum(filepath.Join(t.TempDir(), "missing"), sha256.New(), checksum)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+
+	err := os.WriteFile(src, []byte("test-content"), 0644)
+	require.NoError(t, err)
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(src, mtime, mtime)
+	require.NoError(t, err)
+
+	err = Copy(src, dest)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, "test-content", string(content))
+
+	// Ensure modification time of the source file is preserved.
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	require.True(t, mtime.Equal(info.ModTime()), "Modification time not preserved: %v", info.ModTime())
+
+	err = Copy(filepath.Join(dir, "missing"), dest)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLockFile(t *testing.T) {
+	path := t.TempDir()
+
+	_, err := LockFile(filepath.Join(path, "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	unlock, err := LockFile(path)
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+
+	go func() {
+		unlock, err := LockFile(path)
+		if err == nil {
+			_ = unlock()
+		}
+
+		close(locked)
+	}()
+
+	// Ensure the second lock waits until the first one is released.
+	select {
+	case <-locked:
+		t.Fatal("Lock acquired while the file is already locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = unlock()
+	require.NoError(t, err)
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock not acquired after the file was unlocked")
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "file"), make([]byte, 10), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "a", "b", "file"), make([]byte, 20), 0644)
+	require.NoError(t, err)
+
+	// Symlinks to a file and a directory must not be counted.
+	err = os.Symlink(filepath.Join(dir, "file"), filepath.Join(dir, "a", "link"))
+	require.NoError(t, err)
+
+	err = os.Symlink(filepath.Join(dir, "a", "b"), filepath.Join(dir, "a", "dirlink"))
+	require.NoError(t, err)
+
+	size, err := DirSize(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), size)
+
+	// Unclean path.
+	size, err = DirSize(dir + "//a/../a/")
+	require.NoError(t, err)
+	require.Equal(t, int64(20), size)
+
+	_, err = DirSize(filepath.Join(dir, "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMapKeysSorted(t *testing.T) {
+	m := map[string]int{"c": 3, "a": 1, "b": 2}
+	require.Equal(t, []string{"a", "b", "c"}, MapKeysSorted(m))
+	require.Empty(t, MapKeysSorted(map[int]bool{}))
+}
+
+func TestSourceDateEpochNow(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1717243200")
+	require.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Now())
+
+	// Invalid value falls back to the current time.
+	t.Setenv("SOURCE_DATE_EPOCH", "invalid")
+	require.WithinDuration(t, time.Now(), Now(), time.Minute)
+}
+
+func TestReadGZipFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("test-content\n"), 1000)
+
+	path := filepath.Join(dir, "file.gz")
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	err = os.WriteFile(path, buf.Bytes(), 0644)
+	require.NoError(t, err)
+
+	data, err := ReadGZipFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+
+	// Truncated trailer (CRC and size).
+	truncatedPath := filepath.Join(dir, "truncated.gz")
+	err = os.WriteFile(truncatedPath, buf.Bytes()[:buf.Len()-4], 0644)
+	require.NoError(t, err)
+
+	_, err = ReadGZipFile(truncatedPath)
+	require.ErrorIs(t, err, ErrGZipCorrupted)
+
+	// Truncated compressed data.
+	err = os.WriteFile(truncatedPath, buf.Bytes()[:buf.Len()/2], 0644)
+	require.NoError(t, err)
+
+	_, err = ReadGZipFile(truncatedPath)
+	require.ErrorIs(t, err, ErrGZipCorrupted)
+
+	// Truncated header.
+	err = os.WriteFile(truncatedPath, buf.Bytes()[:4], 0644)
+	require.NoError(t, err)
+
+	_, err = ReadGZipFile(truncatedPath)
+	require.ErrorIs(t, err, ErrGZipCorrupted)
+
+	// Mismatched checksum.
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[len(corrupted)-8] ^= 0xFF
+
+	corruptedPath := filepath.Join(dir, "corrupted.gz")
+	err = os.WriteFile(corruptedPath, corrupted, 0644)
+	require.NoError(t, err)
+
+	_, err = ReadGZipFile(corruptedPath)
+	require.ErrorIs(t, err, ErrGZipCorrupted)
+	require.ErrorIs(t, err, gzip.ErrChecksum)
+
+	_, err = ReadGZipFile(filepath.Join(dir, "missing.gz"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWriteJSONTempFileIn(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := WriteJSONTempFileIn(dir, map[string]string{"key": "value"})
+	require.NoError(t, err)
+	require.Equal(t, dir, filepath.Dir(path))
+	require.True(t, strings.HasPrefix(filepath.Base(path), "."))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	obj, err := ReadJSONFile(path, &map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"key": "value"}, *obj)
+
+	// Ensure temporary files do not collide.
+	other, err := WriteJSONTempFileIn(dir, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, path, other)
+
+	// Ensure no file is left behind if the object cannot be encoded.
+	_, err = WriteJSONTempFileIn(dir, func() {})
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = WriteJSONTempFileIn(filepath.Join(dir, "missing"), nil)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,471 @@
+package casync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// IndexExt is the extension of the blob index file.
+	IndexExt = ".caibx"
+
+	// ChunkExt is the extension of the compressed chunk file in the chunk store.
+	ChunkExt = ".cacnk"
+)
+
+// Default chunk sizes (same as casync defaults).
+const (
+	ChunkSizeMinDefault = 16 * 1024
+	ChunkSizeAvgDefault = 64 * 1024
+	ChunkSizeMaxDefault = 256 * 1024
+)
+
+var (
+	// ErrInvalidIndex indicates that the index file cannot be parsed.
+	ErrInvalidIndex = errors.New("Invalid casync index")
+
+	// ErrInvalidChunk indicates that the content of the chunk does not match
+	// its ID.
+	ErrInvalidChunk = errors.New("Invalid casync chunk")
+)
+
+// Identifiers of the casync format (see casync's caformat.h).
+const (
+	formatIndex           uint64 = 0x96824d9c7b129ff9
+	formatTable           uint64 = 0xe75b9e112f17417d
+	formatTableTailMarker uint64 = 0x4b4f050e5549ecd1
+
+	featureExcludeNoDump uint64 = 0x8000000000000000
+	featureSHA512256     uint64 = 0x2000000000000000
+)
+
+// Size of the index header and table item in bytes.
+const (
+	indexHeaderSize = 48
+	tableHeaderSize = 16
+	tableItemSize   = 40
+	tableTailSize   = 40
+)
+
+// windowSize is the size of the rolling hash window.
+const windowSize = 48
+
+// hashTable contains random values for the rolling hash. Chunk boundaries
+// therefore differ from the ones produced by casync, but the resulting index
+// and chunk store remain compatible with casync and desync clients.
+var hashTable = func() (table [256]uint32) {
+	r := rand.New(rand.NewSource(0x6361737963))
+	for i := range table {
+		table[i] = r.Uint32()
+	}
+
+	return table
+}()
+
+// ChunkID is the SHA512/256 hash of the uncompressed chunk data.
+type ChunkID [32]byte
+
+// String returns the hex encoded chunk ID.
+func (id ChunkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Chunk is a single chunk of the blob.
+type Chunk struct {
+	ID    ChunkID
+	Start uint64
+	Size  uint64
+}
+
+// Index lists chunks of the blob in order.
+type Index struct {
+	ChunkSizeMin uint64
+	ChunkSizeAvg uint64
+	ChunkSizeMax uint64
+	Chunks       []Chunk
+}
+
+// Size returns the total size of the blob.
+func (i Index) Size() uint64 {
+	if len(i.Chunks) == 0 {
+		return 0
+	}
+
+	last := i.Chunks[len(i.Chunks)-1]
+	return last.Start + last.Size
+}
+
+// MakeIndex splits the file on the given path into content-defined chunks
+// using the default chunk sizes, stores missing chunks in the chunk store,
+// and returns the blob index.
+func MakeIndex(ctx context.Context, path string, store Store) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	index := &Index{
+		ChunkSizeMin: ChunkSizeMinDefault,
+		ChunkSizeAvg: ChunkSizeAvgDefault,
+		ChunkSizeMax: ChunkSizeMaxDefault,
+	}
+
+	c := newChunker(bufio.NewReader(file), index.ChunkSizeMin, index.ChunkSizeAvg, index.ChunkSizeMax)
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		start, data, err := c.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		id := ChunkID(sha512.Sum512_256(data))
+
+		err = store.Put(id, data)
+		if err != nil {
+			return nil, err
+		}
+
+		index.Chunks = append(index.Chunks, Chunk{ID: id, Start: start, Size: uint64(len(data))})
+	}
+
+	return index, nil
+}
+
+// ReadIndexFile reads the index from the file on the given path.
+func ReadIndexFile(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseIndex(data)
+}
+
+// ParseIndex parses the index from the content of the index file.
+func ParseIndex(data []byte) (*Index, error) {
+	if len(data) < indexHeaderSize+tableHeaderSize+tableTailSize {
+		return nil, fmt.Errorf("%w: File too short", ErrInvalidIndex)
+	}
+
+	le := binary.LittleEndian
+
+	if le.Uint64(data[0:8]) != indexHeaderSize || le.Uint64(data[8:16]) != formatIndex {
+		return nil, fmt.Errorf("%w: Unexpected index header", ErrInvalidIndex)
+	}
+
+	if le.Uint64(data[16:24])&featureSHA512256 == 0 {
+		return nil, fmt.Errorf("%w: Only SHA512/256 chunk IDs are supported", ErrInvalidIndex)
+	}
+
+	index := &Index{
+		ChunkSizeMin: le.Uint64(data[24:32]),
+		ChunkSizeAvg: le.Uint64(data[32:40]),
+		ChunkSizeMax: le.Uint64(data[40:48]),
+	}
+
+	table := data[indexHeaderSize:]
+	if le.Uint64(table[8:16]) != formatTable {
+		return nil, fmt.Errorf("%w: Unexpected table header", ErrInvalidIndex)
+	}
+
+	items := table[tableHeaderSize : len(table)-tableTailSize]
+	if len(items)%tableItemSize != 0 {
+		return nil, fmt.Errorf("%w: Unexpected table size", ErrInvalidIndex)
+	}
+
+	tail := table[len(table)-tableTailSize:]
+	if le.Uint64(tail[32:40]) != formatTableTailMarker {
+		return nil, fmt.Errorf("%w: Unexpected table tail", ErrInvalidIndex)
+	}
+
+	var start uint64
+
+	for i := 0; i < len(items); i += tableItemSize {
+		end := le.Uint64(items[i : i+8])
+		if end <= start {
+			return nil, fmt.Errorf("%w: Chunk offsets are not increasing", ErrInvalidIndex)
+		}
+
+		chunk := Chunk{Start: start, Size: end - start}
+		copy(chunk.ID[:], items[i+8:i+tableItemSize])
+
+		index.Chunks = append(index.Chunks, chunk)
+		start = end
+	}
+
+	return index, nil
+}
+
+// Bytes encodes the index in the casync blob index format.
+func (i Index) Bytes() []byte {
+	le := binary.LittleEndian
+	buf := bytes.Buffer{}
+
+	// Index header.
+	buf.Write(le.AppendUint64(nil, indexHeaderSize))
+	buf.Write(le.AppendUint64(nil, formatIndex))
+	buf.Write(le.AppendUint64(nil, featureExcludeNoDump|featureSHA512256))
+	buf.Write(le.AppendUint64(nil, i.ChunkSizeMin))
+	buf.Write(le.AppendUint64(nil, i.ChunkSizeAvg))
+	buf.Write(le.AppendUint64(nil, i.ChunkSizeMax))
+
+	// Table header with unknown size.
+	buf.Write(le.AppendUint64(nil, ^uint64(0)))
+	buf.Write(le.AppendUint64(nil, formatTable))
+
+	// Table items contain the end offset and ID of each chunk.
+	for _, c := range i.Chunks {
+		buf.Write(le.AppendUint64(nil, c.Start+c.Size))
+		buf.Write(c.ID[:])
+	}
+
+	// Table tail.
+	buf.Write(le.AppendUint64(nil, 0))
+	buf.Write(le.AppendUint64(nil, 0))
+	buf.Write(le.AppendUint64(nil, indexHeaderSize))
+	buf.Write(le.AppendUint64(nil, uint64(tableHeaderSize+len(i.Chunks)*tableItemSize+tableTailSize)))
+	buf.Write(le.AppendUint64(nil, formatTableTailMarker))
+
+	return buf.Bytes()
+}
+
+// WriteFile writes the index to the file on the given path. The index is
+// written to a temporary file first, which then replaces the final file.
+func (i Index) WriteFile(path string) error {
+	pathTemp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	err := os.WriteFile(pathTemp, i.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(pathTemp)
+
+	return os.Rename(pathTemp, path)
+}
+
+// Extract assembles the blob from the chunks in the chunk store and writes
+// it to the given writer.
+func (i Index) Extract(store Store, w io.Writer) error {
+	for _, c := range i.Chunks {
+		data, err := store.Get(c.ID)
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(data)) != c.Size {
+			return fmt.Errorf("%w: Chunk %q has unexpected size", ErrInvalidChunk, c.ID)
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Store is a local casync chunk store. Chunks are compressed using zstd and
+// stored in "<dir>/<first 4 hex chars of ID>/<ID>.cacnk".
+type Store struct {
+	Dir string
+}
+
+// ChunkPath returns the path of the chunk file with the given ID.
+func (s Store) ChunkPath(id ChunkID) string {
+	name := id.String()
+	return filepath.Join(s.Dir, name[:4], name+ChunkExt)
+}
+
+// Put compresses and stores the chunk data, unless the chunk already exists.
+func (s Store) Put(id ChunkID, data []byte) error {
+	path := s.ChunkPath(id)
+
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+
+	defer enc.Close()
+
+	// Write chunk to a temporary file to ensure concurrent writers and
+	// readers never see a partially written chunk.
+	file, err := os.CreateTemp(filepath.Dir(path), ".chunk-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(enc.EncodeAll(data, nil))
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(file.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Get reads and decompresses the chunk with the given ID and verifies that
+// the chunk data matches the ID.
+func (s Store) Get(id ChunkID) ([]byte, error) {
+	compressed, err := os.ReadFile(s.ChunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer dec.Close()
+
+	data, err := dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: Chunk %q: %w", ErrInvalidChunk, id, err)
+	}
+
+	if ChunkID(sha512.Sum512_256(data)) != id {
+		return nil, fmt.Errorf("%w: Chunk %q does not match its ID", ErrInvalidChunk, id)
+	}
+
+	return data, nil
+}
+
+// chunker splits the data into content-defined chunks using a rolling hash
+// (buzhash) over a window of the last 48 bytes.
+type chunker struct {
+	r             io.Reader
+	buf           []byte
+	eof           bool
+	offset        uint64
+	min           uint64
+	max           uint64
+	discriminator uint32
+}
+
+// newChunker returns a chunker that produces chunks with the given minimum,
+// average, and maximum size.
+func newChunker(r io.Reader, min uint64, avg uint64, max uint64) *chunker {
+	return &chunker{
+		r:             r,
+		buf:           make([]byte, 0, max),
+		min:           min,
+		max:           max,
+		discriminator: discriminator(avg),
+	}
+}
+
+// discriminator returns the value used to find chunk boundaries for the
+// given average chunk size (the same formula as used by casync).
+func discriminator(avg uint64) uint32 {
+	return uint32(float64(avg) / (-1.42888852e-7*float64(avg) + 1.33237515))
+}
+
+// next returns the start offset and the data of the next chunk. The returned
+// data is valid only until the next call. Once all data is consumed, io.EOF
+// is returned.
+func (c *chunker) next() (uint64, []byte, error) {
+	// Fill the buffer up to the maximum chunk size.
+	for !c.eof && uint64(len(c.buf)) < c.max {
+		n, err := c.r.Read(c.buf[len(c.buf):c.max])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return 0, nil, err
+			}
+
+			c.eof = true
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	size := c.boundary()
+	start := c.offset
+
+	chunk := make([]byte, size)
+	copy(chunk, c.buf[:size])
+
+	// Shift the remaining data to the beginning of the buffer.
+	c.buf = c.buf[:copy(c.buf, c.buf[size:])]
+	c.offset += size
+
+	return start, chunk, nil
+}
+
+// boundary returns the size of the next chunk within the buffer.
+func (c *chunker) boundary() uint64 {
+	n := uint64(len(c.buf))
+	if n <= c.min {
+		return n
+	}
+
+	// Hash the window preceding the minimum chunk size.
+	var h uint32
+	for i := c.min - windowSize; i < c.min; i++ {
+		h = rol32(h, 1) ^ hashTable[c.buf[i]]
+	}
+
+	for i := c.min; i < n; i++ {
+		if h%c.discriminator == c.discriminator-1 {
+			return i
+		}
+
+		h = rol32(h, 1) ^ rol32(hashTable[c.buf[i-windowSize]], windowSize%32) ^ hashTable[c.buf[i]]
+	}
+
+	return n
+}
+
+// rol32 rotates the value left by the given number of bits.
+func rol32(v uint32, s uint) uint32 {
+	return v<<s | v>>(32-s)
+}
@@ -0,0 +1,109 @@
+package casync_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/casync"
+)
+
+// writeRandomFile writes random data of the given size generated from the
+// given seed to the file on the given path.
+func writeRandomFile(t *testing.T, path string, size int, seed int64) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+
+	err := os.WriteFile(path, data, 0644)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestMakeIndex(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	store := casync.Store{Dir: filepath.Join(tmpDir, "store")}
+
+	blobPath := filepath.Join(tmpDir, "rootfs.squashfs")
+	data := writeRandomFile(t, blobPath, 2*1024*1024, 1)
+
+	index, err := casync.MakeIndex(context.Background(), blobPath, store)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), index.Size())
+	require.Greater(t, len(index.Chunks), 1)
+
+	// Ensure chunk sizes are within limits (except for the last chunk).
+	for _, c := range index.Chunks[:len(index.Chunks)-1] {
+		require.GreaterOrEqual(t, c.Size, uint64(casync.ChunkSizeMinDefault))
+		require.LessOrEqual(t, c.Size, uint64(casync.ChunkSizeMaxDefault))
+		require.FileExists(t, store.ChunkPath(c.ID))
+	}
+
+	// Ensure index survives encoding.
+	indexPath := filepath.Join(tmpDir, "rootfs.squashfs"+casync.IndexExt)
+	err = index.WriteFile(indexPath)
+	require.NoError(t, err)
+
+	decoded, err := casync.ReadIndexFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, index, decoded)
+
+	// Ensure blob can be reassembled from the chunk store.
+	var buf bytes.Buffer
+	err = decoded.Extract(store, &buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+
+	// Ensure modified blob reuses most of the existing chunks.
+	data[len(data)/2] ^= 0xFF
+	err = os.WriteFile(blobPath, data, 0644)
+	require.NoError(t, err)
+
+	modified, err := casync.MakeIndex(context.Background(), blobPath, store)
+	require.NoError(t, err)
+
+	known := make(map[casync.ChunkID]bool)
+	for _, c := range index.Chunks {
+		known[c.ID] = true
+	}
+
+	changed := 0
+	for _, c := range modified.Chunks {
+		if !known[c.ID] {
+			changed++
+		}
+	}
+
+	require.LessOrEqual(t, changed, 2)
+}
+
+func TestParseIndex_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := casync.ParseIndex([]byte("invalid"))
+	require.ErrorIs(t, err, casync.ErrInvalidIndex)
+
+	// Ensure corrupted chunk is detected.
+	tmpDir := t.TempDir()
+	store := casync.Store{Dir: tmpDir}
+
+	blobPath := filepath.Join(tmpDir, "blob")
+	writeRandomFile(t, blobPath, 1024, 2)
+
+	index, err := casync.MakeIndex(context.Background(), blobPath, store)
+	require.NoError(t, err)
+	require.Len(t, index.Chunks, 1)
+
+	err = os.WriteFile(store.ChunkPath(index.Chunks[0].ID), []byte("corrupted"), 0644)
+	require.NoError(t, err)
+
+	err = index.Extract(store, &bytes.Buffer{})
+	require.ErrorIs(t, err, casync.ErrInvalidChunk)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type auditChecksumsOptions struct {
+	global *globalOptions
+
+	ImageDirs     []string
+	ChecksumFiles []string
+	DeltaDir      string
+	Fix           bool
+}
+
+func (o *auditChecksumsOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "audit-checksums <path> [flags]",
+		Short:   "List items without a checksum entry",
+		Long:    "List items of complete product versions whose file name is absent from the version checksum file, including items of versions without a checksum file (e.g. delta files generated for such versions).",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringSliceVar(&o.ChecksumFiles, "checksum-file-name", []string{stream.FileChecksumSHA256}, "Candidate names of the version checksum file (the first existing one is used, and the first one is created with --fix if none exists)")
+	cmd.PersistentFlags().StringVar(&o.DeltaDir, "delta-dir", "", "Directory for generated delta files (relative to path argument)")
+	cmd.PersistentFlags().BoolVar(&o.Fix, "fix", false, "Calculate checksums of the listed items and append them to the checksum file using its hash algorithms")
+
+	return cmd
+}
+
+func (o *auditChecksumsOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if len(o.ChecksumFiles) == 0 {
+		return fmt.Errorf("Flag %q cannot be empty", "checksum-file-name")
+	}
+
+	var missing []missingChecksum
+
+	for _, dir := range o.ImageDirs {
+		m, err := auditChecksums(args[0], dir, o.ChecksumFiles, o.DeltaDir, o.Fix)
+		if err != nil {
+			return err
+		}
+
+		missing = append(missing, m...)
+	}
+
+	return writeMissingChecksums(cmd.OutOrStdout(), missing)
+}
+
+// missingChecksum is an item without an entry in the version checksum file.
+type missingChecksum struct {
+	// Stream is the name of the stream containing the item.
+	Stream string
+
+	// Product is the product ID.
+	Product string
+
+	// Version is the version name.
+	Version string
+
+	// Item is the item name.
+	Item string
+
+	// ChecksumFile is the name of the version checksum file. It is empty
+	// if the version has no checksum file.
+	ChecksumFile string
+}
+
+// auditChecksums returns items of all complete product versions within the
+// given stream that have no entry in the version checksum file. If deltaDir is
+// set, delta files stored within it are audited against the checksum file
+// located next to them. Items are sorted by product ID, version name, and item
+// name. If fix is true, checksums of such items are appended to the checksum
+// file, which is created using the first of the given names if none exists.
+func auditChecksums(rootDir string, streamName string, checksumFiles []string, deltaDir string, fix bool) ([]missingChecksum, error) {
+	products, err := stream.GetProducts(rootDir, streamName,
+		stream.WithChecksumFiles(checksumFiles...),
+		stream.WithSkipErrors(true),
+		stream.WithLenientConfig(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []missingChecksum
+
+	for _, id := range shared.MapKeysSorted(products) {
+		product := products[id]
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			version := product.Versions[name]
+			versionRelPath := filepath.Join(streamName, product.RelPath(), name)
+
+			dirs := []auditedVersionDir{{
+				path:          filepath.Join(rootDir, versionRelPath),
+				version:       version,
+				checksumName:  version.ChecksumFile,
+				checksumAlgos: checksumFileAlgorithms(version.ChecksumDigests),
+			}}
+
+			// Delta files stored outside the version directory have
+			// their own checksum file, which inherits the name and
+			// algorithms of the version checksum file if it does not
+			// exist yet.
+			if deltaDir != "" {
+				deltaVersion, err := stream.GetVersion(rootDir, filepath.Join(deltaDir, versionRelPath),
+					stream.WithChecksumFiles(checksumFiles...),
+					stream.WithIncompleteVersions(true),
+					stream.WithLenientConfig(true))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return nil, fmt.Errorf("Failed to read delta directory of version %q of product %q: %w", name, id, err)
+				}
+
+				if err == nil {
+					dir := auditedVersionDir{
+						path:          filepath.Join(rootDir, deltaDir, versionRelPath),
+						version:       *deltaVersion,
+						checksumName:  deltaVersion.ChecksumFile,
+						checksumAlgos: checksumFileAlgorithms(deltaVersion.ChecksumDigests),
+					}
+
+					if dir.checksumName == "" {
+						dir.checksumName = version.ChecksumFile
+						dir.checksumAlgos = dirs[0].checksumAlgos
+					}
+
+					dirs = append(dirs, dir)
+				}
+			}
+
+			for _, dir := range dirs {
+				for _, itemName := range shared.MapKeysSorted(dir.version.Items) {
+					_, ok := dir.version.ChecksumDigests[itemName]
+					if ok {
+						continue
+					}
+
+					missing = append(missing, missingChecksum{
+						Stream:       streamName,
+						Product:      id,
+						Version:      name,
+						Item:         itemName,
+						ChecksumFile: dir.version.ChecksumFile,
+					})
+
+					if !fix {
+						continue
+					}
+
+					checksumName := dir.checksumName
+					if checksumName == "" {
+						checksumName = checksumFiles[0]
+					}
+
+					err := appendChecksumDigests(filepath.Join(dir.path, checksumName), filepath.Join(dir.path, itemName), dir.checksumAlgos)
+					if err != nil {
+						return nil, fmt.Errorf("Failed to append checksum of item %q in version %q of product %q: %w", itemName, name, id, err)
+					}
+
+					slog.Info("Checksum appended", "product", id, "version", name, "item", itemName, "checksumFile", checksumName)
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(missing, func(a missingChecksum, b missingChecksum) int {
+		return cmp.Or(cmp.Compare(a.Product, b.Product), cmp.Compare(a.Version, b.Version), cmp.Compare(a.Item, b.Item))
+	})
+
+	return missing, nil
+}
+
+// auditedVersionDir is a directory containing items of a product version.
+type auditedVersionDir struct {
+	// path is the absolute path of the directory.
+	path string
+
+	// version contains the items and checksums read from the directory.
+	version stream.Version
+
+	// checksumName is the name of the checksum file to which missing
+	// checksums are appended. If empty, the default name is used.
+	checksumName string
+
+	// checksumAlgos are hash algorithms of the appended checksums.
+	checksumAlgos []string
+}
+
+// checksumFileAlgorithms returns the supported hash algorithms used within the
+// given checksum file digests, sorted by name. If none is used, SHA-256 is
+// returned.
+func checksumFileAlgorithms(digests map[string]map[string]string) []string {
+	var algorithms []string
+
+	for _, fileDigests := range digests {
+		for algorithm := range fileDigests {
+			if slices.Contains(algorithms, algorithm) {
+				continue
+			}
+
+			_, err := stream.NewHash(algorithm)
+			if err != nil {
+				// Skip unsupported algorithms, such as MD5.
+				continue
+			}
+
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+
+	if len(algorithms) == 0 {
+		return []string{stream.HashAlgorithmSHA256}
+	}
+
+	slices.Sort(algorithms)
+	return algorithms
+}
+
+// appendChecksumDigests calculates the digests of the file on the given path
+// for each of the given hash algorithms, and appends them to the checksum file.
+// The checksum file is created if it does not exist yet. BLAKE2b digests are
+// written in BSD format, as their length does not differ from SHA-512 digests.
+func appendChecksumDigests(checksumPath string, path string, algorithms []string) error {
+	fileName := filepath.Base(path)
+
+	var b strings.Builder
+
+	for _, algorithm := range algorithms {
+		h, err := stream.NewHash(algorithm)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := shared.FileHash(h, path)
+		if err != nil {
+			return err
+		}
+
+		if algorithm == stream.HashAlgorithmBLAKE2b {
+			fmt.Fprintf(&b, "BLAKE2b (%s) = %s\n", fileName, checksum)
+		} else {
+			fmt.Fprintf(&b, "%s  %s\n", checksum, fileName)
+		}
+	}
+
+	file, err := os.OpenFile(checksumPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return shared.AppendToFile(checksumPath, b.String())
+}
+
+// writeMissingChecksums writes the items without a checksum entry to the given
+// writer as a table.
+func writeMissingChecksums(w io.Writer, missing []missingChecksum) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tVERSION\tITEM\tCHECKSUM FILE")
+
+	for _, m := range missing {
+		checksumFile := m.ChecksumFile
+		if checksumFile == "" {
+			checksumFile = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.Stream, m.Product, m.Version, m.Item, checksumFile)
+	}
+
+	return tw.Flush()
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
 	"path"
@@ -13,10 +19,14 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/casync"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/minisign"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
 )
@@ -28,6 +38,54 @@ type buildOptions struct {
 	ImageDirs     []string
 	Workers       int
 	BuildWebPage  bool
+	WebPageFull   bool
+	WebPageStale  int
+	DeltaDir      string
+	BaselineDir   string
+	CrossDeltas   []string
+	ChecksumFiles []string
+	ConfigFiles   []string
+	MinisignKey   string
+	Manifest      bool
+	HashCache     bool
+	GzipLevel     int
+	NoGZip        bool
+	MetaDir       string
+	PublicBase    string
+	MirrorBases   []string
+	SplitByArch   bool
+	CatalogSizes  bool
+	SourceRoot    string
+	WorkRoot      string
+	Strict        bool
+	FailOnEmpty   bool
+	VerifyDeltas  bool
+	Reverify      bool
+	IndexAllow    string
+	PathRewrites  []string
+
+	ExcludeVariants []string
+	ExcludeReleases []string
+	ExcludeArchs    []string
+
+	PostBuildHook string
+	DeltaFormat   string
+	ChunkStoreDir string
+	NormalizeQcow bool
+	AuxFiles      bool
+	AuxFileNames  []string
+	HashAlgos     []string
+	PostVerify    bool
+	MinItemSize   int64
+	RequireBoth   bool
+	RequireSums   bool
+	StreamFormat  string
+	IndexFormat   string
+	LatestPointer bool
+	LatestFormat  string
+	ExtraRoots    []string
+	EventsFile    string
+	Events        bool
 }
 
 func (o *buildOptions) NewCommand() *cobra.Command {
@@ -42,6 +100,52 @@ func (o *buildOptions) NewCommand() *cobra.Command {
 	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
 	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
 	cmd.PersistentFlags().BoolVar(&o.BuildWebPage, "build-webpage", false, "Build index.html")
+	cmd.PersistentFlags().BoolVar(&o.WebPageFull, "webpage-full", false, "List all product versions in index.html instead of only the most recent ones")
+	cmd.PersistentFlags().IntVar(&o.WebPageStale, "webpage-stale-days", webpage.DefaultStaleDays, "Number of days after which a product version is marked as stale in index.html")
+	cmd.PersistentFlags().StringSliceVar(&o.CrossDeltas, "cross-delta", nil, "Generate delta files across sibling products in format '<variant><-<base-variant>' (experimental)")
+	cmd.PersistentFlags().StringVar(&o.DeltaDir, "delta-dir", "", "Directory for generated delta files (relative to path argument). By default, delta files are stored within the target version directory")
+	cmd.PersistentFlags().StringVar(&o.DeltaFormat, "delta-format", deltaFormatVCDiff, "Format of squashfs delta files (vcdiff or casync). With casync, a chunk index is generated for each squashfs item instead of delta files and chunks are stored in the chunk store. Delta files of qcow2 items are always in vcdiff format")
+	cmd.PersistentFlags().StringVar(&o.ChunkStoreDir, "chunk-store-dir", "chunks", "Directory of the casync chunk store (relative to path argument)")
+	cmd.PersistentFlags().BoolVar(&o.NormalizeQcow, "normalize-qcow2", false, "Convert qcow2 images of new versions in place to a canonical format (compressed, 64KiB clusters) using qemu-img before they are hashed. Entries in the version checksum file are updated accordingly. Skipped if qemu-img is not available")
+	cmd.PersistentFlags().BoolVar(&o.AuxFiles, "aux-files", false, "Record auxiliary files (e.g. build logs) of each version with their size and hash in the product catalog")
+	cmd.PersistentFlags().StringSliceVar(&o.AuxFileNames, "aux-file-name", []string{"build.log", "definition.yaml"}, "Glob patterns of auxiliary file names recorded with --aux-files")
+	cmd.PersistentFlags().StringVar(&o.BaselineDir, "baseline-dir", "", "Directory with baseline product versions (relative to path argument) using the same hierarchy as the image directory. The latest baseline version of a product is added to its catalog and used as a delta base for the oldest version (baseline version names must sort before product version names). Baseline versions are never pruned")
+	cmd.PersistentFlags().StringSliceVar(&o.ChecksumFiles, "checksum-file-name", []string{stream.FileChecksumSHA256}, "Candidate names of the version checksum file (the first existing one is used)")
+	cmd.PersistentFlags().BoolVar(&o.RequireSums, "require-checksums", false, "Exclude new versions without a checksum file from the product catalog instead of adding them unverified")
+	cmd.PersistentFlags().StringSliceVar(&o.ConfigFiles, "image-config-name", []string{stream.FileImageConfig}, "Candidate names of the version image config file (the first existing one is used)")
+	cmd.PersistentFlags().StringSliceVar(&o.HashAlgos, "hash-algorithm", nil, "Hash algorithms used to calculate additional item digests recorded in the product catalog (sha256, sha512, or blake2b). Digests are calculated only for new items and are not cached")
+	cmd.PersistentFlags().BoolVar(&o.HashCache, "hash-cache", false, "Cache calculated hashes in the metadata directory and reuse them for unchanged files")
+	cmd.PersistentFlags().BoolVar(&o.Manifest, "manifest", false, "Write a manifest listing all files with their size and modification time into each version directory")
+	cmd.PersistentFlags().BoolVar(&o.NoGZip, "no-gzip", false, "Skip writing of the gzipped index and product catalog files, and remove the existing ones (for local development only, as clients requesting them will fail)")
+	cmd.PersistentFlags().IntVar(&o.GzipLevel, "catalog-gzip-level", gzip.BestCompression, "Compression level of the gzipped index and product catalog files (from 1 for best speed to 9 for best size, 0 for default)")
+	cmd.PersistentFlags().StringVar(&o.MetaDir, "meta-dir", "", "Directory where the index, product catalogs, and index.html are written. By default, they are written within the path argument")
+	cmd.PersistentFlags().StringVar(&o.PublicBase, "public-base", "", "URL or path (relative to the metadata directory) of the path argument used to prefix item paths (required with --meta-dir)")
+	cmd.PersistentFlags().StringSliceVar(&o.MirrorBases, "mirror-base", nil, "URL or path of a mirror of the path argument used to record alternate item paths in the product catalog. Mirrors are listed in the given order")
+	cmd.PersistentFlags().StringVar(&o.IndexAllow, "index-allowlist", "", "File listing product IDs (one per line) that may appear in the index. Other products are still written to the product catalogs, but are omitted from the index")
+	cmd.PersistentFlags().StringVar(&o.StreamFormat, "stream-format", stream.FormatProducts, "Format of the written product catalogs, which is also recorded in their index entries (one of: "+strings.Join(stream.CatalogFormats, ", ")+")")
+	cmd.PersistentFlags().StringVar(&o.IndexFormat, "index-format", stream.FormatIndex, "Format of the written index (one of: "+strings.Join(stream.IndexFormats, ", ")+")")
+	cmd.PersistentFlags().BoolVar(&o.CatalogSizes, "catalog-sizes", false, "Record sizes of the uncompressed and gzipped product catalog files in the index entries")
+	cmd.PersistentFlags().BoolVar(&o.SplitByArch, "split-by-arch", false, "Write per-architecture product catalogs (e.g. '<stream>-amd64.json') and their index entries in addition to the combined catalog")
+	cmd.PersistentFlags().StringVar(&o.SourceRoot, "source-root", "", "Directory from which image items are read (may be read-only). By default, the path argument is used")
+	cmd.PersistentFlags().StringSliceVar(&o.ExtraRoots, "extra-root", nil, "Additional read-only directory scanned for products that are merged into the same product catalogs. Item paths are relative to their originating root, hence all roots must be served under the same public base (requires --public-base). Generated files are written within the path argument")
+	cmd.PersistentFlags().StringVar(&o.WorkRoot, "work-root", "", "Writable directory where generated files (delta files, checksum updates, and metadata) are written. It must contain the source root. By default, the path argument is used")
+	cmd.PersistentFlags().BoolVar(&o.Strict, "strict", false, "Fail if any warnings occur during the build (the index is still written)")
+	cmd.PersistentFlags().BoolVar(&o.FailOnEmpty, "fail-on-empty", false, "Fail the build without writing any metadata if no products are found for a stream whose existing product catalog is not empty")
+	cmd.PersistentFlags().StringSliceVar(&o.PathRewrites, "path-rewrite", nil, "Rewrite the path prefix of items and product catalogs in the written metadata in format 'old=new' (e.g. 'images=cdn/images'). The first matching rewrite is applied. Paths keep their leading slash, or the lack thereof")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeVariants, "exclude-variant", nil, "Omit products with the given variant from the product catalog (files are left on disk)")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeReleases, "exclude-release", nil, "Omit products with the given release from the product catalog (files are left on disk)")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeArchs, "exclude-arch", nil, "Omit products with the given architecture from the product catalog (files are left on disk)")
+	cmd.PersistentFlags().StringVar(&o.PostBuildHook, "post-build-hook", "", "Shell command run after the metadata files are written. Paths of the written files are passed as arguments. The build fails if the command fails")
+	cmd.PersistentFlags().BoolVar(&o.LatestPointer, "write-latest-pointer", false, "Write a pointer to the newest complete version into each product directory")
+	cmd.PersistentFlags().StringVar(&o.LatestFormat, "latest-pointer-format", latestPointerSymlink, "Format of the latest version pointer (symlink named 'latest' or file named 'latest.txt' containing the version name). Symlinks require the source and work roots to be the path argument")
+	cmd.PersistentFlags().Int64Var(&o.MinItemSize, "min-item-size", 1, "Minimum size in bytes of the metadata and root file system items of new versions. Versions with smaller items are not added to the product catalog (0 disables the check)")
+	cmd.PersistentFlags().BoolVar(&o.RequireBoth, "require-both-rootfs", false, "Consider versions complete only if they contain both the container (squashfs) and the VM (qcow2) root file system. Individual versions can require it with 'require_both_rootfs' in their image config")
+	cmd.PersistentFlags().BoolVar(&o.PostVerify, "post-verify", false, "Verify that each file referenced by the built product catalog exists with the recorded size before the metadata is written. The build fails otherwise")
+	cmd.PersistentFlags().BoolVar(&o.VerifyDeltas, "verify-deltas", false, "Verify that each generated delta file reconstructs its target item and regenerate it otherwise")
+	cmd.PersistentFlags().BoolVar(&o.Reverify, "reverify-existing", false, "Recalculate hashes of the items already present in the product catalog. Delta files and chunk indexes that no longer match are regenerated, while other mismatching items are reported as warnings")
+	cmd.PersistentFlags().StringVar(&o.EventsFile, "events-file", "", "File to which build events are appended in JSON Lines format")
+	cmd.PersistentFlags().BoolVar(&o.Events, "events", false, "Write build events to stdout in JSON Lines format")
+	cmd.PersistentFlags().StringVar(&o.MinisignKey, "minisign-key", "", "Minisign secret key used to sign the index and product catalog files (password is read from "+minisignPasswordEnv+" environment variable)")
 
 	return cmd
 }
@@ -51,393 +155,3187 @@ func (o *buildOptions) Run(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
 	}
 
-	return buildIndex(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Workers, o.BuildWebPage)
+	opts, err := o.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	events, closeEvents, err := openEventSink(o.EventsFile, o.Events)
+	if err != nil {
+		return err
+	}
+
+	defer closeEvents()
+
+	opts = append(opts, withEventSink(events))
+
+	return buildIndex(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Workers, o.BuildWebPage, opts...)
+}
+
+// buildOptions converts the command flags into build options.
+func (o *buildOptions) buildOptions() ([]buildOption, error) {
+	crossDeltas := make(map[string]string, len(o.CrossDeltas))
+	for _, m := range o.CrossDeltas {
+		variant, baseVariant, ok := strings.Cut(m, "<-")
+		if !ok || variant == "" || baseVariant == "" || variant == baseVariant {
+			return nil, fmt.Errorf("Invalid cross delta mapping %q: Expected format is '<variant><-<base-variant>'", m)
+		}
+
+		crossDeltas[variant] = baseVariant
+	}
+
+	if o.GzipLevel < 0 || o.GzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("Invalid catalog gzip level %d: Expected value between 0 and %d", o.GzipLevel, gzip.BestCompression)
+	}
+
+	pathRewrites, err := parsePathRewrites(o.PathRewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.DeltaFormat != "" && o.DeltaFormat != deltaFormatVCDiff && o.DeltaFormat != deltaFormatCasync {
+		return nil, fmt.Errorf("Invalid delta format %q. Valid formats are: [%s, %s]", o.DeltaFormat, deltaFormatVCDiff, deltaFormatCasync)
+	}
+
+	if o.NormalizeQcow && o.SourceRoot != "" {
+		return nil, fmt.Errorf("Flag %q cannot be used together with %q", "normalize-qcow2", "source-root")
+	}
+
+	if len(o.ExtraRoots) > 0 {
+		if o.PublicBase == "" {
+			return nil, fmt.Errorf("Flag %q is required when %q is set", "public-base", "extra-root")
+		}
+
+		for flag, set := range map[string]bool{"source-root": o.SourceRoot != "", "work-root": o.WorkRoot != "", "normalize-qcow2": o.NormalizeQcow} {
+			if set {
+				return nil, fmt.Errorf("Flag %q cannot be used together with %q", "extra-root", flag)
+			}
+		}
+	}
+
+	if o.StreamFormat != "" && !slices.Contains(stream.CatalogFormats, o.StreamFormat) {
+		return nil, fmt.Errorf("Invalid stream format %q. Valid formats are: [%s]", o.StreamFormat, strings.Join(stream.CatalogFormats, ", "))
+	}
+
+	if o.IndexFormat != "" && !slices.Contains(stream.IndexFormats, o.IndexFormat) {
+		return nil, fmt.Errorf("Invalid index format %q. Valid formats are: [%s]", o.IndexFormat, strings.Join(stream.IndexFormats, ", "))
+	}
+
+	if o.MinItemSize < 0 {
+		return nil, fmt.Errorf("Invalid minimum item size %d: Expected non-negative value", o.MinItemSize)
+	}
+
+	for _, algorithm := range o.HashAlgos {
+		_, err := stream.NewHash(algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hash algorithm: %w", err)
+		}
+	}
+
+	var auxFiles []string
+	if o.AuxFiles {
+		auxFiles = o.AuxFileNames
+	}
+
+	var latestFormat string
+	if o.LatestPointer {
+		if o.LatestFormat != latestPointerSymlink && o.LatestFormat != latestPointerFile {
+			return nil, fmt.Errorf("Invalid latest pointer format %q. Valid formats are: [%s, %s]", o.LatestFormat, latestPointerSymlink, latestPointerFile)
+		}
+
+		if o.LatestFormat == latestPointerSymlink && (o.SourceRoot != "" || o.WorkRoot != "" || len(o.ExtraRoots) > 0) {
+			return nil, fmt.Errorf("Latest pointer format %q cannot be used together with %q, %q, or %q", latestPointerSymlink, "source-root", "work-root", "extra-root")
+		}
+
+		latestFormat = o.LatestFormat
+	}
+
+	if o.MetaDir != "" && o.PublicBase == "" {
+		return nil, fmt.Errorf("Flag %q is required when %q is set", "public-base", "meta-dir")
+	}
+
+	signKey, err := readMinisignKey(o.MinisignKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexAllowlist []string
+	if o.IndexAllow != "" {
+		indexAllowlist, err = readIndexAllowlist(o.IndexAllow)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read index allowlist: %w", err)
+		}
+	}
+
+	opts := []buildOption{
+		withDeltaDir(o.DeltaDir),
+		withBaselineDir(o.BaselineDir),
+		withCrossDeltas(crossDeltas),
+		withChecksumFiles(o.ChecksumFiles),
+		withConfigFiles(o.ConfigFiles),
+		withSignKey(signKey),
+		withManifest(o.Manifest),
+		withHashCache(o.HashCache),
+		withGzipLevel(o.GzipLevel),
+		withNoGZip(o.NoGZip),
+		withMetaDir(o.MetaDir),
+		withPublicBase(o.PublicBase),
+		withMirrorBases(o.MirrorBases),
+		withSplitByArch(o.SplitByArch),
+		withCatalogSizes(o.CatalogSizes),
+		withSourceRoot(o.SourceRoot),
+		withWorkRoot(o.WorkRoot),
+		withStrict(o.Strict),
+		withFailOnEmpty(o.FailOnEmpty),
+		withVerifyDeltas(o.VerifyDeltas),
+		withReverifyExisting(o.Reverify),
+		withIndexAllowlist(indexAllowlist),
+		withPathRewrites(pathRewrites),
+		withExclude(productFilter{variants: o.ExcludeVariants, releases: o.ExcludeReleases, archs: o.ExcludeArchs}),
+		withPostBuildHook(o.PostBuildHook),
+		withDeltaFormat(o.DeltaFormat, o.ChunkStoreDir),
+		withNormalizeQcow2(o.NormalizeQcow),
+		withAuxFiles(auxFiles),
+		withWebPageFull(o.WebPageFull),
+		withWebPageStaleDays(o.WebPageStale),
+		withHashAlgorithms(o.HashAlgos),
+		withPostVerify(o.PostVerify),
+		withMinItemSize(o.MinItemSize),
+		withRequireBothRootfs(o.RequireBoth),
+		withRequireChecksums(o.RequireSums),
+		withFormats(o.StreamFormat, o.IndexFormat),
+		withLatestPointer(latestFormat),
+		withExtraRoots(o.ExtraRoots),
+	}
+
+	return opts, nil
+}
+
+// buildConfig holds optional settings that modify the build behavior.
+type buildConfig struct {
+	// deltaDir is a directory (relative to the root directory) where the
+	// generated delta files are stored. If empty, delta files are stored
+	// within the target version directory.
+	deltaDir string
+
+	// baselineDir is a directory (relative to the root directory) that
+	// contains baseline product versions. The latest baseline version of
+	// each product is included in the catalog, so that delta files can
+	// be generated for the oldest product version.
+	baselineDir string
+
+	// crossDeltas maps the product variant to the variant of a sibling
+	// product whose versions are used as a base for delta files.
+	crossDeltas map[string]string
+
+	// checksumFiles is a list of candidate names of the checksum file
+	// within the version. The first existing one is used.
+	checksumFiles []string
+
+	// configFiles is a list of candidate names of the image config file
+	// within the version. The first existing one is used.
+	configFiles []string
+
+	// signKey is used to sign the index and product catalog files.
+	// If nil, files are not signed.
+	signKey *minisign.PrivateKey
+
+	// manifest enables writing of a file manifest into each version
+	// directory.
+	manifest bool
+
+	// hashCache enables caching of calculated hashes. Cached hashes are
+	// reused for files whose size and modification time has not changed.
+	hashCache bool
+
+	// gzipLevel is the compression level used for the gzipped index and
+	// product catalog files.
+	gzipLevel int
+
+	// noGZip disables writing of the gzipped index and product catalog
+	// files. It is intended only for local development.
+	noGZip bool
+
+	// metaDir is a directory where the stream metadata (index, product
+	// catalogs, and index.html) is written. If empty, the metadata is
+	// written within the root directory.
+	metaDir string
+
+	// publicBase is a URL or path that prefixes item paths in the written
+	// product catalogs. Item paths are otherwise relative to the root
+	// directory.
+	publicBase string
+
+	// mirrorBases are URLs or paths of mirrors that prefix alternate item
+	// paths in the written product catalogs.
+	mirrorBases []string
+
+	// splitByArch enables writing of per-architecture product catalogs
+	// in addition to the combined one.
+	splitByArch bool
+
+	// catalogSizes enables recording of the uncompressed and gzipped
+	// product catalog sizes in the index entries.
+	catalogSizes bool
+
+	// indexAllowlist contains IDs of products that may appear in the
+	// index. If nil, all products appear in the index.
+	indexAllowlist []string
+
+	// sourceRoot is a directory from which the image items are read. If
+	// empty, the root directory is used.
+	sourceRoot string
+
+	// workRoot is a directory where the generated files are written. It
+	// must contain the source root, since item paths in the catalog are
+	// relative to it. If empty, the root directory is used.
+	workRoot string
+
+	// strict enables failing the build if any warnings occur.
+	strict bool
+
+	// failOnEmpty enables failing the build if no products are found for
+	// a stream whose existing product catalog is not empty.
+	failOnEmpty bool
+
+	// verifyDeltas enables decoding of each generated delta file and
+	// comparing the result against the target item hash.
+	verifyDeltas bool
+
+	// reverifyExisting enables recalculation of the hashes of items that
+	// are already present in the catalog.
+	reverifyExisting bool
+
+	// pathRewrites are applied to the item and product catalog paths in
+	// the written metadata. The first matching rewrite is applied.
+	pathRewrites []pathRewrite
+
+	// exclude filters out products that are omitted from the catalog.
+	exclude productFilter
+
+	// postBuildHook is a shell command that is run once the metadata files
+	// are written. If empty, no command is run.
+	postBuildHook string
+
+	// deltaFormat is the format of squashfs delta files.
+	deltaFormat string
+
+	// chunkStoreDir is a directory (relative to the root directory) of the
+	// casync chunk store. It is used only with the casync delta format.
+	chunkStoreDir string
+
+	// normalizeQcow2 enables conversion of qcow2 images of new versions to
+	// a canonical format before they are hashed.
+	normalizeQcow2 bool
+
+	// auxFiles is a list of glob patterns of auxiliary file names that
+	// are recorded within the catalog versions. If empty, auxiliary files
+	// are not recorded.
+	auxFiles []string
+
+	// webPageFull enables listing of all product versions in index.html.
+	webPageFull bool
+
+	// webPageStaleDays is the number of days after which a product version
+	// is marked as stale in index.html.
+	webPageStaleDays int
+
+	// hashAlgorithms are used to calculate additional digests of new
+	// items.
+	hashAlgorithms []string
+
+	// postVerify enables checking that each file referenced by the built
+	// catalog exists with the recorded size before the metadata is written.
+	postVerify bool
+
+	// minItemSize is the minimum size in bytes of the metadata and root
+	// file system items of new versions. Versions with smaller items are
+	// rejected. If 0, the size is not checked.
+	minItemSize int64
+
+	// requireBothRootfs makes versions without both the container and the
+	// VM root file system incomplete.
+	requireBothRootfs bool
+
+	// requireChecksums excludes new versions without a checksum file
+	// from the product catalog.
+	requireChecksums bool
+
+	// catalogFormat is the format of the written product catalogs.
+	catalogFormat string
+
+	// indexFormat is the format of the written index.
+	indexFormat string
+
+	// latestPointer is the format of the pointer to the newest complete
+	// version written into each product directory. If empty, no pointer
+	// is written.
+	latestPointer string
+
+	// extraRoots are additional read-only directories that are scanned for
+	// products. Item paths of the versions found within an extra root are
+	// relative to that root.
+	extraRoots []string
+
+	// events receives events of the build actions. If nil, no events are
+	// emitted.
+	events eventSink
+
+	// refreshAliases are distributions whose existing products get their
+	// aliases recalculated from the image directories, even if they have
+	// no new versions.
+	refreshAliases []string
+}
+
+// Supported formats of squashfs delta files.
+const (
+	// deltaFormatVCDiff generates vcdiff delta files between adjacent
+	// versions.
+	deltaFormatVCDiff = "vcdiff"
+
+	// deltaFormatCasync generates a casync chunk index for each version
+	// and stores the chunks in the chunk store.
+	deltaFormatCasync = "casync"
+)
+
+// Supported formats of the latest version pointer.
+const (
+	// latestPointerSymlink is a symlink named "latest" that points to the
+	// newest version directory.
+	latestPointerSymlink = "symlink"
+
+	// latestPointerFile is a file named "latest.txt" that contains the
+	// name of the newest version.
+	latestPointerFile = "file"
+)
+
+// Names of the latest version pointers within the product directory.
+const (
+	latestPointerSymlinkName = "latest"
+	latestPointerFileName    = "latest.txt"
+)
+
+// pathRewrite replaces the old path prefix with the new one. Both prefixes
+// are stored without leading and trailing slashes.
+type pathRewrite struct {
+	oldPrefix string
+	newPrefix string
+}
+
+// buildOption modifies the build behavior.
+type buildOption func(*buildConfig)
+
+func newBuildConfig(opts ...buildOption) *buildConfig {
+	c := &buildConfig{
+		checksumFiles: []string{stream.FileChecksumSHA256},
+		gzipLevel:     gzip.BestCompression,
+		deltaFormat:   deltaFormatVCDiff,
+		chunkStoreDir: "chunks",
+		minItemSize:   1,
+		catalogFormat: stream.FormatProducts,
+		indexFormat:   stream.FormatIndex,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			opt(c)
+		}
+	}
+
+	return c
+}
+
+// withCrossDeltas sets the mapping of target variants to base variants used
+// for generating delta files across products.
+func withCrossDeltas(mapping map[string]string) buildOption {
+	return func(c *buildConfig) {
+		c.crossDeltas = mapping
+	}
+}
+
+// streamOptions returns the given stream options extended with the options
+// that control which files are read from the version directories.
+func (c *buildConfig) streamOptions(opts ...stream.Option) []stream.Option {
+	return append(opts,
+		stream.WithChecksumFiles(c.checksumFiles...),
+		stream.WithImageConfigFiles(c.configFiles...),
+		stream.WithAuxFiles(c.auxFiles...),
+		stream.WithHashAlgorithms(c.hashAlgorithms...),
+		stream.WithRequireBothRootfs(c.requireBothRootfs),
+	)
+}
+
+// withChecksumFiles sets the candidate names of the version checksum file.
+func withChecksumFiles(names []string) buildOption {
+	return func(c *buildConfig) {
+		if len(names) > 0 {
+			c.checksumFiles = names
+		}
+	}
+}
+
+// withConfigFiles sets the candidate names of the version image config file.
+func withConfigFiles(names []string) buildOption {
+	return func(c *buildConfig) {
+		c.configFiles = names
+	}
+}
+
+// withSignKey sets the key used to sign the index and product catalog files.
+func withSignKey(key *minisign.PrivateKey) buildOption {
+	return func(c *buildConfig) {
+		c.signKey = key
+	}
+}
+
+// withManifest enables writing of a file manifest into each version directory.
+func withManifest(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.manifest = val
+	}
+}
+
+// withHashCache enables caching of calculated hashes.
+func withHashCache(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.hashCache = val
+	}
+}
+
+// withNoGZip disables writing of the gzipped index and product catalog files.
+func withNoGZip(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.noGZip = val
+	}
+}
+
+// withGzipLevel sets the compression level of the gzipped index and product
+// catalog files. Zero level retains the default (best compression).
+func withGzipLevel(level int) buildOption {
+	return func(c *buildConfig) {
+		if level != 0 {
+			c.gzipLevel = level
+		}
+	}
+}
+
+// withBaselineDir sets the directory containing baseline product versions.
+func withBaselineDir(dir string) buildOption {
+	return func(c *buildConfig) {
+		c.baselineDir = dir
+	}
+}
+
+// withDeltaDir sets the directory where generated delta files are stored.
+func withDeltaDir(dir string) buildOption {
+	return func(c *buildConfig) {
+		c.deltaDir = dir
+	}
+}
+
+// withMetaDir sets the directory where the stream metadata is written.
+func withMetaDir(dir string) buildOption {
+	return func(c *buildConfig) {
+		c.metaDir = dir
+	}
+}
+
+// withPublicBase sets the URL or path that prefixes item paths in the
+// written product catalogs.
+func withPublicBase(base string) buildOption {
+	return func(c *buildConfig) {
+		c.publicBase = base
+	}
+}
+
+// withMirrorBases sets the URLs or paths of mirrors that prefix alternate
+// item paths in the written product catalogs.
+func withMirrorBases(bases []string) buildOption {
+	return func(c *buildConfig) {
+		c.mirrorBases = bases
+	}
+}
+
+// withIndexAllowlist sets IDs of products that may appear in the index.
+func withIndexAllowlist(productIDs []string) buildOption {
+	return func(c *buildConfig) {
+		c.indexAllowlist = productIDs
+	}
+}
+
+// withSplitByArch enables writing of per-architecture product catalogs.
+func withSplitByArch(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.splitByArch = val
+	}
+}
+
+// withCatalogSizes enables recording of the product catalog sizes in the
+// index entries.
+func withCatalogSizes(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.catalogSizes = val
+	}
+}
+
+// withSourceRoot sets the directory from which the image items are read.
+func withSourceRoot(dir string) buildOption {
+	return func(c *buildConfig) {
+		c.sourceRoot = dir
+	}
+}
+
+// withWorkRoot sets the directory where the generated files are written.
+func withWorkRoot(dir string) buildOption {
+	return func(c *buildConfig) {
+		c.workRoot = dir
+	}
+}
+
+// withStrict enables failing the build if any warnings occur.
+func withStrict(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.strict = val
+	}
+}
+
+// withFailOnEmpty enables failing the build if no products are found for
+// a stream whose existing product catalog is not empty.
+func withFailOnEmpty(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.failOnEmpty = val
+	}
+}
+
+// withReverifyExisting enables recalculation of the hashes of items that are
+// already present in the catalog.
+func withReverifyExisting(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.reverifyExisting = val
+	}
+}
+
+// withVerifyDeltas enables verification of generated delta files.
+func withVerifyDeltas(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.verifyDeltas = val
+	}
+}
+
+// withPathRewrites sets the path rewrites applied to the written metadata.
+func withPathRewrites(rewrites []pathRewrite) buildOption {
+	return func(c *buildConfig) {
+		c.pathRewrites = rewrites
+	}
+}
+
+// withExclude sets the filter of products omitted from the catalog.
+func withExclude(filter productFilter) buildOption {
+	return func(c *buildConfig) {
+		c.exclude = filter
+	}
+}
+
+// withPostBuildHook sets the shell command run after the metadata files are
+// written.
+func withPostBuildHook(hook string) buildOption {
+	return func(c *buildConfig) {
+		c.postBuildHook = hook
+	}
+}
+
+// withDeltaFormat sets the format of squashfs delta files and the directory
+// of the chunk store used by the casync format. Empty values are ignored.
+func withDeltaFormat(format string, chunkStoreDir string) buildOption {
+	return func(c *buildConfig) {
+		if format != "" {
+			c.deltaFormat = format
+		}
+
+		if chunkStoreDir != "" {
+			c.chunkStoreDir = chunkStoreDir
+		}
+	}
+}
+
+// withNormalizeQcow2 enables normalization of qcow2 images.
+func withNormalizeQcow2(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.normalizeQcow2 = val
+	}
+}
+
+// withAuxFiles sets the glob patterns of auxiliary file names.
+func withAuxFiles(patterns []string) buildOption {
+	return func(c *buildConfig) {
+		c.auxFiles = patterns
+	}
+}
+
+// withWebPageStaleDays sets the number of days after which a product version
+// is marked as stale in index.html.
+func withWebPageStaleDays(days int) buildOption {
+	return func(c *buildConfig) {
+		c.webPageStaleDays = days
+	}
+}
+
+// withWebPageFull enables listing of all product versions in index.html.
+func withWebPageFull(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.webPageFull = val
+	}
+}
+
+// withHashAlgorithms sets the hash algorithms of additional item digests.
+func withHashAlgorithms(algorithms []string) buildOption {
+	return func(c *buildConfig) {
+		c.hashAlgorithms = algorithms
+	}
+}
+
+// withPostVerify enables verification of the built catalog against the files
+// on disk.
+func withPostVerify(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.postVerify = val
+	}
+}
+
+// withMinItemSize sets the minimum size of the metadata and root file system
+// items of new versions.
+func withMinItemSize(size int64) buildOption {
+	return func(c *buildConfig) {
+		c.minItemSize = size
+	}
+}
+
+// withRequireBothRootfs requires both container and VM root file systems for
+// the version to be complete.
+func withRequireBothRootfs(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.requireBothRootfs = val
+	}
+}
+
+// withRequireChecksums excludes new versions without a checksum file.
+func withRequireChecksums(val bool) buildOption {
+	return func(c *buildConfig) {
+		c.requireChecksums = val
+	}
+}
+
+// withFormats sets the formats of the written product catalogs and index.
+func withFormats(catalogFormat string, indexFormat string) buildOption {
+	return func(c *buildConfig) {
+		if catalogFormat != "" {
+			c.catalogFormat = catalogFormat
+		}
+
+		if indexFormat != "" {
+			c.indexFormat = indexFormat
+		}
+	}
+}
+
+// withLatestPointer sets the format of the latest version pointer.
+func withLatestPointer(format string) buildOption {
+	return func(c *buildConfig) {
+		c.latestPointer = format
+	}
+}
+
+// withExtraRoots sets the additional directories scanned for products.
+func withExtraRoots(dirs []string) buildOption {
+	return func(c *buildConfig) {
+		c.extraRoots = dirs
+	}
+}
+
+// withEventSink sets the sink that receives events of the build actions.
+func withEventSink(sink eventSink) buildOption {
+	return func(c *buildConfig) {
+		c.events = sink
+	}
+}
+
+// withRefreshAliases recalculates aliases of the existing products of the
+// given distributions.
+func withRefreshAliases(distros []string) buildOption {
+	return func(c *buildConfig) {
+		c.refreshAliases = distros
+	}
+}
+
+// rootFor returns the root directory containing the file on the given path
+// relative to the root. The given root is preferred, followed by the extra
+// roots in the configured order. If the file does not exist within any of
+// them, the given root is returned.
+func (c *buildConfig) rootFor(root string, relPath string) string {
+	for _, dir := range append([]string{root}, c.extraRoots...) {
+		_, err := os.Lstat(filepath.Join(dir, relPath))
+		if err == nil {
+			return dir
+		}
+	}
+
+	return root
+}
+
+// sourceRootDir returns the directory from which the image items are read.
+func (c *buildConfig) sourceRootDir(rootDir string) string {
+	if c.sourceRoot != "" {
+		return c.sourceRoot
+	}
+
+	return rootDir
+}
+
+// workRootDir returns the directory where the generated files are written.
+func (c *buildConfig) workRootDir(rootDir string) string {
+	if c.workRoot != "" {
+		return c.workRoot
+	}
+
+	return rootDir
+}
+
+// sourceRelPath returns the path of the source root relative to the work
+// root. An error is returned if the source root is not within the work root.
+func (c *buildConfig) sourceRelPath(rootDir string) (string, error) {
+	workRoot := c.workRootDir(rootDir)
+	sourceRoot := c.sourceRootDir(rootDir)
+
+	relPath, err := filepath.Rel(workRoot, sourceRoot)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("Source root %q must be located within the work root %q", sourceRoot, workRoot)
+	}
+
+	if relPath == "." {
+		return "", nil
+	}
+
+	return relPath, nil
+}
+
+// metaRootDir returns the directory where the stream metadata is written.
+func (c *buildConfig) metaRootDir(rootDir string) string {
+	if c.metaDir != "" {
+		return c.metaDir
+	}
+
+	return c.workRootDir(rootDir)
 }
 
+// minisignPasswordEnv is the name of the environment variable containing
+// the password of the encrypted minisign secret key.
+const minisignPasswordEnv = "MINISIGN_PASSWORD"
+
 // replace struct holds old and new path for a file replace.
 type replace struct {
 	OldPath string
 	NewPath string
 }
 
-func buildIndex(ctx context.Context, rootDir string, streamVersion string, streamNames []string, workers int, buildWebpage bool) error {
-	if len(streamNames) > 1 && buildWebpage {
-		return fmt.Errorf("Building index.html is supported only for a single stream")
+// changed returns true if the content of the file on the old path differs
+// from the content of the file on the new path, or if either of the files
+// cannot be read.
+func (r replace) changed() bool {
+	oldContent, err := os.ReadFile(r.OldPath)
+	if err != nil {
+		return true
+	}
+
+	newContent, err := os.ReadFile(r.NewPath)
+	if err != nil {
+		return true
+	}
+
+	return !bytes.Equal(oldContent, newContent)
+}
+
+// buildWarning is a problem that occurred during the build without aborting
+// it, such as a version that is excluded from the catalog because of a
+// checksum mismatch.
+type buildWarning struct {
+	// Stream is the name of the affected stream.
+	Stream string
+
+	// Product is the ID of the affected product (if known).
+	Product string
+
+	// Version is the name of the affected version (if known).
+	Version string
+
+	// Item is the name of the affected item (if known).
+	Item string
+
+	// Path is the path of the affected file or directory relative to the
+	// root directory (if known).
+	Path string
+
+	// Message describes the warning.
+	Message string
+
+	// Err is the underlying error (if any).
+	Err error
+}
+
+// logAttrs returns non-empty warning fields as log attributes.
+func (w buildWarning) logAttrs() []any {
+	var attrs []any
+
+	fields := [][2]string{
+		{"streamName", w.Stream},
+		{"product", w.Product},
+		{"version", w.Version},
+		{"item", w.Item},
+		{"path", w.Path},
+	}
+
+	for _, f := range fields {
+		if f[1] != "" {
+			attrs = append(attrs, f[0], f[1])
+		}
+	}
+
+	if w.Err != nil {
+		attrs = append(attrs, "error", w.Err)
+	}
+
+	return attrs
+}
+
+// buildWarnings collects build warnings. It is safe for concurrent use.
+type buildWarnings struct {
+	mu       sync.Mutex
+	warnings []buildWarning
+}
+
+// add adds the warning to the collection.
+func (w *buildWarnings) add(warning buildWarning) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.warnings = append(w.warnings, warning)
+}
+
+// list returns the collected warnings.
+func (w *buildWarnings) list() []buildWarning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return slices.Clone(w.warnings)
+}
+
+// logWarnings logs the given build warnings.
+func logWarnings(warnings []buildWarning) {
+	for _, w := range warnings {
+		slog.Warn(w.Message, w.logAttrs()...)
+	}
+}
+
+func buildIndex(ctx context.Context, rootDir string, streamVersion string, streamNames []string, workers int, buildWebpage bool, opts ...buildOption) error {
+	if len(streamNames) > 1 && buildWebpage {
+		return fmt.Errorf("Building index.html is supported only for a single stream")
+	}
+
+	config := newBuildConfig(opts...)
+
+	if config.noGZip {
+		slog.Warn("Skipping gzipped index and product catalog files. Clients expecting them will fail to fetch the metadata, hence this must not be used in production")
+	}
+
+	var indexHTML *webpage.WebPage
+	var replaces []replace
+	catalogs := make(map[string]*stream.ProductCatalog, len(streamNames))
+	var warnings []buildWarning
+	index := stream.NewStreamIndex()
+	index.Format = config.indexFormat
+	metaRootDir := config.metaRootDir(rootDir)
+	metaDir := path.Join(metaRootDir, "streams", streamVersion)
+
+	// Ensure meta directory exists.
+	err := os.MkdirAll(metaDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("Create metadata directory: %w", err)
+	}
+
+	// Load the previous index to retain update times of unchanged catalogs.
+	prevIndex := stream.NewStreamIndex()
+
+	_, err = shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &prevIndex)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		warnings = append(warnings, buildWarning{Message: "Failed to read previous index", Err: err})
+	}
+
+	// Remove temporary files that were not moved to final destinations.
+	defer func() {
+		for _, r := range replaces {
+			_ = os.Remove(r.OldPath)
+		}
+	}()
+
+	// Create product catalogs by reading image directories.
+	for _, streamName := range streamNames {
+		// Create product catalog from directory structure.
+		catalog, catalogWarnings, err := buildProductCatalog(ctx, rootDir, streamVersion, streamName, workers, opts...)
+		if err != nil {
+			return err
+		}
+
+		warnings = append(warnings, catalogWarnings...)
+		catalogs[streamName] = catalog
+
+		// Ensure the catalog does not reference files that were removed
+		// or modified during the build.
+		if config.postVerify {
+			err := verifyCatalogFiles(ctx, rootDir, catalog, workers, config)
+			if err != nil {
+				return fmt.Errorf("Failed to verify product catalog %q: %w", streamName, err)
+			}
+		}
+
+		catalogPath := filepath.Join(metaDir, fmt.Sprintf("%s.json", streamName))
+
+		r, err := writeCatalogFile(catalogPath, prefixItemPaths(catalog, config), config)
+		if err != nil {
+			return err
+		}
+
+		replaces = append(replaces, r...)
+
+		// Relative path for index.
+		catalogRelPath, err := filepath.Rel(metaRootDir, catalogPath)
+		if err != nil {
+			return err
+		}
+
+		// Create webpage for the stream.
+		if buildWebpage {
+			indexHTML = webpage.NewWebPage(*catalog, webpage.WithAllVersions(config.webPageFull), webpage.WithStaleDays(config.webPageStaleDays))
+		}
+
+		// Hash the written catalog file.
+		catalogSHA256, err := shared.FileHash(sha256.New(), r[0].OldPath)
+		if err != nil {
+			return fmt.Errorf("Failed to calculate product catalog hash: %w", err)
+		}
+
+		// Add index entry.
+		index.AddEntry(streamName, rewritePath(catalogRelPath, config.pathRewrites, false), catalogSHA256, *catalog)
+
+		if config.indexAllowlist != nil {
+			index.RetainProducts(streamName, config.indexAllowlist)
+		}
+
+		if config.catalogSizes {
+			err := setCatalogSizes(&index, streamName, r)
+			if err != nil {
+				return err
+			}
+		}
+
+		if config.signKey != nil {
+			index.SetSignKeyID(streamName, config.signKey.KeyID())
+		}
+
+		// Retain the previous update time if the catalog has not changed.
+		if !r[0].changed() {
+			index.RetainUpdated(prevIndex, streamName)
+		}
+
+		// Add per-architecture catalogs and their index entries.
+		if config.splitByArch {
+			for arch, archCatalog := range splitCatalogByArch(catalog) {
+				archStreamName := fmt.Sprintf("%s-%s", streamName, arch)
+				archCatalogPath := filepath.Join(metaDir, fmt.Sprintf("%s.json", archStreamName))
+
+				r, err := writeCatalogFile(archCatalogPath, prefixItemPaths(archCatalog, config), config)
+				if err != nil {
+					return err
+				}
+
+				replaces = append(replaces, r...)
+
+				archCatalogRelPath, err := filepath.Rel(metaRootDir, archCatalogPath)
+				if err != nil {
+					return err
+				}
+
+				archCatalogSHA256, err := shared.FileHash(sha256.New(), r[0].OldPath)
+				if err != nil {
+					return fmt.Errorf("Failed to calculate product catalog hash: %w", err)
+				}
+
+				index.AddEntry(archStreamName, rewritePath(archCatalogRelPath, config.pathRewrites, false), archCatalogSHA256, *archCatalog)
+
+				if config.indexAllowlist != nil {
+					index.RetainProducts(archStreamName, config.indexAllowlist)
+				}
+
+				if config.catalogSizes {
+					err := setCatalogSizes(&index, archStreamName, r)
+					if err != nil {
+						return err
+					}
+				}
+
+				if config.signKey != nil {
+					index.SetSignKeyID(archStreamName, config.signKey.KeyID())
+				}
+
+				if !r[0].changed() {
+					index.RetainUpdated(prevIndex, archStreamName)
+				}
+			}
+		}
+	}
+
+	// Move the catalog files to final destinations and merge the index
+	// with the current one, retaining entries of streams that are not
+	// built now.
+	writtenPaths, err := publishCatalogs(metaDir, replaces, func(currIndex *stream.StreamIndex) error {
+		index.MergeEntries(*currIndex, func(name string, entry stream.StreamIndexEntry) bool {
+			return isBuiltIndexEntry(name, entry, streamNames, config.splitByArch)
+		})
+
+		*currIndex = index
+		return nil
+	}, config)
+	if err != nil {
+		return err
+	}
+
+	// Update latest version pointers once the catalogs are published.
+	if config.latestPointer != "" {
+		for _, streamName := range streamNames {
+			paths, latestWarnings := writeLatestPointers(rootDir, streamName, catalogs[streamName], config)
+			writtenPaths = append(writtenPaths, paths...)
+			warnings = append(warnings, latestWarnings...)
+		}
+	}
+
+	// Write stream's index.html.
+	if indexHTML != nil {
+		err := indexHTML.Write(metaRootDir)
+		if err != nil {
+			return fmt.Errorf("Failed to write index.html: %w", err)
+		}
+
+		writtenPaths = append(writtenPaths, filepath.Join(metaRootDir, "index.html"))
+	}
+
+	// Run post build hook with the written files as arguments.
+	if config.postBuildHook != "" {
+		args := append([]string{"-c", config.postBuildHook + ` "$@"`, "post-build-hook"}, writtenPaths...)
+
+		err := shared.RunCommand(ctx, nil, nil, "sh", args...)
+		if err != nil {
+			return fmt.Errorf("Post build hook failed: %w", err)
+		}
+	}
+
+	logWarnings(warnings)
+
+	if config.strict && len(warnings) > 0 {
+		return fmt.Errorf("Build finished with %d warning(s)", len(warnings))
+	}
+
+	return nil
+}
+
+// getSourceProducts returns the products within the given stream of the source
+// root merged with the products found within the extra roots. Versions of the
+// source root take precedence over the versions of the same name within the
+// extra roots, which take precedence in the configured order.
+func getSourceProducts(sourceRoot string, streamName string, config *buildConfig, opts ...stream.Option) (map[string]stream.Product, error) {
+	products, err := stream.GetProducts(sourceRoot, streamName, config.streamOptions(opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range config.extraRoots {
+		// Extra root may not contain all streams.
+		_, err := os.Stat(filepath.Join(root, streamName))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		extraProducts, err := stream.GetProducts(root, streamName, config.streamOptions(opts...)...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read products of extra root %q: %w", root, err)
+		}
+
+		for id, extra := range extraProducts {
+			product, ok := products[id]
+			if !ok {
+				products[id] = extra
+				continue
+			}
+
+			if product.Versions == nil {
+				product.Versions = make(map[string]stream.Version, len(extra.Versions))
+			}
+
+			for name, version := range extra.Versions {
+				_, ok := product.Versions[name]
+				if ok {
+					slog.Warn("Ignoring duplicate version within extra root", "root", root, "product", id, "version", name)
+					continue
+				}
+
+				product.Versions[name] = version
+			}
+
+			products[id] = product
+		}
+	}
+
+	return products, nil
+}
+
+// writeLatestPointers writes a pointer to the newest complete version into
+// the directory of each product within the catalog. Pointers are replaced
+// atomically and only if the newest version has changed. Paths of the
+// updated pointers are returned.
+func writeLatestPointers(rootDir string, streamName string, catalog *stream.ProductCatalog, config *buildConfig) ([]string, []buildWarning) {
+	var paths []string
+	var warnings []buildWarning
+
+	for _, id := range shared.MapKeysSorted(catalog.Products) {
+		product := catalog.Products[id]
+		productRelPath := filepath.Join(streamName, product.RelPath())
+
+		// Find the newest version located within the product directory,
+		// which excludes baseline versions.
+		var latest string
+		versionNames := shared.MapKeysSorted(product.Versions)
+
+		for i := len(versionNames) - 1; i >= 0; i-- {
+			versionRelPath := filepath.Join(productRelPath, versionNames[i])
+
+			_, err := os.Stat(filepath.Join(config.rootFor(config.sourceRootDir(rootDir), versionRelPath), versionRelPath))
+			if err == nil {
+				latest = versionNames[i]
+				break
+			}
+		}
+
+		if latest == "" {
+			continue
+		}
+
+		path, changed, err := writeLatestPointer(filepath.Join(config.workRootDir(rootDir), productRelPath), latest, config.latestPointer)
+		if err != nil {
+			warnings = append(warnings, buildWarning{Stream: streamName, Product: id, Version: latest, Message: "Failed to write latest version pointer", Err: err})
+			continue
+		}
+
+		if changed {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, warnings
+}
+
+// writeLatestPointer writes a pointer to the given version into the product
+// directory in the given format. The pointer is first written to a temporary
+// file and then moved to the final destination. The path of the pointer is
+// returned along with a flag indicating whether it was changed.
+func writeLatestPointer(productPath string, versionName string, format string) (string, bool, error) {
+	switch format {
+	case latestPointerSymlink:
+		path := filepath.Join(productPath, latestPointerSymlinkName)
+		pathTmp := filepath.Join(productPath, "."+latestPointerSymlinkName+".tmp")
+
+		target, err := os.Readlink(path)
+		if err == nil && target == versionName {
+			return path, false, nil
+		}
+
+		_ = os.Remove(pathTmp)
+
+		err = os.Symlink(versionName, pathTmp)
+		if err != nil {
+			return "", false, err
+		}
+
+		defer os.Remove(pathTmp)
+
+		return path, true, os.Rename(pathTmp, path)
+
+	case latestPointerFile:
+		path := filepath.Join(productPath, latestPointerFileName)
+		pathTmp := filepath.Join(productPath, "."+latestPointerFileName+".tmp")
+		content := []byte(versionName + "\n")
+
+		current, err := os.ReadFile(path)
+		if err == nil && bytes.Equal(current, content) {
+			return path, false, nil
+		}
+
+		err = os.MkdirAll(productPath, os.ModePerm)
+		if err != nil {
+			return "", false, err
+		}
+
+		err = os.WriteFile(pathTmp, content, 0644)
+		if err != nil {
+			return "", false, err
+		}
+
+		defer os.Remove(pathTmp)
+
+		return path, true, os.Rename(pathTmp, path)
+	}
+
+	return "", false, fmt.Errorf("Unknown latest pointer format %q", format)
+}
+
+// verifyCatalogFiles ensures that each item and auxiliary file referenced by
+// the product catalog exists within the work root (or one of the extra roots)
+// and has the recorded size. Files are checked concurrently by the given
+// number of workers, and all mismatches are returned together.
+func verifyCatalogFiles(ctx context.Context, rootDir string, catalog *stream.ProductCatalog, workers int, config *buildConfig) error {
+	workRoot := config.workRootDir(rootDir)
+
+	var mu sync.Mutex
+	var errs []error
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	for _, id := range shared.MapKeysSorted(catalog.Products) {
+		for _, version := range catalog.Products[id].Versions {
+			for _, items := range []map[string]stream.Item{version.Items, version.AuxFiles} {
+				for _, item := range items {
+					g.Go(func() error {
+						err := gctx.Err()
+						if err != nil {
+							return err
+						}
+
+						info, err := os.Stat(filepath.Join(config.rootFor(workRoot, item.Path), item.Path))
+						if err == nil && info.Size() != item.Size {
+							err = fmt.Errorf("Size mismatch: expected %d, actual %d", item.Size, info.Size())
+						}
+
+						if err != nil {
+							mu.Lock()
+							errs = append(errs, fmt.Errorf("Item %q of product %q: %w", item.Path, id, err))
+							mu.Unlock()
+						}
+
+						return nil
+					})
+				}
+			}
+		}
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return err
+	}
+
+	// Sort errors to make the result deterministic.
+	slices.SortFunc(errs, func(a error, b error) int { return strings.Compare(a.Error(), b.Error()) })
+
+	return errors.Join(errs...)
+}
+
+// reverifyExistingItems recalculates the hashes of the items within the given
+// catalog and compares them with the recorded ones. The hash cache is not
+// used. Delta files and chunk indexes that no longer match are removed from
+// the catalog, the disk, and the version checksum file, so that they are
+// regenerated. Other mismatching items cannot be regenerated, and are
+// therefore only reported. A warning is returned for each mismatch.
+func reverifyExistingItems(ctx context.Context, rootDir string, streamName string, catalog *stream.ProductCatalog, workers int, config *buildConfig) ([]buildWarning, error) {
+	workRoot := config.workRootDir(rootDir)
+	warnings := &buildWarnings{}
+
+	type mismatch struct {
+		id          string
+		versionName string
+		itemName    string
+		root        string
+	}
+
+	var mu sync.Mutex
+	var mismatches []mismatch
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	for id, product := range catalog.Products {
+		for versionName, version := range product.Versions {
+			for itemName, item := range version.Items {
+				if item.SHA256 == "" {
+					continue
+				}
+
+				g.Go(func() error {
+					err := gctx.Err()
+					if err != nil {
+						return err
+					}
+
+					root := config.rootFor(workRoot, item.Path)
+
+					hash, err := shared.FileHash(sha256.New(), filepath.Join(root, item.Path))
+					if err != nil {
+						warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Item: itemName, Message: "Failed to reverify existing item", Err: err})
+						return nil
+					}
+
+					if hash != item.SHA256 {
+						mu.Lock()
+						mismatches = append(mismatches, mismatch{id: id, versionName: versionName, itemName: itemName, root: root})
+						mu.Unlock()
+					}
+
+					return nil
+				})
+			}
+		}
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mismatches {
+		version := catalog.Products[m.id].Versions[m.versionName]
+		item := version.Items[m.itemName]
+		err := fmt.Errorf("%w: %q", shared.ErrChecksumMismatch, item.Path)
+
+		emitEvent(config.events, event{Type: eventChecksumMismatch, Stream: streamName, Product: m.id, Version: m.versionName, Item: m.itemName, Path: item.Path, Error: err.Error()})
+
+		if !isGeneratedItem(item) {
+			warnings.add(buildWarning{Stream: streamName, Product: m.id, Version: m.versionName, Item: m.itemName, Message: "Existing item does not match the product catalog", Err: err})
+			continue
+		}
+
+		warnings.add(buildWarning{Stream: streamName, Product: m.id, Version: m.versionName, Item: m.itemName, Message: "Regenerating existing item that does not match the product catalog", Err: err})
+
+		delete(version.Items, m.itemName)
+		delete(version.Checksums, m.itemName)
+
+		// Files within the extra roots are read-only. Generated file is
+		// written into the work root instead.
+		if m.root != workRoot {
+			continue
+		}
+
+		path := filepath.Join(m.root, item.Path)
+
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			warnings.add(buildWarning{Stream: streamName, Product: m.id, Version: m.versionName, Item: m.itemName, Message: "Failed to remove mismatching item", Err: err})
+			continue
+		}
+
+		// Remove the stale entry from the checksum file located next to
+		// the generated file. Remaining checksums are attached to the
+		// version, so that the entry of the regenerated file is appended.
+		for _, checksumName := range config.checksumFiles {
+			checksumPath := filepath.Join(filepath.Dir(path), checksumName)
+
+			err := removeChecksum(checksumPath, m.itemName)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			if err == nil {
+				version.Checksums, err = stream.ReadChecksumFile(checksumPath)
+				version.ChecksumFile = checksumName
+			}
+
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: m.id, Version: m.versionName, Message: "Failed to update checksums file", Err: err})
+			}
+
+			break
+		}
+
+		catalog.Products[m.id].Versions[m.versionName] = version
+	}
+
+	return warnings.list(), nil
+}
+
+// publishCatalogs moves the written product catalog files to their final
+// destinations and writes the index of the metadata directory. The current
+// index is read and modified by the given function while holding an exclusive
+// lock on the metadata directory, so that concurrent commands do not drop each
+// other's changes. The index is moved last, once all catalog files are in
+// place, to avoid referencing non-existing products. Paths of the written
+// files are returned.
+func publishCatalogs(metaDir string, replaces []replace, updateIndex func(index *stream.StreamIndex) error, config *buildConfig) ([]string, error) {
+	indexPath := filepath.Join(metaDir, "index.json")
+	indexPathTemp := filepath.Join(metaDir, ".index.json.tmp")
+
+	unlock, err := shared.LockFile(metaDir)
+	if err != nil {
+		return nil, fmt.Errorf("Lock metadata directory: %w", err)
+	}
+
+	defer func() { _ = unlock() }()
+
+	// Re-read the current index under the lock.
+	index := stream.NewStreamIndex()
+
+	_, err = shared.ReadJSONFile(indexPath, &index)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Read index file: %w", err)
+	}
+
+	err = updateIndex(&index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write index to a temporary file that is located next to the
+	// final file to ensure atomic replace. Temporary file is
+	// prefixed with a dot to hide it.
+	err = shared.WriteJSONFile(indexPathTemp, index)
+	if err != nil {
+		return nil, fmt.Errorf("Write index file: %w", err)
+	}
+
+	defer os.Remove(indexPathTemp)
+
+	replaces = append(slices.Clone(replaces), replace{OldPath: indexPathTemp, NewPath: indexPath})
+
+	// Create compressed version of the index file.
+	if !config.noGZip {
+		indexGzPath := fmt.Sprintf("%s.gz", indexPath)
+		indexGzPathTemp := fmt.Sprintf("%s.gz", indexPathTemp)
+
+		err = shared.GZipFileLevel(indexPathTemp, indexGzPathTemp, config.gzipLevel)
+		if err != nil {
+			return nil, fmt.Errorf("Compress index file: %w", err)
+		}
+
+		defer os.Remove(indexGzPathTemp)
+
+		err = verifyGZipFile(indexPathTemp, indexGzPathTemp)
+		if err != nil {
+			return nil, fmt.Errorf("Verify compressed index file: %w", err)
+		}
+
+		replaces = append(replaces, replace{OldPath: indexGzPathTemp, NewPath: indexGzPath})
+	}
+
+	// Sign index file.
+	if config.signKey != nil {
+		r, err := signFile(config.signKey, indexPathTemp, indexPath)
+		if err != nil {
+			return nil, fmt.Errorf("Sign index file: %w", err)
+		}
+
+		defer os.Remove(r.OldPath)
+		replaces = append(replaces, r)
+	}
+
+	// Move temporary files to final destinations.
+	writtenPaths := make([]string, 0, len(replaces)+1)
+
+	for _, r := range replaces {
+		err := os.Rename(r.OldPath, r.NewPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Set read permissions.
+		err = os.Chmod(r.NewPath, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		writtenPaths = append(writtenPaths, r.NewPath)
+
+		// Remove compressed files of previous builds, so that they do
+		// not diverge from the written ones.
+		if config.noGZip && strings.HasSuffix(r.NewPath, ".json") {
+			err := os.Remove(r.NewPath + ".gz")
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+
+	return writtenPaths, nil
+}
+
+// publishCatalog writes the product catalog of the given stream into the
+// metadata directory and updates the stream's index entry, retaining its path
+// and products omitted by the index allowlist. Item paths of the catalog are
+// expected to be trimmed (see trimItemPaths), and are prefixed according to
+// the configuration when written. If expectedSHA256 is not empty,
+// the catalog is published only if the hash of the existing catalog file still
+// matches it, which guards against overwriting changes made since the catalog
+// was read.
+func publishCatalog(metaRootDir string, streamVersion string, streamName string, catalog *stream.ProductCatalog, expectedSHA256 string, config *buildConfig) error {
+	metaDir := filepath.Join(metaRootDir, "streams", streamVersion)
+	catalogPath := filepath.Join(metaDir, fmt.Sprintf("%s.json", streamName))
+
+	replaces, err := writeCatalogFile(catalogPath, prefixItemPaths(catalog, config), config)
+	if err != nil {
+		return err
+	}
+
+	// Remove temporary files that were not moved to final destinations.
+	defer func() {
+		for _, r := range replaces {
+			_ = os.Remove(r.OldPath)
+		}
+	}()
+
+	catalogSHA256, err := shared.FileHash(sha256.New(), replaces[0].OldPath)
+	if err != nil {
+		return fmt.Errorf("Failed to calculate product catalog hash: %w", err)
+	}
+
+	catalogRelPath, err := filepath.Rel(metaRootDir, catalogPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = publishCatalogs(metaDir, replaces, func(index *stream.StreamIndex) error {
+		if expectedSHA256 != "" {
+			currSHA256, err := shared.FileHash(sha256.New(), catalogPath)
+			if err != nil {
+				return err
+			}
+
+			if currSHA256 != expectedSHA256 {
+				return fmt.Errorf("Product catalog %q was modified concurrently", catalogPath)
+			}
+		}
+
+		prev, ok := index.Index[streamName]
+
+		index.AddEntry(streamName, catalogRelPath, catalogSHA256, *catalog)
+
+		if ok {
+			entry := index.Index[streamName]
+			entry.Path = prev.Path
+			index.Index[streamName] = entry
+
+			index.RetainProducts(streamName, prev.Products)
+
+			if !replaces[0].changed() {
+				index.RetainUpdated(stream.StreamIndex{Index: map[string]stream.StreamIndexEntry{streamName: prev}}, streamName)
+			}
+		}
+
+		if config.catalogSizes || prev.Size > 0 {
+			err := setCatalogSizes(index, streamName, replaces)
+			if err != nil {
+				return err
+			}
+		}
+
+		if config.signKey != nil {
+			index.SetSignKeyID(streamName, config.signKey.KeyID())
+		}
+
+		return nil
+	}, config)
+
+	return err
+}
+
+// writeCatalogFile writes the product catalog, its compressed version (unless
+// disabled), and optionally its signature to temporary files that are located next to the
+// final file to ensure atomic replace. Temporary files are prefixed with a
+// dot to hide them. Replaces for the temporary files are returned.
+func writeCatalogFile(catalogPath string, catalog *stream.ProductCatalog, config *buildConfig) ([]replace, error) {
+	catalogPathTemp := filepath.Join(filepath.Dir(catalogPath), fmt.Sprintf(".%s.tmp", filepath.Base(catalogPath)))
+
+	err := shared.WriteJSONFile(catalogPathTemp, catalog)
+	if err != nil {
+		return nil, fmt.Errorf("Write product catalog file: %w", err)
+	}
+
+	replaces := []replace{{OldPath: catalogPathTemp, NewPath: catalogPath}}
+
+	// removeTemp removes the temporary files written so far.
+	removeTemp := func() {
+		for _, r := range replaces {
+			_ = os.Remove(r.OldPath)
+		}
+	}
+
+	// Create compressed version of the product catalog file.
+	if !config.noGZip {
+		catalogGzPath := fmt.Sprintf("%s.gz", catalogPath)
+		catalogGzPathTemp := fmt.Sprintf("%s.gz", catalogPathTemp)
+
+		replaces = append(replaces, replace{OldPath: catalogGzPathTemp, NewPath: catalogGzPath})
+
+		err = shared.GZipFileLevel(catalogPathTemp, catalogGzPathTemp, config.gzipLevel)
+		if err != nil {
+			removeTemp()
+			return nil, fmt.Errorf("Compress product catalog file: %w", err)
+		}
+
+		err = verifyGZipFile(catalogPathTemp, catalogGzPathTemp)
+		if err != nil {
+			removeTemp()
+			return nil, fmt.Errorf("Verify compressed product catalog file: %w", err)
+		}
+	}
+
+	// Sign product catalog file.
+	if config.signKey != nil {
+		r, err := signFile(config.signKey, catalogPathTemp, catalogPath)
+		if err != nil {
+			removeTemp()
+			return nil, fmt.Errorf("Sign product catalog file: %w", err)
+		}
+
+		replaces = append(replaces, r)
+	}
+
+	return replaces, nil
+}
+
+// isBuiltIndexEntry returns true if the index entry belongs to one of the given
+// streams, either directly or as a per-architecture entry of the stream when
+// catalogs are split by architecture.
+func isBuiltIndexEntry(name string, entry stream.StreamIndexEntry, streamNames []string, splitByArch bool) bool {
+	if slices.Contains(streamNames, name) {
+		return true
+	}
+
+	if !splitByArch || len(entry.Products) == 0 {
+		return false
+	}
+
+	for _, streamName := range streamNames {
+		arch, ok := strings.CutPrefix(name, streamName+"-")
+		if !ok {
+			continue
+		}
+
+		// Product IDs are in format "distro:release:arch:variant".
+		sameArch := !slices.ContainsFunc(entry.Products, func(id string) bool {
+			parts := strings.Split(id, ":")
+			return len(parts) != 4 || parts[2] != arch
+		})
+
+		if sameArch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCatalogByArch partitions the catalog products by their architecture
+// and returns a product catalog for each architecture.
+func splitCatalogByArch(catalog *stream.ProductCatalog) map[string]*stream.ProductCatalog {
+	catalogs := make(map[string]*stream.ProductCatalog)
+
+	for id, product := range catalog.Products {
+		c, ok := catalogs[product.Architecture]
+		if !ok {
+			c = &stream.ProductCatalog{
+				ContentID: catalog.ContentID,
+				Format:    catalog.Format,
+				DataType:  catalog.DataType,
+				Products:  make(map[string]stream.Product),
+			}
+
+			catalogs[product.Architecture] = c
+		}
+
+		c.Products[id] = product
+	}
+
+	return catalogs
+}
+
+// buildProductCatalog compares the existing product catalog and actual products on
+// the disk. For missing any new version, hashes are calculated and compared against
+// the checksums file. Based on the final catalog (that contains only valid version)
+// missing delta files are generated. Finally the catalog is returned.
+//
+// Problems that do not abort the build, such as versions excluded due to a checksum
+// mismatch, are returned as warnings. The first hard error of the jobs, such as a
+// failure to read version files, cancels the remaining jobs and is returned.
+//
+// Note: Workers limit the maximum number of concurent tasks when calulcating hashes
+// and delta files.
+func buildProductCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, opts ...buildOption) (*stream.ProductCatalog, []buildWarning, error) {
+	config := newBuildConfig(opts...)
+	warnings := &buildWarnings{}
+
+	// Collect errors ignored while reading products as warnings.
+	warningHandler := stream.WithWarningHandler(func(relPath string, err error) {
+		warnings.add(buildWarning{Stream: streamName, Path: relPath, Message: "Ignored invalid product or version", Err: err})
+	})
+
+	// Errors ignored while re-reading versions are already collected when
+	// reading the products.
+	ignoreWarnings := stream.WithWarningHandler(func(string, error) {})
+
+	// Get current product catalog (from json file).
+	catalogPath := filepath.Join(config.metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	if catalog == nil {
+		catalog = stream.NewCatalog(streamName, nil)
+	}
+
+	// Item paths of the existing catalog may be rewritten and prefixed with
+	// the public base, while the rest of the build expects them to be
+	// relative to the work root directory.
+	trimItemPaths(catalog, config)
+
+	// Write the catalog in the configured format.
+	catalog.Format = config.catalogFormat
+
+	sourceRoot := config.sourceRootDir(rootDir)
+	sourceRelPath, err := config.sourceRelPath(rootDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Collect incomplete versions, which are reported once the products
+	// of all roots are read.
+	incomplete := make(map[string]stream.Product)
+	incompleteHandler := stream.WithIncompleteVersionHandler(func(p stream.Product, versionName string) {
+		id := p.ID()
+
+		product, ok := incomplete[id]
+		if !ok {
+			product = p
+			product.Versions = make(map[string]stream.Version)
+		}
+
+		product.Versions[versionName] = stream.Version{}
+		incomplete[id] = product
+	})
+
+	// Get existing products (from actual directory hierarchy).
+	products, err := getSourceProducts(sourceRoot, streamName, config, stream.WithSkipErrors(true), stream.WithLenientConfig(true), warningHandler, incompleteHandler)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Protect against replacing a good product catalog with an empty one,
+	// for example, when the image directory is misspelled.
+	if config.failOnEmpty && len(products) == 0 && len(catalog.Products) > 0 {
+		return nil, nil, fmt.Errorf("No products found in stream %q, while its existing product catalog contains %d products", streamName, len(catalog.Products))
+	}
+
+	// Omit excluded products from the catalog, including the ones that
+	// were already part of it.
+	for _, id := range excludeProducts(products, config.exclude) {
+		slog.Info("Excluding product from the product catalog", "streamName", streamName, "product", id)
+	}
+
+	excludeProducts(catalog.Products, config.exclude)
+
+	// Report incomplete versions that are excluded from the catalog, unless
+	// a complete version of the same name exists within another root. Hidden
+	// versions are skipped, as they are most likely still being uploaded.
+	excludeProducts(incomplete, config.exclude)
+
+	for id, p := range incomplete {
+		for versionName := range p.Versions {
+			_, ok := products[id].Versions[versionName]
+			if !ok && !strings.HasPrefix(versionName, ".") {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Skipping incomplete version"})
+			}
+		}
+	}
+
+	// Recalculate aliases of the existing products, unless they are
+	// preserved. New versions apply them to the product anyway.
+	for id, p := range catalog.Products {
+		src, ok := products[id]
+		if !ok || !slices.Contains(config.refreshAliases, p.Distro) || slices.Contains(p.Preserve, stream.ProductFieldAliases) {
+			continue
+		}
+
+		p.Aliases = src.Aliases
+		catalog.Products[id] = p
+	}
+
+	// Reject new versions with undersized items, as they are most likely
+	// leftovers of a failed build.
+	for _, r := range rejectUndersizedVersions(catalog.Products, products, config.minItemSize) {
+		warnings.add(buildWarning{Stream: streamName, Product: r.id, Version: r.versionName, Item: r.itemName, Message: "Skipping version with undersized item", Err: r.err})
+	}
+
+	// Recalculate hashes of the existing items before new versions are
+	// added, so that mismatching delta files are regenerated.
+	if config.reverifyExisting {
+		reverifyWarnings, err := reverifyExistingItems(ctx, rootDir, streamName, catalog, workers, config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, w := range reverifyWarnings {
+			warnings.add(w)
+		}
+	}
+
+	// Load hash cache of the stream.
+	var hashCache *stream.HashCache
+	if config.hashCache {
+		hashCachePath := filepath.Join(config.workRootDir(rootDir), "streams", streamVersion, ".hashcache", fmt.Sprintf("%s.json", streamName))
+
+		hashCache, err = stream.NewHashCache(hashCachePath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var mutex sync.Mutex // To safely update the catalog.Products map
+
+	// Normalization of qcow2 images is skipped if qemu-img is not available.
+	normalizeQcow2 := config.normalizeQcow2
+	if normalizeQcow2 {
+		_, err := exec.LookPath("qemu-img")
+		if err != nil {
+			warnings.add(buildWarning{Stream: streamName, Message: "Skipping normalization of qcow2 images", Err: err})
+			normalizeQcow2 = false
+		}
+	}
+
+	// Create new group of workers. The group context is cancelled once
+	// any job fails.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	// Extract new (unreferenced products and product versions) and add them
+	// to the catalog.
+	_, newProducts := diffProducts(catalog.Products, products)
+	for id, p := range newProducts {
+		productPath := filepath.Join(streamName, p.RelPath())
+
+		// Copy value of the product retrieved from the directory hierarchy
+		// to the catalog's product to ensure the potential new metadata is
+		// applied.
+		mutex.Lock()
+		tmp := p
+
+		prev, ok := catalog.Products[id]
+		if ok {
+			// Carry over manually curated fields from the existing
+			// catalog.
+			err := tmp.PreserveFields(prev)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Message: "Ignored invalid preserved product fields", Err: err})
+			}
+		}
+
+		if ok && len(prev.Versions) > 0 {
+			// Retain existing product versions.
+			tmp.Versions = prev.Versions
+		} else {
+			// Create new map for product versions. They will be added
+			// in the next step.
+			tmp.Versions = make(map[string]stream.Version, len(p.Versions))
+		}
+
+		catalog.Products[id] = tmp
+		mutex.Unlock()
+
+		for versionName := range p.Versions {
+			// Add a job for processing a new version.
+			g.Go(func() error {
+				// Skip the job if the build was cancelled.
+				err := gctx.Err()
+				if err != nil {
+					return err
+				}
+
+				versionPath := filepath.Join(productPath, versionName)
+
+				// Normalize qcow2 images before they are hashed. On
+				// failure, the original images are retained.
+				if normalizeQcow2 {
+					err := normalizeVersionQcow2(gctx, filepath.Join(sourceRoot, versionPath), config.checksumFiles)
+					if err != nil {
+						warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Failed to normalize qcow2 images", Err: err})
+					}
+				}
+
+				// Read the version and generate the file hashes.
+				version, err := stream.GetVersion(config.rootFor(sourceRoot, versionPath), versionPath, config.streamOptions(stream.WithHashes(true), stream.WithLenientConfig(true), stream.WithHashCache(hashCache), ignoreWarnings)...)
+				if err != nil {
+					// Skip incomplete versions and versions that were
+					// removed in the meantime. Other errors are fatal.
+					if errors.Is(err, stream.ErrVersionIncomplete) || errors.Is(err, os.ErrNotExist) {
+						warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Failed to get version", Err: err})
+						return nil
+					}
+
+					return fmt.Errorf("Failed to get version %q of product %q: %w", versionName, id, err)
+				}
+
+				// Reject unverifiable versions if checksums are required.
+				if config.requireChecksums && version.ChecksumFile == "" {
+					err := fmt.Errorf("None of the checksum files %v found", config.checksumFiles)
+					warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Missing checksum file", Err: err})
+					return nil
+				}
+
+				// Verify items checksums if checksum file is present
+				// within the version.
+				err = version.VerifyChecksums()
+				if err != nil {
+					warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Checksum mismatch", Err: err})
+					emitEvent(config.events, event{Type: eventChecksumMismatch, Stream: streamName, Product: id, Version: versionName, Error: err.Error()})
+					return nil
+				}
+
+				// Item paths in the catalog are relative to the work root.
+				if sourceRelPath != "" {
+					for itemName, item := range version.Items {
+						item.Path = filepath.Join(sourceRelPath, item.Path)
+						version.Items[itemName] = item
+					}
+
+					for auxName, aux := range version.AuxFiles {
+						aux.Path = filepath.Join(sourceRelPath, aux.Path)
+						version.AuxFiles[auxName] = aux
+					}
+				}
+
+				mutex.Lock()
+				catalog.Products[id].Versions[versionName] = *version
+				mutex.Unlock()
+
+				slog.Info("New version added to the product catalog", "streamName", streamName, "product", id, "version", versionName)
+				emitEvent(config.events, event{Type: eventVersionAdded, Stream: streamName, Product: id, Version: versionName})
+				return nil
+			})
+		}
+	}
+
+	// Wait for all workers to finish to ensure the final catalog contains
+	// all valid product versions.
+	err = g.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hashCache != nil {
+		err := hashCache.Save(sourceRoot)
+		if err != nil {
+			warnings.add(buildWarning{Stream: streamName, Message: "Failed to save hash cache", Err: err})
+		}
+	}
+
+	// Add baseline versions before delta files are generated, so that they
+	// can be used as delta bases.
+	if config.baselineDir != "" {
+		err := addBaselineVersions(sourceRoot, sourceRelPath, streamName, catalog, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Build delta files after all new versions are added to the catalog.
+	// This way we can determine which versions are valid for delta files.
+	deltaWarnings, err := generateDeltas(ctx, rootDir, streamName, catalog, workers, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, w := range deltaWarnings {
+		warnings.add(w)
+	}
+
+	// Write file manifests once all delta files are in place.
+	if config.manifest {
+		workRoot := config.workRootDir(rootDir)
+
+		for _, product := range catalog.Products {
+			for versionName := range product.Versions {
+				versionRelPath := filepath.Join(streamName, product.RelPath(), versionName)
+
+				outputDir := filepath.Join(workRoot, versionRelPath)
+
+				// Generated files may be stored outside the source
+				// version directory, and the files of the work root
+				// (e.g. updated checksum files) take precedence.
+				versionDirs := []string{filepath.Join(config.rootFor(sourceRoot, versionRelPath), versionRelPath), outputDir}
+				if config.deltaDir != "" {
+					versionDirs = append(versionDirs, filepath.Join(workRoot, config.deltaDir, versionRelPath))
+				}
+
+				err := writeVersionManifest(outputDir, versionDirs...)
+				if err != nil {
+					warnings.add(buildWarning{Stream: streamName, Product: product.ID(), Version: versionName, Message: "Failed to write version manifest", Err: err})
+				}
+			}
+		}
+	}
+
+	// Instance types of the products depend on the final set of versions.
+	for id, product := range catalog.Products {
+		product.UpdateInstanceTypes()
+		catalog.Products[id] = product
+	}
+
+	return catalog, warnings.list(), nil
+}
+
+// productFilter matches products by their release, architecture, or variant.
+type productFilter struct {
+	variants []string
+	releases []string
+	archs    []string
+}
+
+// matches returns true if any of the given release, architecture, or variant
+// is matched by the filter.
+func (f productFilter) matches(release string, arch string, variant string) bool {
+	return slices.Contains(f.releases, release) || slices.Contains(f.archs, arch) || slices.Contains(f.variants, variant)
+}
+
+// excludeProducts removes products matched by the filter from the given map
+// and returns their sorted IDs.
+func excludeProducts(products map[string]stream.Product, filter productFilter) []string {
+	var excluded []string
+
+	for _, id := range shared.MapKeysSorted(products) {
+		p := products[id]
+		if filter.matches(p.Release, p.Architecture, p.Variant) {
+			delete(products, id)
+			excluded = append(excluded, id)
+		}
+	}
+
+	return excluded
+}
+
+// addBaselineVersions adds the latest baseline version of each catalog product
+// to the catalog, unless it is already included. Baseline versions are read
+// from the baseline directory, which uses the same hierarchy as the stream.
+func addBaselineVersions(sourceRoot string, sourceRelPath string, streamName string, catalog *stream.ProductCatalog, config *buildConfig) error {
+	baselineRoot := filepath.Join(sourceRoot, config.baselineDir)
+
+	_, err := os.Stat(filepath.Join(baselineRoot, streamName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
 	}
 
-	var indexHTML *webpage.WebPage
-	var replaces []replace
-	index := stream.NewStreamIndex()
-	metaDir := path.Join(rootDir, "streams", streamVersion)
+	baselines, err := stream.GetProducts(baselineRoot, streamName, config.streamOptions(stream.WithLenientConfig(true))...)
+	if err != nil {
+		return fmt.Errorf("Failed to read baseline versions: %w", err)
+	}
+
+	for id, baseline := range baselines {
+		product, ok := catalog.Products[id]
+		if !ok {
+			continue
+		}
+
+		versionNames := shared.MapKeysSorted(baseline.Versions)
+		versionName := versionNames[len(versionNames)-1]
+
+		_, ok = product.Versions[versionName]
+		if ok {
+			continue
+		}
+
+		versionRelPath := filepath.Join(streamName, baseline.RelPath(), versionName)
+
+		version, err := stream.GetVersion(baselineRoot, versionRelPath, config.streamOptions(stream.WithHashes(true), stream.WithLenientConfig(true))...)
+		if err != nil {
+			return fmt.Errorf("Failed to read baseline version %q of product %q: %w", versionName, id, err)
+		}
+
+		err = version.VerifyChecksums()
+		if err != nil {
+			return fmt.Errorf("Baseline version %q of product %q: %w", versionName, id, err)
+		}
+
+		// Item paths in the catalog are relative to the work root.
+		for itemName, item := range version.Items {
+			item.Path = filepath.Join(sourceRelPath, config.baselineDir, item.Path)
+			version.Items[itemName] = item
+		}
+
+		for auxName, aux := range version.AuxFiles {
+			aux.Path = filepath.Join(sourceRelPath, config.baselineDir, aux.Path)
+			version.AuxFiles[auxName] = aux
+		}
+
+		product.Versions[versionName] = *version
+		slog.Info("Baseline version added to the product catalog", "streamName", streamName, "product", id, "version", versionName)
+	}
+
+	return nil
+}
+
+// prefixItemPaths returns a copy of the product catalog with item paths
+// rewritten by the configured path rewrites and prefixed by the public base.
+// Item mirrors are populated from the rewritten paths prefixed by each mirror
+// base. If none is configured, the catalog is returned unchanged.
+func prefixItemPaths(catalog *stream.ProductCatalog, config *buildConfig) *stream.ProductCatalog {
+	if config.publicBase == "" && len(config.pathRewrites) == 0 && len(config.mirrorBases) == 0 {
+		return catalog
+	}
+
+	base := strings.TrimSuffix(config.publicBase, "/")
+
+	prefix := func(items map[string]stream.Item) map[string]stream.Item {
+		if items == nil {
+			return nil
+		}
+
+		prefixed := make(map[string]stream.Item, len(items))
+
+		for itemName, item := range items {
+			item.Path = rewritePath(item.Path, config.pathRewrites, false)
+
+			item.Mirrors = nil
+			for _, mirror := range config.mirrorBases {
+				item.Mirrors = append(item.Mirrors, strings.TrimSuffix(mirror, "/")+"/"+strings.TrimPrefix(item.Path, "/"))
+			}
+
+			if base != "" {
+				item.Path = base + "/" + item.Path
+			}
+
+			prefixed[itemName] = item
+		}
+
+		return prefixed
+	}
+
+	c := *catalog
+	c.Products = make(map[string]stream.Product, len(catalog.Products))
+
+	for id, product := range catalog.Products {
+		versions := make(map[string]stream.Version, len(product.Versions))
+
+		for versionName, version := range product.Versions {
+			version.Items = prefix(version.Items)
+			version.AuxFiles = prefix(version.AuxFiles)
+			versions[versionName] = version
+		}
+
+		product.Versions = versions
+		c.Products[id] = product
+	}
+
+	return &c
+}
+
+// trimItemPaths reverts the changes of prefixItemPaths by removing the public
+// base prefix from the item paths of the product catalog and reverting the
+// configured path rewrites. Item mirrors are always removed, as they are
+// populated again from the current mirror bases when the catalog is written.
+func trimItemPaths(catalog *stream.ProductCatalog, config *buildConfig) {
+	prefix := strings.TrimSuffix(config.publicBase, "/") + "/"
+
+	trim := func(items map[string]stream.Item) {
+		for itemName, item := range items {
+			if config.publicBase != "" {
+				item.Path = strings.TrimPrefix(item.Path, prefix)
+			}
+
+			item.Path = rewritePath(item.Path, config.pathRewrites, true)
+			item.Mirrors = nil
+			items[itemName] = item
+		}
+	}
+
+	for _, product := range catalog.Products {
+		for _, version := range product.Versions {
+			trim(version.Items)
+			trim(version.AuxFiles)
+		}
+	}
+}
+
+// parsePathRewrites parses the path rewrites in format 'old=new'.
+func parsePathRewrites(rewrites []string) ([]pathRewrite, error) {
+	pathRewrites := make([]pathRewrite, 0, len(rewrites))
+
+	for _, r := range rewrites {
+		oldPrefix, newPrefix, ok := strings.Cut(r, "=")
+		oldPrefix = strings.Trim(oldPrefix, "/")
+		if !ok || oldPrefix == "" {
+			return nil, fmt.Errorf("Invalid path rewrite %q: Expected format is 'old=new'", r)
+		}
+
+		pathRewrites = append(pathRewrites, pathRewrite{oldPrefix: oldPrefix, newPrefix: strings.Trim(newPrefix, "/")})
+	}
+
+	return pathRewrites, nil
+}
+
+// catalogPathOptions contains the flags of commands that rewrite an existing
+// product catalog, which determine where the catalog is located and how its
+// item paths are written. They must match the flags used by the build.
+type catalogPathOptions struct {
+	MetaDir      string
+	PublicBase   string
+	MirrorBases  []string
+	PathRewrites []string
+}
+
+// addFlags adds the catalog path flags to the given command.
+func (o *catalogPathOptions) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&o.MetaDir, "meta-dir", "", "Directory where the index and product catalogs are located (must match the build)")
+	cmd.PersistentFlags().StringVar(&o.PublicBase, "public-base", "", "URL or path of the path argument used to prefix item paths (must match the build)")
+	cmd.PersistentFlags().StringSliceVar(&o.MirrorBases, "mirror-base", nil, "URL or path of a mirror of the path argument used to record alternate item paths (must match the build)")
+	cmd.PersistentFlags().StringSliceVar(&o.PathRewrites, "path-rewrite", nil, "Path prefix rewrite of items in format 'old=new' (must match the build)")
+}
+
+// buildOptions validates the catalog path flags and returns the corresponding
+// build options.
+func (o *catalogPathOptions) buildOptions() ([]buildOption, error) {
+	if o.MetaDir != "" && o.PublicBase == "" {
+		return nil, fmt.Errorf("Flag %q is required when %q is set", "public-base", "meta-dir")
+	}
+
+	pathRewrites, err := parsePathRewrites(o.PathRewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	return []buildOption{
+		withMetaDir(o.MetaDir),
+		withPublicBase(o.PublicBase),
+		withMirrorBases(o.MirrorBases),
+		withPathRewrites(pathRewrites),
+	}, nil
+}
+
+// rewritePath replaces the path prefix using the first matching rewrite.
+// If reverse is true, the new prefix is replaced with the old one instead.
+// Prefixes match only whole path elements, and the leading slash of the path
+// is preserved, meaning relative paths remain relative and absolute paths
+// remain absolute.
+func rewritePath(p string, rewrites []pathRewrite, reverse bool) string {
+	abs := strings.HasPrefix(p, "/")
+	rel := strings.TrimPrefix(p, "/")
+
+	for _, r := range rewrites {
+		from, to := r.oldPrefix, r.newPrefix
+		if reverse {
+			from, to = to, from
+		}
+
+		var rest string
+
+		if from == "" {
+			rest = "/" + rel
+		} else if rel == from || strings.HasPrefix(rel, from+"/") {
+			rest = rel[len(from):]
+		} else {
+			continue
+		}
+
+		rel = strings.TrimPrefix(to+rest, "/")
+		break
+	}
+
+	if abs {
+		return "/" + rel
+	}
+
+	return rel
+}
+
+// writeVersionManifest writes a manifest file into the output directory that
+// lists all files within the given version directories (including files that
+// are not part of the product catalog) with their size and modification time.
+// The first directory must exist, while the others, such as the directories
+// of generated delta files, are optional. If a file with the same name exists
+// in multiple directories, the last one is listed. The manifest is rewritten
+// only if its content has changed.
+func writeVersionManifest(outputDir string, versionDirs ...string) error {
+	infos := make(map[string]fs.FileInfo)
+
+	for i, dir := range versionDirs {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			if i > 0 && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		for _, file := range files {
+			// Skip directories, hidden files, and the manifest itself.
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") || file.Name() == stream.FileManifest {
+				continue
+			}
+
+			info, err := file.Info()
+			if err != nil {
+				return err
+			}
+
+			infos[file.Name()] = info
+		}
+	}
+
+	var b strings.Builder
+
+	for _, name := range shared.MapKeysSorted(infos) {
+		info := infos[name]
+		fmt.Fprintf(&b, "%d %s %s\n", info.Size(), info.ModTime().UTC().Format(time.RFC3339), name)
+	}
+
+	err := os.MkdirAll(outputDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(outputDir, stream.FileManifest)
+
+	content, err := os.ReadFile(manifestPath)
+	if err == nil && string(content) == b.String() {
+		return nil
+	}
+
+	// Write manifest to a temporary file and replace the existing one.
+	manifestPathTemp := filepath.Join(outputDir, "."+stream.FileManifest+".tmp")
+
+	err = os.WriteFile(manifestPathTemp, []byte(b.String()), 0644)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(manifestPathTemp)
+
+	return os.Rename(manifestPathTemp, manifestPath)
+}
+
+// readIndexAllowlist reads product IDs from the allowlist file on the given
+// path. Empty lines and lines starting with "#" are skipped. A non-nil list
+// is returned even if the file contains no product IDs.
+func readIndexAllowlist(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	productIDs := []string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		id := strings.TrimSpace(line)
+		if id == "" || strings.HasPrefix(id, "#") {
+			continue
+		}
+
+		productIDs = append(productIDs, id)
+	}
+
+	return productIDs, nil
+}
+
+// readMinisignKey reads the minisign secret key from the given path. The
+// password of the encrypted key is read from the environment variable. If
+// the path is empty, nil is returned.
+func readMinisignKey(path string) (*minisign.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	key, err := minisign.ReadPrivateKeyFile(path, os.Getenv(minisignPasswordEnv))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read minisign key: %w", err)
+	}
+
+	return key, nil
+}
+
+// setCatalogSizes sets the sizes of the written product catalog files, given
+// by the replaces returned from writeCatalogFile, to the stream's index entry.
+// The size of the compressed file is zero if it is not written.
+func setCatalogSizes(index *stream.StreamIndex, streamName string, replaces []replace) error {
+	catalogPath := replaces[0].NewPath
+	sizes := make(map[string]int64, 2)
+
+	for _, r := range replaces {
+		if r.NewPath != catalogPath && r.NewPath != catalogPath+".gz" {
+			continue
+		}
+
+		info, err := os.Stat(r.OldPath)
+		if err != nil {
+			return fmt.Errorf("Failed to get product catalog size: %w", err)
+		}
+
+		sizes[r.NewPath] = info.Size()
+	}
+
+	index.SetSizes(streamName, sizes[catalogPath], sizes[catalogPath+".gz"])
+	return nil
+}
+
+// verifyGZipFile ensures that the decompressed content of the gzipped file
+// matches the content of the plain file byte-for-byte.
+func verifyGZipFile(path string, gzPath string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decompressed, err := shared.ReadGZipFile(gzPath)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(content, decompressed) {
+		return fmt.Errorf("Decompressed content of %q does not match %q", gzPath, path)
+	}
+
+	return nil
+}
+
+// signFile signs the temporary file and writes the signature to a temporary
+// file. The returned replace moves the signature next to the final file.
+func signFile(key *minisign.PrivateKey, tempPath string, finalPath string) (replace, error) {
+	sigPathTemp := tempPath + minisign.SignatureExt
+
+	err := key.SignFile(tempPath, sigPathTemp, filepath.Base(finalPath))
+	if err != nil {
+		return replace{}, err
+	}
+
+	return replace{OldPath: sigPathTemp, NewPath: finalPath + minisign.SignatureExt}, nil
+}
+
+// createDelta generates the delta file on the output path that transforms
+// the source file into the target file.
+func createDelta(ctx context.Context, sourcePath string, targetPath string, outputPath string) error {
+	// -e compress
+	// -9 compression level (0 no-compression -> 9 max-compression)
+	// -f overwrite existing output file
+	// -s source
+	cmd := exec.CommandContext(ctx, "xdelta3", "-e", "-9", "-f", "-s", sourcePath, targetPath, outputPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// verifyDelta decodes the delta file against the source file and compares
+// the SHA256 hash of the result with the given target hash. If the target
+// hash is empty, it is calculated from the file on the target path.
+func verifyDelta(ctx context.Context, sourcePath string, deltaPath string, targetPath string, targetSHA256 string) error {
+	if targetSHA256 == "" {
+		var err error
+
+		targetSHA256, err = shared.FileHash(sha256.New(), targetPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.New()
+
+	// -d decompress
+	// -s source
+	cmd := exec.CommandContext(ctx, "xdelta3", "-d", "-s", sourcePath, deltaPath, "-")
+	cmd.Stdout = hash
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to decode delta file: %w", err)
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != targetSHA256 {
+		return fmt.Errorf("Decoded delta file hash mismatch: expected %q, actual %q", targetSHA256, actual)
+	}
+
+	return nil
+}
+
+// generateDeltas generates missing delta files for the products in the given
+// catalog. Delta files are generated only between adjacent versions that are
+// present in the catalog. Catalog and version checksum files are updated with
+// the hashes of the generated delta files, while the hashes of other items are
+// left untouched. An error is returned only if the context is cancelled,
+// while failures of individual delta files are returned as warnings.
+func generateDeltas(ctx context.Context, rootDir string, streamName string, catalog *stream.ProductCatalog, workers int, opts ...buildOption) ([]buildWarning, error) {
+	config := newBuildConfig(opts...)
+	warnings := &buildWarnings{}
+
+	// Delta files are generated from the items within the source root,
+	// and are written to the work root.
+	sourceRoot := config.sourceRootDir(rootDir)
+	workRoot := config.workRootDir(rootDir)
+
+	var mutex sync.Mutex // To safely update the catalog.Products map
+
+	// Create new group of workers. Jobs report failures as warnings,
+	// hence the group context is cancelled only with the parent one.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	// addJob adds a job to the group that is skipped once the context
+	// is cancelled.
+	addJob := func(job func(ctx context.Context)) {
+		g.Go(func() error {
+			err := gctx.Err()
+			if err != nil {
+				return err
+			}
+
+			job(gctx)
+			return nil
+		})
+	}
+
+	// processDelta ensures the delta file of the given item exists and that
+	// the catalog contains its file hash. The delta file is generated from
+	// the item on the source path, which is within the base version. If the
+	// baseProductID is set, the base version belongs to a different product.
+	processDelta := func(ctx context.Context, id string, targetVerName string, itemName string, deltaName string, sourcePath string, baseVerName string, baseProductID string) {
+		// Read the version within the job to ensure all items added to the
+		// catalog by the previously completed jobs are visible.
+		mutex.Lock()
+		product := catalog.Products[id]
+		targetVersion := product.Versions[targetVerName]
+		targetSHA256 := targetVersion.Items[itemName].SHA256
+		deltaItem, deltaExists := targetVersion.Items[deltaName]
+		mutex.Unlock()
+
+		productRelPath := filepath.Join(streamName, product.RelPath())
+
+		// Relative path of the product directory where delta files
+		// are stored.
+		deltaProductRelPath := filepath.Join(config.deltaDir, productRelPath)
+		deltaRelPath := filepath.Join(deltaProductRelPath, targetVerName, deltaName)
+
+		// Delta files stored outside the version directory are
+		// not discovered when reading the version, therefore,
+		// check whether the delta file already exists.
+		if !deltaExists && (config.deltaDir != "" || sourceRoot != workRoot || len(config.extraRoots) > 0) {
+			_, err := os.Stat(filepath.Join(workRoot, deltaRelPath))
+			deltaExists = err == nil
+		}
+
+		// Generate delta file if it does not already exist.
+		if !deltaExists {
+			targetRelPath := filepath.Join(productRelPath, targetVerName, itemName)
+			targetPath := filepath.Join(config.rootFor(sourceRoot, targetRelPath), targetRelPath)
+			outputPath := filepath.Join(workRoot, deltaRelPath)
+
+			// Ensure source path exists.
+			_, err := os.Stat(sourcePath)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: itemName, Message: "Skipping delta file with missing source", Err: err})
+					return
+				}
+
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: itemName, Message: "Failed to read base delta file", Err: err})
+				return
+			}
+
+			// Ensure output directory exists.
+			err = os.MkdirAll(filepath.Dir(outputPath), os.ModePerm)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: deltaName, Message: "Failed to create delta directory", Err: err})
+				return
+			}
+
+			err = createDelta(ctx, sourcePath, targetPath, outputPath)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: deltaName, Message: "Failed creating delta file", Err: err})
+				_ = os.Remove(outputPath)
+				return
+			}
+
+			// Ensure the delta file reconstructs the target item. Delta
+			// file that fails the verification is regenerated once.
+			if config.verifyDeltas {
+				err = verifyDelta(ctx, sourcePath, outputPath, targetPath, targetSHA256)
+				if err != nil {
+					slog.Warn("Regenerating delta file that failed verification", "product", id, "version", targetVerName, "item", deltaName, "error", err)
+
+					err = createDelta(ctx, sourcePath, targetPath, outputPath)
+					if err == nil {
+						err = verifyDelta(ctx, sourcePath, outputPath, targetPath, targetSHA256)
+					}
+
+					if err != nil {
+						warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: deltaName, Message: "Failed to verify delta file", Err: err})
+						_ = os.Remove(outputPath)
+						return
+					}
+				}
+			}
+
+			slog.Info("Delta generated successfully", "product", id, "version", targetVerName, "item", deltaName, "deltaBase", baseVerName)
+			emitEvent(config.events, event{Type: eventDeltaGenerated, Stream: streamName, Product: id, Version: targetVerName, Item: deltaName, DeltaBase: baseVerName, Path: deltaRelPath})
+		}
+
+		// If delta file exists but is missing a hash in the catalog,
+		// or was just generated, calculate it's hash and add it to
+		// the catalog.
+		if !deltaExists || deltaItem.SHA256 == "" {
+			newItem, err := stream.GetItem(workRoot, deltaRelPath, stream.WithHashes(true), stream.WithHashAlgorithms(config.hashAlgorithms...))
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Item: deltaName, Message: "Failed to get existing delta item", Err: err})
+				return
+			}
+
+			deltaItem = *newItem
+
+			// Checksums map may be concurrently updated by jobs
+			// processing other items of the same version.
+			mutex.Lock()
+			_, ok := targetVersion.Checksums[deltaName]
+			hasChecksums := len(targetVersion.Checksums) > 0
+			mutex.Unlock()
+
+			// Append delta file hash to the version checksums
+			// file if it exists.
+			if !ok && hasChecksums {
+				// Append new item to the checksums file that is
+				// located next to the delta file.
+				checksumName := targetVersion.ChecksumFile
+				if checksumName == "" {
+					checksumName = config.checksumFiles[0]
+				}
+
+				checksumFile := filepath.Join(workRoot, deltaProductRelPath, targetVerName, checksumName)
+				err := appendChecksum(checksumFile, deltaItem.SHA256, deltaName)
+				if err != nil {
+					warnings.add(buildWarning{Stream: streamName, Product: id, Version: targetVerName, Message: "Failed to update checksums file", Err: err})
+					return
+				}
+
+				// Update version checksums map.
+				mutex.Lock()
+				catalog.Products[id].Versions[targetVerName].Checksums[deltaName] = deltaItem.SHA256
+				mutex.Unlock()
+			}
+		} else if deltaItem.DeltaBaseProduct == baseProductID {
+			// Delta item is already up to date.
+			return
+		}
+
+		// Delta base cannot be reliably parsed from the file name of
+		// the cross-product delta file, therefore, set it explicitly.
+		if baseProductID != "" {
+			deltaItem.DeltaBase = baseVerName
+			deltaItem.DeltaBaseProduct = baseProductID
+		}
+
+		// Include delta item with hashes in the catalog.
+		mutex.Lock()
+		catalog.Products[id].Versions[targetVerName].Items[deltaName] = deltaItem
+		mutex.Unlock()
+	}
+
+	// processChunkIndex ensures the casync chunk index of the given item
+	// exists and that the catalog contains its file hash. Chunks of the
+	// item are written to the chunk store when the index is generated.
+	processChunkIndex := func(ctx context.Context, id string, versionName string, itemName string, store casync.Store) {
+		indexName := itemName + casync.IndexExt
+
+		mutex.Lock()
+		product := catalog.Products[id]
+		version := product.Versions[versionName]
+		indexItem, indexExists := version.Items[indexName]
+		_, hasChecksum := version.Checksums[indexName]
+		hasChecksums := len(version.Checksums) > 0
+		mutex.Unlock()
+
+		productRelPath := filepath.Join(streamName, product.RelPath())
+
+		// Chunk indexes are stored next to the delta files.
+		indexDirRelPath := filepath.Join(config.deltaDir, productRelPath, versionName)
+		indexRelPath := filepath.Join(indexDirRelPath, indexName)
+
+		if !indexExists && (config.deltaDir != "" || sourceRoot != workRoot || len(config.extraRoots) > 0) {
+			_, err := os.Stat(filepath.Join(workRoot, indexRelPath))
+			indexExists = err == nil
+		}
+
+		if indexExists && indexItem.SHA256 != "" {
+			// Chunk index is already up to date.
+			return
+		}
+
+		// Generate chunk index if it does not already exist.
+		if !indexExists {
+			outputPath := filepath.Join(workRoot, indexRelPath)
+
+			err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Item: indexName, Message: "Failed to create delta directory", Err: err})
+				return
+			}
+
+			itemRelPath := filepath.Join(productRelPath, versionName, itemName)
+			index, err := casync.MakeIndex(ctx, filepath.Join(config.rootFor(sourceRoot, itemRelPath), itemRelPath), store)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Item: indexName, Message: "Failed creating chunk index", Err: err})
+				return
+			}
 
-	// Ensure meta directory exists.
-	err := os.MkdirAll(metaDir, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("Create metadata directory: %w", err)
-	}
+			err = index.WriteFile(outputPath)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Item: indexName, Message: "Failed creating chunk index", Err: err})
+				return
+			}
 
-	// Create product catalogs by reading image directories.
-	for _, streamName := range streamNames {
-		// Create product catalog from directory structure.
-		catalog, err := buildProductCatalog(ctx, rootDir, streamVersion, streamName, workers)
+			slog.Info("Chunk index generated successfully", "product", id, "version", versionName, "item", indexName, "chunks", len(index.Chunks))
+			emitEvent(config.events, event{Type: eventDeltaGenerated, Stream: streamName, Product: id, Version: versionName, Item: indexName, Path: indexRelPath})
+		}
+
+		newItem, err := stream.GetItem(workRoot, indexRelPath, stream.WithHashes(true), stream.WithHashAlgorithms(config.hashAlgorithms...))
 		if err != nil {
-			return err
+			warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Item: indexName, Message: "Failed to get existing chunk index item", Err: err})
+			return
 		}
 
-		// Write product catalog to a temporary file that is located next
-		// to the final file to ensure atomic replace. Temporary file is
-		// prefixed with a dot to hide it.
-		catalogPath := filepath.Join(metaDir, fmt.Sprintf("%s.json", streamName))
-		catalogPathTemp := filepath.Join(metaDir, fmt.Sprintf(".%s.json.tmp", streamName))
+		// Append chunk index hash to the version checksums file if
+		// it exists.
+		if !hasChecksum && hasChecksums {
+			checksumName := version.ChecksumFile
+			if checksumName == "" {
+				checksumName = config.checksumFiles[0]
+			}
 
-		err = shared.WriteJSONFile(catalogPathTemp, catalog)
-		if err != nil {
-			return fmt.Errorf("Write product catalog file: %w", err)
+			err := appendChecksum(filepath.Join(workRoot, indexDirRelPath, checksumName), newItem.SHA256, indexName)
+			if err != nil {
+				warnings.add(buildWarning{Stream: streamName, Product: id, Version: versionName, Message: "Failed to update checksums file", Err: err})
+				return
+			}
+
+			mutex.Lock()
+			catalog.Products[id].Versions[versionName].Checksums[indexName] = newItem.SHA256
+			mutex.Unlock()
 		}
 
-		defer os.Remove(catalogPathTemp)
+		// Include chunk index item with hashes in the catalog.
+		mutex.Lock()
+		catalog.Products[id].Versions[versionName].Items[indexName] = *newItem
+		mutex.Unlock()
+	}
 
-		// Create compressed version of the product catalog file.
-		catalogGzPath := fmt.Sprintf("%s.gz", catalogPath)
-		catalogGzPathTemp := fmt.Sprintf("%s.gz", catalogPathTemp)
+	// Traverse through the products. For each product iterate over versions
+	// and find items that are valid for delta files. If a delta file already
+	// exists, ensure that the catalog contains its file hash. If a delta file
+	// does not exist, create it and update the catalog with the new file hash.
+	for id, product := range catalog.Products {
+		productRelPath := filepath.Join(streamName, product.RelPath())
 
-		err = shared.GZipFile(catalogPathTemp, catalogGzPathTemp)
-		if err != nil {
-			return fmt.Errorf("Compress product catalog file: %w", err)
+		versions := shared.MapKeysSorted(product.Versions)
+
+		if len(versions) < 2 {
+			// At least 2 versions must be available for delta.
+			continue
 		}
 
-		defer os.Remove(catalogGzPathTemp)
+		// Skip the oldest version because even if the .vcdiff does
+		// not exist, we cannot generate it.
+		for i := 1; i < len(versions); i++ {
+			sourceVerName := versions[i-1]
+			targetVerName := versions[i]
 
-		// Add replaces for temporary files.
-		replaces = append(replaces,
-			replace{OldPath: catalogPathTemp, NewPath: catalogPath},
-			replace{OldPath: catalogGzPathTemp, NewPath: catalogGzPath},
-		)
+			// Copy version items, because the jobs may concurrently add
+			// delta items to the same map.
+			mutex.Lock()
+			targetItems := maps.Clone(product.Versions[targetVerName].Items)
+			sourceItems := maps.Clone(product.Versions[sourceVerName].Items)
+			mutex.Unlock()
 
-		// Relative path for index.
-		catalogRelPath, err := filepath.Rel(rootDir, catalogPath)
-		if err != nil {
-			return err
+			for itemName, item := range targetItems {
+				// Delta should be created only for qcow2 and squashfs files.
+				if !isDeltaItemType(item.Ftype, config.deltaFormat) {
+					continue
+				}
+
+				deltaName := deltaFileName(itemName, item.Ftype, sourceVerName)
+				baseItemRelPath := filepath.Join(productRelPath, sourceVerName, itemName)
+				sourcePath := filepath.Join(config.rootFor(sourceRoot, baseItemRelPath), baseItemRelPath)
+
+				// Use the item path from the catalog if available,
+				// since versions stored outside the product directory
+				// (e.g. baselines) cannot be located otherwise.
+				sourceItem, ok := sourceItems[itemName]
+				if ok {
+					sourcePath = filepath.Join(config.rootFor(workRoot, sourceItem.Path), sourceItem.Path)
+				}
+
+				addJob(func(ctx context.Context) {
+					processDelta(ctx, id, targetVerName, itemName, deltaName, sourcePath, sourceVerName, "")
+				})
+			}
 		}
+	}
 
-		// Create webpage for the stream.
-		if buildWebpage {
-			indexHTML = webpage.NewWebPage(*catalog)
+	// Generate cross-product delta files, where the base is the same version
+	// of a sibling product (same distribution, release, and architecture)
+	// with a different variant.
+	for id, product := range catalog.Products {
+		baseVariant, ok := config.crossDeltas[product.Variant]
+		if !ok {
+			continue
 		}
 
-		// Add index entry.
-		index.AddEntry(streamName, catalogRelPath, *catalog)
-	}
+		baseProduct, ok := catalog.Products[fmt.Sprintf("%s:%s:%s:%s", product.Distro, product.Release, product.Architecture, baseVariant)]
+		if !ok {
+			continue
+		}
 
-	// Write index to a temporary file that is located next to the
-	// final file to ensure atomic replace. Temporary file is
-	// prefixed with a dot to hide it.
-	indexPath := filepath.Join(metaDir, "index.json")
-	indexPathTemp := filepath.Join(metaDir, ".index.json.tmp")
+		baseRelPath := filepath.Join(streamName, baseProduct.RelPath())
 
-	err = shared.WriteJSONFile(indexPathTemp, index)
-	if err != nil {
-		return fmt.Errorf("Write index file: %w", err)
-	}
+		for versionName := range product.Versions {
+			_, ok := baseProduct.Versions[versionName]
+			if !ok {
+				continue
+			}
 
-	defer os.Remove(indexPathTemp)
+			// Copy version items, because the jobs may concurrently add
+			// delta items to the same maps.
+			mutex.Lock()
+			targetItems := maps.Clone(product.Versions[versionName].Items)
+			baseItems := maps.Clone(baseProduct.Versions[versionName].Items)
+			mutex.Unlock()
 
-	// Create compressed version of the index file.
-	indexGzPath := fmt.Sprintf("%s.gz", indexPath)
-	indexGzPathTemp := fmt.Sprintf("%s.gz", indexPathTemp)
+			for itemName, item := range targetItems {
+				// Delta should be created only for qcow2 and squashfs files.
+				if !isDeltaItemType(item.Ftype, config.deltaFormat) {
+					continue
+				}
 
-	err = shared.GZipFile(indexPathTemp, indexGzPathTemp)
-	if err != nil {
-		return fmt.Errorf("Compress index file: %w", err)
-	}
+				// Find the base item of the same type.
+				for baseItemName, baseItem := range baseItems {
+					if baseItem.Ftype != item.Ftype {
+						continue
+					}
 
-	defer os.Remove(indexGzPathTemp)
+					deltaName := deltaFileName(itemName, item.Ftype, fmt.Sprintf("%s.%s", baseVariant, versionName))
+					baseItemRelPath := filepath.Join(baseRelPath, versionName, baseItemName)
+					sourcePath := filepath.Join(config.rootFor(sourceRoot, baseItemRelPath), baseItemRelPath)
 
-	// Add replaces for temporary files. Note that index file must
-	// be updated last, once all catalog files are in place, to
-	// avoid referencing non-existing products (from catalog).
-	replaces = append(replaces,
-		replace{OldPath: indexPathTemp, NewPath: indexPath},
-		replace{OldPath: indexGzPathTemp, NewPath: indexGzPath},
-	)
+					addJob(func(ctx context.Context) {
+						processDelta(ctx, id, versionName, itemName, deltaName, sourcePath, versionName, baseProduct.ID())
+					})
 
-	// Move temporary files to final destinations.
-	for _, r := range replaces {
-		err := os.Rename(r.OldPath, r.NewPath)
-		if err != nil {
-			return err
+					break
+				}
+			}
 		}
+	}
 
-		// Set read permissions.
-		err = os.Chmod(r.NewPath, 0644)
-		if err != nil {
-			return err
+	// Generate chunk indexes of squashfs items. Unlike delta files, chunk
+	// indexes do not depend on other versions, therefore, they are generated
+	// for all versions.
+	if config.deltaFormat == deltaFormatCasync {
+		store := casync.Store{Dir: filepath.Join(workRoot, config.chunkStoreDir)}
+
+		for id, product := range catalog.Products {
+			for _, versionName := range shared.MapKeysSorted(product.Versions) {
+				mutex.Lock()
+				items := maps.Clone(product.Versions[versionName].Items)
+				mutex.Unlock()
+
+				for itemName, item := range items {
+					if item.Ftype != stream.ItemTypeSquashfs {
+						continue
+					}
+
+					addJob(func(ctx context.Context) {
+						processChunkIndex(ctx, id, versionName, itemName, store)
+					})
+				}
+			}
 		}
 	}
 
-	// Write stream's index.html.
-	if indexHTML != nil {
-		err := indexHTML.Write(rootDir)
-		if err != nil {
-			return fmt.Errorf("Failed to write index.html: %w", err)
-		}
+	// Wait for all jobs to finish. Jobs that were started before the
+	// context was cancelled report the failures as warnings, therefore,
+	// check the context as well.
+	err := g.Wait()
+	if err == nil {
+		err = ctx.Err()
 	}
 
-	return nil
+	if err != nil {
+		return nil, err
+	}
+
+	return warnings.list(), nil
 }
 
-// buildProductCatalog compares the existing product catalog and actual products on
-// the disk. For missing any new version, hashes are calculated and compared against
-// the checksums file. Based on the final catalog (that contains only valid version)
-// missing delta files are generated. Finally the catalog is returned.
-//
-// Note: Workers limit the maximum number of concurent tasks when calulcating hashes
-// and delta files.
-func buildProductCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int) (*stream.ProductCatalog, error) {
-	// Get current product catalog (from json file).
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
-	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, err
+// isDeltaItemType returns true if delta files are generated for items of the
+// given type, which must be one of the primary item types. Squashfs items
+// are chunked instead of diffed with casync format.
+func isDeltaItemType(ftype string, deltaFormat string) bool {
+	if ftype == stream.ItemTypeSquashfs && deltaFormat != deltaFormatVCDiff {
+		return false
 	}
 
-	if catalog == nil {
-		catalog = stream.NewCatalog(streamName, nil)
+	return stream.IsPrimaryItemType(ftype)
+}
+
+// deltaFileName returns the name of the delta file for the given item name
+// and type, where base identifies the version the delta is calculated from.
+func deltaFileName(itemName string, itemType string, base string) string {
+	prefix, _ := strings.CutSuffix(itemName, filepath.Ext(itemName))
+	suffix := "vcdiff"
+
+	if itemType == stream.ItemTypeDiskKVM {
+		suffix = "qcow2.vcdiff"
 	}
 
-	// Get existing products (from actual directory hierarchy).
-	products, err := stream.GetProducts(rootDir, streamName)
+	return fmt.Sprintf("%s.%s.%s", prefix, base, suffix)
+}
+
+// normalizeVersionQcow2 converts qcow2 images within the version directory to
+// a canonical format (compressed, 64KiB clusters), so that images with the same
+// content produced by different pipelines result in the same file. Each image
+// is verified against the version checksum file (the first existing one of the
+// given names) before it is converted, and its entry is updated afterwards.
+func normalizeVersionQcow2(ctx context.Context, versionPath string, checksumFiles []string) error {
+	files, err := os.ReadDir(versionPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var wg sync.WaitGroup
-	var mutex sync.Mutex // To safely update the catalog.Products map
+	var checksumPath string
+	var checksums map[string]string
+
+	for _, name := range checksumFiles {
+		checksums, err = stream.ReadChecksumFile(filepath.Join(versionPath, name))
+		if err == nil {
+			checksumPath = filepath.Join(versionPath, name)
+			break
+		}
 
-	// Ensure at least 1 worker is spawned.
-	if workers < 1 {
-		workers = 1
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 
-	// Job queue.
-	jobs := make(chan func(), workers)
-	defer close(jobs)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), stream.ItemExtDiskKVM) {
+			continue
+		}
 
-	// Create new pool of workers.
-	for i := 0; i < workers; i++ {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case job, ok := <-jobs:
-					if !ok {
-						return
-					}
+		imagePath := filepath.Join(versionPath, file.Name())
 
-					job()
-				}
+		// Ensure the original image is valid, as otherwise the updated
+		// checksum would hide the corruption.
+		checksum, ok := checksums[file.Name()]
+		if ok {
+			err := shared.VerifyChecksum(imagePath, sha256.New(), checksum)
+			if err != nil {
+				return err
 			}
-		}()
-	}
-
-	// Extract new (unreferenced products and product versions) and add them
-	// to the catalog.
-	_, newProducts := diffProducts(catalog.Products, products)
-	for id, p := range newProducts {
-		productPath := filepath.Join(streamName, p.RelPath())
+		}
 
-		// Copy value of the product retrieved from the directory hierarchy
-		// to the catalog's product to ensure the potential new metadata is
-		// applied.
-		mutex.Lock()
-		tmp := p
+		// Convert the image into a temporary file that then atomically
+		// replaces the original image.
+		imagePathTemp := filepath.Join(versionPath, "."+file.Name()+".tmp")
 
-		_, ok := catalog.Products[id]
-		if ok && len(catalog.Products[id].Versions) > 0 {
-			// Retain existing product versions.
-			tmp.Versions = catalog.Products[id].Versions
-		} else {
-			// Create new map for product versions. They will be added
-			// in the next step.
-			tmp.Versions = make(map[string]stream.Version, len(p.Versions))
+		err := shared.RunCommand(ctx, nil, nil, "qemu-img", "convert", "-c", "-f", "qcow2", "-O", "qcow2", "-o", "cluster_size=65536,compression_type=zlib", imagePath, imagePathTemp)
+		if err != nil {
+			_ = os.Remove(imagePathTemp)
+			return fmt.Errorf("Failed to convert %q: %w", file.Name(), err)
 		}
 
-		catalog.Products[id] = tmp
-		mutex.Unlock()
+		err = os.Chmod(imagePathTemp, 0644)
+		if err != nil {
+			_ = os.Remove(imagePathTemp)
+			return err
+		}
 
-		for versionName := range p.Versions {
-			// Add a job for processing a new version.
-			wg.Add(1)
-			jobs <- func() {
-				defer wg.Done()
+		err = os.Rename(imagePathTemp, imagePath)
+		if err != nil {
+			_ = os.Remove(imagePathTemp)
+			return err
+		}
 
-				// Read the version and generate the file hashes.
-				versionPath := filepath.Join(productPath, versionName)
-				version, err := stream.GetVersion(rootDir, versionPath, stream.WithHashes(true))
-				if err != nil {
-					slog.Error("Failed to get version", "streamName", streamName, "product", id, "version", versionName, "error", err)
-					return
-				}
+		if ok {
+			hash, err := shared.FileHash(sha256.New(), imagePath)
+			if err != nil {
+				return err
+			}
 
-				// Verify items checksums if checksum file is present
-				// within the version.
-				if version.Checksums != nil {
-					for itemName, item := range version.Items {
-						checksum := version.Checksums[itemName]
+			err = replaceChecksum(checksumPath, hash, file.Name())
+			if err != nil {
+				return fmt.Errorf("Failed to update checksums file: %w", err)
+			}
+		}
 
-						// Ignore verification, if the checksum for the delta
-						// file does not exist. This is because the delta file
-						// is generated after the checksums file is created.
-						if !ok && (item.Ftype == stream.ItemTypeDiskKVMDelta || item.Ftype == stream.ItemTypeSquashfsDelta) {
-							continue
-						}
+		slog.Info("Normalized qcow2 image", "path", imagePath)
+	}
 
-						// Verify checksum.
-						if checksum != item.SHA256 {
-							slog.Error("Checksum mismatch", "streamName", streamName, "product", id, "version", versionName, "item", itemName)
-							return
-						}
-					}
-				}
+	return nil
+}
 
-				mutex.Lock()
-				catalog.Products[id].Versions[versionName] = *version
-				mutex.Unlock()
+// replaceChecksum replaces the checksum of the given file within the checksum
+// file on the given path. Other lines are retained.
+func replaceChecksum(path string, checksum string, fileName string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-				slog.Info("New version added to the product catalog", "streamName", streamName, "product", id, "version", versionName)
-			}
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		_, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok && strings.TrimSpace(name) == fileName {
+			lines[i] = fmt.Sprintf("%s  %s", checksum, fileName)
 		}
 	}
 
-	// Wait for all workers to finish to ensure the final catalog contains
-	// all valid product versions.
-	wg.Wait()
+	// Write checksums to a temporary file and replace the existing one.
+	pathTemp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
 
-	// Build delta files after all new versions are added to the catalog.
-	// This way we can determine which versions are valid for delta files.
-	//
-	// Traverse through the products. For each product iterate over versions
-	// and find items that are valid for delta files. If a delta file already
-	// exists, ensure that the catalog contains its file hash. If a delta file
-	// does not exist, create it and update the catalog with the new file hash.
-	for id, product := range catalog.Products {
-		productRelPath := filepath.Join(streamName, product.RelPath())
+	err = os.WriteFile(pathTemp, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		return err
+	}
 
-		versions := shared.MapKeys(product.Versions)
-		slices.Sort(versions)
+	defer os.Remove(pathTemp)
 
-		if len(versions) < 2 {
-			// At least 2 versions must be available for delta.
-			continue
-		}
+	return os.Rename(pathTemp, path)
+}
 
-		// Skip the oldest version because even if the .vcdiff does
-		// not exist, we cannot generate it.
-		for i := 1; i < len(versions); i++ {
-			sourceVerName := versions[i-1]
-			targetVerName := versions[i]
-			targetVersion := product.Versions[targetVerName]
+// removeChecksum removes the checksum entries of the given file from the
+// checksum file on the given path. Other lines are retained.
+func removeChecksum(path string, fileName string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-			for itemName, item := range targetVersion.Items {
-				// Delta should be created only for qcow2 and squashfs files.
-				if item.Ftype != stream.ItemTypeDiskKVM && item.Ftype != stream.ItemTypeSquashfs {
-					continue
-				}
+	lines := strings.Split(string(content), "\n")
+	kept := slices.DeleteFunc(slices.Clone(lines), func(line string) bool {
+		_, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+		return ok && strings.TrimSpace(name) == fileName
+	})
 
-				wg.Add(1)
-				jobs <- func() {
-					defer wg.Done()
+	if len(kept) == len(lines) {
+		return nil
+	}
 
-					// Evaluate delta file name.
-					prefix, _ := strings.CutSuffix(itemName, filepath.Ext(itemName))
-					suffix := "vcdiff"
+	// Write checksums to a temporary file and replace the existing one.
+	pathTemp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
 
-					if item.Ftype == stream.ItemTypeDiskKVM {
-						suffix = "qcow2.vcdiff"
-					}
+	err = os.WriteFile(pathTemp, []byte(strings.Join(kept, "\n")), 0644)
+	if err != nil {
+		return err
+	}
 
-					deltaName := fmt.Sprintf("%s.%s.%s", prefix, sourceVerName, suffix)
-					deltaItem, deltaExists := targetVersion.Items[deltaName]
+	defer os.Remove(pathTemp)
 
-					// Generate delta file if it does not already exist.
-					if !deltaExists {
-						sourcePath := filepath.Join(rootDir, productRelPath, sourceVerName, itemName)
-						targetPath := filepath.Join(rootDir, productRelPath, targetVerName, itemName)
-						outputPath := filepath.Join(rootDir, productRelPath, targetVerName, deltaName)
+	return os.Rename(pathTemp, path)
+}
 
-						// Ensure source path exists.
-						_, err := os.Stat(sourcePath)
-						if err != nil {
-							if errors.Is(err, os.ErrNotExist) {
-								// Source does not exist. Skip..
-								return
-							}
+// appendChecksum appends the checksum entry for the given file name to the
+// checksums file on the given path. The checksums file is created if it does
+// not exist yet.
+func appendChecksum(path string, checksum string, fileName string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
 
-							slog.Error("Failed to read base delta file", "product", id, "version", targetVerName, "item", itemName, "deltaBase", sourceVerName, "error", err)
-							return
-						}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
 
-						// -e compress
-						// -9 compression level (0 no-compression -> 9 max-compression)
-						// -s source
-						cmd := exec.CommandContext(ctx, "xdelta3", "-e", "-9", "-s", sourcePath, targetPath, outputPath)
-						cmd.Stdout = os.Stdout
-						cmd.Stderr = os.Stderr
+	return shared.AppendToFile(path, fmt.Sprintf("%s  %s\n", checksum, fileName))
+}
 
-						err = cmd.Run()
-						if err != nil {
-							slog.Error("Failed creating delta file", "product", id, "version", targetVerName, "item", deltaName, "deltaBase", sourceVerName, "error", err)
-							_ = os.Remove(outputPath)
-							return
-						}
+// sizeCheckedItemTypes are item types whose size is checked against the
+// minimum item size. Delta files are omitted, as they can be legitimately
+// small.
+var sizeCheckedItemTypes = []string{
+	stream.ItemTypeMetadata,
+	stream.ItemTypeSquashfs,
+	stream.ItemTypeDiskKVM,
+	stream.ItemTypeRootTarXz,
+	stream.ItemTypeRootTarZst,
+	stream.ItemTypeRootImg,
+}
 
-						slog.Info("Delta generated successfully", "product", id, "version", targetVerName, "item", deltaName, "deltaBase", sourceVerName)
-					}
+// rejectedVersion is a product version rejected because of its item.
+type rejectedVersion struct {
+	id          string
+	versionName string
+	itemName    string
+	err         error
+}
 
-					// If delta file exists but is missing a hash in the catalog,
-					// or was just generated, calculate it's hash and add it to
-					// the catalog.
-					if !deltaExists || deltaItem.SHA256 == "" {
-						deltaRelPath := filepath.Join(productRelPath, targetVerName, deltaName)
-						deltaItem, err := stream.GetItem(rootDir, deltaRelPath, stream.WithHashes(true))
-						if err != nil {
-							slog.Error("Failed to get existing delta item", "product", id, "version", targetVerName, "item", deltaName, "error", err)
-							return
-						}
+// rejectUndersizedVersions removes versions that are not yet in the catalog
+// from the products if any of their metadata or root file system items is
+// smaller than minSize. Products left without versions are removed as well.
+// Rejected versions are returned sorted by product ID and version name.
+func rejectUndersizedVersions(catalogProducts map[string]stream.Product, products map[string]stream.Product, minSize int64) []rejectedVersion {
+	if minSize <= 0 {
+		return nil
+	}
 
-						// Append delta file hash to the version checksums
-						// file if it exists.
-						_, ok := targetVersion.Checksums[deltaName]
-						if !ok && len(targetVersion.Checksums) > 0 {
-							// Append new item to the checksums file.
-							checksumFile := filepath.Join(rootDir, productRelPath, targetVerName, stream.FileChecksumSHA256)
-							err := shared.AppendToFile(checksumFile, fmt.Sprintf("%s  %s\n", deltaItem.SHA256, deltaName))
-							if err != nil {
-								slog.Error("Failed to update checksums file", "product", id, "version", targetVerName, "error", err)
-								return
-							}
-
-							// Update version checksums map.
-							mutex.Lock()
-							catalog.Products[id].Versions[targetVerName].Checksums[deltaName] = deltaItem.SHA256
-							mutex.Unlock()
-						}
+	var rejected []rejectedVersion
 
-						// Include delta item with hashes in the catalog.
-						mutex.Lock()
-						catalog.Products[id].Versions[targetVerName].Items[deltaName] = *deltaItem
-						mutex.Unlock()
-					}
+	for _, id := range shared.MapKeysSorted(products) {
+		product := products[id]
+
+		for _, versionName := range shared.MapKeysSorted(product.Versions) {
+			_, ok := catalogProducts[id].Versions[versionName]
+			if ok {
+				// Existing versions are left untouched.
+				continue
+			}
+
+			for _, itemName := range shared.MapKeysSorted(product.Versions[versionName].Items) {
+				item := product.Versions[versionName].Items[itemName]
+				if !slices.Contains(sizeCheckedItemTypes, item.Ftype) || item.Size >= minSize {
+					continue
 				}
+
+				rejected = append(rejected, rejectedVersion{
+					id:          id,
+					versionName: versionName,
+					itemName:    itemName,
+					err:         fmt.Errorf("Item size %d is less than %d bytes", item.Size, minSize),
+				})
+
+				delete(product.Versions, versionName)
+				break
 			}
 		}
-	}
 
-	// Wait for all goroutines to finish.
-	wg.Wait()
+		if len(product.Versions) == 0 {
+			delete(products, id)
+		}
+	}
 
-	return catalog, nil
+	return rejected
 }
 
 // DiffProducts is a helper function that compares two product maps and returns
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// Reasons why a catalog entry differs between the primary and the mirror.
+const (
+	// driftMissingInMirror indicates that the entry exists only in the
+	// primary catalog.
+	driftMissingInMirror = "missing_in_mirror"
+
+	// driftMissingInPrimary indicates that the entry exists only in the
+	// mirror catalog.
+	driftMissingInPrimary = "missing_in_primary"
+
+	// driftHashMismatch indicates that the item hashes differ.
+	driftHashMismatch = "hash_mismatch"
+)
+
+type compareOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	Format        string
+}
+
+func (o *compareOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "compare <primary-path|url> <mirror-path|url> [flags]",
+		Short:   "Compare product catalogs of two mirrors",
+		Long:    "Compare the product catalogs of two mirrors and report products, versions, and items that are missing on either side or whose hashes differ. The command exits with an error if any difference is found.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument) whose product catalog is compared")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "text", "Output format (text or json)")
+
+	return cmd
+}
+
+func (o *compareOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "primary-path")
+	}
+
+	if len(args) < 2 || args[1] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "mirror-path")
+	}
+
+	if o.Format != "text" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [text, json]", o.Format)
+	}
+
+	var drifts []catalogDrift
+
+	for _, dir := range o.ImageDirs {
+		d, err := compareMirrors(o.global.ctx, args[0], args[1], o.StreamVersion, dir)
+		if err != nil {
+			return err
+		}
+
+		drifts = append(drifts, d...)
+	}
+
+	err := writeDrifts(cmd.OutOrStdout(), drifts, o.Format)
+	if err != nil {
+		return err
+	}
+
+	if len(drifts) > 0 {
+		return fmt.Errorf("Mirrors differ in %d entries", len(drifts))
+	}
+
+	return nil
+}
+
+// catalogDrift is a single difference between the product catalogs of the
+// primary and the mirror.
+type catalogDrift struct {
+	// Stream is the name of the stream.
+	Stream string `json:"stream"`
+
+	// Product is the product ID.
+	Product string `json:"product"`
+
+	// Version is the version name. It is empty if the whole product differs.
+	Version string `json:"version,omitempty"`
+
+	// Item is the item name. It is empty if the whole version differs.
+	Item string `json:"item,omitempty"`
+
+	// Reason describes the difference.
+	Reason string `json:"reason"`
+}
+
+// compareMirrors compares the product catalogs of the given stream located
+// within the primary and the mirror root directories. Each root directory can
+// also be an HTTP(S) URL of a remote mirror. A missing product catalog of the
+// mirror is treated as an empty one, while a missing product catalog of the
+// primary results in an error, as it most likely indicates a misconfiguration.
+func compareMirrors(ctx context.Context, primaryRootDir string, mirrorRootDir string, streamVersion string, streamName string) ([]catalogDrift, error) {
+	readCatalog := func(rootDir string, allowMissing bool) (*stream.ProductCatalog, error) {
+		path := stream.JoinLocation(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+		catalog, err := stream.ReadProductCatalog(ctx, path)
+		if err != nil {
+			if allowMissing && errors.Is(err, os.ErrNotExist) {
+				return &stream.ProductCatalog{}, nil
+			}
+
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", path, err)
+		}
+
+		return catalog, nil
+	}
+
+	primary, err := readCatalog(primaryRootDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	mirror, err := readCatalog(mirrorRootDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareCatalogs(streamName, *primary, *mirror), nil
+}
+
+// compareCatalogs returns differences between the primary and the mirror
+// product catalogs. Differences are sorted by product ID. Within a product,
+// missing versions are listed first, followed by differing items of the
+// versions present on both sides.
+func compareCatalogs(streamName string, primary stream.ProductCatalog, mirror stream.ProductCatalog) []catalogDrift {
+	onlyPrimary, onlyMirror := diffProducts(primary.Products, mirror.Products)
+
+	var drifts []catalogDrift
+
+	// addMissing reports products and versions that exist only on one side.
+	addMissing := func(id string, missing map[string]stream.Product, other map[string]stream.Product, reason string) {
+		product, ok := missing[id]
+		if !ok {
+			return
+		}
+
+		_, ok = other[id]
+		if !ok {
+			drifts = append(drifts, catalogDrift{Stream: streamName, Product: id, Reason: reason})
+			return
+		}
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			drifts = append(drifts, catalogDrift{Stream: streamName, Product: id, Version: name, Reason: reason})
+		}
+	}
+
+	ids := make(map[string]struct{}, len(primary.Products))
+	for id := range primary.Products {
+		ids[id] = struct{}{}
+	}
+
+	for id := range mirror.Products {
+		ids[id] = struct{}{}
+	}
+
+	for _, id := range shared.MapKeysSorted(ids) {
+		addMissing(id, onlyPrimary, mirror.Products, driftMissingInMirror)
+		addMissing(id, onlyMirror, primary.Products, driftMissingInPrimary)
+
+		primaryProduct, ok := primary.Products[id]
+		if !ok {
+			continue
+		}
+
+		mirrorProduct, ok := mirror.Products[id]
+		if !ok {
+			continue
+		}
+
+		// Compare items of versions present on both sides.
+		for _, name := range shared.MapKeysSorted(primaryProduct.Versions) {
+			mirrorVersion, ok := mirrorProduct.Versions[name]
+			if !ok {
+				continue
+			}
+
+			drifts = append(drifts, compareVersionItems(streamName, id, name, primaryProduct.Versions[name], mirrorVersion)...)
+		}
+	}
+
+	return drifts
+}
+
+// compareVersionItems returns differences between items of the same version
+// in the primary and the mirror product catalogs.
+func compareVersionItems(streamName string, id string, name string, primary stream.Version, mirror stream.Version) []catalogDrift {
+	itemNames := make(map[string]struct{}, len(primary.Items))
+	for itemName := range primary.Items {
+		itemNames[itemName] = struct{}{}
+	}
+
+	for itemName := range mirror.Items {
+		itemNames[itemName] = struct{}{}
+	}
+
+	var drifts []catalogDrift
+
+	for _, itemName := range shared.MapKeysSorted(itemNames) {
+		drift := catalogDrift{Stream: streamName, Product: id, Version: name, Item: itemName}
+
+		primaryItem, inPrimary := primary.Items[itemName]
+		mirrorItem, inMirror := mirror.Items[itemName]
+
+		switch {
+		case !inMirror:
+			drift.Reason = driftMissingInMirror
+		case !inPrimary:
+			drift.Reason = driftMissingInPrimary
+		case primaryItem.SHA256 != mirrorItem.SHA256:
+			drift.Reason = driftHashMismatch
+		default:
+			continue
+		}
+
+		drifts = append(drifts, drift)
+	}
+
+	return drifts
+}
+
+// writeDrifts writes the catalog differences to the given writer in the given
+// format (text or json).
+func writeDrifts(w io.Writer, drifts []catalogDrift, format string) error {
+	if format == "json" {
+		if drifts == nil {
+			drifts = []catalogDrift{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(drifts)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tVERSION\tITEM\tREASON")
+
+	for _, d := range drifts {
+		version := d.Version
+		if version == "" {
+			version = "-"
+		}
+
+		item := d.Item
+		if item == "" {
+			item = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Stream, d.Product, version, item, d.Reason)
+	}
+
+	return tw.Flush()
+}
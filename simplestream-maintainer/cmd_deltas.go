@@ -0,0 +1,385 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+
+	"github.com/canonical/lxd/shared/units"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type deltasOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	Workers       int
+	DeltaDir      string
+	ChecksumFiles []string
+	MinisignKey   string
+	VerifyDeltas  bool
+	DeltaFormat   string
+	ChunkStoreDir string
+	DryRun        bool
+	GzipLevel     int
+	NoGZip        bool
+
+	catalogPaths catalogPathOptions
+}
+
+func (o *deltasOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "deltas <path> [flags]",
+		Short:   "Generate missing delta files",
+		Long:    "Generate missing delta files for the product versions referenced by the existing product catalog without recalculating hashes of other items.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+	cmd.PersistentFlags().StringVar(&o.DeltaDir, "delta-dir", "", "Directory for generated delta files (relative to path argument). By default, delta files are stored within the target version directory")
+	cmd.PersistentFlags().StringSliceVar(&o.ChecksumFiles, "checksum-file-name", []string{stream.FileChecksumSHA256}, "Candidate names of the version checksum file (the first existing one is used)")
+	cmd.PersistentFlags().StringVar(&o.DeltaFormat, "delta-format", deltaFormatVCDiff, "Format of squashfs delta files (vcdiff or casync)")
+	cmd.PersistentFlags().StringVar(&o.ChunkStoreDir, "chunk-store-dir", "chunks", "Directory of the casync chunk store (relative to path argument)")
+	cmd.PersistentFlags().BoolVar(&o.VerifyDeltas, "verify-deltas", false, "Verify that each generated delta file reconstructs its target item and regenerate it otherwise")
+	cmd.PersistentFlags().BoolVar(&o.DryRun, "dry-run", false, "Report the estimated size of delta files per product without writing any files. Sizes of missing delta files are estimated by generating them into a discarded output")
+	cmd.PersistentFlags().BoolVar(&o.NoGZip, "no-gzip", false, "Skip writing of the gzipped product catalog files, and remove the existing ones (for local development only, as clients requesting them will fail)")
+	cmd.PersistentFlags().IntVar(&o.GzipLevel, "catalog-gzip-level", gzip.BestCompression, "Compression level of the gzipped product catalog files (from 1 for best speed to 9 for best size, 0 for default)")
+	cmd.PersistentFlags().StringVar(&o.MinisignKey, "minisign-key", "", "Minisign secret key used to sign the product catalog files (password is read from "+minisignPasswordEnv+" environment variable)")
+	o.catalogPaths.addFlags(cmd)
+
+	return cmd
+}
+
+func (o *deltasOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.DeltaFormat != "" && o.DeltaFormat != deltaFormatVCDiff && o.DeltaFormat != deltaFormatCasync {
+		return fmt.Errorf("Invalid delta format %q. Valid formats are: [%s, %s]", o.DeltaFormat, deltaFormatVCDiff, deltaFormatCasync)
+	}
+
+	pathOpts, err := o.catalogPaths.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	if o.DryRun {
+		var estimates []deltaEstimate
+
+		for _, dir := range o.ImageDirs {
+			opts := append([]buildOption{withDeltaDir(o.DeltaDir), withDeltaFormat(o.DeltaFormat, o.ChunkStoreDir)}, pathOpts...)
+
+			e, err := estimateDeltas(o.global.ctx, args[0], o.StreamVersion, dir, o.Workers, opts...)
+			if err != nil {
+				return err
+			}
+
+			estimates = append(estimates, e...)
+		}
+
+		return writeDeltaEstimates(cmd.OutOrStdout(), estimates)
+	}
+
+	if o.GzipLevel < 0 || o.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("Invalid catalog gzip level %d: Expected value between 0 and %d", o.GzipLevel, gzip.BestCompression)
+	}
+
+	signKey, err := readMinisignKey(o.MinisignKey)
+	if err != nil {
+		return err
+	}
+
+	opts := append([]buildOption{
+		withDeltaDir(o.DeltaDir),
+		withChecksumFiles(o.ChecksumFiles),
+		withSignKey(signKey),
+		withVerifyDeltas(o.VerifyDeltas),
+		withDeltaFormat(o.DeltaFormat, o.ChunkStoreDir),
+		withNoGZip(o.NoGZip),
+		withGzipLevel(o.GzipLevel),
+	}, pathOpts...)
+
+	for _, dir := range o.ImageDirs {
+		err := buildDeltas(o.global.ctx, args[0], o.StreamVersion, dir, o.Workers, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildDeltas reads the existing product catalog, generates missing delta
+// files for its products, and writes the updated product catalog.
+func buildDeltas(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, opts ...buildOption) error {
+	config := newBuildConfig(opts...)
+	catalogPath := filepath.Join(config.metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+	// Remember the hash of the catalog file to detect concurrent changes.
+	catalogSHA256, err := shared.FileHash(sha256.New(), catalogPath)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return err
+	}
+
+	// Item paths are resolved relative to the root directory.
+	trimItemPaths(catalog, config)
+
+	// Checksums are not part of the product catalog, therefore, read them
+	// from the checksum files to ensure delta hashes are appended to them.
+	for _, product := range catalog.Products {
+		for versionName, version := range product.Versions {
+			// Use the first existing checksum file.
+			for _, checksumName := range config.checksumFiles {
+				checksumPath := filepath.Join(rootDir, streamName, product.RelPath(), versionName, checksumName)
+				checksums, err := stream.ReadChecksumFile(checksumPath)
+				if err != nil {
+					if errors.Is(err, os.ErrNotExist) {
+						continue
+					}
+
+					return fmt.Errorf("Failed to read checksums file: %w", err)
+				}
+
+				version.Checksums = checksums
+				version.ChecksumFile = checksumName
+				product.Versions[versionName] = version
+				break
+			}
+		}
+	}
+
+	warnings, err := generateDeltas(ctx, rootDir, streamName, catalog, workers, opts...)
+	if err != nil {
+		return err
+	}
+
+	logWarnings(warnings)
+
+	// Do not overwrite the changes of a build that finished meanwhile.
+	// Generated delta files are retained, hence they are added to the
+	// catalog on the next run.
+	return publishCatalog(config.metaRootDir(rootDir), streamVersion, streamName, catalog, catalogSHA256, config)
+}
+
+// deltaEstimate contains the estimated size of delta files of a single
+// product.
+type deltaEstimate struct {
+	// Stream is the name of the stream containing the product.
+	Stream string
+
+	// Product is the product ID.
+	Product string
+
+	// Deltas is the number of delta files, including the existing ones.
+	Deltas int
+
+	// ExistingSize is the total size of the existing delta files.
+	ExistingSize int64
+
+	// NewSize is the estimated total size of the missing delta files.
+	NewSize int64
+}
+
+// estimateDeltas returns the estimated size of delta files between the
+// consecutive versions of each product within the existing product catalog.
+// Sizes of the existing delta files are read from the catalog or the disk,
+// while missing delta files are generated into a discarded output to measure
+// their size. No files are written. Products are sorted by their ID.
+func estimateDeltas(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, opts ...buildOption) ([]deltaEstimate, error) {
+	config := newBuildConfig(opts...)
+	sourceRoot := config.sourceRootDir(rootDir)
+	workRoot := config.workRootDir(rootDir)
+	catalogPath := filepath.Join(config.metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Item paths are resolved relative to the root directory.
+	trimItemPaths(catalog, config)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	estimates := make(map[string]*deltaEstimate, len(catalog.Products))
+
+	// Each job measures a single missing delta file into its own result,
+	// which is added to the product's estimate once all jobs are done.
+	type measuredDelta struct {
+		estimate *deltaEstimate
+		size     int64
+		ok       bool
+	}
+
+	var measured []*measuredDelta
+
+	for id, product := range catalog.Products {
+		estimate := &deltaEstimate{Stream: streamName, Product: id}
+		estimates[id] = estimate
+
+		productRelPath := filepath.Join(streamName, product.RelPath())
+		versions := shared.MapKeysSorted(product.Versions)
+
+		for i := 1; i < len(versions); i++ {
+			sourceVerName := versions[i-1]
+			targetVerName := versions[i]
+			targetVersion := product.Versions[targetVerName]
+
+			for itemName, item := range targetVersion.Items {
+				if !isDeltaItemType(item.Ftype, config.deltaFormat) {
+					continue
+				}
+
+				deltaName := deltaFileName(itemName, item.Ftype, sourceVerName)
+				deltaRelPath := filepath.Join(config.deltaDir, productRelPath, targetVerName, deltaName)
+
+				// Use the size of the existing delta file.
+				deltaItem, ok := targetVersion.Items[deltaName]
+				if !ok {
+					info, err := os.Stat(filepath.Join(workRoot, deltaRelPath))
+					if err == nil {
+						deltaItem = stream.Item{Size: info.Size()}
+						ok = true
+					}
+				}
+
+				if ok {
+					estimate.Deltas++
+					estimate.ExistingSize += deltaItem.Size
+					continue
+				}
+
+				baseItemRelPath := filepath.Join(productRelPath, sourceVerName, itemName)
+				sourcePath := filepath.Join(config.rootFor(sourceRoot, baseItemRelPath), baseItemRelPath)
+
+				sourceItem, ok := product.Versions[sourceVerName].Items[itemName]
+				if ok {
+					sourcePath = filepath.Join(config.rootFor(workRoot, sourceItem.Path), sourceItem.Path)
+				}
+
+				targetRelPath := filepath.Join(productRelPath, targetVerName, itemName)
+				targetPath := filepath.Join(config.rootFor(sourceRoot, targetRelPath), targetRelPath)
+
+				result := &measuredDelta{estimate: estimate}
+				measured = append(measured, result)
+
+				g.Go(func() error {
+					err := gctx.Err()
+					if err != nil {
+						return err
+					}
+
+					size, err := measureDelta(gctx, sourcePath, targetPath)
+					if err != nil {
+						slog.Warn("Failed to estimate delta file size", "product", id, "version", targetVerName, "item", deltaName, "error", err)
+						return nil
+					}
+
+					result.size = size
+					result.ok = true
+					return nil
+				})
+			}
+		}
+	}
+
+	err = g.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range measured {
+		if m.ok {
+			m.estimate.Deltas++
+			m.estimate.NewSize += m.size
+		}
+	}
+
+	result := make([]deltaEstimate, 0, len(estimates))
+	for _, id := range shared.MapKeysSorted(estimates) {
+		result = append(result, *estimates[id])
+	}
+
+	return result, nil
+}
+
+// measureDelta returns the size of the delta file between the source and
+// the target file without writing it.
+func measureDelta(ctx context.Context, sourcePath string, targetPath string) (int64, error) {
+	_, err := os.Stat(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var counter byteCounter
+
+	// -c write to stdout
+	cmd := exec.CommandContext(ctx, "xdelta3", "-e", "-9", "-c", "-s", sourcePath, targetPath)
+	cmd.Stdout = &counter
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(counter), nil
+}
+
+// byteCounter is a writer that counts written bytes and discards them.
+type byteCounter int64
+
+// Write counts the given bytes.
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// writeDeltaEstimates writes the estimated delta sizes to the given writer as
+// a table, followed by the total size.
+func writeDeltaEstimates(w io.Writer, estimates []deltaEstimate) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tDELTAS\tEXISTING\tNEW\tTOTAL")
+
+	var total deltaEstimate
+
+	for _, e := range estimates {
+		total.Deltas += e.Deltas
+		total.ExistingSize += e.ExistingSize
+		total.NewSize += e.NewSize
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", e.Stream, e.Product, e.Deltas, units.GetByteSizeString(e.ExistingSize, 2), units.GetByteSizeString(e.NewSize, 2), units.GetByteSizeString(e.ExistingSize+e.NewSize, 2))
+	}
+
+	fmt.Fprintf(tw, "\t(total)\t%d\t%s\t%s\t%s\n", total.Deltas, units.GetByteSizeString(total.ExistingSize, 2), units.GetByteSizeString(total.NewSize, 2), units.GetByteSizeString(total.ExistingSize+total.NewSize, 2))
+
+	return tw.Flush()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type fsckChecksumsOptions struct {
+	global *globalOptions
+
+	ImageDirs     []string
+	ChecksumFiles []string
+	DryRun        bool
+}
+
+func (o *fsckChecksumsOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "fsck-checksums <path> [flags]",
+		Short:   "Compact checksum files of product versions",
+		Long:    "Rewrite the checksum file of each complete product version in a canonical form (one entry per file, sorted by file name). Entries of files that no longer exist are removed, duplicate entries are merged, and entries of missing items are added with a recalculated checksum.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringSliceVar(&o.ChecksumFiles, "checksum-file-name", []string{stream.FileChecksumSHA256}, "Candidate names of the version checksum file (the first existing one is used)")
+	cmd.PersistentFlags().BoolVar(&o.DryRun, "dry-run", false, "Report checksum files that would be rewritten without modifying them")
+
+	return cmd
+}
+
+func (o *fsckChecksumsOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	for _, dir := range o.ImageDirs {
+		_, err := fsckChecksums(args[0], dir, o.ChecksumFiles, o.DryRun)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checksumFix describes changes of a single checksum file.
+type checksumFix struct {
+	// Path is the path of the checksum file.
+	Path string
+
+	// Removed contains names of files that no longer exist.
+	Removed []string
+
+	// Added contains names of items that were missing.
+	Added []string
+
+	// Duplicates contains names of files with multiple entries.
+	Duplicates []string
+}
+
+// fsckChecksums compacts checksum files of all complete product versions
+// within the given stream. Changed checksum files are returned sorted by
+// their path. If dryRun is true, the files are left untouched.
+func fsckChecksums(rootDir string, streamName string, checksumFiles []string, dryRun bool) ([]checksumFix, error) {
+	products, err := stream.GetProducts(rootDir, streamName,
+		stream.WithChecksumFiles(checksumFiles...),
+		stream.WithSkipErrors(true),
+		stream.WithLenientConfig(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var fixes []checksumFix
+
+	for _, id := range shared.MapKeysSorted(products) {
+		product := products[id]
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			version := product.Versions[name]
+			if version.ChecksumFile == "" {
+				slog.Debug("Skipping version without checksum file", "product", id, "version", name)
+				continue
+			}
+
+			versionPath := filepath.Join(rootDir, streamName, product.RelPath(), name)
+
+			fix, changed, err := fsckChecksumFile(versionPath, version.ChecksumFile, shared.MapKeysSorted(version.Items), dryRun)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to compact checksum file of version %q of product %q: %w", name, id, err)
+			}
+
+			if !changed {
+				continue
+			}
+
+			if dryRun {
+				slog.Info("Checksum file would be rewritten", "path", fix.Path, "removed", fix.Removed, "added", fix.Added, "duplicates", fix.Duplicates)
+			} else {
+				slog.Info("Checksum file rewritten", "path", fix.Path, "removed", fix.Removed, "added", fix.Added, "duplicates", fix.Duplicates)
+			}
+
+			fixes = append(fixes, fix)
+		}
+	}
+
+	return fixes, nil
+}
+
+// fsckChecksumFile rewrites the checksum file with the given name within the
+// version directory in a canonical form. Entries of non-existing files are
+// removed and entries of the given items are added if missing. If a file has
+// multiple entries, the last one is kept, unless they differ, in which case
+// the checksum is recalculated. It returns whether the file content differs
+// from its canonical form.
+func fsckChecksumFile(versionPath string, checksumName string, itemNames []string, dryRun bool) (checksumFix, bool, error) {
+	path := filepath.Join(versionPath, checksumName)
+	fix := checksumFix{Path: path}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fix, false, err
+	}
+
+	checksums := make(map[string]string)
+	recalculate := make(map[string]bool)
+
+	for _, line := range strings.Split(string(content), "\n") {
+		checksum, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+
+		old, ok := checksums[name]
+		if ok {
+			if !slices.Contains(fix.Duplicates, name) {
+				fix.Duplicates = append(fix.Duplicates, name)
+			}
+
+			if old != checksum {
+				recalculate[name] = true
+			}
+		}
+
+		checksums[name] = checksum
+	}
+
+	// Remove entries of files that no longer exist.
+	for _, name := range shared.MapKeysSorted(checksums) {
+		_, err := os.Stat(filepath.Join(versionPath, name))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return fix, false, err
+			}
+
+			delete(checksums, name)
+			delete(recalculate, name)
+			fix.Removed = append(fix.Removed, name)
+		}
+	}
+
+	// Add entries of missing items.
+	for _, name := range itemNames {
+		_, ok := checksums[name]
+		if !ok {
+			recalculate[name] = true
+			fix.Added = append(fix.Added, name)
+		}
+	}
+
+	for _, name := range shared.MapKeysSorted(recalculate) {
+		checksum, err := shared.FileHash(sha256.New(), filepath.Join(versionPath, name))
+		if err != nil {
+			return fix, false, err
+		}
+
+		checksums[name] = checksum
+	}
+
+	var b strings.Builder
+	for _, name := range shared.MapKeysSorted(checksums) {
+		fmt.Fprintf(&b, "%s  %s\n", checksums[name], name)
+	}
+
+	if b.String() == string(content) {
+		return fix, false, nil
+	}
+
+	if dryRun {
+		return fix, true, nil
+	}
+
+	// Write checksums to a temporary file and replace the existing one.
+	pathTemp := filepath.Join(versionPath, "."+checksumName+".tmp")
+
+	err = os.WriteFile(pathTemp, []byte(b.String()), 0644)
+	if err != nil {
+		return fix, false, err
+	}
+
+	defer os.Remove(pathTemp)
+
+	err = os.Rename(pathTemp, path)
+	if err != nil {
+		return fix, false, err
+	}
+
+	return fix, true, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type importOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	Products      []string
+	Since         string
+	Workers       int
+}
+
+func (o *importOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "import <remote-index-url> <path> [flags]",
+		Short:   "Import product versions from a remote simplestream server",
+		Long:    "Import product versions referenced by the remote index into the local directory hierarchy and build the local product catalogs.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVar(&o.Products, "products", nil, "Import only products whose ID matches any of the given patterns (e.g. 'ubuntu:noble:*:cloud')")
+	cmd.PersistentFlags().StringVar(&o.Since, "since", "", "Import only versions built on or after the given date (YYYY-MM-DD). Version names must be prefixed with the build date (YYYYMMDD)")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+
+	return cmd
+}
+
+func (o *importOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "remote-index-url")
+	}
+
+	if len(args) < 2 || args[1] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	var since time.Time
+
+	if o.Since != "" {
+		var err error
+
+		since, err = time.Parse(time.DateOnly, o.Since)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q for %q: %w", o.Since, "since", err)
+		}
+	}
+
+	return importIndex(o.global.ctx, args[0], args[1], o.StreamVersion, o.Products, since, o.Workers)
+}
+
+// importIndex downloads the product versions referenced by the remote index
+// into the local root directory and builds the local product catalogs. Only
+// products matching any of the given patterns and versions built on or after
+// the given time are imported. Versions that already exist locally are skipped.
+func importIndex(ctx context.Context, indexURL string, rootDir string, streamVersion string, products []string, since time.Time, workers int) error {
+	// Item and catalog paths are relative to the server root.
+	indexRelPath := path.Join("streams", streamVersion, "index.json")
+
+	baseURL, ok := strings.CutSuffix(indexURL, indexRelPath)
+	if !ok {
+		return fmt.Errorf("Remote index URL %q must end with %q", indexURL, indexRelPath)
+	}
+
+	index, err := stream.ReadStreamIndex(ctx, indexURL)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch remote index: %w", err)
+	}
+
+	streamNames := shared.MapKeysSorted(index.Index)
+
+	// Stream names are used as local directory names.
+	for _, streamName := range streamNames {
+		if !filepath.IsLocal(streamName) {
+			return fmt.Errorf("Remote index contains invalid stream name %q", streamName)
+		}
+	}
+
+	var errs []error
+
+	for _, streamName := range streamNames {
+		catalog, err := stream.ReadProductCatalog(ctx, baseURL+index.Index[streamName].Path)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch remote product catalog %q: %w", streamName, err)
+		}
+
+		// Continue with the remaining streams if some versions fail
+		// to be imported, unless the import is cancelled.
+		err = importCatalog(ctx, baseURL, rootDir, streamName, catalog, products, since, workers)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+
+			errs = append(errs, fmt.Errorf("Failed to import stream %q: %w", streamName, err))
+		}
+	}
+
+	// Build the index also after a partial import, so that the imported
+	// versions are referenced.
+	err = buildIndex(ctx, rootDir, streamVersion, streamNames, workers, false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// importCatalog downloads matching product versions of the given catalog.
+// Each version is downloaded into a hidden directory, which is renamed once
+// all items are downloaded and verified. Failed versions are logged and
+// skipped, and their errors are returned once all other versions are imported.
+// Versions whose path would escape the stream directory are rejected.
+func importCatalog(ctx context.Context, baseURL string, rootDir string, streamName string, catalog *stream.ProductCatalog, products []string, since time.Time, workers int) error {
+	var mutex sync.Mutex // To safely collect errors.
+	var errs []error
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	for id, product := range catalog.Products {
+		if !matchProduct(id, products) {
+			continue
+		}
+
+		for versionName, version := range product.Versions {
+			if !versionSince(versionName, since) {
+				continue
+			}
+
+			// Product and version names of the remote catalog are
+			// used as local paths.
+			if !filepath.IsLocal(product.RelPath()) || !filepath.IsLocal(versionName) {
+				err := fmt.Errorf("Invalid path of version %q of product %q", versionName, id)
+				slog.Error("Failed to import version", "product", id, "version", versionName, "error", err)
+
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+				continue
+			}
+
+			versionPath := filepath.Join(rootDir, streamName, product.RelPath(), versionName)
+
+			// Skip versions that already exist.
+			_, err := os.Stat(versionPath)
+			if err == nil {
+				slog.Debug("Skipping existing version", "product", id, "version", versionName)
+				continue
+			}
+
+			g.Go(func() error {
+				err := gctx.Err()
+				if err != nil {
+					return err
+				}
+
+				err = importVersion(gctx, baseURL, versionPath, version)
+				if err != nil {
+					slog.Error("Failed to import version", "product", id, "version", versionName, "error", err)
+
+					mutex.Lock()
+					errs = append(errs, fmt.Errorf("Failed to import version %q of product %q: %w", versionName, id, err))
+					mutex.Unlock()
+					return nil
+				}
+
+				slog.Info("Version imported", "product", id, "version", versionName)
+				return nil
+			})
+		}
+	}
+
+	err := g.Wait()
+	if err != nil {
+		errs = append(errs, err)
+	} else if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+
+	return errors.Join(errs...)
+}
+
+// importVersion downloads all version items into a hidden temporary directory
+// next to the version path, verifies their checksums, writes the checksum file,
+// and finally renames the temporary directory to the version path. Item names
+// must be local file names.
+func importVersion(ctx context.Context, baseURL string, versionPath string, version stream.Version) error {
+	versionPathTemp := filepath.Join(filepath.Dir(versionPath), "."+filepath.Base(versionPath))
+
+	err := os.MkdirAll(versionPathTemp, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(versionPathTemp)
+
+	var checksums strings.Builder
+
+	itemNames := shared.MapKeysSorted(version.Items)
+
+	for _, itemName := range itemNames {
+		if !filepath.IsLocal(itemName) {
+			return fmt.Errorf("Invalid item name %q", itemName)
+		}
+
+		item := version.Items[itemName]
+		itemPath := filepath.Join(versionPathTemp, itemName)
+
+		err := stream.DownloadLocation(ctx, baseURL+item.Path, itemPath)
+		if err != nil {
+			return err
+		}
+
+		if item.SHA256 != "" {
+			err = shared.VerifyChecksum(itemPath, sha256.New(), item.SHA256)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(&checksums, "%s  %s\n", item.SHA256, itemName)
+		}
+	}
+
+	if checksums.Len() > 0 {
+		err = os.WriteFile(filepath.Join(versionPathTemp, stream.FileChecksumSHA256), []byte(checksums.String()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(versionPathTemp, versionPath)
+}
+
+// matchProduct returns true if the product ID matches any of the given
+// patterns or if no pattern is given.
+func matchProduct(id string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		ok, _ := path.Match(pattern, id)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionSince returns true if the version was built on or after the given
+// time. The build date is parsed from the version name prefix (YYYYMMDD). If
+// the time is zero or the date cannot be parsed, true is returned.
+func versionSince(versionName string, since time.Time) bool {
+	if since.IsZero() {
+		return true
+	}
+
+	built, ok := versionBuildDate(versionName)
+	if !ok {
+		return true
+	}
+
+	return !built.Before(since)
+}
+
+// versionBuildDate parses the build date from the version name prefix
+// (YYYYMMDD). If the date cannot be parsed, false is returned.
+func versionBuildDate(versionName string) (time.Time, bool) {
+	if len(versionName) < 8 {
+		return time.Time{}, false
+	}
+
+	built, err := time.Parse("20060102", versionName[:8])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return built, true
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// currentRelease is the release alias that resolves to the current release of
+// a distribution. Its aliases are also shortened to "distro/variant" and
+// "distro" (see stream.CreateAliases).
+const currentRelease = "current"
+
+type promoteCurrentOptions struct {
+	build buildOptions
+}
+
+func (o *promoteCurrentOptions) NewCommand() *cobra.Command {
+	// The product catalogs are rebuilt, hence the command accepts the
+	// same flags as the build command.
+	cmd := o.build.NewCommand()
+	cmd.Use = "promote-current <path> <distro> <release> [flags]"
+	cmd.Short = "Promote the given release to the current release of a distribution"
+	cmd.Long = "Promote the given release to the current release of a distribution by moving the \"current\" release alias within the stream defaults file. The product catalogs are then rebuilt with the aliases of all products of the distribution recalculated."
+	cmd.RunE = o.Run
+
+	return cmd
+}
+
+func (o *promoteCurrentOptions) Run(_ *cobra.Command, args []string) error {
+	for i, name := range []string{"path", "distro", "release"} {
+		if len(args) <= i || args[i] == "" {
+			return fmt.Errorf("Argument %q is required and cannot be empty", name)
+		}
+	}
+
+	rootDir, distro, release := args[0], args[1], args[2]
+
+	opts, err := o.build.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	config := newBuildConfig(opts...)
+
+	for _, streamName := range o.build.ImageDirs {
+		err := promoteCurrent(config.sourceRootDir(rootDir), streamName, distro, release, config.streamOptions()...)
+		if err != nil {
+			return fmt.Errorf("Failed to promote current release of stream %q: %w", streamName, err)
+		}
+	}
+
+	events, closeEvents, err := openEventSink(o.build.EventsFile, o.build.Events)
+	if err != nil {
+		return err
+	}
+
+	defer closeEvents()
+
+	opts = append(opts, withEventSink(events), withRefreshAliases([]string{distro}))
+
+	return buildIndex(o.build.global.ctx, rootDir, o.build.StreamVersion, o.build.ImageDirs, o.build.Workers, o.build.BuildWebPage, opts...)
+}
+
+// promoteCurrent moves the "current" alias of the given distribution to the
+// given release within the stream defaults file. Releases of other
+// distributions are not modified. An error is returned if the release has no
+// products, if it is shared with another distribution, or if the image config
+// of any affected product overrides its release aliases, as the defaults would
+// not take effect.
+func promoteCurrent(rootDir string, streamName string, distro string, release string, opts ...stream.Option) error {
+	if release == currentRelease {
+		return fmt.Errorf("Release %q cannot be promoted to itself", release)
+	}
+
+	opts = append(opts, stream.WithSkipErrors(true), stream.WithLenientConfig(true), stream.WithWarningHandler(func(string, error) {}))
+
+	products, err := stream.GetProducts(rootDir, streamName, opts...)
+	if err != nil {
+		return err
+	}
+
+	var releases []string
+
+	for _, id := range shared.MapKeysSorted(products) {
+		p := products[id]
+
+		if p.Distro != distro {
+			if p.Release == release {
+				return fmt.Errorf("Release %q is shared with distribution %q", release, p.Distro)
+			}
+
+			continue
+		}
+
+		if p.Release == currentRelease {
+			return fmt.Errorf("Distribution %q contains a release directory named %q", distro, currentRelease)
+		}
+
+		if !slices.Contains(releases, p.Release) {
+			releases = append(releases, p.Release)
+		}
+
+		// Product aliases are evaluated from the image config of the
+		// last version, which overrides the defaults of the same release.
+		versionNames := shared.MapKeysSorted(p.Versions)
+		lastVersion := versionNames[len(versionNames)-1]
+
+		aliases, ok := p.Versions[lastVersion].ImageConfig.ReleaseAliases[p.Release]
+		if ok && slices.Contains(strings.Split(aliases, ","), currentRelease) != (p.Release == release) {
+			return fmt.Errorf("Release aliases of product %q are overridden by the image config of version %q", id, lastVersion)
+		}
+	}
+
+	if !slices.Contains(releases, release) {
+		return fmt.Errorf("No products found for release %q of distribution %q", release, distro)
+	}
+
+	defaultsPath := filepath.Join(rootDir, streamName, stream.FileStreamDefaults)
+
+	content, err := os.ReadFile(defaultsPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read stream defaults: %w", err)
+	}
+
+	newContent, err := setCurrentRelease(content, releases, release)
+	if err != nil {
+		return fmt.Errorf("Failed to update stream defaults: %w", err)
+	}
+
+	if string(newContent) == string(content) {
+		slog.Info("Current release is already up to date", "streamName", streamName, "distro", distro, "release", release)
+		return nil
+	}
+
+	// Write the defaults to a temporary file next to the final one to
+	// ensure atomic replace.
+	tempPath := filepath.Join(filepath.Dir(defaultsPath), fmt.Sprintf(".%s.tmp", stream.FileStreamDefaults))
+
+	err = os.WriteFile(tempPath, newContent, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write stream defaults: %w", err)
+	}
+
+	defer os.Remove(tempPath)
+
+	err = os.Rename(tempPath, defaultsPath)
+	if err != nil {
+		return fmt.Errorf("Failed to write stream defaults: %w", err)
+	}
+
+	slog.Info("Current release promoted", "streamName", streamName, "distro", distro, "release", release)
+	return nil
+}
+
+// setCurrentRelease removes the "current" alias from the release aliases of
+// the given releases within the stream defaults content and adds it to the
+// aliases of the promoted release. Aliases of other releases and other fields
+// are retained, however, comments are not.
+func setCurrentRelease(content []byte, releases []string, release string) ([]byte, error) {
+	// Release aliases are decoded separately into strings, as the
+	// generic decoding would turn versions such as "22.10" into numbers.
+	var config struct {
+		Simplestream struct {
+			ReleaseAliases map[string]string `yaml:"release_aliases"`
+		} `yaml:"simplestream"`
+	}
+
+	err := yaml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseAliases := config.Simplestream.ReleaseAliases
+	if releaseAliases == nil {
+		releaseAliases = make(map[string]string)
+	}
+
+	changed := false
+
+	for _, r := range releases {
+		aliases, ok := releaseAliases[r]
+		if !ok && r != release {
+			continue
+		}
+
+		var newAliases []string
+		if aliases != "" {
+			newAliases = strings.Split(aliases, ",")
+		}
+
+		newAliases = slices.DeleteFunc(newAliases, func(alias string) bool {
+			return alias == currentRelease
+		})
+
+		if r == release {
+			newAliases = append(newAliases, currentRelease)
+		}
+
+		if len(newAliases) == 0 {
+			delete(releaseAliases, r)
+			changed = changed || ok
+			continue
+		}
+
+		newAliasesStr := strings.Join(newAliases, ",")
+		changed = changed || newAliasesStr != aliases
+		releaseAliases[r] = newAliasesStr
+	}
+
+	if !changed {
+		return content, nil
+	}
+
+	// Retain the remaining content in its original order.
+	var doc yaml.MapSlice
+
+	err = yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	aliasesSlice := make(yaml.MapSlice, 0, len(releaseAliases))
+	for _, r := range shared.MapKeysSorted(releaseAliases) {
+		aliasesSlice = append(aliasesSlice, yaml.MapItem{Key: r, Value: releaseAliases[r]})
+	}
+
+	simplestream, _ := mapSliceValue(doc, "simplestream").(yaml.MapSlice)
+	simplestream = setMapSliceValue(simplestream, "release_aliases", aliasesSlice)
+	doc = setMapSliceValue(doc, "simplestream", simplestream)
+
+	return yaml.Marshal(doc)
+}
+
+// mapSliceValue returns the value of the given key, or nil if the key does not
+// exist.
+func mapSliceValue(m yaml.MapSlice, key string) any {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+
+	return nil
+}
+
+// setMapSliceValue sets the value of the given key. If the key does not exist,
+// it is appended.
+func setMapSliceValue(m yaml.MapSlice, key string, value any) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
@@ -20,8 +30,24 @@ type pruneOptions struct {
 	Dangling      bool
 	RetainBuilds  int
 	RetainDays    int
+	MinComplete   int
+	RetainPolicy  string
 	StreamVersion string
 	ImageDirs     []string
+	DeltaDir      string
+	Workers       int
+
+	ExcludeVariants []string
+	ExcludeReleases []string
+	ExcludeArchs    []string
+
+	EventsFile  string
+	Events      bool
+	MinisignKey string
+	GzipLevel   int
+	NoGZip      bool
+
+	catalogPaths catalogPathOptions
 }
 
 func (o *pruneOptions) NewCommand() *cobra.Command {
@@ -36,8 +62,21 @@ func (o *pruneOptions) NewCommand() *cobra.Command {
 	cmd.PersistentFlags().BoolVar(&o.Dangling, "dangling", false, "Remove dangling product versions (not referenced from any product catalog)")
 	cmd.PersistentFlags().IntVar(&o.RetainBuilds, "retain-builds", 10, "Maximum number of product versions to retain")
 	cmd.PersistentFlags().IntVar(&o.RetainDays, "retain-days", 0, "Maximum number of days to retain any product version")
+	cmd.PersistentFlags().IntVar(&o.MinComplete, "min-complete", 0, "Minimum number of complete product versions to retain regardless of other retention flags (0 to disable)")
+	cmd.PersistentFlags().StringVar(&o.RetainPolicy, "retain-policy", "", "Calendar-based retention policy in format 'daily=7,weekly=4,monthly=*' that keeps the newest product version within each of the given number of most recent periods (daily, weekly, monthly, or yearly; '*' for unlimited). Overrides --retain-builds and --retain-days")
 	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
 	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.DeltaDir, "delta-dir", "", "Directory for generated delta files (relative to path argument)")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeVariants, "exclude-variant", nil, "Do not remove dangling products with the given variant (products excluded from the build)")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeReleases, "exclude-release", nil, "Do not remove dangling products with the given release (products excluded from the build)")
+	cmd.PersistentFlags().StringSliceVar(&o.ExcludeArchs, "exclude-arch", nil, "Do not remove dangling products with the given architecture (products excluded from the build)")
+	cmd.PersistentFlags().StringVar(&o.EventsFile, "events-file", "", "File to which prune events are appended in JSON Lines format")
+	cmd.PersistentFlags().BoolVar(&o.Events, "events", false, "Write prune events to stdout in JSON Lines format")
+	cmd.PersistentFlags().BoolVar(&o.NoGZip, "no-gzip", false, "Skip writing of the gzipped index and product catalog files, and remove the existing ones (for local development only, as clients requesting them will fail)")
+	cmd.PersistentFlags().IntVar(&o.GzipLevel, "catalog-gzip-level", gzip.BestCompression, "Compression level of the gzipped index and product catalog files (from 1 for best speed to 9 for best size, 0 for default)")
+	cmd.PersistentFlags().StringVar(&o.MinisignKey, "minisign-key", "", "Minisign secret key used to sign the index and product catalog files (password is read from "+minisignPasswordEnv+" environment variable)")
+	o.catalogPaths.addFlags(cmd)
 
 	return cmd
 }
@@ -47,71 +86,209 @@ func (o *pruneOptions) Run(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
 	}
 
+	policy, err := parseRetainPolicy(o.RetainPolicy)
+	if err != nil {
+		return err
+	}
+
+	if o.GzipLevel < 0 || o.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("Invalid catalog gzip level %d: Expected value between 0 and %d", o.GzipLevel, gzip.BestCompression)
+	}
+
+	signKey, err := readMinisignKey(o.MinisignKey)
+	if err != nil {
+		return err
+	}
+
+	pathOpts, err := o.catalogPaths.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	opts := append([]buildOption{withSignKey(signKey), withNoGZip(o.NoGZip), withGzipLevel(o.GzipLevel)}, pathOpts...)
+
+	events, closeEvents, err := openEventSink(o.EventsFile, o.Events)
+	if err != nil {
+		return err
+	}
+
+	defer closeEvents()
+
+	var errs []error
+
+	exclude := productFilter{variants: o.ExcludeVariants, releases: o.ExcludeReleases, archs: o.ExcludeArchs}
+
 	for _, dir := range o.ImageDirs {
 		if o.Dangling {
-			err := pruneDanglingProductVersions(args[0], o.StreamVersion, dir)
+			err := pruneDanglingProductVersions(args[0], o.StreamVersion, dir, exclude, events, opts...)
 			if err != nil {
 				return err
 			}
+
+			if o.DeltaDir != "" {
+				err := pruneDanglingDeltas(args[0], o.StreamVersion, dir, o.DeltaDir, exclude, opts...)
+				if err != nil {
+					return err
+				}
+			}
 		}
 
-		err := pruneStreamProductVersions(args[0], o.StreamVersion, dir, o.RetainBuilds, o.RetainDays)
+		// Continue with the remaining image directories if some
+		// versions fail to be pruned.
+		err := pruneStreamProductVersions(o.global.ctx, args[0], o.StreamVersion, dir, o.RetainBuilds, o.RetainDays, o.MinComplete, policy, o.Workers, events, opts...)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
-	return pruneEmptyDirs(args[0], true)
+	err = pruneEmptyDirs(args[0], true)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // pruneStreamProductVersions reads the product catalog and removes all product
 // versions except for the number of latests versions defined by retain integer.
-func pruneStreamProductVersions(rootDir string, streamVersion string, streamName string, retainBuilds int, retainDays int) error {
+// Versions stored outside the product directory, such as baselines, are never
+// removed. Regardless of retention, the latest minComplete versions of each product are
+// never removed. Since the catalog references only complete versions, this
+// guards against pruning products down to nothing after failed builds. The
+// catalog is updated before any version is removed. Versions are removed
+// concurrently, and removal errors are returned once all removals are done.
+// An event is emitted to the given sink (if not nil) for each removed version.
+// If the retention policy is not empty, it selects the retained versions
+// instead of retainBuilds and retainDays. The catalog is written, compressed,
+// and signed according to the given build options.
+func pruneStreamProductVersions(ctx context.Context, rootDir string, streamVersion string, streamName string, retainBuilds int, retainDays int, minComplete int, policy retainPolicy, workers int, events eventSink, opts ...buildOption) error {
 	if retainBuilds < 1 {
 		return fmt.Errorf("At least 1 product version build must be retained")
 	}
 
-	// Read product catalog.
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	config := newBuildConfig(opts...)
+
+	// Read product catalog and remember its hash to detect concurrent
+	// changes.
+	catalogPath := filepath.Join(config.metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalogSHA256, err := shared.FileHash(sha256.New(), catalogPath)
+	if err != nil {
+		return err
+	}
+
 	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
 	if err != nil {
 		return err
 	}
 
+	// Item paths are resolved relative to the root directory.
+	trimItemPaths(catalog, config)
+
 	// Find versions that need to be discarded.
 	var discardVersions []string
 
+	// Events of discarded versions mapped by the version path.
+	pruned := make(map[string]event)
+
 	for id, p := range catalog.Products {
 		productPath := filepath.Join(rootDir, streamName, p.RelPath())
 
-		versions := shared.MapKeys(p.Versions)
-		slices.Sort(versions)
+		// Exclude versions stored outside the product directory.
+		versions := slices.DeleteFunc(shared.MapKeysSorted(p.Versions), func(v string) bool {
+			return isExternalVersion(rootDir, productPath, p.Versions[v])
+		})
+
 		slices.Reverse(versions)
 
+		// discard removes the version from the catalog and marks its
+		// directory for removal. Delta files stored outside the version
+		// directory are removed alongside the version.
+		discard := func(v string, versionPath string) {
+			for _, item := range catalog.Products[id].Versions[v].Items {
+				itemDir := filepath.Dir(filepath.Join(rootDir, item.Path))
+				if isGeneratedItem(item) && itemDir != versionPath && !slices.Contains(discardVersions, itemDir) {
+					discardVersions = append(discardVersions, itemDir)
+				}
+			}
+
+			delete(catalog.Products[id].Versions, v)
+			discardVersions = append(discardVersions, versionPath)
+			pruned[versionPath] = event{Type: eventVersionPruned, Stream: streamName, Product: id, Version: v, Path: versionPath}
+		}
+
+		// Discard versions that cannot be used on their own, such as
+		// versions containing only delta files. They are neither retained
+		// nor counted towards the number of retained versions. Unless
+		// at least minComplete versions remain usable, such versions are
+		// retained, as missing files may indicate an unavailable storage
+		// rather than removed root file systems.
+		var usable []string
+		var unusable []string
+
+		for _, v := range versions {
+			ok, err := hasPrimaryItem(rootDir, p.Versions[v])
+			if err != nil {
+				return fmt.Errorf("Failed to check primary root file system of version %q of product %q: %w", v, id, err)
+			}
+
+			if ok {
+				usable = append(usable, v)
+			} else {
+				unusable = append(unusable, v)
+			}
+		}
+
+		if len(unusable) > 0 && len(usable) < minComplete {
+			slog.Warn("Retaining versions without primary root file system to keep the minimum number of complete versions", "streamName", streamName, "product", id, "versions", unusable, "minComplete", minComplete)
+		} else {
+			for _, v := range unusable {
+				slog.Warn("Discarding version without primary root file system", "streamName", streamName, "product", id, "version", v)
+				discard(v, filepath.Join(productPath, v))
+			}
+
+			versions = usable
+		}
+
+		// Select versions retained by the policy.
+		var retained map[string]bool
+		if len(policy) > 0 {
+			retained, err = policy.retain(productPath, versions)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Extract versions that need to be discarded.
 		for i, v := range versions {
 			versionPath := filepath.Join(productPath, v)
 
-			// Remove version outside the retainBuilds.
-			if i >= retainBuilds {
-				delete(catalog.Products[id].Versions, v)
-				discardVersions = append(discardVersions, versionPath)
-				continue
+			prune := i >= retainBuilds
+			if retained != nil {
+				prune = !retained[v]
 			}
 
 			// Remove versions older then retainDays.
-			if retainDays > 0 {
+			if !prune && retained == nil && retainDays > 0 {
 				info, err := os.Stat(versionPath)
 				if err != nil {
 					return err
 				}
 
 				maxAge := time.Duration(retainDays) * 24 * time.Hour
-				if time.Since(info.ModTime()) > maxAge {
-					delete(catalog.Products[id].Versions, v)
-					discardVersions = append(discardVersions, versionPath)
-				}
+				prune = time.Since(info.ModTime()) > maxAge
 			}
+
+			if !prune {
+				continue
+			}
+
+			// Retain the minimum number of complete versions.
+			if i < minComplete {
+				slog.Warn("Retaining version to keep the minimum number of complete versions", "streamName", streamName, "product", id, "version", v, "minComplete", minComplete)
+				continue
+			}
+
+			discard(v, versionPath)
 		}
 
 		// Remove products that contain no versions.
@@ -120,47 +297,259 @@ func pruneStreamProductVersions(rootDir string, streamVersion string, streamName
 		}
 	}
 
-	// Write product catalog to a temporary file that is located next
-	// to the final file to ensure atomic replace. Temporary file is
-	// prefixed with a dot to hide it.
-	catalogPathTemp := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf(".%s.json.tmp", streamName))
-	err = shared.WriteJSONFile(catalogPathTemp, catalog)
+	// Publish the product catalog along with its index entry, so that
+	// clients do not keep referencing the removed versions.
+	err = publishCatalog(config.metaRootDir(rootDir), streamVersion, streamName, catalog, catalogSHA256, config)
 	if err != nil {
 		return err
 	}
 
-	defer os.Remove(catalogPathTemp)
+	// Remove old versions.
+	err = removeAllConcurrently(ctx, discardVersions, workers)
+
+	// Emit events of versions that no longer exist, as the removal of
+	// some versions may have failed.
+	for _, path := range shared.MapKeysSorted(pruned) {
+		_, statErr := os.Lstat(path)
+		if errors.Is(statErr, os.ErrNotExist) {
+			emitEvent(events, pruned[path])
+		}
+	}
 
-	// Replace existing stream json file.
-	err = os.Rename(catalogPathTemp, catalogPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to prune old product versions: %w", err)
 	}
 
-	// Set read permissions.
-	err = os.Chmod(catalogPath, 0644)
-	if err != nil {
-		return err
+	return nil
+}
+
+// Periods of the retention policy.
+const (
+	retainPeriodDaily   = "daily"
+	retainPeriodWeekly  = "weekly"
+	retainPeriodMonthly = "monthly"
+	retainPeriodYearly  = "yearly"
+)
+
+// retainRule keeps the newest version within each of the most recent
+// periods that contain any version.
+type retainRule struct {
+	// period is the length of the period.
+	period string
+
+	// count is the number of retained periods. If negative, versions of
+	// all periods are retained.
+	count int
+}
+
+// retainPolicy is a GFS (grandfather-father-son) retention policy. A version
+// is retained if any of the rules retains it.
+type retainPolicy []retainRule
+
+// parseRetainPolicy parses the retention policy in format
+// '<period>=<count>[,<period>=<count>...]', where count is a positive number
+// or '*' for unlimited. An empty spec results in an empty policy.
+func parseRetainPolicy(spec string) (retainPolicy, error) {
+	var policy retainPolicy
+
+	if strings.TrimSpace(spec) == "" {
+		return policy, nil
 	}
 
-	// Remove old versions.
-	for _, v := range discardVersions {
-		err := os.RemoveAll(v)
-		if err != nil {
-			slog.Error("Failed to prune old product version", "path", v, "error", err)
-			continue // Do not error out.
+	for _, r := range strings.Split(spec, ",") {
+		period, countStr, ok := strings.Cut(strings.TrimSpace(r), "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid retention rule %q: Expected format is '<period>=<count>'", r)
+		}
+
+		if !slices.Contains([]string{retainPeriodDaily, retainPeriodWeekly, retainPeriodMonthly, retainPeriodYearly}, period) {
+			return nil, fmt.Errorf("Invalid retention period %q. Valid periods are: [%s, %s, %s, %s]", period, retainPeriodDaily, retainPeriodWeekly, retainPeriodMonthly, retainPeriodYearly)
+		}
+
+		count := -1
+		if countStr != "*" {
+			var err error
+
+			count, err = strconv.Atoi(countStr)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("Invalid retention count %q of period %q: Expected positive number or '*'", countStr, period)
+			}
 		}
 
-		slog.Info("Pruned old product version", "path", v, "error", err)
+		policy = append(policy, retainRule{period: period, count: count})
 	}
 
-	return nil
+	return policy, nil
+}
+
+// retain returns the names of the given product versions that are retained
+// by the policy. The build date of a version is parsed from its name
+// (YYYYMMDD prefix), and the modification time of the version directory is
+// used as a fallback. Periods are calculated in UTC.
+func (p retainPolicy) retain(productPath string, versions []string) (map[string]bool, error) {
+	dates := make(map[string]time.Time, len(versions))
+
+	for _, v := range versions {
+		built, ok := versionBuildDate(v)
+		if !ok {
+			info, err := os.Stat(filepath.Join(productPath, v))
+			if err != nil {
+				return nil, err
+			}
+
+			built = info.ModTime()
+		}
+
+		dates[v] = built.UTC()
+	}
+
+	// Sort versions from the newest to the oldest.
+	sorted := slices.Clone(versions)
+	slices.SortFunc(sorted, func(a string, b string) int {
+		c := dates[b].Compare(dates[a])
+		if c == 0 {
+			return strings.Compare(b, a)
+		}
+
+		return c
+	})
+
+	retained := make(map[string]bool)
+
+	for _, rule := range p {
+		var lastPeriod string
+		var periods int
+
+		for _, v := range sorted {
+			period := retainPeriodKey(rule.period, dates[v])
+			if period == lastPeriod {
+				continue
+			}
+
+			if rule.count >= 0 && periods >= rule.count {
+				break
+			}
+
+			// The first version of the period is the newest one.
+			retained[v] = true
+			lastPeriod = period
+			periods++
+		}
+	}
+
+	return retained, nil
+}
+
+// retainPeriodKey returns the key identifying the period of the given length
+// that contains the given time.
+func retainPeriodKey(period string, t time.Time) string {
+	switch period {
+	case retainPeriodWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case retainPeriodMonthly:
+		return t.Format("2006-01")
+	case retainPeriodYearly:
+		return t.Format("2006")
+	}
+
+	return t.Format(time.DateOnly)
+}
+
+// hasPrimaryItem returns true if the version contains an item of a primary
+// type (e.g. squashfs or qcow2) whose file exists on disk. Errors other than
+// a missing file are returned.
+func hasPrimaryItem(rootDir string, version stream.Version) (bool, error) {
+	for _, item := range version.Items {
+		if !stream.IsPrimaryItemType(item.Ftype) {
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(rootDir, item.Path))
+		if err == nil {
+			return true, nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// isExternalVersion returns true if any of the version items (excluding delta
+// files and chunk indexes) is not stored within the product directory, which
+// is the case for baseline versions.
+func isExternalVersion(rootDir string, productPath string, version stream.Version) bool {
+	for _, item := range version.Items {
+		if isGeneratedItem(item) {
+			continue
+		}
+
+		relPath, err := filepath.Rel(productPath, filepath.Join(rootDir, item.Path))
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isGeneratedItem returns true if the item is generated by the build (delta
+// file or chunk index), and may therefore be stored in the delta directory.
+func isGeneratedItem(item stream.Item) bool {
+	return item.DeltaBase != "" || item.Ftype == stream.ItemTypeSquashfsCaibx
+}
+
+// removeAllConcurrently removes the given paths using the given number of
+// workers. Removal errors do not stop the removal of the remaining paths.
+// Instead, they are collected and returned once all removals are done. Paths
+// that are not removed before the context is cancelled are skipped, and the
+// context error is returned along with the removal errors.
+func removeAllConcurrently(ctx context.Context, paths []string, workers int) error {
+	var mutex sync.Mutex // To safely collect errors.
+	var errs []error
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+
+	for _, path := range paths {
+		g.Go(func() error {
+			err := gctx.Err()
+			if err != nil {
+				return err
+			}
+
+			err = os.RemoveAll(path)
+			if err != nil {
+				slog.Error("Failed to prune old product version", "path", path, "error", err)
+
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+				return nil
+			}
+
+			slog.Info("Pruned old product version", "path", path)
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // pruneDanglingProductVersions traverses through the stream directory structure
 // and prunes the product versions that are not referenced by the corresponding
-// product catalog.
-func pruneDanglingProductVersions(rootDir string, streamVersion string, streamName string) error {
+// product catalog. Products matched by the exclude filter are left intact.
+// An event is emitted to the given sink (if not nil) for each removed version.
+// The product catalog is located according to the given build options.
+func pruneDanglingProductVersions(rootDir string, streamVersion string, streamName string, exclude productFilter, events eventSink, opts ...buildOption) error {
 	// Get all products including incomplete (from actual directory hierarchy).
 	products, err := stream.GetProducts(rootDir, streamName, stream.WithIncompleteVersions(true))
 	if err != nil {
@@ -168,7 +557,7 @@ func pruneDanglingProductVersions(rootDir string, streamVersion string, streamNa
 	}
 
 	// Get current products (from stream json file).
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalogPath := filepath.Join(newBuildConfig(opts...).metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
 	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
 	if err != nil {
 		return err
@@ -182,26 +571,7 @@ func pruneDanglingProductVersions(rootDir string, streamVersion string, streamNa
 		return nil
 	}
 
-	// removeIfOlder gets info of the file on the given path and removes it
-	// if it's modification time is older then maxAge.
-	removeIfOlder := func(path string, maxAge time.Duration) error {
-		info, err := os.Stat(path)
-		if err != nil {
-			return err
-		}
-
-		if time.Since(info.ModTime()) > maxAge {
-			err := os.RemoveAll(path)
-			if err != nil {
-				slog.Error("Failed to prune dangling resource", "path", path, "error", err)
-				return nil // Do not error out.
-			}
-
-			slog.Info("Pruned dangling resource", "path", path)
-		}
-
-		return nil
-	}
+	excludeProducts(products, exclude)
 
 	for key, rp := range products {
 		productPath := filepath.Join(rootDir, streamName, rp.RelPath())
@@ -209,10 +579,16 @@ func pruneDanglingProductVersions(rootDir string, streamVersion string, streamNa
 		cp, ok := catalog.Products[key]
 		if !ok {
 			// Remove unreferenced product if older then 6 hours.
-			err := removeIfOlder(productPath, 6*time.Hour)
+			removed, err := removeIfOlder(productPath, 6*time.Hour)
 			if err != nil {
 				return err
 			}
+
+			if removed {
+				for _, rpv := range shared.MapKeysSorted(rp.Versions) {
+					emitEvent(events, event{Type: eventVersionPruned, Stream: streamName, Product: key, Version: rpv, Path: filepath.Join(productPath, rpv)})
+				}
+			}
 		} else {
 			// Iterate over detected versions and remove unreferenced ones.
 			for rpv := range rp.Versions {
@@ -225,17 +601,177 @@ func pruneDanglingProductVersions(rootDir string, streamVersion string, streamNa
 				// Remove unreferenced product version if older
 				// then 6 hours.
 				versionPath := filepath.Join(productPath, rpv)
-				err := removeIfOlder(versionPath, 6*time.Hour)
+				removed, err := removeIfOlder(versionPath, 6*time.Hour)
 				if err != nil {
 					return err
 				}
+
+				if removed {
+					emitEvent(events, event{Type: eventVersionPruned, Stream: streamName, Product: key, Version: rpv, Path: versionPath})
+				}
+			}
+
+			// Latest version pointers are not versions, but they
+			// must not point to unreferenced versions.
+			err := removeStaleLatestPointers(productPath, cp.Versions)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeStaleLatestPointers removes the latest version pointers (symlink and
+// file) within the product directory that point to a version which is not
+// among the given versions. Missing pointers are ignored, as well as a
+// symlink pointer name that is not a symlink.
+func removeStaleLatestPointers(productPath string, versions map[string]stream.Version) error {
+	for _, name := range []string{latestPointerSymlinkName, latestPointerFileName} {
+		path := filepath.Join(productPath, name)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		var versionName string
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			versionName, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		} else if info.Mode().IsRegular() && name == latestPointerFileName {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
 			}
+
+			versionName = strings.TrimSpace(string(content))
+		} else {
+			continue
+		}
+
+		_, ok := versions[versionName]
+		if ok {
+			continue
+		}
+
+		slog.Info("Removing stale latest version pointer", "path", path, "version", versionName)
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// pruneDanglingDeltas traverses through the stream's directory structure within
+// the delta directory and prunes the version directories that are not referenced
+// by the corresponding product catalog. Delta files of products matched by the
+// exclude filter are left intact. The product catalog is located according to
+// the given build options.
+func pruneDanglingDeltas(rootDir string, streamVersion string, streamName string, deltaDir string, exclude productFilter, opts ...buildOption) error {
+	// Get current products (from stream json file).
+	catalogPath := filepath.Join(newBuildConfig(opts...).metaRootDir(rootDir), "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return err
+	}
+
+	// Same as for product versions, skip removal if product catalog is empty.
+	if len(catalog.Products) == 0 {
+		slog.Info("Skipping removal of dangling delta files, because product catalog is empty")
+		return nil
+	}
+
+	// Collect paths of the referenced delta version directories.
+	referenced := make(map[string]bool)
+	for _, p := range catalog.Products {
+		for v := range p.Versions {
+			referenced[filepath.Join(streamName, p.RelPath(), v)] = true
+		}
+	}
+
+	deltaRootDir := filepath.Join(rootDir, deltaDir)
+	deltaStreamDir := filepath.Join(deltaRootDir, streamName)
+
+	// Delta version directories are located on the same depth as the
+	// product version directories ("stream/distro/release/arch/variant/version").
+	versionDepth := 6
+
+	err = filepath.WalkDir(deltaStreamDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(deltaRootDir, path)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(relPath, string(os.PathSeparator))
+		if len(parts) < versionDepth {
+			return nil
+		}
+
+		// Path parts are "stream/distro/release/arch/variant/version".
+		if !referenced[relPath] && !exclude.matches(parts[2], parts[3], parts[4]) {
+			// Remove unreferenced delta version if older then 6 hours.
+			_, err := removeIfOlder(path, 6*time.Hour)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fs.SkipDir
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// removeIfOlder gets info of the file on the given path and removes it
+// if it's modification time is older then maxAge. It returns whether the
+// file was removed.
+func removeIfOlder(path string, maxAge time.Duration) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if time.Since(info.ModTime()) > maxAge {
+		err := os.RemoveAll(path)
+		if err != nil {
+			slog.Error("Failed to prune dangling resource", "path", path, "error", err)
+			return false, nil // Do not error out.
+		}
+
+		slog.Info("Pruned dangling resource", "path", path)
+		return true, nil
+	}
+
+	return false, nil
+}
+
 // pruneEmptyDirs traverses the file structure on the given path and
 // recursively removes all empty directories. Setting keepBaseDir to
 // true, ensures the function does not remove the base directory if
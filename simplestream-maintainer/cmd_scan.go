@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type scanOptions struct {
+	global *globalOptions
+
+	ImageDirs []string
+	Format    string
+}
+
+func (o *scanOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "scan <path> [flags]",
+		Short:   "Scan directory hierarchy for complete and incomplete versions",
+		Long:    "Report complete and incomplete versions of each product found in the directory hierarchy. The product catalog is neither required nor modified.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "text", "Output format (text or json)")
+
+	return cmd
+}
+
+func (o *scanOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "text" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [text, json]", o.Format)
+	}
+
+	var scans []productScan
+
+	for _, dir := range o.ImageDirs {
+		s, err := scanProducts(args[0], dir)
+		if err != nil {
+			return err
+		}
+
+		scans = append(scans, s...)
+	}
+
+	return writeScan(cmd.OutOrStdout(), scans, o.Format)
+}
+
+// productScan contains complete and incomplete versions of a single product.
+type productScan struct {
+	// Stream is the name of the stream containing the product.
+	Stream string `json:"stream"`
+
+	// ID is the product ID.
+	ID string `json:"id"`
+
+	// Complete contains names of complete versions.
+	Complete []string `json:"complete"`
+
+	// Incomplete contains names of incomplete versions.
+	Incomplete []string `json:"incomplete"`
+}
+
+// scanProducts reads all products within the given stream and splits their
+// versions into complete and incomplete ones. Products are sorted by their ID
+// and versions by their name.
+func scanProducts(rootDir string, streamName string) ([]productScan, error) {
+	// Get all products including incomplete versions.
+	allProducts, err := stream.GetProducts(rootDir, streamName, stream.WithIncompleteVersions(true), stream.WithLenientConfig(true))
+	if err != nil {
+		return nil, err
+	}
+
+	// Get products with complete versions only.
+	products, err := stream.GetProducts(rootDir, streamName, stream.WithLenientConfig(true))
+	if err != nil {
+		return nil, err
+	}
+
+	scans := make([]productScan, 0, len(allProducts))
+
+	for _, id := range shared.MapKeysSorted(allProducts) {
+		s := productScan{
+			Stream:     streamName,
+			ID:         id,
+			Complete:   []string{},
+			Incomplete: []string{},
+		}
+
+		for _, name := range shared.MapKeysSorted(allProducts[id].Versions) {
+			_, ok := products[id].Versions[name]
+			if ok {
+				s.Complete = append(s.Complete, name)
+			} else {
+				s.Incomplete = append(s.Incomplete, name)
+			}
+		}
+
+		scans = append(scans, s)
+	}
+
+	return scans, nil
+}
+
+// writeScan writes the scan results to the given writer in the given format
+// (text or json).
+func writeScan(w io.Writer, scans []productScan, format string) error {
+	if format == "json" {
+		if scans == nil {
+			scans = []productScan{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(scans)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tCOMPLETE\tINCOMPLETE")
+
+	for _, s := range scans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Stream, s.ID, valueOrNA(strings.Join(s.Complete, ", ")), valueOrNA(strings.Join(s.Incomplete, ", ")))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/lxd/shared/units"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type statsOptions struct {
+	global *globalOptions
+
+	ImageDirs []string
+	Format    string
+}
+
+func (o *statsOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "stats <path> [flags]",
+		Short:   "Show product statistics",
+		Long:    "Show the number of versions, total size, oldest and newest build date, presence of delta files, and integrity warnings for each product.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "text", "Output format (text or json)")
+
+	return cmd
+}
+
+func (o *statsOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "text" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [text, json]", o.Format)
+	}
+
+	var stats []productStats
+
+	for _, dir := range o.ImageDirs {
+		s, err := collectStats(args[0], dir)
+		if err != nil {
+			return err
+		}
+
+		stats = append(stats, s...)
+	}
+
+	return writeStats(cmd.OutOrStdout(), stats, o.Format)
+}
+
+// productStats contains statistics of a single product.
+type productStats struct {
+	// Stream is the name of the stream containing the product.
+	Stream string `json:"stream"`
+
+	// ID is the product ID.
+	ID string `json:"id"`
+
+	// Versions is the number of complete product versions.
+	Versions int `json:"versions"`
+
+	// Size is the total size of all files within the product directory.
+	Size int64 `json:"size"`
+
+	// OldestBuild is the build date of the oldest version. It is empty if
+	// the build date cannot be parsed from any version name.
+	OldestBuild string `json:"oldest_build,omitempty"`
+
+	// NewestBuild is the build date of the newest version. It is empty if
+	// the build date cannot be parsed from any version name.
+	NewestBuild string `json:"newest_build,omitempty"`
+
+	// Deltas indicates whether any version contains delta files.
+	Deltas bool `json:"deltas"`
+
+	// Warnings contains integrity warnings.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// collectStats collects statistics of all products within the given stream.
+// Products are sorted by their ID.
+func collectStats(rootDir string, streamName string) ([]productStats, error) {
+	products, err := stream.GetProducts(rootDir, streamName, stream.WithSkipErrors(true), stream.WithLenientConfig(true))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]productStats, 0, len(products))
+
+	for _, id := range shared.MapKeysSorted(products) {
+		product := products[id]
+		productPath := filepath.Join(rootDir, streamName, product.RelPath())
+
+		size, err := shared.DirSize(productPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to calculate size of product %q: %w", id, err)
+		}
+
+		s := productStats{
+			Stream:   streamName,
+			ID:       id,
+			Versions: len(product.Versions),
+			Size:     size,
+		}
+
+		var oldest, newest time.Time
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			version := product.Versions[name]
+
+			built, ok := versionBuildDate(name)
+			if ok {
+				if oldest.IsZero() || built.Before(oldest) {
+					oldest = built
+				}
+
+				if newest.IsZero() || built.After(newest) {
+					newest = built
+				}
+			}
+
+			if version.Checksums == nil {
+				s.Warnings = append(s.Warnings, fmt.Sprintf("Version %q has no checksum file", name))
+			}
+
+			for _, itemName := range shared.MapKeysSorted(version.Items) {
+				item := version.Items[itemName]
+
+				isDelta := item.Ftype == stream.ItemTypeDiskKVMDelta || item.Ftype == stream.ItemTypeSquashfsDelta || item.Ftype == stream.ItemTypeSquashfsCaibx
+				if isDelta {
+					s.Deltas = true
+				}
+
+				_, ok := version.Checksums[itemName]
+				if version.Checksums != nil && !ok && !isDelta {
+					s.Warnings = append(s.Warnings, fmt.Sprintf("Item %q in version %q is missing from the checksum file", itemName, name))
+				}
+			}
+		}
+
+		if !oldest.IsZero() {
+			s.OldestBuild = oldest.Format(time.DateOnly)
+			s.NewestBuild = newest.Format(time.DateOnly)
+		}
+
+		// Versions that exist on disk but are not part of the product are
+		// either incomplete or cannot be read.
+		entries, err := os.ReadDir(productPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			_, ok := product.Versions[e.Name()]
+			if e.IsDir() && !ok {
+				s.Warnings = append(s.Warnings, fmt.Sprintf("Version %q is incomplete or invalid", e.Name()))
+			}
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats, nil
+}
+
+// writeStats writes the product statistics to the given writer in the given
+// format (text or json).
+func writeStats(w io.Writer, stats []productStats, format string) error {
+	if format == "json" {
+		if stats == nil {
+			stats = []productStats{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tVERSIONS\tSIZE\tOLDEST\tNEWEST\tDELTAS\tWARNINGS")
+
+	for _, s := range stats {
+		deltas := "no"
+		if s.Deltas {
+			deltas = "yes"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\n", s.Stream, s.ID, s.Versions, units.GetByteSizeString(s.Size, 2), valueOrNA(s.OldestBuild), valueOrNA(s.NewestBuild), deltas, len(s.Warnings))
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	// List warnings below the table.
+	for _, s := range stats {
+		for _, warning := range s.Warnings {
+			_, err := fmt.Fprintf(w, "Warning: %s: %s\n", s.ID, warning)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// valueOrNA returns the given value or "N/A" if the value is empty.
+func valueOrNA(value string) string {
+	if value == "" {
+		return "N/A"
+	}
+
+	return value
+}
@@ -1,22 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/casync"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/minisign"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
 )
 
+// testNow is the fixed time used for timestamps in the generated metadata.
+var testNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	shared.Now = func() time.Time { return testNow }
+	os.Exit(m.Run())
+}
+
 func TestBuildIndex(t *testing.T) {
 	t.Parallel()
 
@@ -43,7 +65,7 @@ func TestBuildIndex(t *testing.T) {
 						Path:     "streams/v1/images.json",
 						Format:   "products:1.0",
 						Datatype: "image-downloads",
-						Updated:  time.Now().Format(time.RFC3339),
+						Updated:  testNow.Format(time.RFC3339),
 						Products: []string{},
 					},
 				},
@@ -75,6 +97,8 @@ func TestBuildIndex(t *testing.T) {
 						ReleaseTitle: "focal",
 						Variant:      "cloud",
 						Requirements: map[string]string{},
+						HasContainer: true,
+						HasVM:        true,
 						Versions: map[string]stream.Version{
 							"2024_01_01": {
 								Items: map[string]stream.Item{
@@ -84,6 +108,9 @@ func TestBuildIndex(t *testing.T) {
 										Path:                     "images-daily/ubuntu/focal/amd64/cloud/2024_01_01/lxd.tar.xz",
 										SHA256:                   "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
 										CombinedSHA256DiskKvmImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+										Combined: map[string]string{
+											"disk-kvm.img": "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+										},
 									},
 									"disk.qcow2": {
 										Ftype:  "disk-kvm.img",
@@ -102,6 +129,10 @@ func TestBuildIndex(t *testing.T) {
 										SHA256:                   "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
 										CombinedSHA256DiskKvmImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
 										CombinedSHA256SquashFs:   "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+										Combined: map[string]string{
+											"disk-kvm.img": "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+											"squashfs":     "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+										},
 									},
 									"disk.qcow2": {
 										Ftype:  "disk-kvm.img",
@@ -136,7 +167,7 @@ func TestBuildIndex(t *testing.T) {
 						Path:     "streams/v1/images-daily.json",
 						Format:   "products:1.0",
 						Datatype: "image-downloads",
-						Updated:  time.Now().Format(time.RFC3339),
+						Updated:  testNow.Format(time.RFC3339),
 						Products: []string{
 							"ubuntu:focal:amd64:cloud",
 						},
@@ -158,14 +189,19 @@ func TestBuildIndex(t *testing.T) {
 			jsonCatalogExpect, err := json.MarshalIndent(test.WantCatalog, "", "  ")
 			require.NoError(t, err)
 
-			jsonIndexExpect, err := json.MarshalIndent(test.WantIndex, "", "  ")
-			require.NoError(t, err)
-
 			// Read actual catalog and index files.
 			jsonCatalogPath := filepath.Join(p.RootDir(), "streams", "v1", fmt.Sprintf("%s.json", p.StreamName()))
 			jsonCatalog, err := os.ReadFile(jsonCatalogPath)
 			require.NoError(t, err)
 
+			// Index entry contains the hash of the catalog file.
+			entry := test.WantIndex.Index[p.StreamName()]
+			entry.SHA256 = fmt.Sprintf("%x", sha256.Sum256(jsonCatalog))
+			test.WantIndex.Index[p.StreamName()] = entry
+
+			jsonIndexExpect, err := json.MarshalIndent(test.WantIndex, "", "  ")
+			require.NoError(t, err)
+
 			jsonIndexPath := filepath.Join(p.RootDir(), "streams", "v1", "index.json")
 			jsonIndex, err := os.ReadFile(jsonIndexPath)
 			require.NoError(t, err)
@@ -276,7 +312,7 @@ func TestBuildProductCatalog_ChecksumVerification(t *testing.T) {
 			p.Create(t, t.TempDir())
 
 			// Build product catalog.
-			catalog, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+			catalog, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
 			require.NoError(t, err, "Failed building product catalog!")
 
 			// Fetch the product from catalog by its id.
@@ -381,7 +417,7 @@ func TestBuildProductCatalog_FinalChecksumFile(t *testing.T) {
 			p.Create(t, t.TempDir())
 
 			// Build product catalog.
-			_, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+			_, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
 			require.NoError(t, err, "Failed building product catalog!")
 
 			// Get products from directory structure and ensure it matches the
@@ -400,6 +436,88 @@ func TestBuildProductCatalog_FinalChecksumFile(t *testing.T) {
 	}
 }
 
+func TestBuildProductCatalog_Warnings(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2").SetChecksums("invalid  disk.qcow2"),
+		testutils.MockVersion("v4").WithFiles("lxd.tar.xz", "disk.qcow2").SetImageConfig("invalid::config"),
+		testutils.MockVersion(".v5").WithFiles("lxd.tar.xz"))
+
+	p.Create(t, t.TempDir())
+
+	catalog, warnings, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"v1", "v4"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+
+	type warning struct {
+		version string
+		message string
+	}
+
+	var got []warning
+	for _, w := range warnings {
+		require.Equal(t, "images", w.Stream)
+		got = append(got, warning{version: w.Version, message: w.Message})
+	}
+
+	// Hidden versions are not reported, and invalid config is reported
+	// by its path.
+	require.ElementsMatch(t, []warning{
+		{version: "v2", message: "Skipping incomplete version"},
+		{version: "v3", message: "Checksum mismatch"},
+		{version: "", message: "Ignored invalid product or version"},
+	}, got)
+
+	// Ensure strict build fails, but still writes the index.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withStrict(true))
+	require.Error(t, err)
+	require.FileExists(t, filepath.Join(p.RootDir(), "streams", "v1", "index.json"))
+}
+
+func TestBuildProductCatalog_JobErrors(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz"))
+
+	p.Create(t, t.TempDir())
+
+	// Item that can be listed but not hashed results in a hard error.
+	err := os.Symlink(t.TempDir(), filepath.Join(p.AbsPath(), "v2", "disk.qcow2"))
+	require.NoError(t, err)
+
+	_, _, err = buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.ErrorContains(t, err, `Failed to get version "v2"`)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.Error(t, err)
+}
+
+func TestBuildProductCatalog_Cancel(t *testing.T) {
+	t.Parallel()
+
+	versions := make([]testutils.VersionMock, 0, 50)
+	for i := range 50 {
+		versions = append(versions, testutils.MockVersion(fmt.Sprintf("v%02d", i)).WithFiles("lxd.tar.xz", "disk.qcow2"))
+	}
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(versions...)
+	p.Create(t, t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+
+	_, _, err := buildProductCatalog(ctx, p.RootDir(), "v1", p.StreamName(), 2)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), 5*time.Second, "Build did not shut down promptly")
+}
+
 // Tests an edge case where missing "versions" field in product catalog caused a panic because
 // map of versions was nil.
 func TestBuildProductCatalog_MissingVersionsField(t *testing.T) {
@@ -439,832 +557,3950 @@ func TestBuildProductCatalog_MissingVersionsField(t *testing.T) {
 	require.NoError(t, err)
 
 	// Ensure missing versions field does not fail the catalog building process.
-	_, err = buildProductCatalog(context.Background(), m.RootDir(), "v1", m.StreamName(), 2)
+	_, _, err = buildProductCatalog(context.Background(), m.RootDir(), "v1", m.StreamName(), 2)
 	require.NoError(t, err, "Failed building product catalog!")
 }
 
-// TestPruneOldVersions tests removal of old versions from directory hierarchy.
-func TestPruneOldVersions(t *testing.T) {
+func TestBuildDeltas(t *testing.T) {
 	t.Parallel()
 
-	tests := []struct {
-		Name                string
-		Mock                testutils.ProductMock
-		RetainBuilds        int
-		RetainDays          int
-		WantErrString       string
-		WantVersions        []string // Expected versions in directory tree.
-		WantCatalogVersions []string // Expected versions in final product catalog.
-	}{
-		{
-			Name:          "Validation | Retain number too low",
-			RetainBuilds:  0,
-			WantErrString: "At least 1 product version build must be retained",
-		},
-		{
-			Name: "Ensure no error on empty product catalog",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddProductCatalog(),
-			RetainBuilds:        1,
-			WantVersions:        []string{},
-			WantCatalogVersions: []string{},
-		},
-		{
-			Name: "Ensure exact number of versions is kept",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					testutils.MockVersion("02").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					testutils.MockVersion("03").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2")).
-				AddProductCatalog(),
-			RetainBuilds:        3,
-			WantVersions:        []string{"01", "02", "03"},
-			WantCatalogVersions: []string{"01", "02", "03"},
-		},
-		{
-			Name: "Ensure the given number of product versions is retained",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					testutils.MockVersion("2024_01_05").WithFiles("lxd.tar.xz", "root.squashfs"),
-					testutils.MockVersion("2024_05_01").WithFiles("lxd.tar.xz", "disk.squashfs"),
-					testutils.MockVersion("2025_01_01").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog(),
-			RetainBuilds:        3,
-			WantVersions:        []string{"2024_01_05", "2024_05_01", "2025_01_01"},
-			WantCatalogVersions: []string{"2024_01_05", "2024_05_01", "2025_01_01"},
-		},
-		{
-			Name: "Ensure only complete versions are retained",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz"),                                // Incomplete
-					testutils.MockVersion("2024_01_02").WithFiles("lxd.tar.xz", "root.squashfs"),               // Complete
-					testutils.MockVersion("2024_01_03").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"), // Complete
-					testutils.MockVersion("2024_01_04").WithFiles("root.squashfs"),                             // Incomplete
-					testutils.MockVersion("2024_01_05").WithFiles("lxd.tar.xz", "disk.qcow2"),                  // Complete
-					testutils.MockVersion("2024_01_06").WithFiles("disk.qcow2")).                               // Incomplete
-				AddProductCatalog(),
-			RetainBuilds:        2,
-			WantVersions:        []string{"2024_01_03", "2024_01_05"},
-			WantCatalogVersions: []string{"2024_01_03", "2024_01_05"},
-		},
-		{
-			Name: "Ensure only referenced versions are prunned",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog().
-				AddVersions(
-					testutils.MockVersion("2027").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2028").WithFiles("lxd.tar.xz", "disk.qcow2")),
-			RetainBuilds:        2,
-			WantVersions:        []string{"2025", "2026", "2027", "2028"},
-			WantCatalogVersions: []string{"2025", "2026"},
-		},
-		{
-			Name: "Ensure versions older then retainDays are prunned",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(3*24*time.Hour), // 3 days
-					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(3*24*time.Hour),
-					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2"),
-				).
-				AddProductCatalog(),
-			RetainBuilds:        3,
-			RetainDays:          2,
-			WantVersions:        []string{"2025", "2026"},
-			WantCatalogVersions: []string{"2025", "2026"},
-		},
-		{
-			Name: "Ensure all versions older then retainDays are prunned",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2"),
-				).
-				AddProductCatalog().
-				SetFilesAge(12 * 24 * time.Hour), // 12 days
-			RetainBuilds:        2,
-			RetainDays:          10,
-			WantVersions:        []string{},
-			WantCatalogVersions: []string{},
-		},
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  disk.qcow2", testutils.ItemDefaultContentSHA),
 	}
 
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			p := test.Mock
-			p.Create(t, t.TempDir())
+	// Create product catalog without hashes and delta files.
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+		AddVersions(
+			testutils.MockVersion("v1").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"),
+			testutils.MockVersion("v2").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2")).
+		AddProductCatalog()
 
-			err := pruneStreamProductVersions(p.RootDir(), "v1", p.StreamName(), test.RetainBuilds, test.RetainDays)
-			if test.WantErrString == "" {
-				require.NoError(t, err)
-			} else {
-				require.EqualError(t, err, test.WantErrString)
-				return
-			}
+	p.Create(t, t.TempDir())
 
-			product, err := stream.GetProduct(p.RootDir(), p.RelPath())
-			require.NoError(t, err)
+	err := buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
 
-			// Ensure expected product versions are found in directory tree.
-			require.ElementsMatch(t, test.WantVersions, shared.MapKeys(product.Versions), "Mismatch between expected product versions and the directory tree")
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
 
-			// Ensure expected product versions are found in final product catalog.
-			catalogPath := filepath.Join(p.RootDir(), "streams", "v1", fmt.Sprintf("%s.json", p.StreamName()))
-			catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
-			require.NoError(t, err)
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.ElementsMatch(t, []string{"v1", "v2"}, shared.MapKeys(product.Versions))
 
-			if len(test.WantCatalogVersions) == 0 {
-				// There must be no products in catalog, if no product versions
-				// are expected.
-				require.Empty(t, shared.MapKeys(catalog.Products))
-			} else {
-				productID := strings.Join(strings.Split(p.RelPath(), "/")[1:], ":")
-				require.ElementsMatch(t, []string{productID}, shared.MapKeys(catalog.Products), "Mismatch between expected products and the product catalog")
-				require.ElementsMatch(t, test.WantCatalogVersions, shared.MapKeys(catalog.Products[productID].Versions), "Mismatch between expected product versions and the product catalog")
+	// Ensure delta is added to the catalog with its hash.
+	delta, ok := product.Versions["v2"].Items["disk.v1.qcow2.vcdiff"]
+	require.True(t, ok, "Delta file not found in the product catalog")
+	require.NotEmpty(t, delta.SHA256)
+	require.Equal(t, "v1", delta.DeltaBase)
+
+	// Ensure hashes of existing items are not calculated.
+	require.Empty(t, product.Versions["v2"].Items["disk.qcow2"].SHA256)
+
+	// Ensure delta checksum is appended to the checksums file.
+	checksumsPath := filepath.Join(p.AbsPath(), "v2", stream.FileChecksumSHA256)
+	versionChecksums, err := stream.ReadChecksumFile(checksumsPath)
+	require.NoError(t, err)
+	require.Equal(t, delta.SHA256, versionChecksums["disk.v1.qcow2.vcdiff"])
+}
+
+// funcSink passes the emitted events to the given function.
+type funcSink func(e event)
+
+func (f funcSink) Emit(e event) {
+	f(e)
+}
+
+func TestBuildDeltas_CatalogFiles(t *testing.T) {
+	t.Parallel()
+
+	newProduct := func() testutils.ProductMock {
+		p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+			AddVersions(
+				testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2")).
+			AddProductCatalog()
+
+		return p.Create(t, t.TempDir())
+	}
+
+	p := newProduct()
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	// Ensure the compressed catalog matches the written one.
+	err := buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withGzipLevel(gzip.BestSpeed))
+	require.NoError(t, err)
+	require.NoError(t, verifyGZipFile(catalogPath, catalogPath+".gz"))
+
+	// Ensure the stale compressed catalog is removed without gzip.
+	err = buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withNoGZip(true))
+	require.NoError(t, err)
+	require.NoFileExists(t, catalogPath+".gz")
+
+	// Ensure the catalog modified during delta generation is not
+	// overwritten.
+	p = newProduct()
+	catalogPath = filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	modify := funcSink(func(e event) {
+		if e.Type == eventDeltaGenerated {
+			_ = os.WriteFile(catalogPath, []byte("{}"), 0644)
+		}
+	})
+
+	err = buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withEventSink(modify))
+	require.ErrorContains(t, err, "was modified concurrently")
+
+	content, err := os.ReadFile(catalogPath)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(content))
+}
+
+func TestPruneAndDeltas_PrefixedItemPaths(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaDir := t.TempDir()
+	catalogPath := filepath.Join(metaDir, "streams", "v1", "images.json")
+	prefix := "https://cdn.example.com/cdn/ubuntu/noble/amd64/cloud/"
+
+	opts := []buildOption{
+		withMetaDir(metaDir),
+		withPublicBase("https://cdn.example.com"),
+		withPathRewrites([]pathRewrite{{oldPrefix: "images", newPrefix: "cdn"}}),
+	}
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	// requirePrefixed ensures all items of the catalog are prefixed, and
+	// returns the catalog product.
+	requirePrefixed := func() stream.Product {
+		catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+		require.NoError(t, err)
+
+		product := catalog.Products["ubuntu:noble:amd64:cloud"]
+		for versionName, version := range product.Versions {
+			for itemName, item := range version.Items {
+				require.True(t, strings.HasPrefix(item.Path, prefix+versionName+"/"), "Item %q of version %q has path %q", itemName, versionName, item.Path)
 			}
-		})
+		}
+
+		return product
+	}
+
+	// Remove delta files from the catalog and the disk.
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	for _, version := range catalog.Products["ubuntu:noble:amd64:cloud"].Versions {
+		for itemName := range version.Items {
+			if strings.HasSuffix(itemName, ".vcdiff") {
+				delete(version.Items, itemName)
+			}
+		}
+	}
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	deltas, err := filepath.Glob(filepath.Join(p.AbsPath(), "*", "*.vcdiff"))
+	require.NoError(t, err)
+	require.NotEmpty(t, deltas)
+
+	for _, path := range deltas {
+		require.NoError(t, os.Remove(path))
 	}
+
+	// Ensure missing delta files are generated and their paths prefixed.
+	err = buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, opts...)
+	require.NoError(t, err)
+
+	product := requirePrefixed()
+	require.Contains(t, product.Versions["v2"].Items, "disk.v1.qcow2.vcdiff")
+	require.Contains(t, product.Versions["v3"].Items, "disk.v2.qcow2.vcdiff")
+
+	// Ensure old versions are pruned.
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 0, nil, 2, nil, opts...)
+	require.NoError(t, err)
+
+	product = requirePrefixed()
+	require.ElementsMatch(t, []string{"v3"}, shared.MapKeys(product.Versions))
+	require.NoDirExists(t, filepath.Join(p.AbsPath(), "v1"))
+	require.NoDirExists(t, filepath.Join(p.AbsPath(), "v2"))
+	require.FileExists(t, filepath.Join(p.AbsPath(), "v3", "disk.v2.qcow2.vcdiff"))
 }
 
-func TestPruneDanglingResources(t *testing.T) {
+func TestPublishCatalog_IndexEntry(t *testing.T) {
 	t.Parallel()
 
-	tests := []struct {
-		Name         string
-		Mock         testutils.ProductMock
-		WantProducts map[string][]string // product: list of versions
-	}{
-		{
-			Name: "Ensure no error on empty product catalog",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddProductCatalog(),
-			WantProducts: map[string][]string{},
-		},
-		{
-			Name: "Ensure referenced product version is not removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2")).
-				AddProductCatalog(),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"1.0",
-				},
-			},
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+	catalogPath := filepath.Join(metaDir, "images.json")
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withCatalogSizes(true))
+	require.NoError(t, err)
+
+	// requireIndexEntry ensures the index entry matches the catalog file.
+	requireIndexEntry := func() {
+		index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+		require.NoError(t, err)
+
+		catalogSHA256, err := shared.FileHash(sha256.New(), catalogPath)
+		require.NoError(t, err)
+
+		info, err := os.Stat(catalogPath)
+		require.NoError(t, err)
+
+		entry := index.Index[p.StreamName()]
+		require.Equal(t, catalogSHA256, entry.SHA256)
+		require.Equal(t, info.Size(), entry.Size)
+		require.Equal(t, "streams/v1/images.json", entry.Path)
+		require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, entry.Products)
+		require.NoError(t, verifyGZipFile(catalogPath, catalogPath+".gz"))
+	}
+
+	// Ensure removing delta files from the catalog is published.
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	delete(catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items, "disk.v1.qcow2.vcdiff")
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	err = buildDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	requireIndexEntry()
+
+	// Ensure pruning versions is published.
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 0, nil, 2, nil)
+	require.NoError(t, err)
+	requireIndexEntry()
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"v2"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+}
+
+func TestEstimateDeltas(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+		AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+			testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+			testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2", "disk.v2.qcow2.vcdiff")).
+		AddProductCatalog()
+
+	p.Create(t, t.TempDir())
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+	catalogBefore, err := os.ReadFile(catalogPath)
+	require.NoError(t, err)
+
+	estimates, err := estimateDeltas(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	require.Len(t, estimates, 1)
+
+	// Ensure the size of the existing delta file is used and the size of
+	// the missing one is estimated.
+	e := estimates[0]
+	require.Equal(t, "ubuntu:noble:amd64:cloud", e.Product)
+	require.Equal(t, 2, e.Deltas)
+	require.Equal(t, int64(len(testutils.ItemDefaultContent)), e.ExistingSize)
+	require.Positive(t, e.NewSize)
+
+	// Ensure no files are written.
+	require.NoFileExists(t, filepath.Join(p.AbsPath(), "v2", "disk.v1.qcow2.vcdiff"))
+
+	catalogAfter, err := os.ReadFile(catalogPath)
+	require.NoError(t, err)
+	require.Equal(t, string(catalogBefore), string(catalogAfter))
+
+	var out strings.Builder
+
+	err = writeDeltaEstimates(&out, estimates)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "ubuntu:noble:amd64:cloud")
+	require.Contains(t, out.String(), "(total)")
+}
+
+func TestIsDeltaItemType(t *testing.T) {
+	t.Parallel()
+
+	ftypes := []string{
+		stream.ItemTypeMetadata,
+		stream.ItemTypeSquashfs,
+		stream.ItemTypeSquashfsDelta,
+		stream.ItemTypeSquashfsCaibx,
+		stream.ItemTypeDiskKVM,
+		stream.ItemTypeDiskKVMDelta,
+		stream.ItemTypeRootTarXz,
+		stream.ItemTypeRootTarZst,
+		stream.ItemTypeRootImg,
+	}
+
+	for _, ftype := range ftypes {
+		// Ensure delta files are generated only for primary item types.
+		require.Equal(t, stream.IsPrimaryItemType(ftype), isDeltaItemType(ftype, deltaFormatVCDiff), ftype)
+
+		// Ensure squashfs items are not diffed with casync format.
+		require.Equal(t, stream.IsPrimaryItemType(ftype) && ftype != stream.ItemTypeSquashfs, isDeltaItemType(ftype, deltaFormatCasync), ftype)
+	}
+}
+
+func TestBuildProductCatalog_DeltaDir(t *testing.T) {
+	t.Parallel()
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  disk.qcow2", testutils.ItemDefaultContentSHA),
+	}
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v3").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	deltaDir := filepath.Join("streams", "v1", "deltas")
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withDeltaDir(deltaDir))
+	require.NoError(t, err)
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	// Ensure delta is stored in the delta directory and referenced correctly.
+	delta, ok := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v3"].Items["disk.v2.qcow2.vcdiff"]
+	require.True(t, ok, "Delta file not found in the product catalog")
+	require.Equal(t, filepath.Join(deltaDir, p.RelPath(), "v3", "disk.v2.qcow2.vcdiff"), delta.Path)
+	require.FileExists(t, filepath.Join(p.RootDir(), delta.Path))
+	require.NoFileExists(t, filepath.Join(p.AbsPath(), "v3", "disk.v2.qcow2.vcdiff"))
+
+	// Ensure version checksums file is not modified and delta checksum is
+	// written next to the delta file.
+	versionChecksums, err := stream.ReadChecksumFile(filepath.Join(p.AbsPath(), "v3", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.NotContains(t, versionChecksums, "disk.v2.qcow2.vcdiff")
+
+	deltaChecksums, err := stream.ReadChecksumFile(filepath.Join(p.RootDir(), deltaDir, p.RelPath(), "v3", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, delta.SHA256, deltaChecksums["disk.v2.qcow2.vcdiff"])
+
+	// Ensure delta files are pruned together with their versions.
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 0, nil, 2, nil)
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Join(p.RootDir(), deltaDir, p.RelPath(), "v2"))
+	require.DirExists(t, filepath.Join(p.RootDir(), deltaDir, p.RelPath(), "v3"))
+}
+
+func TestBuildProductCatalog_VerifyDeltas(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	catalog, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withVerifyDeltas(true))
+	require.NoError(t, err)
+
+	delta, ok := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items["disk.v1.qcow2.vcdiff"]
+	require.True(t, ok, "Verified delta file not found in the product catalog")
+	require.FileExists(t, filepath.Join(p.RootDir(), delta.Path))
+
+	// Ensure verification fails if the decoded delta does not match the
+	// target hash.
+	sourcePath := filepath.Join(p.AbsPath(), "v1", "disk.qcow2")
+	targetPath := filepath.Join(p.AbsPath(), "v2", "disk.qcow2")
+
+	err = verifyDelta(context.Background(), sourcePath, filepath.Join(p.RootDir(), delta.Path), targetPath, "")
+	require.NoError(t, err)
+
+	err = verifyDelta(context.Background(), sourcePath, filepath.Join(p.RootDir(), delta.Path), targetPath, "invalid")
+	require.ErrorContains(t, err, "hash mismatch")
+}
+
+func TestBuildProductCatalog_CasyncDeltas(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	opts, err := (&buildOptions{DeltaFormat: deltaFormatCasync, ChunkStoreDir: "chunks"}).buildOptions()
+	require.NoError(t, err)
+
+	// Build twice to ensure existing chunk indexes are retained.
+	var catalog *stream.ProductCatalog
+	for range 2 {
+		catalog, _, err = buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, opts...)
+		require.NoError(t, err)
+	}
+
+	store := casync.Store{Dir: filepath.Join(p.RootDir(), "chunks")}
+
+	for _, versionName := range []string{"v1", "v2"} {
+		items := catalog.Products["ubuntu:noble:amd64:cloud"].Versions[versionName].Items
+
+		// Ensure chunk index replaces the squashfs delta file.
+		indexItem, ok := items["root.squashfs.caibx"]
+		require.True(t, ok, "Chunk index not found in version %q", versionName)
+		require.Equal(t, stream.ItemTypeSquashfsCaibx, indexItem.Ftype)
+		require.NotEmpty(t, indexItem.SHA256)
+		require.NotContains(t, items, "root.v1.vcdiff")
+
+		// Ensure squashfs can be reassembled from the chunk store.
+		index, err := casync.ReadIndexFile(filepath.Join(p.RootDir(), indexItem.Path))
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		err = index.Extract(store, &buf)
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(p.RootDir(), items["root.squashfs"].Path))
+		require.NoError(t, err)
+		require.Equal(t, content, buf.Bytes())
+	}
+
+	// Ensure qcow2 delta files are still generated.
+	require.Contains(t, catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items, "disk.v1.qcow2.vcdiff")
+
+	// Ensure delta format is validated.
+	_, err = (&buildOptions{DeltaFormat: "invalid"}).buildOptions()
+	require.Error(t, err)
+}
+
+func TestBuildProductCatalog_NormalizeQcow2(t *testing.T) {
+	// Fake qemu-img is provided through PATH, therefore, the test cannot
+	// run in parallel.
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+# Append a marker to the source image (last but one argument).
+for dst; do :; done
+eval src=\${$(($# - 1))}
+{ cat "$src"; printf normalized; } >"$dst"
+`
+	err := os.WriteFile(filepath.Join(binDir, "qemu-img"), []byte(script), 0755)
+	require.NoError(t, err)
+
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  disk.qcow2", testutils.ItemDefaultContentSHA),
+	}
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	catalog, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withNormalizeQcow2(true))
+	require.NoError(t, err)
+
+	// Ensure normalized image is included with the updated hash and size.
+	content, err := os.ReadFile(filepath.Join(p.AbsPath(), "v1", "disk.qcow2"))
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(content), "normalized"))
+
+	item := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["disk.qcow2"]
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), item.SHA256)
+	require.Equal(t, int64(len(content)), item.Size)
+
+	// Ensure checksum file is updated.
+	versionChecksums, err := stream.ReadChecksumFile(filepath.Join(p.AbsPath(), "v1", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, item.SHA256, versionChecksums["disk.qcow2"])
+	require.Equal(t, testutils.ItemDefaultContentSHA, versionChecksums["lxd.tar.xz"])
+
+	// Ensure normalization is skipped if qemu-img is not available.
+	t.Setenv("PATH", t.TempDir())
+
+	p2 := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p2.Create(t, t.TempDir())
+
+	catalog, warnings, err := buildProductCatalog(context.Background(), p2.RootDir(), "v1", p2.StreamName(), 2, withNormalizeQcow2(true))
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	require.Equal(t, testutils.ItemDefaultContentSHA, catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["disk.qcow2"].SHA256)
+}
+
+func TestBuildProductCatalog_SourceRoot(t *testing.T) {
+	t.Parallel()
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  disk.qcow2", testutils.ItemDefaultContentSHA),
+	}
+
+	workRoot := t.TempDir()
+	sourceRoot := filepath.Join(workRoot, "mirror")
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, sourceRoot)
+
+	opts := []buildOption{
+		withSourceRoot(sourceRoot),
+		withWorkRoot(workRoot),
+	}
+
+	err := buildIndex(context.Background(), sourceRoot, "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	// Ensure metadata is written to the work root.
+	require.NoDirExists(t, filepath.Join(sourceRoot, "streams"))
+
+	catalogPath := filepath.Join(workRoot, "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	items := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items
+
+	// Ensure original items reference the source root.
+	require.Equal(t, filepath.Join("mirror", p.RelPath(), "v2", "disk.qcow2"), items["disk.qcow2"].Path)
+	require.FileExists(t, filepath.Join(workRoot, items["disk.qcow2"].Path))
+
+	// Ensure delta file and its checksum are written to the work root.
+	delta, ok := items["disk.v1.qcow2.vcdiff"]
+	require.True(t, ok, "Delta file not found in the product catalog")
+	require.Equal(t, filepath.Join(p.RelPath(), "v2", "disk.v1.qcow2.vcdiff"), delta.Path)
+	require.FileExists(t, filepath.Join(workRoot, delta.Path))
+	require.NoFileExists(t, filepath.Join(p.AbsPath(), "v2", "disk.v1.qcow2.vcdiff"))
+
+	deltaChecksums, err := stream.ReadChecksumFile(filepath.Join(workRoot, p.RelPath(), "v2", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, delta.SHA256, deltaChecksums["disk.v1.qcow2.vcdiff"])
+
+	versionChecksums, err := stream.ReadChecksumFile(filepath.Join(p.AbsPath(), "v2", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.NotContains(t, versionChecksums, "disk.v1.qcow2.vcdiff")
+
+	// Ensure source root outside of the work root is rejected.
+	err = buildIndex(context.Background(), sourceRoot, "v1", []string{p.StreamName()}, 2, false, withSourceRoot(sourceRoot), withWorkRoot(t.TempDir()))
+	require.Error(t, err)
+}
+
+func TestBuildProductCatalog_Baseline(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	baseline := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v0").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, rootDir)
+	baseline.Create(t, filepath.Join(rootDir, "baselines"))
+
+	err := buildIndex(context.Background(), rootDir, "v1", []string{p.StreamName()}, 2, false, withBaselineDir("baselines"))
+	require.NoError(t, err)
+
+	catalogPath := filepath.Join(rootDir, "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	// Ensure only the latest baseline version is added to the catalog.
+	versions := catalog.Products["ubuntu:noble:amd64:cloud"].Versions
+	require.ElementsMatch(t, []string{"v1", "v2", "v3"}, shared.MapKeys(versions))
+	require.Equal(t, filepath.Join("baselines", p.RelPath(), "v1", "disk.qcow2"), versions["v1"].Items["disk.qcow2"].Path)
+
+	// Ensure the oldest version has a delta from the baseline.
+	delta, ok := versions["v2"].Items["disk.v1.qcow2.vcdiff"]
+	require.True(t, ok, "Delta file from the baseline not found in the product catalog")
+	require.FileExists(t, filepath.Join(rootDir, delta.Path))
+
+	// Ensure baseline is neither pruned nor counted towards retained versions.
+	err = pruneStreamProductVersions(context.Background(), rootDir, "v1", p.StreamName(), 1, 0, 0, nil, 2, nil)
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"v1", "v3"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+	require.DirExists(t, filepath.Join(rootDir, "baselines", p.RelPath(), "v1"))
+	require.NoDirExists(t, filepath.Join(p.AbsPath(), "v2"))
+}
+
+func TestBuildProductCatalog_CrossDeltas(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	mocks := []testutils.ProductMock{
+		testutils.MockProduct("images/ubuntu/noble/amd64/minimal").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2", "root.squashfs"),
+			testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2", "root.squashfs"),
+		),
+		testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+			testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+			testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		),
+	}
+
+	for _, m := range mocks {
+		m.Create(t, tmpDir)
+	}
+
+	catalog, _, err := buildProductCatalog(context.Background(), tmpDir, "v1", "images", 2, withCrossDeltas(map[string]string{"cloud": "minimal"}))
+	require.NoError(t, err)
+
+	// Ensure cross-product delta is generated only for the version that
+	// exists in both products.
+	items := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items
+	delta, ok := items["disk.minimal.v2.qcow2.vcdiff"]
+	require.True(t, ok, "Cross-product delta not found in the product catalog")
+	require.Equal(t, stream.ItemTypeDiskKVMDelta, delta.Ftype)
+	require.Equal(t, "v2", delta.DeltaBase)
+	require.Equal(t, "ubuntu:noble:amd64:minimal", delta.DeltaBaseProduct)
+	require.NotEmpty(t, delta.SHA256)
+
+	items = catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v3"].Items
+	require.NotContains(t, items, "disk.minimal.v3.qcow2.vcdiff")
+	require.Contains(t, items, "disk.v2.qcow2.vcdiff")
+
+	// Ensure regular deltas do not reference the base product.
+	require.Empty(t, items["disk.v2.qcow2.vcdiff"].DeltaBaseProduct)
+
+	// Ensure the base product does not receive cross-product deltas.
+	for name := range catalog.Products["ubuntu:noble:amd64:minimal"].Versions["v2"].Items {
+		require.NotContains(t, name, "cloud")
+	}
+}
+
+// TestBuildProductCatalog_ConcurrentVersions builds a product with many versions
+// concurrently. It is intended to be run with the race detector enabled.
+func TestBuildProductCatalog_ConcurrentVersions(t *testing.T) {
+	t.Parallel()
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  disk.qcow2", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  root.squashfs", testutils.ItemDefaultContentSHA),
+	}
+
+	versionCount := 20
+	versions := make([]testutils.VersionMock, 0, versionCount)
+	for i := 0; i < versionCount; i++ {
+		versions = append(versions, testutils.MockVersion(fmt.Sprintf("v%02d", i)).
+			SetChecksums(checksums...).
+			WithFiles("lxd.tar.xz", "disk.qcow2", "root.squashfs"))
+	}
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(versions...)
+	p.Create(t, t.TempDir())
+
+	catalog, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 8)
+	require.NoError(t, err)
+
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.Len(t, product.Versions, versionCount)
+
+	// Ensure each version (except the oldest one) contains both delta files.
+	for i := 1; i < versionCount; i++ {
+		prev := fmt.Sprintf("v%02d", i-1)
+		items := product.Versions[fmt.Sprintf("v%02d", i)].Items
+		require.Contains(t, items, fmt.Sprintf("disk.%s.qcow2.vcdiff", prev))
+		require.Contains(t, items, fmt.Sprintf("root.%s.vcdiff", prev))
+	}
+}
+
+func TestBuildIndex_Minisign(t *testing.T) {
+	t.Parallel()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key := &minisign.PrivateKey{ID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Key: priv}
+	pubKey := key.Public()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withSignKey(key))
+	require.NoError(t, err)
+
+	// Ensure signatures are created and valid.
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+	require.FileExists(t, filepath.Join(metaDir, "index.json"+minisign.SignatureExt))
+	require.FileExists(t, filepath.Join(metaDir, "images.json"+minisign.SignatureExt))
+	require.NoError(t, verifyIndex(context.Background(), p.RootDir(), "v1", &pubKey, false, false))
+
+	// Ensure signatures can be verified on a remote mirror.
+	server := httptest.NewServer(http.FileServer(http.Dir(p.RootDir())))
+	defer server.Close()
+
+	require.NoError(t, verifyIndex(context.Background(), server.URL, "v1", &pubKey, false, false))
+
+	// Ensure ID of the signing key is recorded in the index.
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, "0807060504030201", index.Index["images"].SignKeyID)
+
+	// Ensure temporary signature files are removed.
+	entries, err := os.ReadDir(metaDir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasPrefix(e.Name(), "."), "Temporary file %q not removed", e.Name())
+	}
+
+	// Ensure verification fails when the catalog is modified.
+	catalogPath := filepath.Join(metaDir, "images.json")
+	err = os.WriteFile(catalogPath, []byte("{}"), 0644)
+	require.NoError(t, err)
+
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", &pubKey, false, false)
+	require.ErrorIs(t, err, minisign.ErrInvalidSignature)
+}
+
+func TestPruneStreamProductVersions_Minisign(t *testing.T) {
+	t.Parallel()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key := &minisign.PrivateKey{ID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Key: priv}
+	pubKey := key.Public()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withSignKey(key))
+	require.NoError(t, err)
+
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 0, nil, 2, nil, withSignKey(key))
+	require.NoError(t, err)
+
+	// Ensure the rewritten catalog and index are signed again.
+	require.NoError(t, verifyIndex(context.Background(), p.RootDir(), "v1", &pubKey, false, false))
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.NotContains(t, catalog.Products["ubuntu:noble:amd64:cloud"].Versions, "v1")
+}
+
+func TestVerifyIndex_LXDFingerprints(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	// Ensure recorded combined hashes match the recalculated ones.
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, true, false)
+	require.NoError(t, err)
+
+	// Ensure a drifted combined hash is reported.
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	metaItem := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["lxd.tar.xz"]
+	metaItem.Combined[stream.ItemTypeSquashfs] = testutils.ItemDefaultContentSHA
+	catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["lxd.tar.xz"] = metaItem
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, true, false)
+	require.ErrorContains(t, err, `Fingerprint of item "rootfs.squashfs"`)
+	require.NotContains(t, err.Error(), `"disk.qcow2"`)
+
+	// Ensure fingerprints are not verified by default.
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, false, false)
+	require.NoError(t, err)
+}
+
+func TestVerifyIndex_Sniff(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	versionPath := filepath.Join(p.RootDir(), p.RelPath(), "v1")
+
+	writeItem := func(name string, content string) {
+		err := os.WriteFile(filepath.Join(versionPath, name), []byte(content), 0644)
+		require.NoError(t, err)
+	}
+
+	// Ensure mock items are reported, as their content is plain text.
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, false, true)
+	require.ErrorContains(t, err, `Content of item "lxd.tar.xz"`)
+	require.ErrorContains(t, err, `Content of item "rootfs.squashfs"`)
+	require.ErrorContains(t, err, `Content of item "disk.qcow2"`)
+
+	// Ensure items with the expected magic bytes pass.
+	writeItem("lxd.tar.xz", "\xfd7zXZ\x00content")
+	writeItem("rootfs.squashfs", "sqshcontent")
+	writeItem("disk.qcow2", "QFI\xfbcontent")
+
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, false, true)
+	require.NoError(t, err)
+
+	// Ensure mislabeled items are reported.
+	writeItem("rootfs.squashfs", "\x1f\x8bgzip")
+	writeItem("disk.qcow2", "")
+
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, false, true)
+	require.ErrorContains(t, err, `Content of item "rootfs.squashfs"`)
+	require.ErrorContains(t, err, `Content of item "disk.qcow2"`)
+	require.NotContains(t, err.Error(), `"lxd.tar.xz"`)
+
+	// Ensure item contents are not verified by default.
+	err = verifyIndex(context.Background(), p.RootDir(), "v1", nil, false, false)
+	require.NoError(t, err)
+}
+
+func TestBuildIndex_GzipLevel(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withGzipLevel(gzip.BestSpeed))
+	require.NoError(t, err)
+
+	// Ensure compressed files match the uncompressed ones.
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+	for _, name := range []string{"index.json", "images.json"} {
+		content, err := os.ReadFile(filepath.Join(metaDir, name))
+		require.NoError(t, err)
+
+		contentGz, err := shared.ReadGZipFile(filepath.Join(metaDir, name+".gz"))
+		require.NoError(t, err)
+		require.Equal(t, content, contentGz)
+	}
+
+	// Ensure invalid level is rejected.
+	opts := buildOptions{GzipLevel: gzip.BestCompression + 1}
+	_, err = opts.buildOptions()
+	require.Error(t, err)
+}
+
+func TestBuildIndex_CatalogSizes(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+
+	// Ensure sizes are omitted by default.
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Zero(t, index.Index["images"].Size)
+	require.Zero(t, index.Index["images"].SizeGZip)
+
+	// Ensure sizes of the written catalog files are recorded.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withCatalogSizes(true), withSplitByArch(true))
+	require.NoError(t, err)
+
+	index, err = shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+
+	for _, name := range []string{"images", "images-amd64"} {
+		info, err := os.Stat(filepath.Join(metaDir, name+".json"))
+		require.NoError(t, err)
+		require.Equal(t, info.Size(), index.Index[name].Size, name)
+
+		info, err = os.Stat(filepath.Join(metaDir, name+".json.gz"))
+		require.NoError(t, err)
+		require.Equal(t, info.Size(), index.Index[name].SizeGZip, name)
+	}
+}
+
+func TestBuildIndex_NoGZip(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(metaDir, "index.json.gz"))
+	require.FileExists(t, filepath.Join(metaDir, "images.json.gz"))
+
+	// Ensure compressed files are neither written nor left from the
+	// previous build.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withNoGZip(true), withCatalogSizes(true))
+	require.NoError(t, err)
+
+	for _, name := range []string{"index.json", "images.json"} {
+		require.FileExists(t, filepath.Join(metaDir, name))
+		require.NoFileExists(t, filepath.Join(metaDir, name+".gz"))
+	}
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.NotZero(t, index.Index["images"].Size)
+	require.Zero(t, index.Index["images"].SizeGZip)
+
+	// Ensure temporary files are removed.
+	entries, err := os.ReadDir(metaDir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasPrefix(e.Name(), "."), "Temporary file %q not removed", e.Name())
+	}
+}
+
+func TestBuildIndex_FailOnEmpty(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	// Ensure the flag has no effect when the product catalog does not exist.
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withFailOnEmpty(true))
+	require.NoError(t, err)
+
+	// Remove all products, as if the wrong image directory was used.
+	err = os.RemoveAll(filepath.Join(p.RootDir(), p.StreamName()))
+	require.NoError(t, err)
+
+	err = os.Mkdir(filepath.Join(p.RootDir(), p.StreamName()), 0755)
+	require.NoError(t, err)
+
+	// Ensure the build fails and the existing product catalog is retained.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withFailOnEmpty(true))
+	require.ErrorContains(t, err, `No products found in stream "images"`)
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Contains(t, catalog.Products, "ubuntu:noble:amd64:cloud")
+
+	// Ensure the build succeeds without the flag.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+}
+
+func TestVerifyGZipFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "catalog.json")
+	gzPath := path + ".gz"
+
+	err := os.WriteFile(path, []byte(`{"products":{}}`), 0644)
+	require.NoError(t, err)
+
+	err = shared.GZipFileLevel(path, gzPath, gzip.BestSpeed)
+	require.NoError(t, err)
+
+	// Ensure matching files are accepted.
+	err = verifyGZipFile(path, gzPath)
+	require.NoError(t, err)
+
+	// Ensure diverged files are rejected.
+	err = os.WriteFile(path, []byte(`{"products":{"a":{}}}`), 0644)
+	require.NoError(t, err)
+
+	err = verifyGZipFile(path, gzPath)
+	require.ErrorContains(t, err, "does not match")
+
+	// Ensure truncated compressed file is rejected.
+	err = os.Truncate(gzPath, 10)
+	require.NoError(t, err)
+
+	err = verifyGZipFile(path, gzPath)
+	require.ErrorIs(t, err, shared.ErrGZipCorrupted)
+}
+
+func TestBuildIndex_MetaDir(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaRootDir := t.TempDir()
+	opts := []buildOption{
+		withMetaDir(metaRootDir),
+		withPublicBase("https://images.example.com/"),
+	}
+
+	// Build twice to ensure the existing catalog is read from the meta dir.
+	for range 2 {
+		err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, true, opts...)
+		require.NoError(t, err)
+	}
+
+	// Ensure no metadata is written within the root directory.
+	require.NoDirExists(t, filepath.Join(p.RootDir(), "streams"))
+	require.NoFileExists(t, filepath.Join(p.RootDir(), "index.html"))
+	require.FileExists(t, filepath.Join(metaRootDir, "index.html"))
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaRootDir, "streams", "v1", "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, "streams/v1/images.json", index.Index["images"].Path)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(metaRootDir, "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	items := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items
+	require.Len(t, items, 2)
+	require.Equal(t, "https://images.example.com/images/ubuntu/noble/amd64/cloud/v1/disk.qcow2", items["disk.qcow2"].Path)
+
+	// Ensure public base is required with meta dir.
+	_, err = (&buildOptions{MetaDir: metaRootDir}).buildOptions()
+	require.Error(t, err)
+}
+
+func TestBuildIndex_SplitByArch(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		p := testutils.MockProduct("images/ubuntu/noble/" + arch + "/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+		p.Create(t, rootDir)
+	}
+
+	err := buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, withSplitByArch(true))
+	require.NoError(t, err)
+
+	metaDir := filepath.Join(rootDir, "streams", "v1")
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Len(t, index.Index, 3)
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud"}, index.Index["images"].Products)
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		entry, ok := index.Index["images-"+arch]
+		require.True(t, ok)
+		require.Equal(t, "streams/v1/images-"+arch+".json", entry.Path)
+		require.Equal(t, []string{"ubuntu:noble:" + arch + ":cloud"}, entry.Products)
+
+		catalog, err := shared.ReadJSONFile(filepath.Join(metaDir, "images-"+arch+".json"), &stream.ProductCatalog{})
+		require.NoError(t, err)
+		require.Len(t, catalog.Products, 1)
+		require.Contains(t, catalog.Products, "ubuntu:noble:"+arch+":cloud")
+		require.FileExists(t, filepath.Join(metaDir, "images-"+arch+".json.gz"))
+	}
+}
+
+func TestBuildIndex_CatalogHash(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+
+	// Ensure index entry contains the hash of the final catalog file.
+	hash, err := shared.FileHash(sha256.New(), filepath.Join(metaDir, "images.json"))
+	require.NoError(t, err)
+	require.Equal(t, hash, index.Index["images"].SHA256)
+}
+
+func TestBuildIndex_UpdatedOnChange(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	indexPath := filepath.Join(p.RootDir(), "streams", "v1", "index.json")
+	prevUpdated := "2024-01-01T00:00:00Z"
+
+	// setUpdated overwrites the update time of the stream's index entry.
+	setUpdated := func() {
+		index, err := shared.ReadJSONFile(indexPath, &stream.StreamIndex{})
+		require.NoError(t, err)
+
+		entry := index.Index["images"]
+		entry.Updated = prevUpdated
+		index.Index["images"] = entry
+
+		err = shared.WriteJSONFile(indexPath, index)
+		require.NoError(t, err)
+	}
+
+	getUpdated := func() string {
+		index, err := shared.ReadJSONFile(indexPath, &stream.StreamIndex{})
+		require.NoError(t, err)
+		return index.Index["images"].Updated
+	}
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	// Ensure update time is retained when the catalog is unchanged.
+	setUpdated()
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, prevUpdated, getUpdated())
+
+	// Ensure update time changes when a new version is added.
+	p2 := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p2.Create(t, p.RootDir())
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+	require.NotEqual(t, prevUpdated, getUpdated())
+}
+
+func TestBuildIndex_MergeEntries(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	streamNames := []string{"images", "images-daily", "images-minimal"}
+
+	for _, name := range streamNames {
+		p := testutils.MockProduct(name + "/ubuntu/noble/amd64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+		p.Create(t, rootDir)
+	}
+
+	// Build each stream concurrently, as separate maintainers would.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(streamNames))
+
+	for _, name := range streamNames {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			errs <- buildIndex(context.Background(), rootDir, "v1", []string{name}, 2, false)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	indexPath := filepath.Join(rootDir, "streams", "v1", "index.json")
+
+	// Ensure entries of all streams are merged into a single index.
+	index, err := shared.ReadJSONFile(indexPath, &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, streamNames, shared.MapKeys(index.Index))
+
+	for _, name := range streamNames {
+		require.Equal(t, "streams/v1/"+name+".json", index.Index[name].Path)
+		require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, index.Index[name].Products)
+	}
+
+	// Ensure per-architecture entries of the built stream are replaced,
+	// while the entries of other streams are retained.
+	index.Index["images-arm64"] = stream.StreamIndexEntry{Path: "streams/v1/images-arm64.json", Products: []string{"ubuntu:noble:arm64:cloud"}}
+	err = shared.WriteJSONFile(indexPath, index)
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, withSplitByArch(true))
+	require.NoError(t, err)
+
+	index, err = shared.ReadJSONFile(indexPath, &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"images", "images-amd64", "images-daily", "images-minimal"}, shared.MapKeys(index.Index))
+}
+
+func TestBuildIndex_Manifest(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").
+			WithFiles("lxd.tar.xz", "disk.qcow2").
+			SetImageConfig("simplestream:"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withManifest(true))
+	require.NoError(t, err)
+
+	manifestPath := filepath.Join(p.AbsPath(), "v1", stream.FileManifest)
+	content, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+
+	// Ensure all files are listed, including the ones not in the catalog.
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 3)
+
+	var names []string
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 3)
+		require.Len(t, parts, 3)
+
+		_, err := time.Parse(time.RFC3339, parts[1])
+		require.NoError(t, err)
+
+		names = append(names, parts[2])
+	}
+
+	require.Equal(t, []string{"disk.qcow2", stream.FileImageConfig, "lxd.tar.xz"}, names)
+	require.Contains(t, lines[0], "12 ")
+
+	// Ensure manifest is not rewritten if nothing has changed.
+	info, err := os.Stat(manifestPath)
+	require.NoError(t, err)
+
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(manifestPath, past, past)
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withManifest(true))
+	require.NoError(t, err)
+
+	newInfo, err := os.Stat(manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), newInfo.Size())
+	require.WithinDuration(t, past, newInfo.ModTime(), time.Second)
+}
+
+func TestBuildIndex_ManifestGeneratedFiles(t *testing.T) {
+	t.Parallel()
+
+	workRoot := t.TempDir()
+	sourceRoot := filepath.Join(workRoot, "mirror")
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, sourceRoot)
+
+	opts := []buildOption{
+		withSourceRoot(sourceRoot),
+		withWorkRoot(workRoot),
+		withDeltaDir("deltas"),
+		withManifest(true),
+	}
+
+	err := buildIndex(context.Background(), sourceRoot, "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	// Ensure manifest is written to the work root and lists both the source
+	// files and the generated delta files.
+	content, err := os.ReadFile(filepath.Join(workRoot, p.RelPath(), "v2", stream.FileManifest))
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(p.AbsPath(), "v2", stream.FileManifest))
+
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		parts := strings.SplitN(line, " ", 3)
+		require.Len(t, parts, 3)
+		names = append(names, parts[2])
+	}
+
+	require.Equal(t, []string{"disk.qcow2", "disk.v1.qcow2.vcdiff", "lxd.tar.xz"}, names)
+}
+
+func TestBuildIndex_PathRewrite(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	opts, err := (&buildOptions{PathRewrites: []string{"images=cdn/images/", "/streams/=cdn/streams"}}).buildOptions()
+	require.NoError(t, err)
+
+	// Build twice to ensure rewritten paths of the existing catalog are
+	// reverted when read.
+	for range 2 {
+		err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+		require.NoError(t, err)
+	}
+
+	index, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, "cdn/streams/v1/images.json", index.Index["images"].Path)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	items := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items
+	require.Len(t, items, 3)
+	require.Equal(t, "cdn/images/ubuntu/noble/amd64/cloud/v2/disk.qcow2", items["disk.qcow2"].Path)
+	require.Equal(t, "cdn/images/ubuntu/noble/amd64/cloud/v2/disk.v1.qcow2.vcdiff", items["disk.v1.qcow2.vcdiff"].Path)
+
+	// Ensure rewrite format is validated.
+	_, err = (&buildOptions{PathRewrites: []string{"images"}}).buildOptions()
+	require.Error(t, err)
+}
+
+func TestBuildIndex_IndexAllowlist(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	published := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	staged := testutils.MockProduct("images/newdistro/1.0/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	published.Create(t, rootDir)
+	staged.Create(t, rootDir)
+
+	allowlistPath := filepath.Join(t.TempDir(), "allowlist")
+	err := os.WriteFile(allowlistPath, []byte("# Published products\nubuntu:noble:amd64:cloud\n\n"), 0644)
+	require.NoError(t, err)
+
+	opts, err := (&buildOptions{IndexAllow: allowlistPath, SplitByArch: true}).buildOptions()
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, opts...)
+	require.NoError(t, err)
+
+	index, err := shared.ReadJSONFile(filepath.Join(rootDir, "streams", "v1", "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, index.Index["images"].Products)
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, index.Index["images-amd64"].Products)
+
+	// Ensure staged product is still part of the product catalog.
+	catalog, err := shared.ReadJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"ubuntu:noble:amd64:cloud", "newdistro:1.0:amd64:cloud"}, shared.MapKeys(catalog.Products))
+
+	// Ensure allowlist file must exist.
+	_, err = (&buildOptions{IndexAllow: filepath.Join(t.TempDir(), "missing")}).buildOptions()
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBuildIndex_MirrorBases(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	opts, err := (&buildOptions{
+		PublicBase:  "https://images.example.com",
+		MirrorBases: []string{"https://mirror1.example.com/", "/mirror2"},
+	}).buildOptions()
+	require.NoError(t, err)
+
+	// Build twice to ensure mirrors of the existing catalog are not
+	// duplicated.
+	for range 2 {
+		err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+		require.NoError(t, err)
+	}
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	item := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["disk.qcow2"]
+	require.Equal(t, "https://images.example.com/images/ubuntu/noble/amd64/cloud/v1/disk.qcow2", item.Path)
+	require.Equal(t, []string{
+		"https://mirror1.example.com/images/ubuntu/noble/amd64/cloud/v1/disk.qcow2",
+		"/mirror2/images/ubuntu/noble/amd64/cloud/v1/disk.qcow2",
+	}, item.Mirrors)
+
+	// Ensure mirrors are removed once no mirror base is configured.
+	opts, err = (&buildOptions{PublicBase: "https://images.example.com"}).buildOptions()
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	item = catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["disk.qcow2"]
+	require.Equal(t, "https://images.example.com/images/ubuntu/noble/amd64/cloud/v1/disk.qcow2", item.Path)
+	require.Empty(t, item.Mirrors)
+}
+
+func TestRewritePath(t *testing.T) {
+	t.Parallel()
+
+	rewrites := []pathRewrite{
+		{oldPrefix: "images", newPrefix: "cdn/images"},
+		{oldPrefix: "images/ubuntu", newPrefix: "ubuntu"},
+		{oldPrefix: "streams", newPrefix: ""},
+	}
+
+	tests := []struct {
+		Name    string
+		Path    string
+		Reverse bool
+		Want    string
+	}{
+		{Name: "Relative path", Path: "images/ubuntu/disk.qcow2", Want: "cdn/images/ubuntu/disk.qcow2"},
+		{Name: "Absolute path", Path: "/images/ubuntu/disk.qcow2", Want: "/cdn/images/ubuntu/disk.qcow2"},
+		{Name: "Partial element is not matched", Path: "images-daily/disk.qcow2", Want: "images-daily/disk.qcow2"},
+		{Name: "Prefix removed", Path: "streams/v1/images.json", Want: "v1/images.json"},
+		{Name: "Prefix removed from absolute path", Path: "/streams/v1/images.json", Want: "/v1/images.json"},
+		{Name: "Reverse", Path: "cdn/images/ubuntu/disk.qcow2", Reverse: true, Want: "images/ubuntu/disk.qcow2"},
+		{Name: "No match", Path: "other/disk.qcow2", Want: "other/disk.qcow2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.Equal(t, test.Want, rewritePath(test.Path, rewrites, test.Reverse))
+		})
+	}
+}
+
+func TestBuildIndex_Exclude(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	cloud := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+	cloud.Create(t, rootDir)
+
+	def := testutils.MockProduct("images/ubuntu/noble/amd64/default").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+	def.Create(t, rootDir)
+
+	readCatalog := func() *stream.ProductCatalog {
+		catalog, err := shared.ReadJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), &stream.ProductCatalog{})
+		require.NoError(t, err)
+		return catalog
+	}
+
+	err := buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false)
+	require.NoError(t, err)
+	require.Len(t, readCatalog().Products, 2)
+
+	// Ensure excluded product is removed from the existing catalog, but
+	// left on disk.
+	opts, err := (&buildOptions{ExcludeVariants: []string{"cloud"}}).buildOptions()
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, opts...)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ubuntu:noble:amd64:default"}, shared.MapKeysSorted(readCatalog().Products))
+	require.DirExists(t, cloud.AbsPath())
+
+	// Ensure excluded product is not removed as dangling.
+	past := time.Now().Add(-24 * time.Hour)
+	err = os.Chtimes(cloud.AbsPath(), past, past)
+	require.NoError(t, err)
+
+	err = pruneDanglingProductVersions(rootDir, "v1", "images", productFilter{variants: []string{"cloud"}}, nil)
+	require.NoError(t, err)
+	require.DirExists(t, cloud.AbsPath())
+
+	// Ensure the product is included again once it is no longer excluded.
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false)
+	require.NoError(t, err)
+	require.Len(t, readCatalog().Products, 2)
+}
+
+func TestBuildIndex_PostBuildHook(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	outPath := filepath.Join(t.TempDir(), "hook.out")
+
+	// Ensure hook receives paths of the written files.
+	hook := fmt.Sprintf("printf '%%s\\n' >%q", outPath)
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, true, withPostBuildHook(hook))
+	require.NoError(t, err)
+
+	out, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+	require.Equal(t, []string{
+		filepath.Join(metaDir, "images.json"),
+		filepath.Join(metaDir, "images.json.gz"),
+		filepath.Join(metaDir, "index.json"),
+		filepath.Join(metaDir, "index.json.gz"),
+		filepath.Join(p.RootDir(), "index.html"),
+	}, strings.Fields(string(out)))
+
+	// Ensure failing hook fails the build.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withPostBuildHook("false"))
+	require.ErrorContains(t, err, "Post build hook failed")
+}
+
+func TestImportIndex(t *testing.T) {
+	t.Parallel()
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  root.squashfs", testutils.ItemDefaultContentSHA),
+	}
+
+	// Build the remote server.
+	remote := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240101_0000").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "root.squashfs"),
+		testutils.MockVersion("20240601_0000").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	remote.Create(t, t.TempDir())
+
+	other := testutils.MockProduct("images/ubuntu/noble/amd64/desktop").AddVersions(
+		testutils.MockVersion("20240601_0000").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	other.Create(t, remote.RootDir())
+
+	err := buildIndex(context.Background(), remote.RootDir(), "v1", []string{remote.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(remote.RootDir())))
+	defer server.Close()
+
+	indexURL := server.URL + "/streams/v1/index.json"
+
+	// Import only recent versions of the cloud product.
+	rootDir := t.TempDir()
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	err = importIndex(context.Background(), indexURL, rootDir, "v1", []string{"ubuntu:noble:*:cloud"}, since, 2)
+	require.NoError(t, err)
+
+	catalogPath := filepath.Join(rootDir, "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"ubuntu:noble:amd64:cloud"}, shared.MapKeys(catalog.Products))
+
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.ElementsMatch(t, []string{"20240601_0000"}, shared.MapKeys(product.Versions))
+	require.Equal(t, testutils.ItemDefaultContentSHA, product.Versions["20240601_0000"].Items["root.squashfs"].SHA256)
+
+	// Ensure checksum file is written.
+	require.FileExists(t, filepath.Join(rootDir, "images/ubuntu/noble/amd64/cloud/20240601_0000", stream.FileChecksumSHA256))
+
+	// Ensure invalid index URL is rejected.
+	err = importIndex(context.Background(), server.URL+"/index.json", rootDir, "v1", nil, time.Time{}, 2)
+	require.ErrorContains(t, err, "must end with")
+}
+
+func TestImportIndex_InvalidVersions(t *testing.T) {
+	t.Parallel()
+
+	checksums := []string{
+		fmt.Sprintf("%s  lxd.tar.xz", testutils.ItemDefaultContentSHA),
+		fmt.Sprintf("%s  root.squashfs", testutils.ItemDefaultContentSHA),
+	}
+
+	remote := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240601_0000").SetChecksums(checksums...).WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	remote.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), remote.RootDir(), "v1", []string{remote.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	// Tamper with the remote catalog.
+	catalogPath := filepath.Join(remote.RootDir(), "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	valid := product.Versions["20240601_0000"]
+
+	// Version escaping the stream directory.
+	product.Versions["../../../../../escape"] = valid
+
+	// Item escaping the version directory.
+	escapingItem := stream.Version{Items: maps.Clone(valid.Items)}
+	escapingItem.Items["../evil"] = valid.Items["lxd.tar.xz"]
+	product.Versions["20240701_0000"] = escapingItem
+
+	// Item missing on the remote server.
+	missingItem := stream.Version{Items: maps.Clone(valid.Items)}
+	item := missingItem.Items["root.squashfs"]
+	item.Path += ".missing"
+	missingItem.Items["root.squashfs"] = item
+	product.Versions["20240801_0000"] = missingItem
+
+	catalog.Products["ubuntu:noble:amd64:cloud"] = product
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(remote.RootDir())))
+	defer server.Close()
+
+	baseDir := t.TempDir()
+	rootDir := filepath.Join(baseDir, "root")
+
+	// Ensure failed versions are reported, while the valid one is imported.
+	err = importIndex(context.Background(), server.URL+"/streams/v1/index.json", rootDir, "v1", nil, time.Time{}, 2)
+	require.ErrorContains(t, err, `Invalid path of version "../../../../../escape"`)
+	require.ErrorContains(t, err, `Invalid item name "../evil"`)
+	require.ErrorContains(t, err, `Failed to import version "20240801_0000"`)
+
+	catalog, err = shared.ReadJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"20240601_0000"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+
+	// Ensure nothing is written outside of the root directory.
+	entries, err := os.ReadDir(baseDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	productDir := filepath.Join(rootDir, "images", "ubuntu", "noble", "amd64", "cloud")
+	entries, err = os.ReadDir(productDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestCollectStats(t *testing.T) {
+	t.Parallel()
+
+	sha := "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240101_0000").
+			WithFiles("lxd.tar.xz", "disk.qcow2").
+			SetChecksums(sha+"  lxd.tar.xz", sha+"  disk.qcow2"),
+		testutils.MockVersion("20240301_0000").
+			WithFiles("lxd.tar.xz", "disk.qcow2", "20240101_0000.qcow2.vcdiff").
+			SetChecksums(sha+"  lxd.tar.xz"),
+		testutils.MockVersion("20240401_0000").
+			WithFiles("lxd.tar.xz"))
+
+	p.Create(t, t.TempDir())
+
+	stats, err := collectStats(p.RootDir(), p.StreamName())
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+
+	size, err := shared.DirSize(p.AbsPath())
+	require.NoError(t, err)
+
+	require.Equal(t, productStats{
+		Stream:      "images",
+		ID:          "ubuntu:noble:amd64:cloud",
+		Versions:    2,
+		Size:        size,
+		OldestBuild: "2024-01-01",
+		NewestBuild: "2024-03-01",
+		Deltas:      true,
+		Warnings: []string{
+			`Item "disk.qcow2" in version "20240301_0000" is missing from the checksum file`,
+			`Version "20240401_0000" is incomplete or invalid`,
+		},
+	}, stats[0])
+
+	// Ensure both output formats are written.
+	var out strings.Builder
+
+	err = writeStats(&out, stats, "text")
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "ubuntu:noble:amd64:cloud")
+	require.Contains(t, out.String(), "Warning: ubuntu:noble:amd64:cloud: Version")
+
+	out.Reset()
+
+	err = writeStats(&out, stats, "json")
+	require.NoError(t, err)
+
+	var got []productStats
+	err = json.Unmarshal([]byte(out.String()), &got)
+	require.NoError(t, err)
+	require.Equal(t, stats, got)
+}
+
+func TestScanProducts(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p1 := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	p2 := testutils.MockProduct("images/ubuntu/noble/arm64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("disk.qcow2"))
+
+	p1.Create(t, rootDir)
+	p2.Create(t, rootDir)
+
+	scans, err := scanProducts(rootDir, "images")
+	require.NoError(t, err)
+	require.Equal(t, []productScan{
+		{
+			Stream:     "images",
+			ID:         "ubuntu:noble:amd64:cloud",
+			Complete:   []string{"v1", "v3"},
+			Incomplete: []string{"v2"},
+		},
+		{
+			Stream:     "images",
+			ID:         "ubuntu:noble:arm64:cloud",
+			Complete:   []string{},
+			Incomplete: []string{"v1"},
+		},
+	}, scans)
+
+	// Ensure no catalog is written.
+	require.NoDirExists(t, filepath.Join(rootDir, "streams"))
+
+	var out strings.Builder
+
+	err = writeScan(&out, scans, "text")
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "ubuntu:noble:amd64:cloud  v1, v3")
+}
+
+// TestPruneOldVersions tests removal of old versions from directory hierarchy.
+func TestPruneOldVersions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name                string
+		Mock                testutils.ProductMock
+		RetainBuilds        int
+		RetainDays          int
+		MinComplete         int
+		RetainPolicy        string
+		WantErrString       string
+		WantVersions        []string // Expected versions in directory tree.
+		WantCatalogVersions []string // Expected versions in final product catalog.
+	}{
+		{
+			Name:          "Validation | Retain number too low",
+			RetainBuilds:  0,
+			WantErrString: "At least 1 product version build must be retained",
+		},
+		{
+			Name: "Ensure no error on empty product catalog",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddProductCatalog(),
+			RetainBuilds:        1,
+			WantVersions:        []string{},
+			WantCatalogVersions: []string{},
+		},
+		{
+			Name: "Ensure exact number of versions is kept",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					testutils.MockVersion("02").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					testutils.MockVersion("03").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2")).
+				AddProductCatalog(),
+			RetainBuilds:        3,
+			WantVersions:        []string{"01", "02", "03"},
+			WantCatalogVersions: []string{"01", "02", "03"},
+		},
+		{
+			Name: "Ensure the given number of product versions is retained",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					testutils.MockVersion("2024_01_05").WithFiles("lxd.tar.xz", "root.squashfs"),
+					testutils.MockVersion("2024_05_01").WithFiles("lxd.tar.xz", "disk.squashfs"),
+					testutils.MockVersion("2025_01_01").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog(),
+			RetainBuilds:        3,
+			WantVersions:        []string{"2024_01_05", "2024_05_01", "2025_01_01"},
+			WantCatalogVersions: []string{"2024_01_05", "2024_05_01", "2025_01_01"},
+		},
+		{
+			Name: "Ensure only complete versions are retained",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz"),                                // Incomplete
+					testutils.MockVersion("2024_01_02").WithFiles("lxd.tar.xz", "root.squashfs"),               // Complete
+					testutils.MockVersion("2024_01_03").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"), // Complete
+					testutils.MockVersion("2024_01_04").WithFiles("root.squashfs"),                             // Incomplete
+					testutils.MockVersion("2024_01_05").WithFiles("lxd.tar.xz", "disk.qcow2"),                  // Complete
+					testutils.MockVersion("2024_01_06").WithFiles("disk.qcow2")).                               // Incomplete
+				AddProductCatalog(),
+			RetainBuilds:        2,
+			WantVersions:        []string{"2024_01_03", "2024_01_05"},
+			WantCatalogVersions: []string{"2024_01_03", "2024_01_05"},
+		},
+		{
+			Name: "Ensure only referenced versions are prunned",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog().
+				AddVersions(
+					testutils.MockVersion("2027").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2028").WithFiles("lxd.tar.xz", "disk.qcow2")),
+			RetainBuilds:        2,
+			WantVersions:        []string{"2025", "2026", "2027", "2028"},
+			WantCatalogVersions: []string{"2025", "2026"},
+		},
+		{
+			Name: "Ensure versions older then retainDays are prunned",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(3*24*time.Hour), // 3 days
+					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(3*24*time.Hour),
+					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				).
+				AddProductCatalog(),
+			RetainBuilds:        3,
+			RetainDays:          2,
+			WantVersions:        []string{"2025", "2026"},
+			WantCatalogVersions: []string{"2025", "2026"},
+		},
+		{
+			Name: "Ensure all versions older then retainDays are prunned",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				).
+				AddProductCatalog().
+				SetFilesAge(12 * 24 * time.Hour), // 12 days
+			RetainBuilds:        2,
+			RetainDays:          10,
+			WantVersions:        []string{},
+			WantCatalogVersions: []string{},
+		},
+		{
+			Name: "Ensure minimum number of complete versions is retained",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2023").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2024").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2025").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2026").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				).
+				AddProductCatalog().
+				SetFilesAge(12 * 24 * time.Hour), // 12 days
+			RetainBuilds:        1,
+			RetainDays:          10,
+			MinComplete:         2,
+			WantVersions:        []string{"2025", "2026"},
+			WantCatalogVersions: []string{"2025", "2026"},
+		},
+		{
+			Name: "Ensure newest version per period is retained by the retention policy",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("20240301_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240410_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240415_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240520_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240530_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240531_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240601_0600").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240601_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				).
+				AddProductCatalog(),
+			RetainBuilds:        1,
+			RetainDays:          1,
+			RetainPolicy:        "daily=2,weekly=2,monthly=*",
+			WantVersions:        []string{"20240301_1200", "20240415_1200", "20240520_1200", "20240531_1200", "20240601_1200"},
+			WantCatalogVersions: []string{"20240301_1200", "20240415_1200", "20240520_1200", "20240531_1200", "20240601_1200"},
+		},
+		{
+			Name: "Ensure limited number of periods is retained by the retention policy",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("20220101_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20230101_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20231231_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("20240101_1200").WithFiles("lxd.tar.xz", "disk.qcow2"),
+				).
+				AddProductCatalog(),
+			RetainBuilds:        10,
+			RetainPolicy:        "yearly=2",
+			WantVersions:        []string{"20231231_1200", "20240101_1200"},
+			WantCatalogVersions: []string{"20231231_1200", "20240101_1200"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			p := test.Mock
+			p.Create(t, t.TempDir())
+
+			policy, err := parseRetainPolicy(test.RetainPolicy)
+			require.NoError(t, err)
+
+			err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), test.RetainBuilds, test.RetainDays, test.MinComplete, policy, 2, nil)
+			if test.WantErrString == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.WantErrString)
+				return
+			}
+
+			product, err := stream.GetProduct(p.RootDir(), p.RelPath())
+			require.NoError(t, err)
+
+			// Ensure expected product versions are found in directory tree.
+			require.ElementsMatch(t, test.WantVersions, shared.MapKeys(product.Versions), "Mismatch between expected product versions and the directory tree")
+
+			// Ensure expected product versions are found in final product catalog.
+			catalogPath := filepath.Join(p.RootDir(), "streams", "v1", fmt.Sprintf("%s.json", p.StreamName()))
+			catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+			require.NoError(t, err)
+
+			if len(test.WantCatalogVersions) == 0 {
+				// There must be no products in catalog, if no product versions
+				// are expected.
+				require.Empty(t, shared.MapKeys(catalog.Products))
+			} else {
+				productID := strings.Join(strings.Split(p.RelPath(), "/")[1:], ":")
+				require.ElementsMatch(t, []string{productID}, shared.MapKeys(catalog.Products), "Mismatch between expected products and the product catalog")
+				require.ElementsMatch(t, test.WantCatalogVersions, shared.MapKeys(catalog.Products[productID].Versions), "Mismatch between expected product versions and the product catalog")
+			}
+		})
+	}
+}
+
+func TestRemoveAllConcurrently(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	var paths []string
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("v%d", i))
+		require.NoError(t, os.MkdirAll(filepath.Join(path, "nested"), os.ModePerm))
+		paths = append(paths, path)
+	}
+
+	// Invalid path must not prevent removal of other paths.
+	paths = append(paths[:5], append([]string{"invalid\x00path"}, paths[5:]...)...)
+
+	err := removeAllConcurrently(context.Background(), paths, 3)
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestParseRetainPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := parseRetainPolicy("")
+	require.NoError(t, err)
+	require.Empty(t, policy)
+
+	policy, err = parseRetainPolicy("daily=7, weekly=4,monthly=*")
+	require.NoError(t, err)
+	require.Equal(t, retainPolicy{
+		{period: retainPeriodDaily, count: 7},
+		{period: retainPeriodWeekly, count: 4},
+		{period: retainPeriodMonthly, count: -1},
+	}, policy)
+
+	for _, spec := range []string{"daily", "hourly=1", "daily=0", "weekly=-1", "monthly=x"} {
+		_, err := parseRetainPolicy(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestPruneDanglingResources(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name         string
+		Mock         testutils.ProductMock
+		WantProducts map[string][]string // product: list of versions
+	}{
+		{
+			Name: "Ensure no error on empty product catalog",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddProductCatalog(),
+			WantProducts: map[string][]string{},
+		},
+		{
+			Name: "Ensure referenced product version is not removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2")).
+				AddProductCatalog(),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"1.0",
+				},
+			},
+		},
+		{
+			Name: "Ensure referenced product version older then 1 day is not removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog().
+				SetFilesAge(24 * time.Hour),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"1.0",
+				},
+			},
+		},
+		{
+			Name: "Ensure fresh unreferenced product version is not removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog().
+				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz", "root.squashfs")),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"1.0",
+					"2.0",
+				},
+			},
+		},
+		{
+			Name: "Ensure unreferenced old product version is removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog().
+				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz", "root.squashfs")).
+				SetFilesAge(24 * time.Hour),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"1.0",
+				},
+			},
+		},
+		{
+			Name: "Ensure unreferenced old incomplete product version is removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
+				AddProductCatalog().
+				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz")).
+				SetFilesAge(24 * time.Hour),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"1.0",
+				},
+			},
+		},
+		{
+			Name: "Ensure unreferenced old product is not removed when product catalog is not empty",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddProductCatalog().
+				AddVersions(testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs")).
+				SetFilesAge(24 * time.Hour),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"2024_01_01",
+				},
+			},
+		},
+		{
+			Name: "Ensure only unreferenced project versions are removed",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+				AddVersions(
+					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2024_01_02").WithFiles("lxd.tar.xz", "root.squashfs")).
+				AddProductCatalog().
+				AddVersions(
+					testutils.MockVersion("2024_01_03").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					testutils.MockVersion("2024_01_04").WithFiles("lxd.tar.xz", "root.squashfs")).
+				SetFilesAge(48 * time.Hour),
+			WantProducts: map[string][]string{
+				"ubuntu:noble:amd64:cloud": {
+					"2024_01_01",
+					"2024_01_02",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			p := test.Mock
+			p.Create(t, t.TempDir())
+
+			err := pruneDanglingProductVersions(p.RootDir(), "v1", p.StreamName(), productFilter{}, nil)
+			require.NoError(t, err)
+
+			products, err := stream.GetProducts(p.RootDir(), p.StreamName(), stream.WithIncompleteVersions(true))
+			require.NoError(t, err)
+
+			// Ensure all expected products are found.
+			require.Equal(t, shared.MapKeys(test.WantProducts), shared.MapKeys(products))
+
+			// Ensure all expected product versions are found.
+			for pid, p := range products {
+				require.ElementsMatch(t, test.WantProducts[pid], shared.MapKeys(p.Versions))
+			}
+		})
+	}
+}
+
+func TestBuildIndexAndPrune_Steps(t *testing.T) {
+	t.Parallel()
+
+	type ProductMeta struct {
+		Requirements map[string]string
+		Aliases      string
+	}
+
+	type Step struct {
+		MockVersions    []testutils.VersionMock
+		WantVersions    map[string][]string // Expected versions and their items (in dir hierarchy).
+		WantProductMeta *ProductMeta        // Expected product metadata.
+	}
+
+	tests := []struct {
+		Name           string
+		Steps          []Step
+		WithIncomplete bool
+	}{
+		{
+			Name: "Calculate deltas for new versions",
+			Steps: []Step{
+				{
+					// Step 0
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						"v1": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+					},
+				},
+				{
+					// Step 1
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						"v1": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+						"v3": {"lxd.tar.xz", "root.squashfs", "disk.qcow2", "root.v1.vcdiff", "disk.v1.qcow2.vcdiff"},
+					},
+				},
+				{
+					// Step 2
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+						testutils.MockVersion("v5").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						// "v1": Pruned (retain = 3).
+						"v2": {"lxd.tar.xz", "disk.qcow2", "disk.v1.qcow2.vcdiff"},
+						"v3": {"lxd.tar.xz", "root.squashfs", "disk.qcow2", "root.v1.vcdiff", "disk.v1.qcow2.vcdiff", "disk.v2.qcow2.vcdiff"},
+						"v5": {"lxd.tar.xz", "disk.qcow2", "disk.v3.qcow2.vcdiff"},
+					},
+				},
+			},
+		},
+		{
+			Name:           "Incomplete versions",
+			WithIncomplete: true,
+			Steps: []Step{
+				{
+					// Step 0: Valid version.
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v0").
+							WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+					},
+				},
+				{
+					// Step 1: Old incomplete version (missing rootfs).
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v1").WithFiles("lxd.tar.xz").WithAge(24 * time.Hour),
+					},
+					WantVersions: map[string][]string{
+						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+					},
+				},
+				{
+					// Step 2: Old incomplete version (hidden).
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion(".v2").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(24 * time.Hour),
+					},
+					WantVersions: map[string][]string{
+						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+					},
+				},
+				{
+					// Step 3: New incomplete version (hidden).
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion(".v3").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						"v0":  {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+						".v3": {"lxd.tar.xz", "disk.qcow2"}, // Incomplete, but not removed.
+					},
+				},
+				{
+					// Step 4: Valid version.
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v4").WithFiles("lxd.tar.xz", "disk.qcow2"),
+					},
+					WantVersions: map[string][]string{
+						"v0":  {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
+						".v3": {"lxd.tar.xz", "disk.qcow2"},
+						"v4":  {"lxd.tar.xz", "disk.qcow2", "disk.v0.qcow2.vcdiff"},
+					},
+				},
+			},
+		},
+		{
+			Name: "Ensure config from last version is applied",
+			Steps: []Step{
+				{
+					// Step 0: Initial version.
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v2").
+							WithFiles("lxd.tar.xz", "disk.qcow2").
+							SetImageConfig(
+								"simplestream:",
+								"  requirements:",
+								"  - requirements:",
+								"      secure_boot: false",
+							),
+					},
+					WantProductMeta: &ProductMeta{
+						Aliases:      "ubuntu/noble/cloud",
+						Requirements: map[string]string{"secure_boot": "false"},
+					},
+				},
+				{
+					// Step 1: Add older version
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v1").
+							WithFiles("lxd.tar.xz", "disk.qcow2").
+							SetImageConfig(
+								"simplestream:",
+								"  requirements:",
+								"  - requirements:",
+								"      req: failnow",
+							),
+					},
+					WantProductMeta: &ProductMeta{
+						Aliases:      "ubuntu/noble/cloud",
+						Requirements: map[string]string{"secure_boot": "false"},
+					},
+				},
+				{
+					// Step 2: Ensure config from last version is applied.
+					MockVersions: []testutils.VersionMock{
+						testutils.MockVersion("v2").
+							WithFiles("lxd.tar.xz", "disk.qcow2").
+							SetImageConfig(
+								"simplestream:",
+								"  requirements:",
+								"  - requirements:",
+								"      secure_boot: true",
+							),
+						testutils.MockVersion("v3").
+							WithFiles("lxd.tar.xz", "disk.qcow2").
+							SetImageConfig(
+								"simplestream:",
+								"  release_aliases:",
+								"    noble: 24",
+							),
+					},
+					WantProductMeta: &ProductMeta{
+						Aliases:      "ubuntu/noble/cloud,ubuntu/24/cloud",
+						Requirements: map[string]string{},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+
+			streamName := "images"
+			streamVersion := "v99"
+			productID := "ubuntu:noble:amd64:cloud"
+			productRelPath := "images/ubuntu/noble/amd64/cloud"
+
+			global := &globalOptions{
+				ctx: context.Background(),
+			}
+
+			buildOpts := buildOptions{
+				global:        global,
+				StreamVersion: streamVersion,
+				ImageDirs:     []string{streamName},
+				Workers:       2,
+			}
+
+			pruneOpts := pruneOptions{
+				global:        global,
+				StreamVersion: streamVersion,
+				ImageDirs:     []string{streamName},
+				Dangling:      true,
+				RetainBuilds:  3,
+			}
+
+			// Run each step within a test case. Each step first mocks the product
+			// with given versions and then runs the build and prune commands.
+			for i, step := range test.Steps {
+				p := testutils.MockProduct(productRelPath).AddVersions(step.MockVersions...)
+				p.Create(t, tmpDir)
+
+				// Build.
+				err := buildOpts.Run(nil, []string{tmpDir})
+				require.NoErrorf(t, err, "[ Step %d ] Failed running build command!", i)
+
+				// Prune.
+				err = pruneOpts.Run(nil, []string{tmpDir})
+				require.NoErrorf(t, err, "[ Step %d ] Failed running prune command!", i)
+
+				if step.WantProductMeta != nil {
+					catalog, _, err := buildProductCatalog(context.Background(), tmpDir, streamVersion, streamName, 2)
+					require.NoErrorf(t, err, "[ Step %d ] Failed building product catalog!", i)
+
+					product, ok := catalog.Products[productID]
+					require.Truef(t, ok, "[ Step %d ] Product not found in the product catalog!", i)
+
+					// Ensure product metadata matches the expected values.
+					require.Equalf(t, step.WantProductMeta.Requirements, product.Requirements, "[ Step %d ] Requirements mismatch!", i)
+					require.Equalf(t, step.WantProductMeta.Aliases, product.Aliases, "[ Step %d ] Aliases mismatch!", i)
+				}
+
+				if len(step.WantVersions) > 0 {
+					products, err := stream.GetProducts(tmpDir, streamName, stream.WithIncompleteVersions(test.WithIncomplete))
+					require.NoErrorf(t, err, "[ Step %d ] Failed to retrieve products!", i)
+
+					product, ok := products[productID]
+					require.Truef(t, ok, "[ Step %d ] Product not found in directory structure!", i)
+
+					// Ensure product contains all expected versions.
+					require.ElementsMatch(t,
+						shared.MapKeys(step.WantVersions),
+						shared.MapKeys(product.Versions),
+						"[ Step %d ] Versions mismatch!", i)
+
+					for versionName, wantItems := range step.WantVersions {
+						version, ok := product.Versions[versionName]
+						require.True(t, ok, "[ Step %d ] Version %q not found within resulting product %q!", i, versionName, productID)
+
+						// Ensure each version contains all expected items.
+						require.ElementsMatchf(t, wantItems, shared.MapKeys(version.Items),
+							"[ Step %d ] Items mismatch for version %q!", i, versionName)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		TestName     string
+		Structure    []string // Created before test. Suffix "/" represents directory.
+		ExpectRemove []string
+		ExpectExists []string
+	}{
+		{
+			TestName:     "Test non-empty dir",
+			Structure:    []string{"root/file"},
+			ExpectExists: []string{"root"},
+		},
+		{
+			TestName:     "Test empty dir",
+			Structure:    []string{"root/"},
+			ExpectRemove: []string{"root"},
+		},
+		{
+			TestName:     "Test nested empty dirs",
+			Structure:    []string{"root/parent/child/empty/"},
+			ExpectRemove: []string{"root"},
+		},
+		{
+			TestName: "Test partial parent removal",
+			Structure: []string{
+				"root/parent/empty/",
+				"root/file",
+			},
+			ExpectRemove: []string{"root/parent"},
+			ExpectExists: []string{"root"},
+		},
+		{
+			TestName: "Test multiple dirs",
+			Structure: []string{
+				"root/parent-1/child-1/empty/",
+				"root/parent-1/child-2/",
+				"root/parent-2/child-1/empty/",
+				"root/parent-2/child-2/",
+				"root/parent-2/file",
+				"root/parent-3/child-1/non-empty/file",
+			},
+			ExpectRemove: []string{
+				"root/parent-1",
+				"root/parent-2/child-1",
+				"root/parent-2/child-2",
+				"root/parent-2/child-3",
+			},
+			ExpectExists: []string{
+				"root/parent-2",
+				"root/parent-3/child-1/non-empty/",
+			},
+		},
+		{
+			TestName: "Test unclean dirs",
+			Structure: []string{
+				"root1/./file",
+				"root2/../root2/file",
+				"root3/../root3/gone/",
+				"/root4/file",
+				"//root5//.//..//root5//empty///file",
+			},
+			ExpectExists: []string{
+				"root1",
+				"root2",
+				"root4",
+				"root5/empty",
+			},
+			ExpectRemove: []string{
+				"root3/gone",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.TestName, func(t *testing.T) {
+			tmpDir := t.TempDir()
+
+			// Ensure all expected directories and files exist.
+			for _, f := range test.Structure {
+				path := filepath.Join(tmpDir, f)
+
+				if strings.HasSuffix(f, "/") {
+					err := os.MkdirAll(path, os.ModePerm)
+					require.NoError(t, err, "Failed creating temporary directory")
+				} else {
+					err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+					require.NoError(t, err, "Failed creating temporary directory")
+
+					err = os.WriteFile(path, []byte{}, os.ModePerm)
+					require.NoError(t, err, "Failed creating temporary file")
+				}
+			}
+
+			err := pruneEmptyDirs(tmpDir, true)
+			require.NoError(t, err)
+
+			// Check expected remaining directories.
+			for _, f := range test.ExpectExists {
+				path := filepath.Join(tmpDir, f)
+				require.DirExists(t, path, "Directory (or file) was unexpectedly pruned!")
+			}
+
+			// Check expected removed directories.
+			for _, f := range test.ExpectRemove {
+				path := filepath.Join(tmpDir, f)
+				require.NoDirExists(t, path, "Directory was expected to be pruned, but still exists!")
+			}
+		})
+	}
+}
+
+func TestPruneEmptyDirs_KeepRoot(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		FullPath string
+		RootPath string
+	}{
+		{
+			Name:     "Test empty dir itself",
+			FullPath: "root",
+			RootPath: "root",
+		},
+		{
+			Name:     "Test nested empty dirs",
+			FullPath: "root/child",
+			RootPath: "root",
+		},
+		{
+			Name:     "Test unclean: Double slashed",
+			FullPath: "root///child//",
+			RootPath: "//root///",
+		},
+		{
+			Name:     "Test unclean: Self-reference",
+			FullPath: "root/././child/./.",
+			RootPath: "./root/./././",
+		},
+		{
+			Name:     "Test unclean: Redundant change dir",
+			FullPath: "root/child/../../root/child/../child",
+			RootPath: "root/../root",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+
+			// Merge using Sprintf to preserve unclean paths.
+			fullPath := fmt.Sprintf("%s/%s", tmpDir, test.FullPath)
+			rootPath := fmt.Sprintf("%s/%s", tmpDir, test.RootPath)
+
+			// Create a chain of direcories.
+			err := os.MkdirAll(fullPath, os.ModePerm)
+			require.NoError(t, err)
+
+			// Prune empty dirs within rootPath.
+			err = pruneEmptyDirs(rootPath, true)
+			require.NoError(t, err)
+
+			// Ensure rootPath directory still exists.
+			expectPath := filepath.Join(tmpDir, "root")
+			require.DirExists(t, expectPath)
+		})
+	}
+}
+
+func TestDiffProducts(t *testing.T) {
+	t.Parallel()
+
+	type mapP map[string]stream.Product
+	type mapV map[string]stream.Version
+	type mapI map[string]stream.Item
+
+	tests := []struct {
+		Name    string
+		Old     map[string]stream.Product
+		New     map[string]stream.Product
+		WantOld map[string]stream.Product // Missing in New
+		WantNew map[string]stream.Product // Missing in Old
+	}{
+		{
+			Name:    "Products | Equal",
+			Old:     mapP{"p1": {}},
+			New:     mapP{"p1": {}},
+			WantOld: mapP{},
+			WantNew: mapP{},
+		},
+		{
+			Name:    "Products | Add",
+			Old:     mapP{},
+			New:     mapP{"p1": {}},
+			WantOld: mapP{},
+			WantNew: mapP{"p1": {}},
+		},
+		{
+			Name:    "Products | Remove",
+			Old:     mapP{"p1": {}},
+			New:     mapP{},
+			WantOld: mapP{"p1": {}},
+			WantNew: mapP{},
 		},
 		{
-			Name: "Ensure referenced product version older then 1 day is not removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog().
-				SetFilesAge(24 * time.Hour),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"1.0",
-				},
-			},
+			Name:    "Products | Replace",
+			Old:     mapP{"p1": {}},
+			New:     mapP{"p2": {}},
+			WantOld: mapP{"p1": {}},
+			WantNew: mapP{"p2": {}},
 		},
 		{
-			Name: "Ensure fresh unreferenced product version is not removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog().
-				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz", "root.squashfs")),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"1.0",
-					"2.0",
-				},
-			},
+			Name:    "Versions | Equal",
+			Old:     mapP{"p1": {Versions: mapV{"v1": {}, "v2": {}}}},
+			New:     mapP{"p1": {Versions: mapV{"v1": {}, "v2": {}}}},
+			WantOld: mapP{},
+			WantNew: mapP{},
 		},
 		{
-			Name: "Ensure unreferenced old product version is removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog().
-				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz", "root.squashfs")).
-				SetFilesAge(24 * time.Hour),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"1.0",
-				},
-			},
+			Name:    "Versions | Add",
+			Old:     mapP{"p": {Versions: mapV{"v1": {}}}},
+			New:     mapP{"p": {Versions: mapV{"v1": {}, "v2": {}}}},
+			WantOld: mapP{},
+			WantNew: mapP{"p": {Versions: mapV{"v2": {}}}},
 		},
 		{
-			Name: "Ensure unreferenced old incomplete product version is removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "disk.qcow2")).
-				AddProductCatalog().
-				AddVersions(testutils.MockVersion("2.0").WithFiles("lxd.tar.xz")).
-				SetFilesAge(24 * time.Hour),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"1.0",
-				},
-			},
+			Name:    "Versions | Remove",
+			Old:     mapP{"p": {Versions: mapV{"v1": {}, "v2": {}}}},
+			New:     mapP{"p": {Versions: mapV{"v1": {}}}},
+			WantOld: mapP{"p": {Versions: mapV{"v2": {}}}},
+			WantNew: mapP{},
 		},
 		{
-			Name: "Ensure unreferenced old product is not removed when product catalog is not empty",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddProductCatalog().
-				AddVersions(testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs")).
-				SetFilesAge(24 * time.Hour),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"2024_01_01",
-				},
-			},
+			Name:    "Versions | Replace",
+			Old:     mapP{"p": {Versions: mapV{"v1": {}}}},
+			New:     mapP{"p": {Versions: mapV{"v2": {}}}},
+			WantOld: mapP{"p": {Versions: mapV{"v1": {}}}},
+			WantNew: mapP{"p": {Versions: mapV{"v2": {}}}},
 		},
 		{
-			Name: "Ensure only unreferenced project versions are removed",
-			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
-				AddVersions(
-					testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2024_01_02").WithFiles("lxd.tar.xz", "root.squashfs")).
-				AddProductCatalog().
-				AddVersions(
-					testutils.MockVersion("2024_01_03").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					testutils.MockVersion("2024_01_04").WithFiles("lxd.tar.xz", "root.squashfs")).
-				SetFilesAge(48 * time.Hour),
-			WantProducts: map[string][]string{
-				"ubuntu:noble:amd64:cloud": {
-					"2024_01_01",
-					"2024_01_02",
+			Name: "Products and versions | Ensure metadata is preseverd",
+			Old: mapP{
+				"eql": {Aliases: "eql", Versions: mapV{"v1": {}}},
+				"old": {Aliases: "old", Versions: mapV{"v1": {}}},
+				"mod": {
+					Aliases: "---",
+					Versions: mapV{
+						"eql": {},
+						"old": {},
+						"mod": {Items: mapI{"old": {}}},
+					},
+				},
+			},
+			New: mapP{
+				"eql": {Aliases: "eql", Versions: mapV{"v1": {}}},
+				"new": {Aliases: "new", Versions: mapV{"v1": {}}},
+				"mod": {
+					Aliases: "+++",
+					Versions: mapV{
+						"eql": {},
+						"new": {},
+						"mod": {Items: mapI{"new": {}}},
+					},
 				},
 			},
+			WantOld: mapP{
+				"old": {Aliases: "old", Versions: mapV{"v1": {}}},
+				"mod": {Aliases: "---", Versions: mapV{"old": {}}},
+			},
+			WantNew: mapP{
+				"new": {Aliases: "new", Versions: mapV{"v1": {}}},
+				"mod": {Aliases: "+++", Versions: mapV{"new": {}}},
+			},
 		},
 	}
 
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			p := test.Mock
-			p.Create(t, t.TempDir())
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			old, new := diffProducts(test.Old, test.New)
+			require.Equal(t, test.WantOld, old, "Mismatch in diffed OLD products!")
+			require.Equal(t, test.WantNew, new, "Mismatch in diffed NEW products!")
+		})
+	}
+}
+
+func TestBuildIndex_AuxFiles(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2", "build.log", "definition.yaml", "notes.txt"))
+
+	p.Create(t, t.TempDir())
+
+	opts, err := (&buildOptions{AuxFiles: true, AuxFileNames: []string{"build.log", "*.yaml"}, PublicBase: "https://cdn.example.com"}).buildOptions()
+	require.NoError(t, err)
+
+	// Build twice to ensure paths of the existing auxiliary files are
+	// reverted when read.
+	for range 2 {
+		err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+		require.NoError(t, err)
+	}
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	version := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"]
+	require.Len(t, version.Items, 2)
+	require.Len(t, version.AuxFiles, 2)
+
+	aux := version.AuxFiles["build.log"]
+	require.Equal(t, "https://cdn.example.com/images/ubuntu/noble/amd64/cloud/v1/build.log", aux.Path)
+	require.Equal(t, testutils.ItemDefaultContentSHA, aux.SHA256)
+	require.Equal(t, "build.log", aux.Ftype)
+	require.Contains(t, version.AuxFiles, "definition.yaml")
+
+	// Ensure auxiliary files are not recorded unless enabled.
+	opts, err = (&buildOptions{AuxFileNames: []string{"build.log"}}).buildOptions()
+	require.NoError(t, err)
+
+	p2 := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2", "build.log"))
+
+	p2.Create(t, t.TempDir())
+
+	err = buildIndex(context.Background(), p2.RootDir(), "v1", []string{p2.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(filepath.Join(p2.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Empty(t, catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].AuxFiles)
+}
+
+func TestBuildWebPage(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240530_1200").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	// Ensure missing catalog is reported.
+	err := buildWebPage(p.RootDir(), "v1", p.StreamName())
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(p.RootDir(), "index.html"))
+
+	err = buildWebPage(p.RootDir(), "v1", p.StreamName())
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(p.RootDir(), "index.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "/images/ubuntu/noble/amd64/cloud/20240530_1200")
+}
+
+func TestBuildWebPage_RecentVersions(t *testing.T) {
+	t.Parallel()
+
+	versions := make([]testutils.VersionMock, 0, webpage.RecentVersions+2)
+	for i := range webpage.RecentVersions + 2 {
+		versions = append(versions, testutils.MockVersion(fmt.Sprintf("202405%02d_1200", i+1)).WithFiles("lxd.tar.xz", "disk.qcow2"))
+	}
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(versions...)
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, true)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(p.RootDir(), "index.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "Show all (7)")
+	require.NotContains(t, string(content), "/images/ubuntu/noble/amd64/cloud/20240501_1200")
+
+	// Ensure all versions are listed when requested.
+	err = buildWebPage(p.RootDir(), "v1", p.StreamName(), webpage.WithAllVersions(true))
+	require.NoError(t, err)
+
+	content, err = os.ReadFile(filepath.Join(p.RootDir(), "index.html"))
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "Show all")
+	require.Contains(t, string(content), "/images/ubuntu/noble/amd64/cloud/20240501_1200")
+}
+
+func TestBuildWebPage_Stale(t *testing.T) {
+	t.Parallel()
+
+	oldVersion := testNow.AddDate(0, 0, -10).Format("20060102_1504")
+	newVersion := testNow.AddDate(0, 0, -3).Format("20060102_1504")
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion(oldVersion).WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion(newVersion).WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	// Ensure only the old version is stale by default.
+	page := webpage.NewWebPage(*catalog)
+	require.Equal(t, webpage.DefaultStaleDays, page.StaleDays)
+	require.Len(t, page.Images, 1)
+	require.False(t, page.Images[0].IsStale)
+	require.False(t, page.Images[0].Versions[0].IsStale)
+	require.True(t, page.Images[0].Versions[1].IsStale)
+
+	// Ensure product is stale once its newest version is stale.
+	page = webpage.NewWebPage(*catalog, webpage.WithStaleDays(2))
+	require.True(t, page.Images[0].IsStale)
+	require.True(t, page.Images[0].Versions[0].IsStale)
+
+	// Ensure stale badge is rendered.
+	err = buildWebPage(p.RootDir(), "v1", p.StreamName())
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(p.RootDir(), "index.html"))
+	require.NoError(t, err)
+	require.NotContains(t, string(content), `class="lxd-badge-stale"`)
+
+	err = buildWebPage(p.RootDir(), "v1", p.StreamName(), webpage.WithStaleDays(2))
+	require.NoError(t, err)
+
+	content, err = os.ReadFile(filepath.Join(p.RootDir(), "index.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(content), `class="lxd-badge-stale"`)
+	require.Contains(t, string(content), "No image was built in the last 2 days.")
+}
+
+func TestBuildIndex_InstanceTypes(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240530_1200").WithFiles("lxd.tar.xz", "rootfs.squashfs", "disk.qcow2"),
+		testutils.MockVersion("20240531_1200").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, true)
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.True(t, product.HasContainer)
+	require.True(t, product.HasVM)
+
+	// Ensure webpage distinguishes between the last and any version.
+	page := webpage.NewWebPage(*catalog)
+	require.Len(t, page.Images, 1)
+	require.False(t, page.Images[0].SupportsContainer)
+	require.True(t, page.Images[0].HasContainer)
+	require.True(t, page.Images[0].SupportsVM)
+	require.True(t, page.Images[0].HasVM)
+}
+
+func TestBuildIndex_RequireBothRootfs(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240530_1200").WithFiles("lxd.tar.xz", "rootfs.squashfs", "disk.qcow2"),
+		testutils.MockVersion("20240531_1200").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	// Ensure versions without both root file systems are not added.
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withRequireBothRootfs(true))
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"20240530_1200"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+
+	// Ensure both versions are added by default.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"20240530_1200", "20240531_1200"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+}
+
+func TestBuildIndex_RequireChecksums(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240530_1200").WithFiles("lxd.tar.xz", "disk.qcow2").SetChecksums(
+			testutils.ItemDefaultContentSHA+"  lxd.tar.xz",
+			testutils.ItemDefaultContentSHA+"  disk.qcow2"),
+		testutils.MockVersion("20240531_1200").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+
+	// Ensure versions without a checksum file are excluded.
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withRequireChecksums(true))
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"20240530_1200"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+
+	// Ensure the exclusion is reported as a warning.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withRequireChecksums(true), withStrict(true))
+	require.ErrorContains(t, err, "warning")
+
+	// Ensure versions without a checksum file are added by default.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"20240530_1200", "20240531_1200"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+}
+
+func TestBuildIndex_Formats(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	metaDir := filepath.Join(p.RootDir(), "streams", "v1")
+
+	// Ensure default formats are written.
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	index, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, stream.FormatIndex, index.Format)
+	require.Equal(t, stream.FormatProducts, index.Index["images"].Format)
+
+	// Ensure configured formats replace the ones of the existing files.
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withFormats("products:1.1", "index:1.1"))
+	require.NoError(t, err)
+
+	index, err = shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, "index:1.1", index.Format)
+	require.Equal(t, "products:1.1", index.Index["images"].Format)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(metaDir, "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Equal(t, "products:1.1", catalog.Format)
+
+	// Ensure unknown formats are rejected.
+	_, err = (&buildOptions{StreamFormat: "products:9.9"}).buildOptions()
+	require.ErrorContains(t, err, "Invalid stream format")
+
+	_, err = (&buildOptions{IndexFormat: "index:9.9"}).buildOptions()
+	require.ErrorContains(t, err, "Invalid index format")
+
+	_, err = (&buildOptions{StreamFormat: stream.FormatProducts, IndexFormat: stream.FormatIndex}).buildOptions()
+	require.NoError(t, err)
+}
 
-			err := pruneDanglingProductVersions(p.RootDir(), "v1", p.StreamName())
-			require.NoError(t, err)
+func TestBuildIndex_HashAlgorithms(t *testing.T) {
+	t.Parallel()
 
-			products, err := stream.GetProducts(p.RootDir(), p.StreamName(), stream.WithIncompleteVersions(true))
-			require.NoError(t, err)
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
 
-			// Ensure all expected products are found.
-			require.Equal(t, shared.MapKeys(test.WantProducts), shared.MapKeys(products))
+	p.Create(t, t.TempDir())
 
-			// Ensure all expected product versions are found.
-			for pid, p := range products {
-				require.ElementsMatch(t, test.WantProducts[pid], shared.MapKeys(p.Versions))
-			}
-		})
-	}
+	opts, err := (&buildOptions{HashAlgos: []string{"sha512"}}).buildOptions()
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(filepath.Join(p.RootDir(), "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	item := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v1"].Items["disk.qcow2"]
+	require.Equal(t, testutils.ItemDefaultContentSHA, item.SHA256)
+	require.Len(t, item.Digests, 1)
+	require.Len(t, item.Digests["sha512"], 128)
+
+	// Ensure unknown algorithm is rejected.
+	_, err = (&buildOptions{HashAlgos: []string{"md5"}}).buildOptions()
+	require.ErrorIs(t, err, stream.ErrUnknownHashAlgorithm)
 }
 
-func TestBuildIndexAndPrune_Steps(t *testing.T) {
+func TestVerifyCatalogFiles(t *testing.T) {
 	t.Parallel()
 
-	type ProductMeta struct {
-		Requirements map[string]string
-		Aliases      string
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "rootfs.squashfs"))
+
+	p.Create(t, t.TempDir())
+
+	opts, err := (&buildOptions{PostVerify: true}).buildOptions()
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+	require.NoError(t, err)
+
+	catalog, _, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+
+	err = verifyCatalogFiles(context.Background(), p.RootDir(), catalog, 2, newBuildConfig())
+	require.NoError(t, err)
+
+	// Simulate files removed and modified during the build.
+	versionPath := filepath.Join(p.RootDir(), p.RelPath())
+
+	err = os.Remove(filepath.Join(versionPath, "v1", "disk.qcow2"))
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(versionPath, "v2", "rootfs.squashfs"), []byte("modified"), 0644)
+	require.NoError(t, err)
+
+	err = verifyCatalogFiles(context.Background(), p.RootDir(), catalog, 2, newBuildConfig())
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorContains(t, err, "v2/rootfs.squashfs\" of product \"ubuntu:noble:amd64:cloud\": Size mismatch")
+}
+
+func TestBuildIndex_LatestPointer(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz")) // Incomplete version
+
+	p.Create(t, t.TempDir())
+
+	productPath := filepath.Join(p.RootDir(), p.RelPath())
+
+	for _, format := range []string{latestPointerSymlink, latestPointerFile} {
+		opts, err := (&buildOptions{LatestPointer: true, LatestFormat: format}).buildOptions()
+		require.NoError(t, err)
+
+		err = buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, opts...)
+		require.NoError(t, err)
 	}
 
-	type Step struct {
-		MockVersions    []testutils.VersionMock
-		WantVersions    map[string][]string // Expected versions and their items (in dir hierarchy).
-		WantProductMeta *ProductMeta        // Expected product metadata.
+	target, err := os.Readlink(filepath.Join(productPath, "latest"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", target)
+	require.FileExists(t, filepath.Join(productPath, "latest", "disk.qcow2"))
+
+	content, err := os.ReadFile(filepath.Join(productPath, "latest.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "v2\n", string(content))
+
+	// Ensure pointers are ignored when reading products.
+	product, err := stream.GetProduct(p.RootDir(), filepath.Join(p.StreamName(), "ubuntu/noble/amd64/cloud"), stream.WithIncompleteVersions(true))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"v1", "v2", "v3"}, shared.MapKeys(product.Versions))
+
+	// Ensure stale pointers are removed by prune.
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", "images.json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	delete(catalog.Products["ubuntu:noble:amd64:cloud"].Versions, "v2")
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	err = pruneDanglingProductVersions(p.RootDir(), "v1", p.StreamName(), productFilter{}, nil)
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(productPath, "latest"))
+	require.NoFileExists(t, filepath.Join(productPath, "latest.txt"))
+
+	// Ensure invalid configurations are rejected.
+	_, err = (&buildOptions{LatestPointer: true, LatestFormat: "invalid"}).buildOptions()
+	require.Error(t, err)
+
+	_, err = (&buildOptions{LatestPointer: true, LatestFormat: latestPointerSymlink, WorkRoot: "/tmp"}).buildOptions()
+	require.Error(t, err)
+}
+
+func TestBuildIndex_ExtraRoots(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	extraRoot := t.TempDir()
+
+	primary := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"))
+	primary.Create(t, rootDir)
+
+	extra := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2"))
+	extra.Create(t, extraRoot)
+
+	extraOnly := testutils.MockProduct("images/ubuntu/jammy/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs"))
+	extraOnly.Create(t, extraRoot)
+
+	opts, err := (&buildOptions{ExtraRoots: []string{extraRoot}, PublicBase: "https://cdn.example.com", PostVerify: true}).buildOptions()
+	require.NoError(t, err)
+
+	// Build twice to ensure the existing catalog is reused.
+	for range 2 {
+		err := buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, opts...)
+		require.NoError(t, err)
 	}
 
-	tests := []struct {
-		Name           string
-		Steps          []Step
-		WithIncomplete bool
-	}{
-		{
-			Name: "Calculate deltas for new versions",
-			Steps: []Step{
-				{
-					// Step 0
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						"v1": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-					},
-				},
-				{
-					// Step 1
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						"v1": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-						"v3": {"lxd.tar.xz", "root.squashfs", "disk.qcow2", "root.v1.vcdiff", "disk.v1.qcow2.vcdiff"},
-					},
-				},
-				{
-					// Step 2
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
-						testutils.MockVersion("v5").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						// "v1": Pruned (retain = 3).
-						"v2": {"lxd.tar.xz", "disk.qcow2", "disk.v1.qcow2.vcdiff"},
-						"v3": {"lxd.tar.xz", "root.squashfs", "disk.qcow2", "root.v1.vcdiff", "disk.v1.qcow2.vcdiff", "disk.v2.qcow2.vcdiff"},
-						"v5": {"lxd.tar.xz", "disk.qcow2", "disk.v3.qcow2.vcdiff"},
-					},
-				},
-			},
-		},
+	catalog, err := shared.ReadJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"ubuntu:noble:amd64:cloud", "ubuntu:jammy:amd64:cloud"}, shared.MapKeys(catalog.Products))
+
+	noble := catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.ElementsMatch(t, []string{"v1", "v2", "v3"}, shared.MapKeys(noble.Versions))
+	require.Equal(t, "https://cdn.example.com/images/ubuntu/noble/amd64/cloud/v3/disk.qcow2", noble.Versions["v3"].Items["disk.qcow2"].Path)
+
+	// Ensure delta file of the version within the extra root is written
+	// within the primary root.
+	delta, ok := noble.Versions["v3"].Items["disk.v2.qcow2.vcdiff"]
+	require.True(t, ok)
+	require.Equal(t, "https://cdn.example.com/images/ubuntu/noble/amd64/cloud/v3/disk.v2.qcow2.vcdiff", delta.Path)
+	require.FileExists(t, filepath.Join(rootDir, "images/ubuntu/noble/amd64/cloud/v3/disk.v2.qcow2.vcdiff"))
+	require.NoFileExists(t, filepath.Join(extraRoot, "images/ubuntu/noble/amd64/cloud/v3/disk.v2.qcow2.vcdiff"))
+
+	// Ensure invalid flag combinations are rejected.
+	_, err = (&buildOptions{ExtraRoots: []string{extraRoot}}).buildOptions()
+	require.Error(t, err)
+
+	_, err = (&buildOptions{ExtraRoots: []string{extraRoot}, PublicBase: "/", WorkRoot: rootDir}).buildOptions()
+	require.Error(t, err)
+}
+
+func TestFsckChecksums(t *testing.T) {
+	t.Parallel()
+
+	sha := "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240101_0000").
+			WithFiles("lxd.tar.xz", "disk.qcow2").
+			SetChecksums(sha+"  disk.qcow2"),
+		testutils.MockVersion("20240301_0000").
+			WithFiles("lxd.tar.xz", "disk.qcow2", "20240101_0000.qcow2.vcdiff").
+			SetChecksums(
+				sha+"  lxd.tar.xz",
+				sha+"  disk.qcow2",
+				sha+"  removed.squashfs",
+				"invalid  20240101_0000.qcow2.vcdiff",
+				sha+"  20240101_0000.qcow2.vcdiff",
+				sha+"  disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	checksumPath := filepath.Join(p.AbsPath(), "20240301_0000", stream.FileChecksumSHA256)
+
+	original, err := os.ReadFile(checksumPath)
+	require.NoError(t, err)
+
+	vcdiffHash, err := shared.FileHash(sha256.New(), filepath.Join(p.AbsPath(), "20240301_0000", "20240101_0000.qcow2.vcdiff"))
+	require.NoError(t, err)
+
+	want := []checksumFix{
 		{
-			Name:           "Incomplete versions",
-			WithIncomplete: true,
-			Steps: []Step{
-				{
-					// Step 0: Valid version.
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v0").
-							WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-					},
-				},
-				{
-					// Step 1: Old incomplete version (missing rootfs).
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v1").WithFiles("lxd.tar.xz").WithAge(24 * time.Hour),
-					},
-					WantVersions: map[string][]string{
-						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-					},
-				},
-				{
-					// Step 2: Old incomplete version (hidden).
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion(".v2").WithFiles("lxd.tar.xz", "disk.qcow2").WithAge(24 * time.Hour),
-					},
-					WantVersions: map[string][]string{
-						"v0": {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-					},
-				},
-				{
-					// Step 3: New incomplete version (hidden).
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion(".v3").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						"v0":  {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-						".v3": {"lxd.tar.xz", "disk.qcow2"}, // Incomplete, but not removed.
-					},
-				},
-				{
-					// Step 4: Valid version.
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v4").WithFiles("lxd.tar.xz", "disk.qcow2"),
-					},
-					WantVersions: map[string][]string{
-						"v0":  {"lxd.tar.xz", "root.squashfs", "disk.qcow2"},
-						".v3": {"lxd.tar.xz", "disk.qcow2"},
-						"v4":  {"lxd.tar.xz", "disk.qcow2", "disk.v0.qcow2.vcdiff"},
-					},
-				},
-			},
+			Path:  filepath.Join(p.AbsPath(), "20240101_0000", stream.FileChecksumSHA256),
+			Added: []string{"lxd.tar.xz"},
 		},
 		{
-			Name: "Ensure config from last version is applied",
-			Steps: []Step{
-				{
-					// Step 0: Initial version.
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v2").
-							WithFiles("lxd.tar.xz", "disk.qcow2").
-							SetImageConfig(
-								"simplestream:",
-								"  requirements:",
-								"  - requirements:",
-								"      secure_boot: false",
-							),
-					},
-					WantProductMeta: &ProductMeta{
-						Aliases:      "ubuntu/noble/cloud",
-						Requirements: map[string]string{"secure_boot": "false"},
-					},
-				},
-				{
-					// Step 1: Add older version
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v1").
-							WithFiles("lxd.tar.xz", "disk.qcow2").
-							SetImageConfig(
-								"simplestream:",
-								"  requirements:",
-								"  - requirements:",
-								"      req: failnow",
-							),
-					},
-					WantProductMeta: &ProductMeta{
-						Aliases:      "ubuntu/noble/cloud",
-						Requirements: map[string]string{"secure_boot": "false"},
-					},
-				},
-				{
-					// Step 2: Ensure config from last version is applied.
-					MockVersions: []testutils.VersionMock{
-						testutils.MockVersion("v2").
-							WithFiles("lxd.tar.xz", "disk.qcow2").
-							SetImageConfig(
-								"simplestream:",
-								"  requirements:",
-								"  - requirements:",
-								"      secure_boot: true",
-							),
-						testutils.MockVersion("v3").
-							WithFiles("lxd.tar.xz", "disk.qcow2").
-							SetImageConfig(
-								"simplestream:",
-								"  release_aliases:",
-								"    noble: 24",
-							),
-					},
-					WantProductMeta: &ProductMeta{
-						Aliases:      "ubuntu/noble/cloud,ubuntu/24/cloud",
-						Requirements: map[string]string{},
-					},
-				},
-			},
+			Path:       checksumPath,
+			Removed:    []string{"removed.squashfs"},
+			Duplicates: []string{"20240101_0000.qcow2.vcdiff", "disk.qcow2"},
 		},
 	}
 
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			tmpDir := t.TempDir()
+	// Ensure dry run does not modify checksum files.
+	fixes, err := fsckChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, true)
+	require.NoError(t, err)
+	require.Equal(t, want, fixes)
+
+	content, err := os.ReadFile(checksumPath)
+	require.NoError(t, err)
+	require.Equal(t, string(original), string(content))
+
+	// Ensure checksum file is rewritten in a canonical form.
+	fixes, err = fsckChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, false)
+	require.NoError(t, err)
+	require.Equal(t, want, fixes)
+
+	content, err = os.ReadFile(checksumPath)
+	require.NoError(t, err)
+	require.Equal(t, vcdiffHash+"  20240101_0000.qcow2.vcdiff\n"+sha+"  disk.qcow2\n"+sha+"  lxd.tar.xz\n", string(content))
+
+	content, err = os.ReadFile(want[0].Path)
+	require.NoError(t, err)
+	require.Equal(t, sha+"  disk.qcow2\n"+sha+"  lxd.tar.xz\n", string(content))
+
+	// Ensure canonical checksum files are left untouched.
+	fixes, err = fsckChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, false)
+	require.NoError(t, err)
+	require.Empty(t, fixes)
+}
+
+func TestAuditChecksums(t *testing.T) {
+	t.Parallel()
+
+	sha := "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").
+			WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").
+			WithFiles("lxd.tar.xz", "disk.qcow2", "disk.v1.qcow2.vcdiff").
+			SetChecksums(sha+"  lxd.tar.xz", sha+"  disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	want := []missingChecksum{
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "disk.qcow2"},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "lxd.tar.xz"},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v2", Item: "disk.v1.qcow2.vcdiff", ChecksumFile: stream.FileChecksumSHA256},
+	}
+
+	// Ensure items without checksum entry are reported and files are not
+	// modified.
+	missing, err := auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "", false)
+	require.NoError(t, err)
+	require.Equal(t, want, missing)
+	require.NoFileExists(t, filepath.Join(p.AbsPath(), "v1", stream.FileChecksumSHA256))
 
-			streamName := "images"
-			streamVersion := "v99"
-			productID := "ubuntu:noble:amd64:cloud"
-			productRelPath := "images/ubuntu/noble/amd64/cloud"
+	var out strings.Builder
 
-			global := &globalOptions{
-				ctx: context.Background(),
-			}
+	err = writeMissingChecksums(&out, missing)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "disk.v1.qcow2.vcdiff")
 
-			buildOpts := buildOptions{
-				global:        global,
-				StreamVersion: streamVersion,
-				ImageDirs:     []string{streamName},
-				Workers:       2,
-			}
+	// Ensure missing checksums are appended with fix.
+	missing, err = auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "", true)
+	require.NoError(t, err)
+	require.Equal(t, want, missing)
 
-			pruneOpts := pruneOptions{
-				global:        global,
-				StreamVersion: streamVersion,
-				ImageDirs:     []string{streamName},
-				Dangling:      true,
-				RetainBuilds:  3,
-			}
+	content, err := os.ReadFile(filepath.Join(p.AbsPath(), "v1", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, sha+"  disk.qcow2\n"+sha+"  lxd.tar.xz\n", string(content))
 
-			// Run each step within a test case. Each step first mocks the product
-			// with given versions and then runs the build and prune commands.
-			for i, step := range test.Steps {
-				p := testutils.MockProduct(productRelPath).AddVersions(step.MockVersions...)
-				p.Create(t, tmpDir)
+	content, err = os.ReadFile(filepath.Join(p.AbsPath(), "v2", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, sha+"  lxd.tar.xz\n"+sha+"  disk.qcow2\n"+sha+"  disk.v1.qcow2.vcdiff\n", string(content))
 
-				// Build.
-				err := buildOpts.Run(nil, []string{tmpDir})
-				require.NoErrorf(t, err, "[ Step %d ] Failed running build command!", i)
+	// Ensure nothing is reported once fixed.
+	missing, err = auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "", false)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
 
-				// Prune.
-				err = pruneOpts.Run(nil, []string{tmpDir})
-				require.NoErrorf(t, err, "[ Step %d ] Failed running prune command!", i)
+func TestAuditChecksums_DeltaDir(t *testing.T) {
+	t.Parallel()
 
-				if step.WantProductMeta != nil {
-					catalog, err := buildProductCatalog(context.Background(), tmpDir, streamVersion, streamName, 2)
-					require.NoErrorf(t, err, "[ Step %d ] Failed building product catalog!", i)
+	sum := sha512.Sum512([]byte(testutils.ItemDefaultContent))
+	sha := hex.EncodeToString(sum[:])
 
-					product, ok := catalog.Products[productID]
-					require.Truef(t, ok, "[ Step %d ] Product not found in the product catalog!", i)
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").
+			WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").
+			WithFiles("lxd.tar.xz", "disk.qcow2").
+			SetChecksums(sha+"  lxd.tar.xz", sha+"  disk.qcow2"))
 
-					// Ensure product metadata matches the expected values.
-					require.Equalf(t, step.WantProductMeta.Requirements, product.Requirements, "[ Step %d ] Requirements mismatch!", i)
-					require.Equalf(t, step.WantProductMeta.Aliases, product.Aliases, "[ Step %d ] Aliases mismatch!", i)
-				}
+	p.Create(t, t.TempDir())
 
-				if len(step.WantVersions) > 0 {
-					products, err := stream.GetProducts(tmpDir, streamName, stream.WithIncompleteVersions(test.WithIncomplete))
-					require.NoErrorf(t, err, "[ Step %d ] Failed to retrieve products!", i)
+	// Store delta file outside the version directory.
+	deltaVersionPath := filepath.Join(p.RootDir(), "deltas", p.RelPath(), "v2")
+	err := os.MkdirAll(deltaVersionPath, os.ModePerm)
+	require.NoError(t, err)
 
-					product, ok := products[productID]
-					require.Truef(t, ok, "[ Step %d ] Product not found in directory structure!", i)
+	err = os.WriteFile(filepath.Join(deltaVersionPath, "disk.v1.qcow2.vcdiff"), []byte(testutils.ItemDefaultContent), 0644)
+	require.NoError(t, err)
 
-					// Ensure product contains all expected versions.
-					require.ElementsMatch(t,
-						shared.MapKeys(step.WantVersions),
-						shared.MapKeys(product.Versions),
-						"[ Step %d ] Versions mismatch!", i)
+	want := []missingChecksum{
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "disk.qcow2"},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "lxd.tar.xz"},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v2", Item: "disk.v1.qcow2.vcdiff"},
+	}
 
-					for versionName, wantItems := range step.WantVersions {
-						version, ok := product.Versions[versionName]
-						require.True(t, ok, "[ Step %d ] Version %q not found within resulting product %q!", i, versionName, productID)
+	// Ensure delta files within the delta directory are reported only
+	// if the delta directory is set.
+	missing, err := auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "", false)
+	require.NoError(t, err)
+	require.Equal(t, want[:2], missing)
 
-						// Ensure each version contains all expected items.
-						require.ElementsMatchf(t, wantItems, shared.MapKeys(version.Items),
-							"[ Step %d ] Items mismatch for version %q!", i, versionName)
-					}
-				}
-			}
-		})
+	missing, err = auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "deltas", true)
+	require.NoError(t, err)
+	require.Equal(t, want, missing)
+
+	// Ensure checksum of the delta file is appended to the checksum file
+	// next to it using the algorithm of the version checksum file.
+	content, err := os.ReadFile(filepath.Join(deltaVersionPath, stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, sha+"  disk.v1.qcow2.vcdiff\n", string(content))
+
+	content, err = os.ReadFile(filepath.Join(p.AbsPath(), "v2", stream.FileChecksumSHA256))
+	require.NoError(t, err)
+	require.Equal(t, sha+"  lxd.tar.xz\n"+sha+"  disk.qcow2\n", string(content))
+
+	// Ensure nothing is reported once fixed.
+	missing, err = auditChecksums(p.RootDir(), p.StreamName(), []string{stream.FileChecksumSHA256}, "deltas", false)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
+// cancelSink cancels the context once the first event of the given type is
+// emitted.
+type cancelSink struct {
+	eventType string
+	cancel    context.CancelFunc
+}
+
+func (s cancelSink) Emit(e event) {
+	if e.Type == s.eventType {
+		s.cancel()
 	}
 }
 
-func TestPruneEmptyDirs(t *testing.T) {
+func TestBuildIndex_CancelDeltas(t *testing.T) {
 	t.Parallel()
 
-	tests := []struct {
-		TestName     string
-		Structure    []string // Created before test. Suffix "/" represents directory.
-		ExpectRemove []string
-		ExpectExists []string
-	}{
-		{
-			TestName:     "Test non-empty dir",
-			Structure:    []string{"root/file"},
-			ExpectExists: []string{"root"},
-		},
-		{
-			TestName:     "Test empty dir",
-			Structure:    []string{"root/"},
-			ExpectRemove: []string{"root"},
-		},
-		{
-			TestName:     "Test nested empty dirs",
-			Structure:    []string{"root/parent/child/empty/"},
-			ExpectRemove: []string{"root"},
-		},
-		{
-			TestName: "Test partial parent removal",
-			Structure: []string{
-				"root/parent/empty/",
-				"root/file",
-			},
-			ExpectRemove: []string{"root/parent"},
-			ExpectExists: []string{"root"},
-		},
-		{
-			TestName: "Test multiple dirs",
-			Structure: []string{
-				"root/parent-1/child-1/empty/",
-				"root/parent-1/child-2/",
-				"root/parent-2/child-1/empty/",
-				"root/parent-2/child-2/",
-				"root/parent-2/file",
-				"root/parent-3/child-1/non-empty/file",
-			},
-			ExpectRemove: []string{
-				"root/parent-1",
-				"root/parent-2/child-1",
-				"root/parent-2/child-2",
-				"root/parent-2/child-3",
-			},
-			ExpectExists: []string{
-				"root/parent-2",
-				"root/parent-3/child-1/non-empty/",
-			},
-		},
-		{
-			TestName: "Test unclean dirs",
-			Structure: []string{
-				"root1/./file",
-				"root2/../root2/file",
-				"root3/../root3/gone/",
-				"/root4/file",
-				"//root5//.//..//root5//empty///file",
-			},
-			ExpectExists: []string{
-				"root1",
-				"root2",
-				"root4",
-				"root5/empty",
-			},
-			ExpectRemove: []string{
-				"root3/gone",
-			},
-		},
+	var versions []testutils.VersionMock
+	for i := 1; i <= 8; i++ {
+		versions = append(versions, testutils.MockVersion(fmt.Sprintf("v%d", i)).WithFiles("lxd.tar.xz", "disk.qcow2"))
 	}
 
-	for _, test := range tests {
-		t.Run(test.TestName, func(t *testing.T) {
-			tmpDir := t.TempDir()
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(versions...)
+	p.Create(t, t.TempDir())
 
-			// Ensure all expected directories and files exist.
-			for _, f := range test.Structure {
-				path := filepath.Join(tmpDir, f)
+	// Cancel the build once the first delta file is generated.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-				if strings.HasSuffix(f, "/") {
-					err := os.MkdirAll(path, os.ModePerm)
-					require.NoError(t, err, "Failed creating temporary directory")
-				} else {
-					err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
-					require.NoError(t, err, "Failed creating temporary directory")
+	done := make(chan error, 1)
+	go func() {
+		done <- buildIndex(ctx, p.RootDir(), "v1", []string{p.StreamName()}, 1, false, withEventSink(cancelSink{eventType: eventDeltaGenerated, cancel: cancel}))
+	}()
 
-					err = os.WriteFile(path, []byte{}, os.ModePerm)
-					require.NoError(t, err, "Failed creating temporary file")
-				}
-			}
+	// Ensure the build does not hang on the remaining delta jobs.
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(30 * time.Second):
+		t.Fatal("Build did not finish after cancellation")
+	}
 
-			err := pruneEmptyDirs(tmpDir, true)
-			require.NoError(t, err)
+	// Ensure no metadata is written.
+	require.NoFileExists(t, filepath.Join(p.RootDir(), "streams", "v1", "index.json"))
+}
 
-			// Check expected remaining directories.
-			for _, f := range test.ExpectExists {
-				path := filepath.Join(tmpDir, f)
-				require.DirExists(t, path, "Directory (or file) was unexpectedly pruned!")
-			}
+func TestBuildIndexAndPrune_Events(t *testing.T) {
+	t.Parallel()
 
-			// Check expected removed directories.
-			for _, f := range test.ExpectRemove {
-				path := filepath.Join(tmpDir, f)
-				require.NoDirExists(t, path, "Directory was expected to be pruned, but still exists!")
-			}
-		})
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v3").WithFiles("lxd.tar.xz", "disk.qcow2").SetChecksums("invalid  disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	var buf bytes.Buffer
+	sink := newJSONEventSink(&buf)
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false, withEventSink(sink))
+	require.NoError(t, err)
+
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 0, nil, 2, sink)
+	require.NoError(t, err)
+
+	// Compare events without timestamps, as build events are emitted
+	// concurrently.
+	var events []event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e event
+		err := json.Unmarshal([]byte(line), &e)
+		require.NoError(t, err)
+		require.NotEmpty(t, e.Time)
+
+		e.Time = ""
+		e.Error = ""
+		events = append(events, e)
+	}
+
+	id := "ubuntu:noble:amd64:cloud"
+
+	require.ElementsMatch(t, []event{
+		{Type: eventVersionAdded, Stream: "images", Product: id, Version: "v1"},
+		{Type: eventVersionAdded, Stream: "images", Product: id, Version: "v2"},
+		{Type: eventChecksumMismatch, Stream: "images", Product: id, Version: "v3"},
+		{Type: eventDeltaGenerated, Stream: "images", Product: id, Version: "v2", Item: "disk.v1.qcow2.vcdiff", DeltaBase: "v1", Path: filepath.Join(p.RelPath(), "v2", "disk.v1.qcow2.vcdiff")},
+		{Type: eventVersionPruned, Stream: "images", Product: id, Version: "v1", Path: filepath.Join(p.AbsPath(), "v1")},
+	}, events)
+
+	// Ensure events of the build are emitted before the events of the prune.
+	require.Equal(t, eventVersionPruned, events[len(events)-1].Type)
+
+	// Ensure only one event destination can be set.
+	_, _, err = openEventSink(filepath.Join(t.TempDir(), "events.jsonl"), true)
+	require.Error(t, err)
+}
+
+func TestBuildProductCatalog_ReverifyExisting(t *testing.T) {
+	t.Parallel()
+
+	sha := "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "disk.qcow2").SetChecksums(sha+"  lxd.tar.xz", sha+"  disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	deltaName := "disk.v1.qcow2.vcdiff"
+	deltaPath := filepath.Join(p.AbsPath(), "v2", deltaName)
+	checksumPath := filepath.Join(p.AbsPath(), "v2", stream.FileChecksumSHA256)
+
+	deltaHash, err := shared.FileHash(sha256.New(), deltaPath)
+	require.NoError(t, err)
+
+	// Corrupt existing delta file and image.
+	err = os.WriteFile(deltaPath, []byte("corrupted"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(p.AbsPath(), "v1", "lxd.tar.xz"), []byte("corrupted"), 0644)
+	require.NoError(t, err)
+
+	// Ensure existing items are trusted by default.
+	_, warnings, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+
+	// Ensure mismatching delta file is regenerated and image is reported.
+	catalog, warnings, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withReverifyExisting(true))
+	require.NoError(t, err)
+
+	messages := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		messages = append(messages, w.Product+"/"+w.Version+"/"+w.Item+": "+w.Message)
 	}
+
+	require.ElementsMatch(t, []string{
+		"ubuntu:noble:amd64:cloud/v1/lxd.tar.xz: Existing item does not match the product catalog",
+		"ubuntu:noble:amd64:cloud/v2/" + deltaName + ": Regenerating existing item that does not match the product catalog",
+	}, messages)
+
+	regeneratedHash, err := shared.FileHash(sha256.New(), deltaPath)
+	require.NoError(t, err)
+	require.Equal(t, deltaHash, regeneratedHash)
+	require.Equal(t, deltaHash, catalog.Products["ubuntu:noble:amd64:cloud"].Versions["v2"].Items[deltaName].SHA256)
+
+	// Ensure checksum file contains a single entry of the delta file.
+	checksums, err := os.ReadFile(checksumPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(checksums), deltaName))
+	require.Contains(t, string(checksums), deltaHash+"  "+deltaName)
+}
+
+func TestBuildProductCatalog_PreserveFields(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	p.Create(t, t.TempDir())
+
+	err := buildIndex(context.Background(), p.RootDir(), "v1", []string{p.StreamName()}, 2, false)
+	require.NoError(t, err)
+
+	// Manually curate product fields within the product catalog.
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", p.StreamName()+".json")
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	product := catalog.Products["ubuntu:noble:amd64:cloud"]
+	product.ReleaseTitle = "Noble Numbat (LTS)"
+	product.Aliases = "ubuntu/lts/cloud"
+	product.Preserve = []string{stream.ProductFieldReleaseTitle, "invalid"}
+	catalog.Products["ubuntu:noble:amd64:cloud"] = product
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	// Add new version to force the product to be rebuilt.
+	v := testutils.MockVersion("v2").WithFiles("lxd.tar.xz", "root.squashfs")
+	v.Create(t, p.AbsPath())
+
+	catalog, warnings, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	require.ErrorIs(t, warnings[0].Err, stream.ErrProductFieldNotPreservable)
+
+	// Ensure preserved field is carried over, while others are recomputed.
+	product = catalog.Products["ubuntu:noble:amd64:cloud"]
+	require.Contains(t, product.Versions, "v2")
+	require.Equal(t, "Noble Numbat (LTS)", product.ReleaseTitle)
+	require.Equal(t, "ubuntu/noble/cloud", product.Aliases)
+	require.Equal(t, []string{stream.ProductFieldReleaseTitle, "invalid"}, product.Preserve)
 }
 
-func TestPruneEmptyDirs_KeepRoot(t *testing.T) {
+func TestBuildProductCatalog_MinItemSize(t *testing.T) {
 	t.Parallel()
 
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+		testutils.MockVersion("v2").WithFiles("lxd.tar.xz").AddItems(testutils.MockItem("disk.qcow2").WithContent("")))
+
+	p2 := testutils.MockProduct("images/ubuntu/noble/amd64/desktop").AddVersions(
+		testutils.MockVersion("v1").WithFiles("root.squashfs").AddItems(testutils.MockItem("lxd.tar.xz").WithContent("")))
+
+	p.Create(t, t.TempDir())
+	p2.Create(t, p.RootDir())
+
+	// Ensure versions with empty items are rejected by default.
+	catalog, warnings, err := buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2)
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	require.Equal(t, "Skipping version with undersized item", warnings[0].Message)
+	require.ElementsMatch(t, []string{"v2/disk.qcow2", "v1/lxd.tar.xz"}, []string{
+		warnings[0].Version + "/" + warnings[0].Item,
+		warnings[1].Version + "/" + warnings[1].Item,
+	})
+
+	require.Len(t, catalog.Products, 1)
+	require.Equal(t, []string{"v1"}, shared.MapKeysSorted(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+
+	// Ensure the items are accepted once the check is disabled.
+	catalog, warnings, err = buildProductCatalog(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, withMinItemSize(0))
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+	require.Len(t, catalog.Products, 2)
+	require.Equal(t, []string{"v1", "v2"}, shared.MapKeysSorted(catalog.Products["ubuntu:noble:amd64:cloud"].Versions))
+}
+
+func TestApplyEnvFlags(t *testing.T) {
 	tests := []struct {
-		Name     string
-		FullPath string
-		RootPath string
+		Name            string
+		Args            []string
+		EnvWorkers      string
+		EnvTimeout      string
+		WantWorkers     int
+		WantTimeout     uint
+		WantErrContains string
 	}{
 		{
-			Name:     "Test empty dir itself",
-			FullPath: "root",
-			RootPath: "root",
+			Name:        "Environment variables are used when flags are not set",
+			EnvWorkers:  "3",
+			EnvTimeout:  "60",
+			WantWorkers: 3,
+			WantTimeout: 60,
 		},
 		{
-			Name:     "Test nested empty dirs",
-			FullPath: "root/child",
-			RootPath: "root",
+			Name:        "Flags take precedence over environment variables",
+			Args:        []string{"--workers", "5", "--timeout", "10"},
+			EnvWorkers:  "3",
+			EnvTimeout:  "60",
+			WantWorkers: 5,
+			WantTimeout: 10,
 		},
 		{
-			Name:     "Test unclean: Double slashed",
-			FullPath: "root///child//",
-			RootPath: "//root///",
+			Name:        "Zero timeout is allowed",
+			Args:        []string{"--workers", "2"},
+			EnvTimeout:  "0",
+			WantWorkers: 2,
+			WantTimeout: 0,
 		},
 		{
-			Name:     "Test unclean: Self-reference",
-			FullPath: "root/././child/./.",
-			RootPath: "./root/./././",
+			Name:            "Zero workers are rejected",
+			EnvWorkers:      "0",
+			WantErrContains: `Invalid environment variable "SIMPLESTREAM_WORKERS" value "0"`,
 		},
 		{
-			Name:     "Test unclean: Redundant change dir",
-			FullPath: "root/child/../../root/child/../child",
-			RootPath: "root/../root",
+			Name:            "Non-numeric timeout is rejected",
+			Args:            []string{"--workers", "2"},
+			EnvTimeout:      "1m",
+			WantErrContains: `Invalid environment variable "SIMPLESTREAM_TIMEOUT" value "1m"`,
+		},
+		{
+			Name:        "Invalid environment variable is ignored when flag is set",
+			Args:        []string{"--workers", "2"},
+			EnvWorkers:  "-1",
+			WantWorkers: 2,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			tmpDir := t.TempDir()
+			t.Setenv("SIMPLESTREAM_WORKERS", test.EnvWorkers)
+			t.Setenv("SIMPLESTREAM_TIMEOUT", test.EnvTimeout)
 
-			// Merge using Sprintf to preserve unclean paths.
-			fullPath := fmt.Sprintf("%s/%s", tmpDir, test.FullPath)
-			rootPath := fmt.Sprintf("%s/%s", tmpDir, test.RootPath)
+			cmd, _, err := NewRootCmd().Find([]string{"build"})
+			require.NoError(t, err)
 
-			// Create a chain of direcories.
-			err := os.MkdirAll(fullPath, os.ModePerm)
+			err = cmd.ParseFlags(test.Args)
 			require.NoError(t, err)
 
-			// Prune empty dirs within rootPath.
-			err = pruneEmptyDirs(rootPath, true)
+			err = applyEnvFlags(cmd)
+			if test.WantErrContains != "" {
+				require.ErrorContains(t, err, test.WantErrContains)
+				return
+			}
+
 			require.NoError(t, err)
 
-			// Ensure rootPath directory still exists.
-			expectPath := filepath.Join(tmpDir, "root")
-			require.DirExists(t, expectPath)
+			workers, err := cmd.Flags().GetInt("workers")
+			require.NoError(t, err)
+			require.Equal(t, test.WantWorkers, workers)
+
+			timeout, err := cmd.Flags().GetUint("timeout")
+			require.NoError(t, err)
+			require.Equal(t, test.WantTimeout, timeout)
 		})
 	}
 }
 
-func TestDiffProducts(t *testing.T) {
+func TestCompareMirrors(t *testing.T) {
 	t.Parallel()
 
-	type mapP map[string]stream.Product
-	type mapV map[string]stream.Version
-	type mapI map[string]stream.Item
+	item := func(sha string) stream.Item {
+		return stream.Item{Ftype: stream.ItemTypeSquashfs, SHA256: sha}
+	}
 
-	tests := []struct {
-		Name    string
-		Old     map[string]stream.Product
-		New     map[string]stream.Product
-		WantOld map[string]stream.Product // Missing in New
-		WantNew map[string]stream.Product // Missing in Old
-	}{
-		{
-			Name:    "Products | Equal",
-			Old:     mapP{"p1": {}},
-			New:     mapP{"p1": {}},
-			WantOld: mapP{},
-			WantNew: mapP{},
-		},
-		{
-			Name:    "Products | Add",
-			Old:     mapP{},
-			New:     mapP{"p1": {}},
-			WantOld: mapP{},
-			WantNew: mapP{"p1": {}},
-		},
-		{
-			Name:    "Products | Remove",
-			Old:     mapP{"p1": {}},
-			New:     mapP{},
-			WantOld: mapP{"p1": {}},
-			WantNew: mapP{},
-		},
-		{
-			Name:    "Products | Replace",
-			Old:     mapP{"p1": {}},
-			New:     mapP{"p2": {}},
-			WantOld: mapP{"p1": {}},
-			WantNew: mapP{"p2": {}},
-		},
-		{
-			Name:    "Versions | Equal",
-			Old:     mapP{"p1": {Versions: mapV{"v1": {}, "v2": {}}}},
-			New:     mapP{"p1": {Versions: mapV{"v1": {}, "v2": {}}}},
-			WantOld: mapP{},
-			WantNew: mapP{},
-		},
-		{
-			Name:    "Versions | Add",
-			Old:     mapP{"p": {Versions: mapV{"v1": {}}}},
-			New:     mapP{"p": {Versions: mapV{"v1": {}, "v2": {}}}},
-			WantOld: mapP{},
-			WantNew: mapP{"p": {Versions: mapV{"v2": {}}}},
-		},
-		{
-			Name:    "Versions | Remove",
-			Old:     mapP{"p": {Versions: mapV{"v1": {}, "v2": {}}}},
-			New:     mapP{"p": {Versions: mapV{"v1": {}}}},
-			WantOld: mapP{"p": {Versions: mapV{"v2": {}}}},
-			WantNew: mapP{},
-		},
-		{
-			Name:    "Versions | Replace",
-			Old:     mapP{"p": {Versions: mapV{"v1": {}}}},
-			New:     mapP{"p": {Versions: mapV{"v2": {}}}},
-			WantOld: mapP{"p": {Versions: mapV{"v1": {}}}},
-			WantNew: mapP{"p": {Versions: mapV{"v2": {}}}},
-		},
-		{
-			Name: "Products and versions | Ensure metadata is preseverd",
-			Old: mapP{
-				"eql": {Aliases: "eql", Versions: mapV{"v1": {}}},
-				"old": {Aliases: "old", Versions: mapV{"v1": {}}},
-				"mod": {
-					Aliases: "---",
-					Versions: mapV{
-						"eql": {},
-						"old": {},
-						"mod": {Items: mapI{"old": {}}},
-					},
+	primary := stream.ProductCatalog{
+		Products: map[string]stream.Product{
+			"ubuntu:noble:amd64:cloud": {
+				Versions: map[string]stream.Version{
+					"v1": {Items: map[string]stream.Item{"root.squashfs": item("aaa"), "lxd.tar.xz": item("bbb")}},
+					"v2": {Items: map[string]stream.Item{"root.squashfs": item("ccc")}},
 				},
 			},
-			New: mapP{
-				"eql": {Aliases: "eql", Versions: mapV{"v1": {}}},
-				"new": {Aliases: "new", Versions: mapV{"v1": {}}},
-				"mod": {
-					Aliases: "+++",
-					Versions: mapV{
-						"eql": {},
-						"new": {},
-						"mod": {Items: mapI{"new": {}}},
-					},
+			"ubuntu:noble:arm64:cloud": {
+				Versions: map[string]stream.Version{
+					"v1": {Items: map[string]stream.Item{"root.squashfs": item("ddd")}},
 				},
 			},
-			WantOld: mapP{
-				"old": {Aliases: "old", Versions: mapV{"v1": {}}},
-				"mod": {Aliases: "---", Versions: mapV{"old": {}}},
-			},
-			WantNew: mapP{
-				"new": {Aliases: "new", Versions: mapV{"v1": {}}},
-				"mod": {Aliases: "+++", Versions: mapV{"new": {}}},
+		},
+	}
+
+	mirror := stream.ProductCatalog{
+		Products: map[string]stream.Product{
+			"ubuntu:noble:amd64:cloud": {
+				Versions: map[string]stream.Version{
+					"v1": {Items: map[string]stream.Item{"root.squashfs": item("xxx"), "disk.qcow2": item("eee")}},
+					"v3": {Items: map[string]stream.Item{"root.squashfs": item("fff")}},
+				},
 			},
 		},
 	}
 
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			old, new := diffProducts(test.Old, test.New)
-			require.Equal(t, test.WantOld, old, "Mismatch in diffed OLD products!")
-			require.Equal(t, test.WantNew, new, "Mismatch in diffed NEW products!")
-		})
+	primaryDir := t.TempDir()
+	mirrorDir := t.TempDir()
+
+	for dir, catalog := range map[string]stream.ProductCatalog{primaryDir: primary, mirrorDir: mirror} {
+		err := os.MkdirAll(filepath.Join(dir, "streams", "v1"), 0755)
+		require.NoError(t, err)
+
+		err = shared.WriteJSONFile(filepath.Join(dir, "streams", "v1", "images.json"), catalog)
+		require.NoError(t, err)
+	}
+
+	drifts, err := compareMirrors(context.Background(), primaryDir, mirrorDir, "v1", "images")
+	require.NoError(t, err)
+	require.Equal(t, []catalogDrift{
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v2", Reason: driftMissingInMirror},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v3", Reason: driftMissingInPrimary},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "disk.qcow2", Reason: driftMissingInPrimary},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "lxd.tar.xz", Reason: driftMissingInMirror},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "v1", Item: "root.squashfs", Reason: driftHashMismatch},
+		{Stream: "images", Product: "ubuntu:noble:arm64:cloud", Reason: driftMissingInMirror},
+	}, drifts)
+
+	var out strings.Builder
+
+	err = writeDrifts(&out, drifts[:1], "json")
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"stream":"images","product":"ubuntu:noble:amd64:cloud","version":"v2","reason":"missing_in_mirror"}]`, out.String())
+
+	// Ensure identical mirrors do not differ.
+	drifts, err = compareMirrors(context.Background(), primaryDir, primaryDir, "v1", "images")
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+
+	// Ensure a missing product catalog of the mirror is treated as an empty one.
+	drifts, err = compareMirrors(context.Background(), primaryDir, t.TempDir(), "v1", "images")
+	require.NoError(t, err)
+	require.Equal(t, []catalogDrift{
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Reason: driftMissingInMirror},
+		{Stream: "images", Product: "ubuntu:noble:arm64:cloud", Reason: driftMissingInMirror},
+	}, drifts)
+
+	// Ensure a missing product catalog of the primary is rejected.
+	_, err = compareMirrors(context.Background(), t.TempDir(), mirrorDir, "v1", "images")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = compareMirrors(context.Background(), primaryDir, primaryDir, "v1", "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPruneOldVersions_DeltaOnlyVersion(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+		AddVersions(
+			testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs"),
+			testutils.MockVersion("02").WithFiles("lxd.tar.xz", "root.squashfs"),
+			testutils.MockVersion("03").WithFiles("lxd.tar.xz", "01.vcdiff", "02.vcdiff")).
+		AddProductCatalog()
+
+	p.Create(t, t.TempDir())
+
+	// Version containing only delta files is not complete, hence it has to
+	// be added to the product catalog manually.
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", fmt.Sprintf("%s.json", p.StreamName()))
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	id := "ubuntu:noble:amd64:cloud"
+	versionPath := filepath.Join(p.RelPath(), "03")
+
+	catalog.Products[id].Versions["03"] = stream.Version{
+		Items: map[string]stream.Item{
+			"lxd.tar.xz": {Ftype: stream.ItemTypeMetadata, Path: filepath.Join(versionPath, "lxd.tar.xz")},
+			"01.vcdiff":  {Ftype: stream.ItemTypeSquashfsDelta, Path: filepath.Join(versionPath, "01.vcdiff"), DeltaBase: "01"},
+			"02.vcdiff":  {Ftype: stream.ItemTypeSquashfsDelta, Path: filepath.Join(versionPath, "02.vcdiff"), DeltaBase: "02"},
+		},
+	}
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	// Ensure the version with only delta files is discarded and does not
+	// count towards the retained versions.
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 2, 0, 2, nil, 2, nil)
+	require.NoError(t, err)
+
+	require.DirExists(t, filepath.Join(p.AbsPath(), "01"))
+	require.DirExists(t, filepath.Join(p.AbsPath(), "02"))
+	require.NoDirExists(t, filepath.Join(p.AbsPath(), "03"))
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"01", "02"}, shared.MapKeys(catalog.Products[id].Versions))
+}
+
+func TestPruneOldVersions_UnreadablePrimaryItem(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").
+		AddVersions(
+			testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs"),
+			testutils.MockVersion("02").WithFiles("lxd.tar.xz", "root.squashfs"),
+			testutils.MockVersion("03").WithFiles("lxd.tar.xz", "01.vcdiff")).
+		AddProductCatalog()
+
+	p.Create(t, t.TempDir())
+
+	catalogPath := filepath.Join(p.RootDir(), "streams", "v1", fmt.Sprintf("%s.json", p.StreamName()))
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+
+	id := "ubuntu:noble:amd64:cloud"
+	versionPath := filepath.Join(p.RelPath(), "03")
+
+	// Primary item whose path cannot be checked, as its parent is a file.
+	catalog.Products[id].Versions["03"] = stream.Version{
+		Items: map[string]stream.Item{
+			"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Path: filepath.Join(versionPath, "lxd.tar.xz")},
+			"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Path: filepath.Join(versionPath, "lxd.tar.xz", "root.squashfs")},
+			"01.vcdiff":     {Ftype: stream.ItemTypeSquashfsDelta, Path: filepath.Join(versionPath, "01.vcdiff"), DeltaBase: "01"},
+		},
 	}
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	// Ensure the version is not discarded if its primary item cannot be
+	// checked.
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 1, nil, 2, nil)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, os.ErrNotExist)
+	require.DirExists(t, filepath.Join(p.AbsPath(), "03"))
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"01", "02", "03"}, shared.MapKeys(catalog.Products[id].Versions))
+
+	// Ensure versions without primary item are retained if fewer than
+	// minComplete versions would remain usable.
+	version := catalog.Products[id].Versions["03"]
+	delete(version.Items, "root.squashfs")
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	err = pruneStreamProductVersions(context.Background(), p.RootDir(), "v1", p.StreamName(), 1, 0, 3, nil, 2, nil)
+	require.NoError(t, err)
+	require.DirExists(t, filepath.Join(p.AbsPath(), "01"))
+	require.DirExists(t, filepath.Join(p.AbsPath(), "02"))
+	require.DirExists(t, filepath.Join(p.AbsPath(), "03"))
+}
+
+func TestPromoteCurrent(t *testing.T) {
+	t.Parallel()
+
+	jammy := testutils.MockProduct("images/ubuntu/jammy/amd64/default").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	noble := testutils.MockProduct("images/ubuntu/noble/amd64/default").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	debian := testutils.MockProduct("images/debian/bookworm/amd64/default").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	jammy.Create(t, t.TempDir())
+	noble.Create(t, jammy.RootDir())
+	debian.Create(t, jammy.RootDir())
+
+	rootDir := jammy.RootDir()
+	defaultsPath := filepath.Join(rootDir, "images", stream.FileStreamDefaults)
+	catalogPath := filepath.Join(rootDir, "streams", "v1", "images.json")
+
+	defaults := strings.Join([]string{
+		"simplestream:",
+		"  release_aliases:",
+		"    jammy: 22.04,current",
+		"    noble: \"24.04\"",
+		"    bookworm: current",
+		"  requirements:",
+		"  - requirements:",
+		"      secure_boot: false",
+	}, "\n")
+
+	err := os.WriteFile(defaultsPath, []byte(defaults), 0644)
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false)
+	require.NoError(t, err)
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Contains(t, catalog.Products["ubuntu:jammy:amd64:default"].Aliases, "ubuntu/current")
+
+	// Promote noble and rebuild the aliases of the existing products.
+	err = promoteCurrent(rootDir, "images", "ubuntu", "noble")
+	require.NoError(t, err)
+
+	err = buildIndex(context.Background(), rootDir, "v1", []string{"images"}, 2, false, withRefreshAliases([]string{"ubuntu"}))
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu/jammy/default,ubuntu/jammy,ubuntu/22.04/default,ubuntu/22.04", catalog.Products["ubuntu:jammy:amd64:default"].Aliases)
+	require.Equal(t, "ubuntu/noble/default,ubuntu/noble,ubuntu/24.04/default,ubuntu/24.04,ubuntu/current/default,ubuntu/default,ubuntu/current,ubuntu", catalog.Products["ubuntu:noble:amd64:default"].Aliases)
+	require.Contains(t, catalog.Products["debian:bookworm:amd64:default"].Aliases, "debian/current")
+
+	// Ensure other content of the defaults is retained.
+	product, err := stream.GetProduct(rootDir, noble.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"secure_boot": "false"}, product.Requirements)
+
+	// Ensure promoting the same release again does not modify the defaults.
+	content, err := os.ReadFile(defaultsPath)
+	require.NoError(t, err)
+
+	err = promoteCurrent(rootDir, "images", "ubuntu", "noble")
+	require.NoError(t, err)
+
+	newContent, err := os.ReadFile(defaultsPath)
+	require.NoError(t, err)
+	require.Equal(t, string(content), string(newContent))
+
+	// Ensure invalid releases are rejected.
+	err = promoteCurrent(rootDir, "images", "ubuntu", "focal")
+	require.ErrorContains(t, err, "No products found")
+
+	err = promoteCurrent(rootDir, "images", "ubuntu", "bookworm")
+	require.ErrorContains(t, err, "shared with distribution")
+}
+
+func TestPromoteCurrent_ImageConfigOverride(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/jammy/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2").SetImageConfig(
+			"simplestream:",
+			"  release_aliases:",
+			"    jammy: 22.04,current",
+		))
+
+	noble := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "disk.qcow2"))
+
+	p.Create(t, t.TempDir())
+	noble.Create(t, p.RootDir())
+
+	// Ensure the defaults are not modified, as the image config of jammy
+	// would keep its current aliases.
+	err := promoteCurrent(p.RootDir(), "images", "ubuntu", "noble")
+	require.ErrorContains(t, err, "overridden by the image config")
+	require.NoFileExists(t, filepath.Join(p.RootDir(), "images", stream.FileStreamDefaults))
+}
+
+func TestSetCurrentRelease(t *testing.T) {
+	t.Parallel()
+
+	content := strings.Join([]string{
+		"simplestream:",
+		"  requirements:",
+		"  - requirements:",
+		"      nesting: \"true\"",
+		"  release_aliases:",
+		"    kinetic: 22.10,current",
+		"    other: current",
+		"",
+	}, "\n")
+
+	newContent, err := setCurrentRelease([]byte(content), []string{"kinetic", "lunar"}, "lunar")
+	require.NoError(t, err)
+	require.Equal(t, strings.Join([]string{
+		"simplestream:",
+		"  requirements:",
+		"  - requirements:",
+		"      nesting: \"true\"",
+		"  release_aliases:",
+		"    kinetic: \"22.10\"",
+		"    lunar: current",
+		"    other: current",
+		"",
+	}, "\n"), string(newContent))
+
+	// Ensure the defaults are created if they are empty.
+	newContent, err = setCurrentRelease(nil, []string{"lunar"}, "lunar")
+	require.NoError(t, err)
+	require.Equal(t, "simplestream:\n  release_aliases:\n    lunar: current\n", string(newContent))
 }
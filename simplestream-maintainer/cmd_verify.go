@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/minisign"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type verifyOptions struct {
+	global *globalOptions
+
+	StreamVersion   string
+	MinisignPubKey  string
+	LXDFingerprints bool
+	Sniff           bool
+}
+
+func (o *verifyOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "verify <path|url> [flags]",
+		Short:   "Verify simplestream index on the given path",
+		Long:    "Verify that the index and all product catalogs referenced by it are readable and, optionally, that their signatures are valid.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringVar(&o.MinisignPubKey, "minisign-pubkey", "", "Minisign public key used to verify signatures of the index and product catalog files")
+	cmd.PersistentFlags().BoolVar(&o.LXDFingerprints, "lxd-fingerprints", false, "Recalculate the combined hashes of the metadata and root file system items, which LXD uses as image fingerprints, and compare them with the product catalogs (local path only)")
+	cmd.PersistentFlags().BoolVar(&o.Sniff, "sniff", false, "Check that the content of the squashfs, qcow2, and tarball items starts with the magic bytes of their declared file type (local path only)")
+
+	return cmd
+}
+
+func (o *verifyOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	var pubKey *minisign.PublicKey
+
+	if o.MinisignPubKey != "" {
+		var err error
+
+		pubKey, err = minisign.ReadPublicKeyFile(o.MinisignPubKey)
+		if err != nil {
+			return fmt.Errorf("Failed to read minisign public key: %w", err)
+		}
+	}
+
+	if o.LXDFingerprints && stream.IsRemoteLocation(args[0]) {
+		return fmt.Errorf("Flag %q is supported only for local paths", "lxd-fingerprints")
+	}
+
+	if o.Sniff && stream.IsRemoteLocation(args[0]) {
+		return fmt.Errorf("Flag %q is supported only for local paths", "sniff")
+	}
+
+	return verifyIndex(o.global.ctx, args[0], o.StreamVersion, pubKey, o.LXDFingerprints, o.Sniff)
+}
+
+// verifyIndex verifies the index file and the product catalogs referenced by
+// it. If the public key is set, signatures of the files are verified as well.
+// If lxdFingerprints is true, the combined hashes recorded in the product
+// catalogs are compared with the ones recalculated from the item files. If
+// sniff is true, the content of the items is checked against their declared
+// file types. The root directory can also be an HTTP(S) URL of a remote
+// mirror, in which case the item files cannot be verified. All encountered
+// errors are logged and returned together.
+func verifyIndex(ctx context.Context, rootDir string, streamVersion string, pubKey *minisign.PublicKey, lxdFingerprints bool, sniff bool) error {
+	var errs []error
+
+	indexPath := stream.JoinLocation(rootDir, "streams", streamVersion, "index.json")
+
+	index, err := verifyJSONFile(ctx, indexPath, &stream.StreamIndex{}, pubKey)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if index != nil {
+		streamNames := shared.MapKeysSorted(index.Index)
+
+		for _, streamName := range streamNames {
+			catalogPath := stream.JoinLocation(rootDir, index.Index[streamName].Path)
+
+			catalog, err := verifyJSONFile(ctx, catalogPath, &stream.ProductCatalog{}, pubKey)
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+			if lxdFingerprints && catalog != nil {
+				errs = append(errs, verifyLXDFingerprints(ctx, rootDir, *catalog)...)
+			}
+
+			if sniff && catalog != nil {
+				errs = append(errs, verifyItemContents(ctx, rootDir, *catalog)...)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Verification failed: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// verifyJSONFile reads the JSON file on the given location (local path or
+// HTTP(S) URL) into the given object. If the public key is set, the file's
+// signature is verified. The object is returned if the file was read
+// successfully, even if the signature is invalid.
+func verifyJSONFile[T any](ctx context.Context, path string, obj *T, pubKey *minisign.PublicKey) (*T, error) {
+	data, err := stream.ReadLocation(ctx, path)
+	if err == nil {
+		err = json.Unmarshal(data, obj)
+	}
+
+	if err != nil {
+		slog.Error("Failed to read file", "path", path, "error", err)
+		return nil, fmt.Errorf("Read %q: %w", path, err)
+	}
+
+	if pubKey != nil {
+		var sig []byte
+
+		sig, err = stream.ReadLocation(ctx, path+minisign.SignatureExt)
+		if err == nil {
+			err = pubKey.Verify(data, sig)
+		}
+
+		if err != nil {
+			slog.Error("Invalid signature", "path", path, "error", err)
+			return obj, fmt.Errorf("Verify signature of %q: %w", path, err)
+		}
+	}
+
+	slog.Debug("File verified", "path", path)
+	return obj, nil
+}
+
+// verifyLXDFingerprints recalculates the combined hashes of the metadata item
+// and each primary root file system item of all catalog versions, and returns
+// an error for each hash that differs from the one recorded with the metadata
+// item. LXD calculates the image fingerprint as the SHA256 hash of the
+// metadata file followed by the root file system file, hence clients cannot
+// launch images whose recorded hash does not match. Item paths are resolved
+// relative to the root directory.
+func verifyLXDFingerprints(ctx context.Context, rootDir string, catalog stream.ProductCatalog) []error {
+	var errs []error
+
+	for _, id := range shared.MapKeysSorted(catalog.Products) {
+		product := catalog.Products[id]
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			version := product.Versions[name]
+
+			metaItem, ok := version.Items[stream.ItemTypeMetadata]
+			if !ok {
+				continue
+			}
+
+			for _, itemName := range shared.MapKeysSorted(version.Items) {
+				item := version.Items[itemName]
+				if !stream.IsPrimaryItemType(item.Ftype) {
+					continue
+				}
+
+				err := ctx.Err()
+				if err != nil {
+					return append(errs, err)
+				}
+
+				fingerprint, err := lxdFingerprint(filepath.Join(rootDir, metaItem.Path), filepath.Join(rootDir, item.Path))
+				if err == nil && fingerprint != metaItem.CombinedSHA256(item.Ftype) {
+					err = fmt.Errorf("Expected %q, got %q", metaItem.CombinedSHA256(item.Ftype), fingerprint)
+				}
+
+				if err != nil {
+					slog.Error("Fingerprint verification failed", "product", id, "version", name, "item", itemName, "error", err)
+					errs = append(errs, fmt.Errorf("Fingerprint of item %q in version %q of product %q: %w", itemName, name, id, err))
+					continue
+				}
+
+				slog.Debug("Fingerprint verified", "product", id, "version", name, "item", itemName)
+			}
+		}
+	}
+
+	return errs
+}
+
+// lxdFingerprint calculates the image fingerprint the way LXD does for split
+// images, which is the SHA256 hash of the metadata file content followed by
+// the root file system file content.
+func lxdFingerprint(metaPath string, rootfsPath string) (string, error) {
+	hash := sha256.New()
+
+	for _, path := range []string{metaPath, rootfsPath} {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(hash, file)
+		_ = file.Close()
+		if err != nil {
+			return "", fmt.Errorf("Failed to read file %q: %w", path, err)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// itemMagics maps item file types to the magic bytes their content can start
+// with. Items of other file types are not checked.
+var itemMagics = map[string][][]byte{
+	stream.ItemTypeSquashfs:   {[]byte("hsqs"), []byte("sqsh")},
+	stream.ItemTypeDiskKVM:    {[]byte("QFI\xfb")},
+	stream.ItemTypeMetadata:   {[]byte("\xfd7zXZ\x00")},
+	stream.ItemTypeRootTarXz:  {[]byte("\xfd7zXZ\x00")},
+	stream.ItemTypeRootTarZst: {[]byte("\x28\xb5\x2f\xfd")},
+}
+
+// verifyItemContents checks that the content of each item of all catalog
+// versions starts with the magic bytes of the item's file type, and returns an
+// error for each item that does not. The file type of an item is derived from
+// its file name, hence a misconfigured pipeline can publish, for example, a
+// raw disk image as qcow2, which LXD then fails to use. Item paths are
+// resolved relative to the root directory.
+func verifyItemContents(ctx context.Context, rootDir string, catalog stream.ProductCatalog) []error {
+	var errs []error
+
+	for _, id := range shared.MapKeysSorted(catalog.Products) {
+		product := catalog.Products[id]
+
+		for _, name := range shared.MapKeysSorted(product.Versions) {
+			version := product.Versions[name]
+
+			for _, itemName := range shared.MapKeysSorted(version.Items) {
+				item := version.Items[itemName]
+
+				magics, ok := itemMagics[item.Ftype]
+				if !ok {
+					continue
+				}
+
+				err := ctx.Err()
+				if err != nil {
+					return append(errs, err)
+				}
+
+				err = sniffFile(filepath.Join(rootDir, item.Path), magics)
+				if err != nil {
+					slog.Error("Item content does not match its file type", "product", id, "version", name, "item", itemName, "ftype", item.Ftype, "error", err)
+					errs = append(errs, fmt.Errorf("Content of item %q in version %q of product %q does not match file type %q: %w", itemName, name, id, item.Ftype, err))
+					continue
+				}
+
+				slog.Debug("Item content verified", "product", id, "version", name, "item", itemName)
+			}
+		}
+	}
+
+	return errs
+}
+
+// sniffFile returns an error if the file on the given path does not start
+// with any of the given magic bytes.
+func sniffFile(path string, magics [][]byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	var header []byte
+
+	for _, magic := range magics {
+		if len(magic) > len(header) {
+			header = make([]byte, len(magic))
+		}
+	}
+
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Failed to read file %q: %w", path, err)
+	}
+
+	for _, magic := range magics {
+		if bytes.HasPrefix(header[:n], magic) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unexpected magic bytes %q", header[:n])
+}
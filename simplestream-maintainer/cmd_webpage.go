@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+type webpageOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDir      string
+	MetaDir       string
+	Full          bool
+	StaleDays     int
+}
+
+func (o *webpageOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "webpage <path> [flags]",
+		Short:   "Build index.html from the existing product catalog",
+		Long:    "Build index.html from the existing product catalog of the given stream. Neither the image directories nor the product catalog are read or modified, hence the catalog must be built beforehand.",
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringVarP(&o.ImageDir, "image-dir", "d", "images", "Image directory (relative to path argument) whose product catalog is used")
+	cmd.PersistentFlags().StringVar(&o.MetaDir, "meta-dir", "", "Directory where the product catalogs and index.html are located. By default, the path argument is used")
+	cmd.PersistentFlags().BoolVar(&o.Full, "webpage-full", false, "List all product versions instead of only the most recent ones")
+	cmd.PersistentFlags().IntVar(&o.StaleDays, "webpage-stale-days", webpage.DefaultStaleDays, "Number of days after which a product version is marked as stale")
+
+	return cmd
+}
+
+func (o *webpageOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	metaRootDir := args[0]
+	if o.MetaDir != "" {
+		metaRootDir = o.MetaDir
+	}
+
+	return buildWebPage(metaRootDir, o.StreamVersion, o.ImageDir, webpage.WithAllVersions(o.Full), webpage.WithStaleDays(o.StaleDays))
+}
+
+// buildWebPage writes index.html into the metadata root directory from the
+// existing product catalog of the given stream.
+func buildWebPage(metaRootDir string, streamVersion string, streamName string, opts ...webpage.Option) error {
+	catalogPath := filepath.Join(metaRootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return fmt.Errorf("Failed to read product catalog: %w", err)
+	}
+
+	err = webpage.NewWebPage(*catalog, opts...).Write(metaRootDir)
+	if err != nil {
+		return fmt.Errorf("Failed to write index.html: %w", err)
+	}
+
+	slog.Info("Webpage written", "streamName", streamName, "path", filepath.Join(metaRootDir, "index.html"))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// Types of events emitted during the build and prune.
+const (
+	// eventVersionAdded is emitted when a new version is added to the
+	// product catalog.
+	eventVersionAdded = "version_added"
+
+	// eventDeltaGenerated is emitted when a delta file or a chunk index
+	// is generated.
+	eventDeltaGenerated = "delta_generated"
+
+	// eventVersionPruned is emitted when a version is removed from the
+	// disk.
+	eventVersionPruned = "version_pruned"
+
+	// eventChecksumMismatch is emitted when the version items do not
+	// match the version checksum file.
+	eventChecksumMismatch = "checksum_mismatch"
+)
+
+// event is a single build or prune action. Its JSON representation is
+// a stable schema, hence fields must not be renamed or removed.
+type event struct {
+	// Time is the time when the event occurred in RFC 3339 format.
+	Time string `json:"time"`
+
+	// Type is the type of the event.
+	Type string `json:"type"`
+
+	// Stream is the name of the stream.
+	Stream string `json:"stream,omitempty"`
+
+	// Product is the product ID.
+	Product string `json:"product,omitempty"`
+
+	// Version is the version name.
+	Version string `json:"version,omitempty"`
+
+	// Item is the item name.
+	Item string `json:"item,omitempty"`
+
+	// DeltaBase is the version used as a base for the delta file.
+	DeltaBase string `json:"delta_base,omitempty"`
+
+	// Path is the path of the affected file or directory.
+	Path string `json:"path,omitempty"`
+
+	// Error is the error message.
+	Error string `json:"error,omitempty"`
+}
+
+// eventSink receives events as they occur. Implementations must be safe for
+// concurrent use.
+type eventSink interface {
+	Emit(e event)
+}
+
+// emitEvent emits the event to the given sink. Nothing is emitted if the sink
+// is nil.
+func emitEvent(sink eventSink, e event) {
+	if sink == nil {
+		return
+	}
+
+	if e.Time == "" {
+		e.Time = shared.Now().UTC().Format(time.RFC3339)
+	}
+
+	sink.Emit(e)
+}
+
+// jsonEventSink writes each event as a single JSON line (JSON Lines format).
+type jsonEventSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newJSONEventSink returns an event sink that writes events to the given
+// writer.
+func newJSONEventSink(w io.Writer) *jsonEventSink {
+	return &jsonEventSink{enc: json.NewEncoder(w)}
+}
+
+// Emit writes the event as a JSON line. Write errors are logged, as they
+// must not interrupt the build or prune.
+func (s *jsonEventSink) Emit(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.enc.Encode(e)
+	if err != nil {
+		slog.Warn("Failed to write event", "type", e.Type, "error", err)
+	}
+}
+
+// openEventSink returns an event sink that writes events to the file on the
+// given path, or to stdout if toStdout is true. The file is appended to if
+// it exists. The returned function closes the file. If neither is set, a nil
+// sink is returned.
+func openEventSink(path string, toStdout bool) (eventSink, func() error, error) {
+	if path != "" && toStdout {
+		return nil, nil, fmt.Errorf("Flags %q and %q cannot be used together", "events-file", "events")
+	}
+
+	if toStdout {
+		return newJSONEventSink(os.Stdout), func() error { return nil }, nil
+	}
+
+	if path == "" {
+		return nil, func() error { return nil }, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open events file: %w", err)
+	}
+
+	return newJSONEventSink(file), file.Close, nil
+}
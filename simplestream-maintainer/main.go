@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -55,10 +56,47 @@ func NewRootCmd() *cobra.Command {
 	pruneOpts := pruneOptions{global: &o}
 	cmd.AddCommand(pruneOpts.NewCommand())
 
+	deltasOpts := deltasOptions{global: &o}
+	cmd.AddCommand(deltasOpts.NewCommand())
+
+	importOpts := importOptions{global: &o}
+	cmd.AddCommand(importOpts.NewCommand())
+
+	verifyOpts := verifyOptions{global: &o}
+	cmd.AddCommand(verifyOpts.NewCommand())
+
+	statsOpts := statsOptions{global: &o}
+	cmd.AddCommand(statsOpts.NewCommand())
+
+	scanOpts := scanOptions{global: &o}
+	cmd.AddCommand(scanOpts.NewCommand())
+
+	webpageOpts := webpageOptions{global: &o}
+	cmd.AddCommand(webpageOpts.NewCommand())
+
+	fsckChecksumsOpts := fsckChecksumsOptions{global: &o}
+	cmd.AddCommand(fsckChecksumsOpts.NewCommand())
+
+	auditChecksumsOpts := auditChecksumsOptions{global: &o}
+	cmd.AddCommand(auditChecksumsOpts.NewCommand())
+
+	compareOpts := compareOptions{global: &o}
+	cmd.AddCommand(compareOpts.NewCommand())
+
+	promoteCurrentOpts := promoteCurrentOptions{build: buildOptions{global: &o}}
+	cmd.AddCommand(promoteCurrentOpts.NewCommand())
+
 	return cmd
 }
 
 func (o *globalOptions) PreRun(cmd *cobra.Command, args []string) {
+	// Apply values of unset flags from the environment.
+	err := applyEnvFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
 	// Configure global context.
 	if o.flagTimeout == 0 {
 		o.ctx, o.cancel = context.WithCancel(context.Background())
@@ -70,7 +108,7 @@ func (o *globalOptions) PreRun(cmd *cobra.Command, args []string) {
 	o.ctx, o.cancel = signal.NotifyContext(o.ctx, os.Interrupt)
 
 	// Configure default logger.
-	err := setDefaultLogger(o.flagLogLevel, o.flagLogFormat)
+	err = setDefaultLogger(o.flagLogLevel, o.flagLogFormat)
 	if err != nil {
 		// Error out, so we don't use the default logger.
 		fmt.Fprintln(os.Stderr, "Error:", err)
@@ -78,6 +116,59 @@ func (o *globalOptions) PreRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// envFlag is a flag whose value can be provided by an environment variable.
+type envFlag struct {
+	// Flag is the name of the flag.
+	Flag string
+
+	// Env is the name of the environment variable.
+	Env string
+
+	// Min is the minimum allowed value.
+	Min uint64
+}
+
+// envFlags contains flags that fall back to environment variables when they
+// are not explicitly set. Flag values always take precedence, followed by
+// the environment variables, and finally the built-in defaults.
+var envFlags = []envFlag{
+	{Flag: "workers", Env: "SIMPLESTREAM_WORKERS", Min: 1},
+	{Flag: "timeout", Env: "SIMPLESTREAM_TIMEOUT", Min: 0},
+}
+
+// applyEnvFlags sets flags of the given command that are not explicitly set
+// to the values of their corresponding environment variables. Flags that the
+// command does not have and empty or unset environment variables are ignored.
+func applyEnvFlags(cmd *cobra.Command) error {
+	for _, f := range envFlags {
+		flag := cmd.Flags().Lookup(f.Flag)
+		if flag == nil || flag.Changed {
+			continue
+		}
+
+		value := os.Getenv(f.Env)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil || n < f.Min {
+			if f.Min > 0 {
+				return fmt.Errorf("Invalid environment variable %q value %q: Expected a positive integer", f.Env, value)
+			}
+
+			return fmt.Errorf("Invalid environment variable %q value %q: Expected a non-negative integer", f.Env, value)
+		}
+
+		err = cmd.Flags().Set(f.Flag, strconv.FormatUint(n, 10))
+		if err != nil {
+			return fmt.Errorf("Failed to set flag %q from environment variable %q: %w", f.Flag, f.Env, err)
+		}
+	}
+
+	return nil
+}
+
 func setDefaultLogger(level string, format string) error {
 	opts := slog.HandlerOptions{}
 
@@ -0,0 +1,318 @@
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// SignatureExt is the extension of the signature file.
+const SignatureExt = ".minisig"
+
+var (
+	// ErrInvalidKey indicates that the key cannot be parsed.
+	ErrInvalidKey = errors.New("Invalid minisign key")
+
+	// ErrInvalidSignature indicates that the signature cannot be parsed or
+	// does not match the signed data.
+	ErrInvalidSignature = errors.New("Invalid minisign signature")
+)
+
+var (
+	algEd25519         = [2]byte{'E', 'd'}
+	algEd25519Hashed   = [2]byte{'E', 'D'}
+	algBlake2b         = [2]byte{'B', '2'}
+	kdfScrypt          = [2]byte{'S', 'c'}
+	kdfNone            = [2]byte{0, 0}
+	untrustedCommentHd = "untrusted comment: "
+	trustedCommentHd   = "trusted comment: "
+)
+
+// PublicKey is a minisign public key.
+type PublicKey struct {
+	ID  [8]byte
+	Key ed25519.PublicKey
+}
+
+// PrivateKey is a minisign private (secret) key.
+type PrivateKey struct {
+	ID  [8]byte
+	Key ed25519.PrivateKey
+}
+
+// Public returns the public key corresponding to the private key.
+func (k PrivateKey) Public() PublicKey {
+	return PublicKey{
+		ID:  k.ID,
+		Key: k.Key.Public().(ed25519.PublicKey),
+	}
+}
+
+// KeyID returns the key ID in the hexadecimal format used by minisign.
+func (k PublicKey) KeyID() string {
+	return formatKeyID(k.ID)
+}
+
+// KeyID returns the key ID in the hexadecimal format used by minisign.
+func (k PrivateKey) KeyID() string {
+	return formatKeyID(k.ID)
+}
+
+// formatKeyID formats the key ID as an uppercase hexadecimal number, where
+// the key ID bytes are interpreted in little-endian order.
+func formatKeyID(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// ReadPublicKeyFile reads the public key from the given file.
+func ReadPublicKeyFile(path string) (*PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePublicKey(data)
+}
+
+// ParsePublicKey parses the public key either from the content of the public
+// key file or from a single base64 encoded line.
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	raw, err := decodeKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) != 42 || !bytes.Equal(raw[:2], algEd25519[:]) {
+		return nil, fmt.Errorf("%w: Unexpected public key format", ErrInvalidKey)
+	}
+
+	k := PublicKey{Key: ed25519.PublicKey(raw[10:])}
+	copy(k.ID[:], raw[2:10])
+
+	return &k, nil
+}
+
+// ReadPrivateKeyFile reads the private key from the given file. The password
+// is used only if the key is encrypted.
+func ReadPrivateKeyFile(path string, password string) (*PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePrivateKey(data, password)
+}
+
+// ParsePrivateKey parses the content of the minisign secret key file. Both
+// encrypted (scrypt) and unencrypted keys are supported.
+func ParsePrivateKey(data []byte, password string) (*PrivateKey, error) {
+	raw, err := decodeKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Layout: sig_alg(2) kdf_alg(2) cksum_alg(2) kdf_salt(32) kdf_opslimit(8)
+	// kdf_memlimit(8) key_id(8) secret_key(64) checksum(32).
+	if len(raw) != 158 || !bytes.Equal(raw[:2], algEd25519[:]) || !bytes.Equal(raw[4:6], algBlake2b[:]) {
+		return nil, fmt.Errorf("%w: Unexpected secret key format", ErrInvalidKey)
+	}
+
+	keynum := raw[54:]
+
+	switch [2]byte(raw[2:4]) {
+	case kdfNone:
+	case kdfScrypt:
+		salt := raw[6:38]
+		opsLimit := binary.LittleEndian.Uint64(raw[38:46])
+		memLimit := binary.LittleEndian.Uint64(raw[46:54])
+
+		n, r, p := scryptParams(opsLimit, memLimit)
+
+		stream, err := scrypt.Key([]byte(password), salt, n, r, p, len(keynum))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: Unsupported key derivation function", ErrInvalidKey)
+	}
+
+	k := PrivateKey{Key: ed25519.PrivateKey(keynum[8:72])}
+	copy(k.ID[:], keynum[:8])
+
+	// Verify the checksum to detect invalid password.
+	checksum := blake2b.Sum256(slices.Concat(raw[:2], keynum[:72]))
+	if subtle.ConstantTimeCompare(checksum[:], keynum[72:]) != 1 {
+		return nil, fmt.Errorf("%w: Checksum mismatch (wrong password?)", ErrInvalidKey)
+	}
+
+	return &k, nil
+}
+
+// Sign signs the given data and returns the content of the signature file.
+// The data is prehashed with BLAKE2b-512. The trusted comment is signed
+// together with the signature.
+func (k PrivateKey) Sign(data []byte, trustedComment string) []byte {
+	hash := blake2b.Sum512(data)
+
+	sig := make([]byte, 0, 74)
+	sig = append(sig, algEd25519Hashed[:]...)
+	sig = append(sig, k.ID[:]...)
+	sig = append(sig, ed25519.Sign(k.Key, hash[:])...)
+
+	globalSig := ed25519.Sign(k.Key, slices.Concat(sig[10:], []byte(trustedComment)))
+
+	var b strings.Builder
+	b.WriteString(untrustedCommentHd + "signature from minisign secret key\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(sig) + "\n")
+	b.WriteString(trustedCommentHd + trustedComment + "\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(globalSig) + "\n")
+
+	return []byte(b.String())
+}
+
+// SignFile signs the file on the given path and writes the signature to the
+// signature path. The name is used in the trusted comment and defaults to the
+// base name of the signed file.
+func (k PrivateKey) SignFile(path string, sigPath string, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		name = filepath.Base(path)
+	}
+
+	comment := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", shared.Now().Unix(), name)
+
+	return os.WriteFile(sigPath, k.Sign(data, comment), 0644)
+}
+
+// Verify verifies the signature (content of the signature file) of the given
+// data.
+func (k PublicKey) Verify(data []byte, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], trustedCommentHd) {
+		return fmt.Errorf("%w: Unexpected signature format", ErrInvalidSignature)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return fmt.Errorf("%w: Unexpected signature format", ErrInvalidSignature)
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: Unexpected global signature format", ErrInvalidSignature)
+	}
+
+	if !bytes.Equal(sig[2:10], k.ID[:]) {
+		return fmt.Errorf("%w: Signed with a different key", ErrInvalidSignature)
+	}
+
+	switch [2]byte(sig[:2]) {
+	case algEd25519Hashed:
+		hash := blake2b.Sum512(data)
+		data = hash[:]
+	case algEd25519:
+	default:
+		return fmt.Errorf("%w: Unsupported signature algorithm", ErrInvalidSignature)
+	}
+
+	if !ed25519.Verify(k.Key, data, sig[10:]) {
+		return fmt.Errorf("%w: Signature verification failed", ErrInvalidSignature)
+	}
+
+	trustedComment := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), trustedCommentHd)
+	if !ed25519.Verify(k.Key, slices.Concat(sig[10:], []byte(trustedComment)), globalSig) {
+		return fmt.Errorf("%w: Trusted comment verification failed", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// VerifyFile verifies the file on the given path against its signature file
+// that is located next to it.
+func (k PublicKey) VerifyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sig, err := os.ReadFile(path + SignatureExt)
+	if err != nil {
+		return err
+	}
+
+	return k.Verify(data, sig)
+}
+
+// decodeKey decodes the base64 encoded key. If multiple lines are present,
+// the untrusted comment is skipped.
+func decodeKey(data []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	line := lines[0]
+	if strings.HasPrefix(line, untrustedCommentHd) {
+		if len(lines) < 2 {
+			return nil, fmt.Errorf("%w: Missing key", ErrInvalidKey)
+		}
+
+		line = lines[1]
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	return raw, nil
+}
+
+// scryptParams converts the libsodium's opslimit and memlimit into scrypt
+// parameters N, r, and p.
+func scryptParams(opsLimit uint64, memLimit uint64) (n int, r int, p int) {
+	r = 8
+	opsLimit = max(opsLimit, 32768)
+
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		maxN = opsLimit / (uint64(r) * 4)
+		p = 1
+	} else {
+		maxN = memLimit / (uint64(r) * 128)
+	}
+
+	logN := 1
+	for ; logN < 63; logN++ {
+		if uint64(1)<<logN > maxN/2 {
+			break
+		}
+	}
+
+	if opsLimit >= memLimit/32 {
+		maxRP := (opsLimit / 4) / (uint64(1) << logN)
+		maxRP = min(maxRP, 0x3fffffff)
+		p = int(maxRP) / r
+	}
+
+	return 1 << logN, r, p
+}
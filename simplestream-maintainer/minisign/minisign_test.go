@@ -0,0 +1,199 @@
+package minisign_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/minisign"
+)
+
+// encodeSecretKey encodes the key in the minisign secret key file format.
+// If the password is not empty, the key is encrypted using scrypt with
+// parameters N=1024, r=8, p=1.
+func encodeSecretKey(t *testing.T, key minisign.PrivateKey, password string) []byte {
+	keynum := slices.Concat(key.ID[:], key.Key)
+	checksum := blake2b.Sum256(slices.Concat([]byte("Ed"), keynum))
+	keynum = append(keynum, checksum[:]...)
+
+	salt := make([]byte, 32)
+	kdf := []byte{0, 0}
+	opsLimit := make([]byte, 8)
+	memLimit := make([]byte, 8)
+
+	if password != "" {
+		_, err := rand.Read(salt)
+		require.NoError(t, err)
+
+		kdf = []byte("Sc")
+		binary.LittleEndian.PutUint64(opsLimit, 32768)
+		binary.LittleEndian.PutUint64(memLimit, 1<<20)
+
+		stream, err := scrypt.Key([]byte(password), salt, 1024, 8, 1, len(keynum))
+		require.NoError(t, err)
+
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	}
+
+	raw := slices.Concat([]byte("Ed"), kdf, []byte("B2"), salt, opsLimit, memLimit, keynum)
+	return []byte("untrusted comment: minisign secret key\n" + base64.StdEncoding.EncodeToString(raw) + "\n")
+}
+
+func newKey(t *testing.T) minisign.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key := minisign.PrivateKey{Key: priv}
+	_, err = rand.Read(key.ID[:])
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	t.Parallel()
+
+	key := newKey(t)
+
+	tests := []struct {
+		Name        string
+		Password    string
+		UsePassword string
+		WantErr     error
+	}{
+		{
+			Name: "Unencrypted key",
+		},
+		{
+			Name:        "Encrypted key",
+			Password:    "secret",
+			UsePassword: "secret",
+		},
+		{
+			Name:        "Encrypted key with wrong password",
+			Password:    "secret",
+			UsePassword: "invalid",
+			WantErr:     minisign.ErrInvalidKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			data := encodeSecretKey(t, key, test.Password)
+
+			got, err := minisign.ParsePrivateKey(data, test.UsePassword)
+			if test.WantErr != nil {
+				require.ErrorIs(t, err, test.WantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, key.ID, got.ID)
+			require.Equal(t, key.Key, got.Key)
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	t.Parallel()
+
+	key := newKey(t).Public()
+	encoded := base64.StdEncoding.EncodeToString(slices.Concat([]byte("Ed"), key.ID[:], key.Key))
+
+	// Public key file.
+	got, err := minisign.ParsePublicKey([]byte("untrusted comment: minisign public key\n" + encoded + "\n"))
+	require.NoError(t, err)
+	require.Equal(t, key, *got)
+
+	// Single base64 encoded line.
+	got, err = minisign.ParsePublicKey([]byte(encoded))
+	require.NoError(t, err)
+	require.Equal(t, key, *got)
+
+	// Invalid key.
+	_, err = minisign.ParsePublicKey([]byte("invalid"))
+	require.ErrorIs(t, err, minisign.ErrInvalidKey)
+}
+
+func TestKeyID(t *testing.T) {
+	t.Parallel()
+
+	key := newKey(t)
+	key.ID = [8]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0xAB}
+
+	require.Equal(t, "AB07060504030201", key.KeyID())
+	require.Equal(t, key.KeyID(), key.Public().KeyID())
+}
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	key := newKey(t)
+	data := []byte("content")
+	sig := key.Sign(data, "timestamp:0\tfile:test\thashed")
+
+	tests := []struct {
+		Name      string
+		Key       minisign.PublicKey
+		Data      []byte
+		Signature []byte
+		WantErr   bool
+	}{
+		{
+			Name:      "Valid signature",
+			Key:       key.Public(),
+			Data:      data,
+			Signature: sig,
+		},
+		{
+			Name:      "Modified data",
+			Key:       key.Public(),
+			Data:      []byte("modified"),
+			Signature: sig,
+			WantErr:   true,
+		},
+		{
+			Name:      "Modified trusted comment",
+			Key:       key.Public(),
+			Data:      data,
+			Signature: []byte(strings.Replace(string(sig), "file:test", "file:other", 1)),
+			WantErr:   true,
+		},
+		{
+			Name:      "Different key",
+			Key:       newKey(t).Public(),
+			Data:      data,
+			Signature: sig,
+			WantErr:   true,
+		},
+		{
+			Name:      "Invalid signature format",
+			Key:       key.Public(),
+			Data:      data,
+			Signature: []byte("invalid"),
+			WantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Key.Verify(test.Data, test.Signature)
+			if test.WantErr {
+				require.ErrorIs(t, err, minisign.ErrInvalidSignature)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrUnknownHashAlgorithm indicates that the hash algorithm is not supported.
+var ErrUnknownHashAlgorithm = errors.New("Unknown hash algorithm")
+
+// Supported hash algorithms of the item digests.
+const (
+	// HashAlgorithmSHA256 represents the SHA-256 hash algorithm.
+	HashAlgorithmSHA256 = "sha256"
+
+	// HashAlgorithmSHA512 represents the SHA-512 hash algorithm.
+	HashAlgorithmSHA512 = "sha512"
+
+	// HashAlgorithmBLAKE2b represents the BLAKE2b-512 hash algorithm.
+	HashAlgorithmBLAKE2b = "blake2b"
+)
+
+// checksumAlgorithms are hash algorithms supported for checksum verification
+// ordered from the strongest to the weakest.
+var checksumAlgorithms = []string{
+	HashAlgorithmBLAKE2b,
+	HashAlgorithmSHA512,
+	HashAlgorithmSHA256,
+}
+
+// strongestAlgorithm returns the strongest supported hash algorithm among the
+// keys of the given digests. If none is supported, SHA-256 is returned.
+func strongestAlgorithm(digests map[string]string) string {
+	for _, algorithm := range checksumAlgorithms {
+		_, ok := digests[algorithm]
+		if ok {
+			return algorithm
+		}
+	}
+
+	return HashAlgorithmSHA256
+}
+
+// NewHash returns a new hash for the given hash algorithm.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashAlgorithmSHA256:
+		return sha256.New(), nil
+	case HashAlgorithmSHA512:
+		return sha512.New(), nil
+	case HashAlgorithmBLAKE2b:
+		return blake2b.New512(nil)
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownHashAlgorithm, algorithm)
+}
+
+// fileDigests calculates the digests of the file on the given path for each
+// of the given hash algorithms. The file is read only once. Digests are
+// returned in a map, where the key represents the hash algorithm.
+func fileDigests(path string, algorithms []string) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+
+	for _, algorithm := range algorithms {
+		_, ok := hashes[algorithm]
+		if ok {
+			continue
+		}
+
+		h, err := NewHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+
+	if len(hashes) == 0 {
+		return map[string]string{}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(io.MultiWriter(writers...), file)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		digests[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return digests, nil
+}
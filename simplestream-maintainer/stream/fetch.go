@@ -0,0 +1,266 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// fetchAttempts is the number of attempts to fetch a remote file.
+const fetchAttempts = 3
+
+// fetchRetryDelay is the delay between the attempts to fetch a remote file.
+const fetchRetryDelay = time.Second
+
+// httpTransport is the transport used to fetch remote files. It bounds the
+// time spent on establishing the connection and waiting for the response.
+var httpTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return transport
+}()
+
+// readClient is used to fetch remote files that are read into memory, such as
+// product catalogs. Such files are small, hence the whole request is bounded.
+var readClient = &http.Client{
+	Transport: httpTransport,
+	Timeout:   5 * time.Minute,
+}
+
+// downloadClient is used to download remote files of arbitrary size, such as
+// image items, therefore, only the transport timeouts apply.
+var downloadClient = &http.Client{
+	Transport: httpTransport,
+}
+
+// retryFetch calls the given function up to fetchAttempts times until it
+// succeeds. Retrying stops once the context is cancelled.
+func retryFetch(ctx context.Context, f func() error) error {
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || i >= fetchAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(fetchRetryDelay):
+		}
+	}
+}
+
+// IsRemoteLocation returns true if the location is an HTTP or HTTPS URL.
+func IsRemoteLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// JoinLocation joins the given elements to the location, which is either
+// a local path or an HTTP(S) URL.
+func JoinLocation(location string, elem ...string) string {
+	if !IsRemoteLocation(location) {
+		return filepath.Join(append([]string{location}, elem...)...)
+	}
+
+	joined, err := url.JoinPath(location, elem...)
+	if err != nil {
+		// Fallback to plain concatenation for URLs that cannot be parsed.
+		return strings.TrimSuffix(location, "/") + "/" + strings.Join(elem, "/")
+	}
+
+	return joined
+}
+
+// ReadLocation returns the content of the file on the given location, which
+// is either a local path or an HTTP(S) URL. Content of files with the ".gz"
+// extension is decompressed. Remote files are fetched with retries. If the
+// remote file does not exist, the returned error wraps os.ErrNotExist.
+func ReadLocation(ctx context.Context, location string) ([]byte, error) {
+	isGZip := strings.HasSuffix(location, ".gz")
+
+	if !IsRemoteLocation(location) {
+		if isGZip {
+			return shared.ReadGZipFile(location)
+		}
+
+		return os.ReadFile(location)
+	}
+
+	var data []byte
+
+	err := retryFetch(ctx, func() error {
+		var err error
+
+		data, err = httpGetBytes(ctx, location)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		// Do not retry missing files.
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("Failed to fetch %q: %w", location, os.ErrNotExist)
+	}
+
+	if isGZip {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", shared.ErrGZipCorrupted, location, err)
+		}
+
+		defer reader.Close()
+
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", shared.ErrGZipCorrupted, location, err)
+		}
+	}
+
+	return data, nil
+}
+
+// DownloadLocation writes the content of the file on the given location, which
+// is either a local path or an HTTP(S) URL, to the given path. In contrast to
+// ReadLocation, the content is never decompressed nor held in memory. Remote
+// files are fetched with retries. If the remote file does not exist, the
+// returned error wraps os.ErrNotExist.
+func DownloadLocation(ctx context.Context, location string, path string) error {
+	if !IsRemoteLocation(location) {
+		return shared.Copy(location, path)
+	}
+
+	var notExistErr error
+
+	err := retryFetch(ctx, func() error {
+		err := httpDownload(ctx, location, path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Do not retry missing files.
+			notExistErr = err
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return notExistErr
+}
+
+// httpGet returns the body of the response to the GET request sent to the
+// given URL using the given client. If the server responds with 404, an error
+// wrapping os.ErrNotExist is returned. The caller is responsible for closing
+// the body.
+func httpGet(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch %q: %w", url, os.ErrNotExist)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch %q: %s", url, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// httpGetBytes returns the body of the response to the GET request sent to
+// the given URL.
+func httpGetBytes(ctx context.Context, url string) ([]byte, error) {
+	body, err := httpGet(ctx, readClient, url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %q: %w", url, err)
+	}
+
+	return data, nil
+}
+
+// httpDownload writes the body of the response to the GET request sent to
+// the given URL to the given path.
+func httpDownload(ctx context.Context, url string, path string) error {
+	body, err := httpGet(ctx, downloadClient, url)
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, body)
+	if err != nil {
+		return fmt.Errorf("Failed to download %q: %w", url, err)
+	}
+
+	return file.Close()
+}
+
+// readJSONLocation reads the JSON file on the given location into the given
+// object.
+func readJSONLocation[T any](ctx context.Context, location string, obj *T) (*T, error) {
+	data, err := ReadLocation(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, obj)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding JSON: %w", err)
+	}
+
+	return obj, nil
+}
+
+// ReadProductCatalog reads the product catalog from the given location, which
+// is either a local path or an HTTP(S) URL.
+func ReadProductCatalog(ctx context.Context, location string) (*ProductCatalog, error) {
+	return readJSONLocation(ctx, location, &ProductCatalog{})
+}
+
+// ReadStreamIndex reads the stream index from the given location, which is
+// either a local path or an HTTP(S) URL.
+func ReadStreamIndex(ctx context.Context, location string) (*StreamIndex, error) {
+	return readJSONLocation(ctx, location, &StreamIndex{})
+}
@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// hashCacheKeySep separates file paths within the cache key.
+const hashCacheKeySep = "|"
+
+// HashCache caches SHA256 hashes of files (or combined hashes of multiple
+// files). Cached hash is invalidated when the size or modification time of
+// any of the hashed files changes.
+type HashCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	// Root is the absolute path of the root directory the hashed file
+	// paths are relative to. It is empty for entries written before the
+	// root was recorded.
+	Root string `json:"root,omitempty"`
+
+	// Files contains size and modification time of each hashed file.
+	Files []hashCacheFile `json:"files"`
+
+	// SHA256 is the hash of the files.
+	SHA256 string `json:"sha256"`
+}
+
+type hashCacheFile struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+}
+
+// NewHashCache creates a new hash cache that is persisted in the file on the
+// given path. If the file already exists, the cache entries are loaded from it.
+func NewHashCache(path string) (*HashCache, error) {
+	c := &HashCache{
+		path:    path,
+		entries: make(map[string]hashCacheEntry),
+	}
+
+	_, err := shared.ReadJSONFile(path, &c.entries)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read hash cache: %w", err)
+	}
+
+	return c, nil
+}
+
+// FileHash returns the SHA256 hash of the files on the given paths that are
+// relative to the root directory. If the hash is cached for the same root
+// directory and none of the files has changed, the cached hash is returned.
+// Otherwise, the hash is calculated and stored in the cache. If the cache is
+// nil, the hash is always calculated.
+func (c *HashCache) FileHash(rootDir string, relPaths ...string) (string, error) {
+	paths := make([]string, 0, len(relPaths))
+	files := make([]hashCacheFile, 0, len(relPaths))
+
+	for _, relPath := range relPaths {
+		path := filepath.Join(rootDir, relPath)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+
+		paths = append(paths, path)
+		files = append(files, hashCacheFile{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	if c == nil {
+		return shared.FileHash(sha256.New(), paths...)
+	}
+
+	root, err := filepath.Abs(rootDir)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.Join(relPaths, hashCacheKeySep)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && entry.SHA256 != "" && (entry.Root == root || entry.Root == "") && slices.Equal(entry.Files, files) {
+		// Record the root of entries written before it was recorded.
+		entry.Root = root
+		c.entries[key] = entry
+		c.mu.Unlock()
+
+		return entry.SHA256, nil
+	}
+
+	c.mu.Unlock()
+
+	hash, err := shared.FileHash(sha256.New(), paths...)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = hashCacheEntry{Root: root, Files: files, SHA256: hash}
+	c.mu.Unlock()
+
+	return hash, nil
+}
+
+// Save writes the cache to its file. Entries referencing files that no longer
+// exist within the root directory they were hashed from are removed from the
+// cache. Entries without a recorded root are checked against the given root
+// directory.
+func (c *HashCache) Save(rootDir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		root := entry.Root
+		if root == "" {
+			root = rootDir
+		}
+
+		for _, relPath := range strings.Split(key, hashCacheKeySep) {
+			_, err := os.Stat(filepath.Join(root, relPath))
+			if err != nil {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(c.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write cache to a temporary file to ensure atomic replace.
+	pathTemp := filepath.Join(filepath.Dir(c.path), "."+filepath.Base(c.path)+".tmp")
+
+	err = shared.WriteJSONFile(pathTemp, c.entries)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(pathTemp)
+
+	return os.Rename(pathTemp, c.path)
+}
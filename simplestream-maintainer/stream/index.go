@@ -1,8 +1,11 @@
 package stream
 
 import (
+	"slices"
 	"sort"
 	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
 type StreamIndexEntry struct {
@@ -11,8 +14,30 @@ type StreamIndexEntry struct {
 	Format   string   `json:"format"`
 	Updated  string   `json:"updated"`
 	Products []string `json:"products"`
+
+	// SHA256 is the hash of the product catalog file. It allows clients
+	// to skip downloading an unchanged product catalog.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Size is the size of the uncompressed product catalog file.
+	Size int64 `json:"size,omitempty"`
+
+	// SizeGZip is the size of the gzipped product catalog file.
+	SizeGZip int64 `json:"size_gz,omitempty"`
+
+	// SignKeyID is the ID of the minisign key used to sign the product
+	// catalog file. It allows mapping signatures to keys across key
+	// rotations.
+	SignKeyID string `json:"sign_key_id,omitempty"`
 }
 
+// FormatIndex is the default format of the index.
+const FormatIndex = "index:1.0"
+
+// IndexFormats are the known formats of the index. A new format must be added
+// here before it can be written.
+var IndexFormats = []string{FormatIndex}
+
 type StreamIndex struct {
 	Format string                      `json:"format"`
 	Index  map[string]StreamIndexEntry `json:"index"`
@@ -21,13 +46,15 @@ type StreamIndex struct {
 // NewStreamIndex creates new empty index.
 func NewStreamIndex() StreamIndex {
 	return StreamIndex{
-		Format: "index:1.0",
+		Format: FormatIndex,
 		Index:  make(map[string]StreamIndexEntry),
 	}
 }
 
-// AddEntry adds catalog and a list of its products to the index.
-func (i *StreamIndex) AddEntry(streamName string, catalogPath string, catalog ProductCatalog) {
+// AddEntry adds catalog and a list of its products to the index. The given
+// hash of the catalog file is included in the entry, unless it is empty. The
+// entry format matches the catalog format.
+func (i *StreamIndex) AddEntry(streamName string, catalogPath string, catalogSHA256 string, catalog ProductCatalog) {
 	products := make([]string, 0, len(catalog.Products))
 	for p := range catalog.Products {
 		products = append(products, p)
@@ -35,11 +62,93 @@ func (i *StreamIndex) AddEntry(streamName string, catalogPath string, catalog Pr
 
 	sort.Strings(products)
 
+	format := catalog.Format
+	if format == "" {
+		format = FormatProducts
+	}
+
 	i.Index[streamName] = StreamIndexEntry{
-		Format:   "products:1.0",
+		Format:   format,
 		Path:     catalogPath,
 		Datatype: catalog.DataType,
-		Updated:  time.Now().Format(time.RFC3339),
+		Updated:  shared.Now().Format(time.RFC3339),
 		Products: products,
+		SHA256:   catalogSHA256,
+	}
+}
+
+// RetainUpdated sets the update time of the stream's index entry to the one
+// from the previous index. This way, the update time changes only when the
+// stream's product catalog changes. If either of the entries does not exist,
+// the index is not modified.
+func (i *StreamIndex) RetainUpdated(prev StreamIndex, streamName string) {
+	entry, ok := i.Index[streamName]
+	if !ok {
+		return
+	}
+
+	prevEntry, ok := prev.Index[streamName]
+	if !ok || prevEntry.Updated == "" {
+		return
+	}
+
+	entry.Updated = prevEntry.Updated
+	i.Index[streamName] = entry
+}
+
+// MergeEntries adds entries of the previous index that are missing in the
+// index, unless the given function reports them as replaced. Existing entries
+// of the index are never overwritten.
+func (i *StreamIndex) MergeEntries(prev StreamIndex, replaced func(streamName string, entry StreamIndexEntry) bool) {
+	for name, entry := range prev.Index {
+		_, ok := i.Index[name]
+		if ok || replaced(name, entry) {
+			continue
+		}
+
+		i.Index[name] = entry
+	}
+}
+
+// RetainProducts removes products that are not among the given product IDs
+// from the stream's index entry. The product catalog referenced by the entry
+// is not affected. If the entry does not exist, the index is not modified.
+func (i *StreamIndex) RetainProducts(streamName string, productIDs []string) {
+	entry, ok := i.Index[streamName]
+	if !ok {
+		return
+	}
+
+	entry.Products = slices.DeleteFunc(entry.Products, func(id string) bool {
+		return !slices.Contains(productIDs, id)
+	})
+
+	i.Index[streamName] = entry
+}
+
+// SetSizes sets the sizes of the uncompressed and gzipped product catalog
+// files of the stream's index entry. If the entry does not exist, the index
+// is not modified.
+func (i *StreamIndex) SetSizes(streamName string, size int64, sizeGZip int64) {
+	entry, ok := i.Index[streamName]
+	if !ok {
+		return
+	}
+
+	entry.Size = size
+	entry.SizeGZip = sizeGZip
+	i.Index[streamName] = entry
+}
+
+// SetSignKeyID sets the ID of the key used to sign the product catalog file
+// of the stream's index entry. If the entry does not exist, the index is not
+// modified.
+func (i *StreamIndex) SetSignKeyID(streamName string, keyID string) {
+	entry, ok := i.Index[streamName]
+	if !ok {
+		return
 	}
+
+	entry.SignKeyID = keyID
+	i.Index[streamName] = entry
 }
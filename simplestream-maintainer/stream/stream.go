@@ -2,10 +2,11 @@ package stream
 
 import (
 	"bufio"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
@@ -31,6 +32,25 @@ var (
 	// either the directory on the given path does not exist, or it's path
 	// does not match the expected format.
 	ErrProductInvalidPath = errors.New("Invalid product path")
+
+	// ErrChecksumMismatch indicates that the hash of the version item does
+	// not match the checksum found in the version's checksum file.
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+	// ErrProductFieldNotPreservable indicates that the product field cannot
+	// be preserved, because it is either unknown or derived from the product
+	// path or versions.
+	ErrProductFieldNotPreservable = errors.New("Product field cannot be preserved")
+)
+
+// Product fields (JSON names) that can be preserved from the existing
+// product catalog.
+const (
+	ProductFieldAliases                  = "aliases"
+	ProductFieldOS                       = "os"
+	ProductFieldReleaseTitle             = "release_title"
+	ProductFieldRequirements             = "requirements"
+	ProductFieldInstanceTypeRequirements = "instance_type_requirements"
 )
 
 // Static list of file names.
@@ -38,9 +58,27 @@ const (
 	// FileChecksumSHA256 is the name of the checksum file containing SHA256 hashes.
 	FileChecksumSHA256 = "SHA256SUMS"
 
-	// FileImageConfig is the name of the file that contains additional information
-	// about the version.
+	// FileImageConfig is the default name of the file that contains additional
+	// information about the version.
 	FileImageConfig = "image.yaml"
+
+	// FileImageConfigGz is the name of the compressed image config file. It is
+	// used only when uncompressed image config does not exist.
+	FileImageConfigGz = FileImageConfig + ".gz"
+
+	// FileManifest is the name of the file that lists all files within the
+	// version directory with their size and modification time.
+	FileManifest = "MANIFEST"
+
+	// FileStreamDefaults is the name of the file within the stream directory
+	// that contains image config defaults shared by all products of the
+	// stream.
+	FileStreamDefaults = "defaults.yaml"
+
+	// FileIgnore is the name of the file containing glob patterns of files
+	// that are excluded from the version items. It can be placed in either
+	// the product or the version directory.
+	FileIgnore = ".ssignore"
 )
 
 // ItemType is a type of the file that item holds.
@@ -56,6 +94,10 @@ const (
 	// ItemTypeSquashfsDelta represents container's root file system delta (VCDiff).
 	ItemTypeSquashfsDelta = "squashfs.vcdiff"
 
+	// ItemTypeSquashfsCaibx represents casync chunk index of container's root
+	// file system (squashfs).
+	ItemTypeSquashfsCaibx = "squashfs.caibx"
+
 	// ItemTypeDiskKVM represents VM's root file system (qcow2).
 	ItemTypeDiskKVM = "disk-kvm.img"
 
@@ -64,8 +106,29 @@ const (
 
 	// ItemTypeRootTarXz represents root file system as a tarball.
 	ItemTypeRootTarXz = "root.tar.xz"
+
+	// ItemTypeRootTarZst represents root file system as a zstd compressed tarball.
+	ItemTypeRootTarZst = "root.tar.zst"
+
+	// ItemTypeRootImg represents root file system as a raw disk image.
+	ItemTypeRootImg = "root.img"
 )
 
+// PrimaryItemTypes are root file system item types that make a version
+// complete when present alongside the metadata. They are also the targets
+// of generated delta files. Adding a new root file system type here applies
+// it consistently to version completeness, pruning, and delta generation.
+var PrimaryItemTypes = []string{
+	ItemTypeSquashfs,
+	ItemTypeDiskKVM,
+}
+
+// IsPrimaryItemType returns true if the given item type is one of the
+// PrimaryItemTypes.
+func IsPrimaryItemType(ftype string) bool {
+	return slices.Contains(PrimaryItemTypes, ftype)
+}
+
 // ItemExt is file extension of the the file that item holds.
 type ItemExt string
 
@@ -79,11 +142,21 @@ const (
 	// ItemExtSquashfsDelta is a file extension of container's root file system delta (VCDiff).
 	ItemExtSquashfsDelta = ".vcdiff"
 
+	// ItemExtSquashfsCaibx is a file extension of container's root file system
+	// casync chunk index.
+	ItemExtSquashfsCaibx = ".squashfs.caibx"
+
 	// ItemExtDiskKVM is a file extension of VM's root file system.
 	ItemExtDiskKVM = ".qcow2"
 
 	// ItemExtDiskKVMDelta is a file extension of VM's root file system delta (VCDiff).
 	ItemExtDiskKVMDelta = ".qcow2.vcdiff"
+
+	// ItemExtRootTarZst is a file extension of root file system zstd compressed tarball.
+	ItemExtRootTarZst = ".tar.zst"
+
+	// ItemExtRootImg is a file extension of root file system raw disk image.
+	ItemExtRootImg = ".img"
 )
 
 // List of item extensions that will be included in a product version.
@@ -91,8 +164,11 @@ var allowedItemExtensions = []string{
 	ItemExtMetadata,
 	ItemExtSquashfs,
 	ItemExtSquashfsDelta,
+	ItemExtSquashfsCaibx,
 	ItemExtDiskKVM,
 	ItemExtDiskKVMDelta,
+	ItemExtRootTarZst,
+	ItemExtRootImg,
 }
 
 // Item represents a file within a product version.
@@ -105,12 +181,21 @@ type Item struct {
 	// the simplestream content is hosted from).
 	Path string `json:"path"`
 
+	// Mirrors contains alternate paths or URLs of the file in the order of
+	// preference. The Path field remains the canonical location.
+	Mirrors []string `json:"mirrors,omitempty"`
+
 	// Size of file.
 	Size int64 `json:"size"`
 
 	// SHA256 hash of the file.
 	SHA256 string `json:"sha256,omitempty"`
 
+	// Digests of the file calculated using the configured hash algorithms,
+	// where the map key represents the hash algorithm. The SHA256 field is
+	// populated regardless of the configured algorithms.
+	Digests map[string]string `json:"digests,omitempty"`
+
 	// CombinedSHA256DiskKvmImg stores the combined SHA256 hash of the metadata
 	// and VM file system (qcow2) files. This field is set only for the metadata
 	// item when both files exist in the same product version.
@@ -126,9 +211,55 @@ type Item struct {
 	// item when both files exist in the same product version.
 	CombinedSHA256RootXz string `json:"combined_rootxz_sha256,omitempty"`
 
+	// CombinedSHA256RootZst stores the combined SHA256 hash of the metadata and
+	// root file system zstd compressed tarball files. This field is set only for
+	// the metadata item when both files exist in the same product version.
+	CombinedSHA256RootZst string `json:"combined_rootzst_sha256,omitempty"`
+
+	// CombinedSHA256RootImg stores the combined SHA256 hash of the metadata and
+	// root file system raw disk image files. This field is set only for the
+	// metadata item when both files exist in the same product version.
+	CombinedSHA256RootImg string `json:"combined_rootimg_sha256,omitempty"`
+
+	// Combined stores the combined SHA256 hashes of the metadata and root file
+	// system files, where the map key represents the root file system type.
+	// This field is set only for the metadata item and is populated alongside
+	// the dedicated CombinedSHA256* fields which are kept for compatibility.
+	Combined map[string]string `json:"combined_sha256s,omitempty"`
+
 	// DeltaBase indicates the version from which the delta (.vcdiff) file was
 	// calculated from. This field is set only for the delta items.
 	DeltaBase string `json:"delta_base,omitempty"`
+
+	// DeltaBaseProduct indicates the product whose version was used as a base
+	// for the delta file. This field is set only for delta items calculated
+	// across sibling products.
+	DeltaBaseProduct string `json:"delta_base_product,omitempty"`
+}
+
+// CombinedSHA256 returns the combined SHA256 hash of the metadata and the root
+// file system of the given type. Hash is primarily retrieved from the Combined
+// map, and the dedicated CombinedSHA256* fields are used as a fallback.
+func (i Item) CombinedSHA256(rootfsType string) string {
+	hash, ok := i.Combined[rootfsType]
+	if ok {
+		return hash
+	}
+
+	switch rootfsType {
+	case ItemTypeDiskKVM:
+		return i.CombinedSHA256DiskKvmImg
+	case ItemTypeSquashfs:
+		return i.CombinedSHA256SquashFs
+	case ItemTypeRootTarXz:
+		return i.CombinedSHA256RootXz
+	case ItemTypeRootTarZst:
+		return i.CombinedSHA256RootZst
+	case ItemTypeRootImg:
+		return i.CombinedSHA256RootImg
+	}
+
+	return ""
 }
 
 // Version represents a list of items available for the given image version.
@@ -141,12 +272,96 @@ type Version struct {
 	// Checksums of files within the version.
 	Checksums map[string]string `json:"-"`
 
+	// ChecksumFile is the name of the checksum file from which the
+	// checksums were read.
+	ChecksumFile string `json:"-"`
+
+	// ChecksumDigests contains all digests read from the version's
+	// checksum file, mapped by the file name and the hash algorithm.
+	// Checksums contain only the SHA-256 ones.
+	ChecksumDigests map[string]map[string]string `json:"-"`
+
+	// digests contains digests of the items calculated for checksum
+	// verification using algorithms other than SHA-256, mapped by the
+	// item name and the hash algorithm.
+	digests map[string]map[string]string
+
 	// ImageConfig contains additional information about the product version.
 	ImageConfig shared.DefinitionSimplestream `json:"-"`
 
 	// Map of items found within the version, where the map key
 	// represents file name.
 	Items map[string]Item `json:"items,omitempty"`
+
+	// Map of auxiliary files (e.g. build logs) found within the version,
+	// where the map key represents file name. Auxiliary files are not
+	// image items, but are recorded so that mirrors can replicate them.
+	AuxFiles map[string]Item `json:"aux_files,omitempty"`
+}
+
+// HasItemType returns true if the version contains an item of the given type.
+func (v Version) HasItemType(ftype string) bool {
+	for _, item := range v.Items {
+		if item.Ftype == ftype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyChecksums compares the hashes of the version items with the checksums
+// read from the version's checksum file. If the checksum file contains digests
+// of multiple hash algorithms for an item, the strongest supported one is
+// used. For each mismatched item, an error wrapping ErrChecksumMismatch is
+// returned. Delta items without a checksum are ignored, because delta files
+// are generated after the checksum file is created. If the version has no
+// checksums, nil is returned.
+func (v Version) VerifyChecksums() error {
+	if v.Checksums == nil && v.ChecksumDigests == nil {
+		return nil
+	}
+
+	var errs []error
+
+	itemNames := shared.MapKeysSorted(v.Items)
+
+	for _, itemName := range itemNames {
+		item := v.Items[itemName]
+
+		// Checksums take precedence over the SHA-256 digests read from
+		// the checksum file, as they are updated when delta files are
+		// generated.
+		expected := maps.Clone(v.ChecksumDigests[itemName])
+		checksum, ok := v.Checksums[itemName]
+		if ok {
+			if expected == nil {
+				expected = make(map[string]string)
+			}
+
+			expected[HashAlgorithmSHA256] = checksum
+		}
+
+		if len(expected) == 0 && (item.Ftype == ItemTypeDiskKVMDelta || item.Ftype == ItemTypeSquashfsDelta) {
+			continue
+		}
+
+		algorithm := strongestAlgorithm(expected)
+
+		actual := item.SHA256
+		if algorithm != HashAlgorithmSHA256 {
+			actual = item.Digests[algorithm]
+			if actual == "" {
+				actual = v.digests[itemName][algorithm]
+			}
+		}
+
+		if expected[algorithm] != actual {
+			errs = append(errs, fmt.Errorf("%w: Item %q in version %q: expected %q, actual %q", ErrChecksumMismatch, itemName, filepath.Dir(item.Path), expected[algorithm], actual))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // Product represents a single image with all its available versions.
@@ -179,6 +394,67 @@ type Product struct {
 	// image to work. Map key represents the configuration key and map
 	// value the expected configuration value.
 	Requirements map[string]string `json:"requirements"`
+
+	// Map of the requirements that apply only to a specific instance type.
+	// Map key represents the instance type (container or vm) and map value
+	// the requirements that need to be satisfied, in addition to the product
+	// requirements, by the instances of that type.
+	InstanceTypeRequirements map[string]map[string]string `json:"instance_type_requirements,omitempty"`
+
+	// HasContainer indicates whether any product version contains the
+	// container root file system (squashfs).
+	HasContainer bool `json:"has_container,omitempty"`
+
+	// HasVM indicates whether any product version contains the VM root
+	// file system (qcow2).
+	HasVM bool `json:"has_vm,omitempty"`
+
+	// Preserve contains JSON names of the product fields that are curated
+	// manually within the product catalog. On rebuild, such fields are
+	// carried over from the existing catalog instead of being derived from
+	// the directory hierarchy.
+	Preserve []string `json:"_preserve,omitempty"`
+}
+
+// PreserveFields copies the fields listed in the Preserve list of the given
+// previous product into the product, including the list itself. Unknown and
+// non-preservable fields are skipped and returned as a joined error, once
+// the remaining fields are copied.
+func (p *Product) PreserveFields(prev Product) error {
+	var errs []error
+
+	for _, field := range prev.Preserve {
+		switch field {
+		case ProductFieldAliases:
+			p.Aliases = prev.Aliases
+		case ProductFieldOS:
+			p.OS = prev.OS
+		case ProductFieldReleaseTitle:
+			p.ReleaseTitle = prev.ReleaseTitle
+		case ProductFieldRequirements:
+			p.Requirements = maps.Clone(prev.Requirements)
+		case ProductFieldInstanceTypeRequirements:
+			p.InstanceTypeRequirements = maps.Clone(prev.InstanceTypeRequirements)
+		default:
+			errs = append(errs, fmt.Errorf("%w: %q", ErrProductFieldNotPreservable, field))
+		}
+	}
+
+	p.Preserve = slices.Clone(prev.Preserve)
+
+	return errors.Join(errs...)
+}
+
+// UpdateInstanceTypes sets HasContainer and HasVM based on the item types of
+// the product versions.
+func (p *Product) UpdateInstanceTypes() {
+	p.HasContainer = false
+	p.HasVM = false
+
+	for _, version := range p.Versions {
+		p.HasContainer = p.HasContainer || version.HasItemType(ItemTypeSquashfs)
+		p.HasVM = p.HasVM || version.HasItemType(ItemTypeDiskKVM)
+	}
 }
 
 // ID returns the ID of the product.
@@ -206,6 +482,13 @@ type ProductCatalog struct {
 	Products map[string]Product `json:"products"`
 }
 
+// FormatProducts is the default format of the product catalog.
+const FormatProducts = "products:1.0"
+
+// CatalogFormats are the known formats of the product catalog. A new format
+// must be added here before it can be written.
+var CatalogFormats = []string{FormatProducts}
+
 // NewCatalog creates a new product catalog.
 func NewCatalog(streamName string, products map[string]Product) *ProductCatalog {
 	if products == nil {
@@ -215,7 +498,7 @@ func NewCatalog(streamName string, products map[string]Product) *ProductCatalog
 	return &ProductCatalog{
 		ContentID: streamName,
 		DataType:  "image-downloads",
-		Format:    "products:1.0",
+		Format:    FormatProducts,
 		Products:  products,
 	}
 }
@@ -226,10 +509,23 @@ type Option func(*options)
 type options struct {
 	includeIncomplete bool
 	calcHashes        bool
+	skipErrors        bool
+	lenientConfig     bool
+	checksumFiles     []string
+	configFiles       []string
+	auxFiles          []string
+	hashAlgorithms    []string
+	hashCache         *HashCache
+	requireBothRootfs bool
+	warningHandler    func(relPath string, err error)
+	incompleteHandler func(product Product, versionName string)
 }
 
 func newOptions(opts ...Option) *options {
-	o := &options{}
+	o := &options{
+		checksumFiles: []string{FileChecksumSHA256},
+		configFiles:   []string{FileImageConfig},
+	}
 
 	for _, opt := range opts {
 		if opt != nil {
@@ -255,9 +551,127 @@ func WithHashes(val bool) Option {
 	}
 }
 
+// WithSkipErrors ensures that products which fail to be read are logged and
+// skipped instead of aborting the entire traversal. Errors that occur while
+// walking the directory tree itself are still returned.
+func WithSkipErrors(val bool) Option {
+	return func(o *options) {
+		o.skipErrors = val
+	}
+}
+
+// WithLenientConfig ensures that a version with an invalid image config is
+// not rejected. Instead, the error is logged and the version is retrieved
+// with an empty image config.
+func WithLenientConfig(val bool) Option {
+	return func(o *options) {
+		o.lenientConfig = val
+	}
+}
+
+// WithWarningHandler sets the function that is called for each error that is
+// ignored instead of being returned, such as an invalid image config ignored
+// due to lenient config or a product skipped due to skipped errors. The path
+// of the affected version or product is relative to the root directory. If
+// the handler is not set, ignored errors are logged.
+func WithWarningHandler(handler func(relPath string, err error)) Option {
+	return func(o *options) {
+		o.warningHandler = handler
+	}
+}
+
+// WithIncompleteVersionHandler sets the function that is called for each
+// incomplete version (including hidden versions) that is omitted from the
+// retrieved product. The product may not be fully read yet, therefore, only
+// the fields derived from its path (e.g. distro and release) are reliable.
+func WithIncompleteVersionHandler(handler func(product Product, versionName string)) Option {
+	return func(o *options) {
+		o.incompleteHandler = handler
+	}
+}
+
+// warn reports the ignored error either to the warning handler or to the log.
+func (o *options) warn(msg string, relPath string, err error) {
+	if o.warningHandler != nil {
+		o.warningHandler(relPath, fmt.Errorf("%s: %w", msg, err))
+		return
+	}
+
+	slog.Warn(msg, "path", relPath, "error", err)
+}
+
+// WithChecksumFiles sets the candidate names of the checksum file within
+// the version. If multiple candidates exist, the first one in the given
+// order is used. Defaults to SHA256SUMS.
+func WithChecksumFiles(names ...string) Option {
+	return func(o *options) {
+		if len(names) > 0 {
+			o.checksumFiles = names
+		}
+	}
+}
+
+// WithImageConfigFiles sets the candidate names of the image config file
+// within the version. Each candidate may also be gzip compressed, in which
+// case it has an additional ".gz" suffix. Candidates take precedence in the
+// given order, and the uncompressed file is preferred over the compressed
+// one with the same name. Defaults to image.yaml.
+func WithImageConfigFiles(names ...string) Option {
+	return func(o *options) {
+		if len(names) > 0 {
+			o.configFiles = names
+		}
+	}
+}
+
+// WithAuxFiles sets the glob patterns of auxiliary file names that are
+// recorded within the version. Files matching an item extension, checksum
+// file, or image config file are never considered auxiliary.
+func WithAuxFiles(patterns ...string) Option {
+	return func(o *options) {
+		o.auxFiles = patterns
+	}
+}
+
+// WithHashAlgorithms sets the hash algorithms used to calculate the item
+// digests when item hashes are calculated. Digests are not cached.
+func WithHashAlgorithms(algorithms ...string) Option {
+	return func(o *options) {
+		o.hashAlgorithms = algorithms
+	}
+}
+
+// WithHashCache sets the cache that is consulted before calculating the item
+// hashes and combined hashes.
+func WithHashCache(cache *HashCache) Option {
+	return func(o *options) {
+		o.hashCache = cache
+	}
+}
+
+// WithRequireBothRootfs ensures that a version is considered complete only
+// if it contains both the container (squashfs) and the VM (qcow2) root file
+// system. The same requirement can be set for an individual version within
+// its image config.
+func WithRequireBothRootfs(val bool) Option {
+	return func(o *options) {
+		o.requireBothRootfs = val
+	}
+}
+
+// productPathFormat is the required format of the product path relative to
+// the root directory.
+const productPathFormat = "stream/distribution/release/architecture/variant"
+
+// productPathDepth is the number of components of the product path.
+var productPathDepth = len(strings.Split(productPathFormat, "/"))
+
 // GetProducts traverses through the directories on the given path and retrieves
-// a map of found products.
+// a map of found products. The path relative to the root directory can point to
+// the stream or to any directory within it (e.g. release or architecture), in
+// which case only products within that subtree are retrieved.
 func GetProducts(rootDir string, streamRelPath string, options ...Option) (map[string]Product, error) {
+	opts := newOptions(options...)
 	streamPath := filepath.Join(rootDir, streamRelPath)
 
 	products := make(map[string]Product)
@@ -274,6 +688,23 @@ func GetProducts(rootDir string, streamRelPath string, options ...Option) (map[s
 			return err
 		}
 
+		// skip prevents descending into the current directory. Note
+		// that symlinked products are not directories.
+		skip := func() error {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		// Products cannot be located deeper than the product path
+		// format allows, therefore, do not descend further.
+		depth := len(strings.Split(relPath, string(os.PathSeparator)))
+		if depth > productPathDepth {
+			return skip()
+		}
+
 		// Get product on the given path.
 		product, err := GetProduct(rootDir, relPath, options...)
 		if err != nil {
@@ -282,16 +713,23 @@ func GetProducts(rootDir string, streamRelPath string, options ...Option) (map[s
 				return nil
 			}
 
+			if opts.skipErrors {
+				opts.warn("Skipping product that cannot be read", relPath, err)
+				return skip()
+			}
+
 			return err
 		}
 
-		// Skip products with no versions (empty products).
+		// Skip products with no versions (empty products). Product
+		// subdirectories are versions, therefore, do not descend
+		// into them.
 		if len(product.Versions) == 0 {
-			return nil
+			return skip()
 		}
 
 		products[product.ID()] = *product
-		return nil
+		return skip()
 	})
 	if err != nil {
 		return nil, err
@@ -304,16 +742,20 @@ func GetProducts(rootDir string, streamRelPath string, options ...Option) (map[s
 // Product's relative path must match the predetermined format, otherwise, an error
 // is returned.
 func GetProduct(rootDir string, productRelPath string, options ...Option) (*Product, error) {
-	productPath := filepath.Join(rootDir, productRelPath)
-	productPathFormat := "stream/distribution/release/architecture/variant"
-	productPathLength := len(strings.Split(productPathFormat, string(os.PathSeparator)))
+	// Normalize the separators and redundant path elements, so that the
+	// path components are counted correctly regardless of how the path
+	// was constructed.
+	normalizedPath := path.Clean(filepath.ToSlash(productRelPath))
 
 	// Ensure product relative path matches the required format.
-	parts := strings.Split(productRelPath, string(os.PathSeparator))
-	if len(parts) < productPathLength || len(parts) > productPathLength {
-		return nil, fmt.Errorf("%w: path %q does not match the required format %q", ErrProductInvalidPath, productRelPath, productPathFormat)
+	parts := strings.Split(normalizedPath, "/")
+	if len(parts) != productPathDepth {
+		return nil, fmt.Errorf("%w: path %q (normalized as %q) does not match the required format %q", ErrProductInvalidPath, productRelPath, normalizedPath, productPathFormat)
 	}
 
+	productRelPath = filepath.FromSlash(normalizedPath)
+	productPath := filepath.Join(rootDir, productRelPath)
+
 	// Ensure product path is a directory.
 	info, err := os.Stat(productPath)
 	if err != nil {
@@ -334,6 +776,20 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		Requirements: make(map[string]string, 0),
 	}
 
+	// Read the stream defaults that are merged into the image config of
+	// each version.
+	opts := newOptions(options...)
+	defaultsRelPath := filepath.Join(parts[0], FileStreamDefaults)
+
+	defaults, err := readStreamDefaults(filepath.Join(rootDir, defaultsRelPath))
+	if err != nil {
+		if !opts.lenientConfig {
+			return nil, fmt.Errorf("Failed to read stream defaults: %w", err)
+		}
+
+		opts.warn("Ignoring invalid stream defaults", defaultsRelPath, err)
+	}
+
 	// Check product content.
 	files, err := os.ReadDir(productPath)
 	if err != nil {
@@ -341,7 +797,9 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 	}
 
 	var aliases []string
+	var archAliases []string
 	var osName string
+	var withArchAliases bool
 
 	for _, f := range files {
 		if !f.IsDir() {
@@ -355,6 +813,10 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		if err != nil {
 			if errors.Is(err, ErrVersionIncomplete) {
 				// Ignore incomplete versions.
+				if opts.incompleteHandler != nil {
+					opts.incompleteHandler(p, f.Name())
+				}
+
 				continue
 			}
 
@@ -365,32 +827,76 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		if !version.incomplete {
 			// Reset old values.
 			aliases = []string{}
+			archAliases = []string{}
 			p.Requirements = make(map[string]string)
+			p.InstanceTypeRequirements = nil
+
+			config := mergeStreamDefaults(defaults, version.ImageConfig)
 
 			// Set pretty OS name.
-			osName = version.ImageConfig.DistroName
+			osName = config.DistroName
+			withArchAliases = config.ArchAliases
 
 			// Set product requirements.
-			for _, req := range version.ImageConfig.Requirements {
-				// Apply requirements if filter matches the current product.
-				// Note that instance types are not supported because requirements
-				// are applied to the product itself and not a specific version.
-				if shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, "", 0) {
-					for k, v := range req.Requirements {
-						p.Requirements[k] = v
+			for _, req := range config.Requirements {
+				// Requirements without instance types are applied to the
+				// product if filter matches the current product.
+				if len(req.Types) == 0 {
+					if shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, "", 0) {
+						maps.Copy(p.Requirements, req.Requirements)
+					}
+
+					continue
+				}
+
+				// Otherwise, requirements are applied only to the matching
+				// instance types.
+				for _, instanceType := range []shared.DefinitionFilterType{shared.DefinitionFilterTypeContainer, shared.DefinitionFilterTypeVM} {
+					if !shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, instanceType, shared.ImageTargetContainer|shared.ImageTargetVM) {
+						continue
 					}
+
+					if p.InstanceTypeRequirements == nil {
+						p.InstanceTypeRequirements = make(map[string]map[string]string)
+					}
+
+					if p.InstanceTypeRequirements[string(instanceType)] == nil {
+						p.InstanceTypeRequirements[string(instanceType)] = make(map[string]string)
+					}
+
+					maps.Copy(p.InstanceTypeRequirements[string(instanceType)], req.Requirements)
 				}
 			}
 
 			// Evaluate additional aliases.
-			for release, releaseAliases := range version.ImageConfig.ReleaseAliases {
+			releases := []string{p.Release}
+
+			for release, releaseAliases := range config.ReleaseAliases {
 				if release != p.Release {
 					// Skip aliases for other releases.
 					continue
 				}
 
 				for _, releaseAlias := range strings.Split(releaseAliases, ",") {
+					releases = append(releases, releaseAlias)
 					aliases = append(aliases, CreateAliases(p.Distro, releaseAlias, p.Variant)...)
+					archAliases = append(archAliases, CreateArchAlias(p.Distro, releaseAlias, p.Variant, p.Architecture))
+				}
+			}
+
+			// Evaluate variant aliases, which are combined with the
+			// product release and all of its aliases.
+			for variant, variantAliases := range config.VariantAliases {
+				if variant != p.Variant {
+					// Skip aliases for other variants.
+					continue
+				}
+
+				for _, variantAlias := range strings.Split(variantAliases, ",") {
+					for _, release := range releases {
+						aliases = append(aliases, CreateAliases(p.Distro, release, variantAlias)...)
+						archAliases = append(archAliases, CreateArchAlias(p.Distro, release, variantAlias, p.Architecture))
+					}
 				}
 			}
 		}
@@ -404,6 +910,13 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 
 	// Prepend default aliases.
 	aliases = append(CreateAliases(p.Distro, p.Release, p.Variant), aliases...)
+
+	// Append architecture qualified aliases if enabled in the image config.
+	if withArchAliases {
+		aliases = append(aliases, CreateArchAlias(p.Distro, p.Release, p.Variant, p.Architecture))
+		aliases = append(aliases, archAliases...)
+	}
+
 	p.Aliases = strings.Join(aliases, ",")
 
 	// Set OS name.
@@ -441,10 +954,38 @@ func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Vers
 		return nil, err
 	}
 
+	// Read patterns of files that are excluded from the items. Patterns
+	// from the product directory apply to all of its versions.
+	var ignorePatterns []string
+
+	for _, dir := range []string{filepath.Dir(versionPath), versionPath} {
+		patterns, err := ReadIgnoreFile(filepath.Join(dir, FileIgnore))
+		if err != nil {
+			return nil, err
+		}
+
+		ignorePatterns = append(ignorePatterns, patterns...)
+	}
+
+	// Name of the image config file found within the version.
+	var configName string
+
+	// Names of the files that are recognized and ignored. They are logged
+	// to help diagnosing why a version is considered incomplete.
+	var recognized []string
+	var ignored []string
+
 	// Extract relevant items from the version directory.
 	for _, file := range files {
 		if file.IsDir() {
 			// Skip directories.
+			ignored = append(ignored, file.Name()+"/")
+			continue
+		}
+
+		if matchAny(ignorePatterns, file.Name()) {
+			// Skip files excluded by the ignore file.
+			ignored = append(ignored, file.Name())
 			continue
 		}
 
@@ -457,22 +998,90 @@ func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Vers
 			}
 
 			version.Items[file.Name()] = *item
-		} else if file.Name() == FileChecksumSHA256 {
-			// Read the checksum file and convert it to a map
-			// of filename and checksum pairs.
-			checksumPath := filepath.Join(versionPath, file.Name())
-			version.Checksums, err = ReadChecksumFile(checksumPath)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to read checksums file: %w", err)
+		} else if slices.Contains(opts.checksumFiles, file.Name()) {
+			// Prefer the checksum file that is configured first.
+			if version.ChecksumFile == "" || slices.Index(opts.checksumFiles, file.Name()) < slices.Index(opts.checksumFiles, version.ChecksumFile) {
+				version.ChecksumFile = file.Name()
+			}
+		} else if rank := imageConfigRank(opts.configFiles, file.Name()); rank >= 0 {
+			// Prefer image config with the highest precedence.
+			if configName == "" || rank < imageConfigRank(opts.configFiles, configName) {
+				configName = file.Name()
 			}
-		} else if file.Name() == FileImageConfig {
-			// Read the image config file.
-			configPath := filepath.Join(versionPath, file.Name())
-			config, err := shared.ReadYAMLFile(configPath, &shared.Definition{})
+		} else if matchAny(opts.auxFiles, file.Name()) {
+			// Get an auxiliary file and calculate its hash if necessary.
+			auxRelPath := filepath.Join(versionRelPath, file.Name())
+			aux, err := GetItem(rootDir, auxRelPath, options...)
 			if err != nil {
+				return nil, err
+			}
+
+			if version.AuxFiles == nil {
+				version.AuxFiles = make(map[string]Item)
+			}
+
+			version.AuxFiles[file.Name()] = *aux
+		} else {
+			ignored = append(ignored, file.Name())
+			continue
+		}
+
+		recognized = append(recognized, file.Name())
+	}
+
+	// Read the checksum file and convert it to a map of filename
+	// and checksum pairs.
+	if version.ChecksumFile != "" {
+		checksumPath := filepath.Join(versionPath, version.ChecksumFile)
+		version.ChecksumDigests, err = ReadChecksumFileMulti(checksumPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read checksums file: %w", err)
+		}
+
+		version.Checksums = make(map[string]string, len(version.ChecksumDigests))
+		for name, digests := range version.ChecksumDigests {
+			checksum, ok := digests[HashAlgorithmSHA256]
+			if ok {
+				version.Checksums[name] = checksum
+			}
+		}
+
+		// Calculate digests of the items whose strongest checksum is not
+		// SHA-256 and was not calculated already.
+		if opts.calcHashes {
+			for itemName, item := range version.Items {
+				algorithm := strongestAlgorithm(version.ChecksumDigests[itemName])
+				if algorithm == HashAlgorithmSHA256 || item.Digests[algorithm] != "" {
+					continue
+				}
+
+				digests, err := fileDigests(filepath.Join(rootDir, item.Path), []string{algorithm})
+				if err != nil {
+					return nil, err
+				}
+
+				if version.digests == nil {
+					version.digests = make(map[string]map[string]string)
+				}
+
+				version.digests[itemName] = digests
+			}
+		}
+	}
+
+	slog.Debug("Read version directory", "version", versionRelPath, "recognized", recognized, "ignored", ignored)
+
+	// Read the image config file.
+	if configName != "" {
+		configPath := filepath.Join(versionPath, configName)
+		config, err := readImageConfig(configPath)
+		if err != nil {
+			if !opts.lenientConfig {
 				return nil, fmt.Errorf("%w: %w", ErrVersionInvalidImageConfig, err)
 			}
 
+			opts.warn("Ignoring invalid image config", versionRelPath, err)
+		} else {
 			version.ImageConfig = config.Simplestream
 		}
 	}
@@ -480,10 +1089,8 @@ func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Vers
 	// Check whether version is complete, and calculate combined hashes if necessary.
 	metaItem, ok := version.Items[ItemTypeMetadata]
 	if ok {
-		metaItemPath := filepath.Join(versionPath, ItemTypeMetadata)
-
-		for itemName, item := range version.Items {
-			if !slices.Contains([]string{ItemTypeSquashfs, ItemTypeDiskKVM, ItemTypeRootTarXz}, item.Ftype) {
+		for _, item := range version.Items {
+			if !IsPrimaryItemType(item.Ftype) && !slices.Contains([]string{ItemTypeRootTarXz, ItemTypeRootTarZst, ItemTypeRootImg}, item.Ftype) {
 				// Skip files that are not required for combined checksum.
 				continue
 			}
@@ -492,39 +1099,103 @@ func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Vers
 
 			if opts.calcHashes {
 				// Calculate combined hash for the item.
-				itemPath := filepath.Join(versionPath, itemName)
-				itemHash, err = shared.FileHash(sha256.New(), metaItemPath, itemPath)
+				itemHash, err = opts.hashCache.FileHash(rootDir, metaItem.Path, item.Path)
 				if err != nil {
 					return nil, err
 				}
 			}
 
+			if itemHash != "" {
+				if metaItem.Combined == nil {
+					metaItem.Combined = make(map[string]string)
+				}
+
+				metaItem.Combined[item.Ftype] = itemHash
+			}
+
+			if IsPrimaryItemType(item.Ftype) {
+				version.incomplete = false
+			}
+
 			switch item.Ftype {
 			case ItemTypeDiskKVM:
 				metaItem.CombinedSHA256DiskKvmImg = itemHash
-				version.incomplete = false
 
 			case ItemTypeSquashfs:
 				metaItem.CombinedSHA256SquashFs = itemHash
-				version.incomplete = false
 
 			case ItemTypeRootTarXz:
 				metaItem.CombinedSHA256RootXz = itemHash
+
+			case ItemTypeRootTarZst:
+				metaItem.CombinedSHA256RootZst = itemHash
+
+			case ItemTypeRootImg:
+				metaItem.CombinedSHA256RootImg = itemHash
 			}
 		}
 
 		version.Items[ItemTypeMetadata] = metaItem
 	}
 
-	// At least metadata and one of squashfs or qcow2 files must exist
-	// for the version to be considered complete.
+	// If required, both container and VM root file systems must exist for
+	// the version to be considered complete.
+	if !version.incomplete && (opts.requireBothRootfs || version.ImageConfig.RequireBothRootfs) {
+		version.incomplete = !version.HasItemType(ItemTypeSquashfs) || !version.HasItemType(ItemTypeDiskKVM)
+	}
+
+	// At least metadata and one of the primary root file system items must
+	// exist for the version to be considered complete.
 	if version.incomplete && !opts.includeIncomplete {
+		slog.Debug("Version is incomplete", "version", versionRelPath, "hasMetadata", ok, "recognized", recognized, "ignored", ignored)
 		return nil, fmt.Errorf("%w: %q", ErrVersionIncomplete, versionRelPath)
 	}
 
 	return &version, nil
 }
 
+// IsVersionComplete reports whether the version on the given path contains
+// all files required for it to be included in the product catalog. In
+// contrast to GetVersion, an incomplete version is not reported as an error
+// and item hashes are never calculated. The image config validity does not
+// affect the completeness of the version.
+func IsVersionComplete(rootDir string, versionRelPath string, options ...Option) (bool, error) {
+	options = append(options,
+		WithIncompleteVersions(false),
+		WithHashes(false),
+		WithLenientConfig(true),
+		WithWarningHandler(func(string, error) {}),
+	)
+
+	_, err := GetVersion(rootDir, versionRelPath, options...)
+	if err != nil {
+		if errors.Is(err, ErrVersionIncomplete) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// imageConfigRank returns the precedence of the given file name among the image
+// config candidates, where lower value means higher precedence. Uncompressed
+// file ranks before the compressed one of the same candidate. If the file name
+// does not match any candidate, -1 is returned.
+func imageConfigRank(candidates []string, fileName string) int {
+	for i, name := range candidates {
+		switch fileName {
+		case name:
+			return 2 * i
+		case name + ".gz":
+			return 2*i + 1
+		}
+	}
+
+	return -1
+}
+
 // GetItem retrieves item metadata for the file on a given path. If calcHash is
 // set to true, the file's hash is calculated.
 func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, error) {
@@ -541,12 +1212,26 @@ func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, erro
 	item.Path = itemRelPath
 
 	if opts.calcHashes {
-		hash, err := shared.FileHash(sha256.New(), itemPath)
+		hash, err := opts.hashCache.FileHash(rootDir, itemRelPath)
 		if err != nil {
 			return nil, err
 		}
 
 		item.SHA256 = hash
+
+		if len(opts.hashAlgorithms) > 0 {
+			// Reuse the SHA256 hash that is possibly cached.
+			algorithms := slices.DeleteFunc(slices.Clone(opts.hashAlgorithms), func(a string) bool { return a == HashAlgorithmSHA256 })
+
+			item.Digests, err = fileDigests(itemPath, algorithms)
+			if err != nil {
+				return nil, err
+			}
+
+			if slices.Contains(opts.hashAlgorithms, HashAlgorithmSHA256) {
+				item.Digests[HashAlgorithmSHA256] = hash
+			}
+		}
 	}
 
 	switch filepath.Ext(itemPath) {
@@ -556,14 +1241,25 @@ func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, erro
 	case ItemExtDiskKVM:
 		item.Ftype = ItemTypeDiskKVM
 
+	case ".caibx":
+		if strings.HasSuffix(file.Name(), ItemExtSquashfsCaibx) {
+			item.Ftype = ItemTypeSquashfsCaibx
+		} else {
+			item.Ftype = file.Name()
+		}
+
 	case ".vcdiff":
-		parts := strings.Split(file.Name(), ".")
+		// Delta files are located within the target version directory,
+		// therefore, sibling versions are located in the parent directory
+		// of the version directory.
+		versions := siblingVersions(filepath.Dir(filepath.Dir(itemPath)))
+
 		if strings.HasSuffix(file.Name(), ItemExtDiskKVMDelta) {
 			item.Ftype = ItemTypeDiskKVMDelta
-			item.DeltaBase = parts[len(parts)-3]
+			item.DeltaBase = parseDeltaBase(file.Name(), ItemExtDiskKVMDelta, versions)
 		} else {
 			item.Ftype = ItemTypeSquashfsDelta
-			item.DeltaBase = parts[len(parts)-2]
+			item.DeltaBase = parseDeltaBase(file.Name(), ItemExtSquashfsDelta, versions)
 		}
 
 	default:
@@ -573,6 +1269,102 @@ func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, erro
 	return &item, nil
 }
 
+// siblingVersions returns the names of directories within the given product
+// directory. Errors are ignored, as the list is used only as a hint.
+func siblingVersions(productPath string) []string {
+	files, err := os.ReadDir(productPath)
+	if err != nil {
+		return nil
+	}
+
+	var versions []string
+	for _, f := range files {
+		if f.IsDir() {
+			versions = append(versions, f.Name())
+		}
+	}
+
+	return versions
+}
+
+// parseDeltaBase extracts the delta base (source version) from the delta file
+// name in format "<name>.<base><suffix>". Since version names may contain dots,
+// the longest matching known version is preferred. If none of the versions
+// match, the last dot-separated part before the suffix is used.
+func parseDeltaBase(fileName string, suffix string, versions []string) string {
+	name := strings.TrimSuffix(fileName, suffix)
+
+	base := ""
+	for _, v := range versions {
+		if len(v) > len(base) && strings.HasSuffix(name, "."+v) {
+			base = v
+		}
+	}
+
+	if base != "" {
+		return base
+	}
+
+	parts := strings.Split(name, ".")
+	return parts[len(parts)-1]
+}
+
+// readStreamDefaults reads the simplestream section of the stream defaults file
+// on the given path. If the file does not exist, empty defaults are returned.
+func readStreamDefaults(path string) (shared.DefinitionSimplestream, error) {
+	config, err := readImageConfig(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return shared.DefinitionSimplestream{}, nil
+		}
+
+		return shared.DefinitionSimplestream{}, err
+	}
+
+	return config.Simplestream, nil
+}
+
+// mergeStreamDefaults merges the stream defaults into the version's image
+// config. Requirements of the defaults are evaluated before the ones of the
+// image config, hence the latter override the same requirement keys. Release
+// aliases of the image config replace the default aliases of the same release.
+// Other fields are taken from the image config only.
+func mergeStreamDefaults(defaults shared.DefinitionSimplestream, config shared.DefinitionSimplestream) shared.DefinitionSimplestream {
+	if len(defaults.Requirements) > 0 {
+		config.Requirements = append(slices.Clone(defaults.Requirements), config.Requirements...)
+	}
+
+	if len(defaults.ReleaseAliases) > 0 {
+		releaseAliases := maps.Clone(defaults.ReleaseAliases)
+		maps.Copy(releaseAliases, config.ReleaseAliases)
+		config.ReleaseAliases = releaseAliases
+	}
+
+	return config
+}
+
+// readImageConfig reads the image config file on the given path. Files with
+// .gz suffix are decompressed before decoding. Unknown or misplaced keys within
+// the simplestream section are reported as an error.
+func readImageConfig(path string) (*shared.Definition, error) {
+	var content []byte
+	var err error
+
+	if strings.HasSuffix(path, ".gz") {
+		content, err = shared.ReadGZipFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading compressed file: %w", err)
+		}
+	} else {
+		content, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening file: %w", err)
+		}
+	}
+
+	return shared.LoadDefinition(content)
+}
+
 // ReadChecksumFile reads a checksum file and returns a map of filename
 // checksum pairs.
 func ReadChecksumFile(path string) (map[string]string, error) {
@@ -605,8 +1397,138 @@ func ReadChecksumFile(path string) (map[string]string, error) {
 	return checksums, nil
 }
 
+// checksumLengthAlgorithms maps the length of hex encoded digests to the hash
+// algorithms. It is used to detect the algorithm of the checksum lines that
+// do not specify it.
+var checksumLengthAlgorithms = map[int]string{
+	32:  "md5",
+	40:  "sha1",
+	64:  HashAlgorithmSHA256,
+	128: HashAlgorithmSHA512,
+}
+
+// ReadChecksumFileMulti reads a checksum file that may contain digests of
+// different hash algorithms, and returns a map of filenames and their digests
+// mapped by the hash algorithm. Lines in BSD format ("SHA256 (file) = hash")
+// specify the algorithm explicitly, while for lines in the common format
+// ("hash  file") it is detected from the digest length, defaulting to SHA-256.
+// Algorithm names are lower-cased (e.g. "sha256", "md5").
+func ReadChecksumFileMulti(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	checksums := make(map[string]map[string]string)
+
+	add := func(filename string, algorithm string, checksum string) {
+		if checksums[filename] == nil {
+			checksums[filename] = make(map[string]string)
+		}
+
+		checksums[filename][algorithm] = checksum
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Trim all leading and trailing whitespace.
+		line := strings.TrimSpace(scanner.Text())
+
+		// Parse line in BSD format.
+		algorithm, rest, ok := strings.Cut(line, " (")
+		if ok {
+			filename, checksum, ok := strings.Cut(rest, ") = ")
+			if ok && !strings.Contains(algorithm, " ") {
+				add(filename, strings.ToLower(strings.ReplaceAll(algorithm, "-", "")), strings.TrimSpace(checksum))
+				continue
+			}
+		}
+
+		// Split the line into checksum and filename.
+		checksum, filename, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+
+		// Strip the binary mode indicator.
+		filename = strings.TrimPrefix(strings.TrimSpace(filename), "*")
+
+		algorithm, ok = checksumLengthAlgorithms[len(checksum)]
+		if !ok {
+			algorithm = HashAlgorithmSHA256
+		}
+
+		add(filename, algorithm, checksum)
+	}
+
+	return checksums, scanner.Err()
+}
+
+// ReadIgnoreFile reads glob patterns from the ignore file on the given path.
+// Empty lines and lines starting with "#" are skipped. If the file does not
+// exist, no patterns are returned.
+func ReadIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		// Ensure the pattern is valid.
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q in %q: %w", pattern, path, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return patterns, nil
+}
+
+// matchAny returns true if the name matches any of the given glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		ok, _ := filepath.Match(pattern, name)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 // CreateAliases creates aliases from the given distro, release, and variant.
-// It appends them to the aliases slice and returns the updated slice.
+// The first alias always contains all three parts. If release is "current",
+// an alias without release is added. If variant is "default", an alias without
+// variant is added. If both apply, an alias containing only the distro is
+// added as well. The resulting order is:
+//
+//	distro/release/variant
+//	distro/variant          (release "current")
+//	distro/release          (variant "default")
+//	distro                  (release "current" and variant "default")
 func CreateAliases(distro string, release string, variant string) []string {
 	// Use path.Join for aliases to ignore OS specific filepath separator.
 	aliases := []string{path.Join(distro, release, variant)}
@@ -618,13 +1540,21 @@ func CreateAliases(distro string, release string, variant string) []string {
 
 	// If variant is "default" create an additional alias without variant.
 	if variant == "default" {
+		aliases = append(aliases, path.Join(distro, release))
+
+		// If release is also "current", remove release and variant.
 		if release == "current" {
-			// If release is also "current", remove release and variant.
 			aliases = append(aliases, distro)
-		} else {
-			aliases = append(aliases, path.Join(distro, release))
 		}
 	}
 
 	return aliases
 }
+
+// CreateArchAlias returns an architecture qualified alias in format
+// distro/release/variant/arch. Unlike CreateAliases, no shortened aliases
+// are created for the "current" release or the "default" variant, as they
+// would be ambiguous with the default alias scheme.
+func CreateArchAlias(distro string, release string, variant string, arch string) string {
+	return path.Join(distro, release, variant, arch)
+}
@@ -1,11 +1,20 @@
 package stream_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -96,15 +105,125 @@ func TestGetItem(t *testing.T) {
 	}
 }
 
+func TestGetItem_DeltaBaseWithDots(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("2024.04").WithFiles("lxd.tar.xz", "disk.qcow2", "rootfs.squashfs"),
+		testutils.MockVersion("24.04").WithFiles("lxd.tar.xz", "disk.qcow2", "rootfs.squashfs"),
+		testutils.MockVersion("24.04.1").WithFiles(
+			"lxd.tar.xz",
+			"disk.qcow2",
+			"rootfs.squashfs",
+			"disk.24.04.qcow2.vcdiff",
+			"rootfs.24.04.vcdiff",
+			"disk.2024.04.qcow2.vcdiff",
+			"rootfs.2024.04.vcdiff",
+			"disk.unknown.qcow2.vcdiff",
+		),
+	)
+
+	p.Create(t, t.TempDir())
+
+	tests := []struct {
+		Name          string
+		WantFtype     string
+		WantDeltaBase string
+	}{
+		{
+			Name:          "disk.24.04.qcow2.vcdiff",
+			WantFtype:     stream.ItemTypeDiskKVMDelta,
+			WantDeltaBase: "24.04",
+		},
+		{
+			Name:          "rootfs.24.04.vcdiff",
+			WantFtype:     stream.ItemTypeSquashfsDelta,
+			WantDeltaBase: "24.04",
+		},
+		{
+			Name:          "disk.2024.04.qcow2.vcdiff",
+			WantFtype:     stream.ItemTypeDiskKVMDelta,
+			WantDeltaBase: "2024.04",
+		},
+		{
+			Name:          "rootfs.2024.04.vcdiff",
+			WantFtype:     stream.ItemTypeSquashfsDelta,
+			WantDeltaBase: "2024.04",
+		},
+		{
+			// Falls back to the last part if no sibling version matches.
+			Name:          "disk.unknown.qcow2.vcdiff",
+			WantFtype:     stream.ItemTypeDiskKVMDelta,
+			WantDeltaBase: "unknown",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			itemRelPath := filepath.Join(p.RelPath(), "24.04.1", test.Name)
+			item, err := stream.GetItem(p.RootDir(), itemRelPath)
+			require.NoError(t, err)
+			assert.Equal(t, test.WantFtype, item.Ftype)
+			assert.Equal(t, test.WantDeltaBase, item.DeltaBase)
+		})
+	}
+}
+
+func TestGetItem_HashAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	mock := testutils.MockItem("disk.qcow2").WithContent("VM")
+	mock.Create(t, tmpDir)
+
+	item, err := stream.GetItem(tmpDir, "disk.qcow2", stream.WithHashes(true), stream.WithHashAlgorithms(stream.HashAlgorithmSHA256, stream.HashAlgorithmSHA512, stream.HashAlgorithmBLAKE2b))
+	require.NoError(t, err)
+	assert.Equal(t, "8e5abdd396d535012cb3b24b6c998ab6d8f8118fe5c564c21c624c54964464e6", item.SHA256)
+	assert.Equal(t, map[string]string{
+		"sha256":  "8e5abdd396d535012cb3b24b6c998ab6d8f8118fe5c564c21c624c54964464e6",
+		"sha512":  "826bb5b65ae01691fe8c9577f5f19b54fc0c8de71d451cdfdc8c90096a352113ec40c65bb1d4a149d5ec0db09564a3d8cd81647281d2b27f96bd82ca18c03f90",
+		"blake2b": "9432e3138ec6fad78369beda4bec111c7a7c0b46d7b4975a76eee9b9c788f541aa0e42931e107f6736d31bc66d6d877f6e0e0ad5eded8aa1283a6feb71997646",
+	}, item.Digests)
+
+	// Ensure digests are calculated only together with item hashes.
+	item, err = stream.GetItem(tmpDir, "disk.qcow2", stream.WithHashAlgorithms(stream.HashAlgorithmSHA512))
+	require.NoError(t, err)
+	assert.Nil(t, item.Digests)
+
+	// Ensure unknown algorithm is rejected.
+	_, err = stream.GetItem(tmpDir, "disk.qcow2", stream.WithHashes(true), stream.WithHashAlgorithms("md4"))
+	assert.ErrorIs(t, err, stream.ErrUnknownHashAlgorithm)
+}
+
+func TestItemCombinedSHA256(t *testing.T) {
+	item := stream.Item{
+		CombinedSHA256SquashFs:   "legacy-squashfs",
+		CombinedSHA256DiskKvmImg: "legacy-vm",
+		Combined: map[string]string{
+			stream.ItemTypeSquashfs:   "squashfs",
+			stream.ItemTypeRootTarZst: "zst",
+		},
+	}
+
+	// Ensure map values take precedence over legacy fields.
+	assert.Equal(t, "squashfs", item.CombinedSHA256(stream.ItemTypeSquashfs))
+	assert.Equal(t, "zst", item.CombinedSHA256(stream.ItemTypeRootTarZst))
+
+	// Ensure legacy fields are used as a fallback.
+	assert.Equal(t, "legacy-vm", item.CombinedSHA256(stream.ItemTypeDiskKVM))
+	assert.Equal(t, "", item.CombinedSHA256(stream.ItemTypeRootImg))
+}
+
 func TestGetVersion(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		Name        string
-		Mock        testutils.VersionMock
-		CalcHashes  bool
-		WantErr     error
-		WantVersion stream.Version
+		Name          string
+		Mock          testutils.VersionMock
+		CalcHashes    bool
+		LenientConfig bool
+		WantErr       error
+		WantVersion   stream.Version
 	}{
 		{
 			Name: "Version is incomplete: missing rootfs",
@@ -129,6 +248,32 @@ func TestGetVersion(t *testing.T) {
 			),
 			WantErr: stream.ErrVersionIncomplete,
 		},
+		{
+			Name: "Version with invalid image config",
+			Mock: testutils.MockVersion("20241010_1212").
+				WithFiles("lxd.tar.xz", "rootfs.squashfs").
+				SetImageConfig("invalid::config"),
+			WantErr: stream.ErrVersionInvalidImageConfig,
+		},
+		{
+			Name:          "Version with invalid image config (lenient)",
+			LenientConfig: true,
+			Mock: testutils.MockVersion("20241010_1212").
+				WithFiles("lxd.tar.xz", "rootfs.squashfs").
+				SetImageConfig("invalid::config"),
+			WantVersion: stream.Version{
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:  12,
+						Ftype: "lxd.tar.xz",
+					},
+					"rootfs.squashfs": {
+						Size:  12,
+						Ftype: "squashfs",
+					},
+				},
+			},
+		},
 		{
 			Name: "Valid version without item hashes",
 			Mock: testutils.MockVersion("v10").AddItems(
@@ -169,6 +314,10 @@ func TestGetVersion(t *testing.T) {
 						SHA256:                   "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
 						CombinedSHA256DiskKvmImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
 						CombinedSHA256SquashFs:   "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						Combined: map[string]string{
+							"disk-kvm.img": "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+							"squashfs":     "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						},
 					},
 					"disk.qcow2": {
 						Size:   12,
@@ -183,6 +332,56 @@ func TestGetVersion(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:       "Valid version with item hashes: Container and additional root file systems",
+			CalcHashes: true,
+			Mock: testutils.MockVersion("v10").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("rootfs.squashfs"),
+				testutils.MockItem("root.tar.xz"),
+				testutils.MockItem("root.tar.zst"),
+				testutils.MockItem("root.img"),
+			),
+			WantVersion: stream.Version{
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:                   12,
+						Ftype:                  "lxd.tar.xz",
+						SHA256:                 "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+						CombinedSHA256SquashFs: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						CombinedSHA256RootXz:   "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						CombinedSHA256RootZst:  "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						CombinedSHA256RootImg:  "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						Combined: map[string]string{
+							"squashfs":     "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+							"root.tar.xz":  "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+							"root.tar.zst": "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+							"root.img":     "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						},
+					},
+					"rootfs.squashfs": {
+						Size:   12,
+						Ftype:  "squashfs",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+					"root.tar.xz": {
+						Size:   12,
+						Ftype:  "root.tar.xz",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+					"root.tar.zst": {
+						Size:   12,
+						Ftype:  "root.tar.zst",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+					"root.img": {
+						Size:   12,
+						Ftype:  "root.img",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+				},
+			},
+		},
 		{
 			Name:       "Valid version with item hashes: Container and VM including delta files",
 			CalcHashes: true,
@@ -201,6 +400,10 @@ func TestGetVersion(t *testing.T) {
 						SHA256:                   "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
 						CombinedSHA256DiskKvmImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
 						CombinedSHA256SquashFs:   "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						Combined: map[string]string{
+							"disk-kvm.img": "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+							"squashfs":     "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+						},
 					},
 					"disk.qcow2": {
 						Size:   12,
@@ -233,7 +436,7 @@ func TestGetVersion(t *testing.T) {
 		t.Run(test.Name, func(t *testing.T) {
 			test.Mock.Create(t, t.TempDir())
 
-			version, err := stream.GetVersion(test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHashes))
+			version, err := stream.GetVersion(test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHashes), stream.WithLenientConfig(test.LenientConfig))
 			if test.WantErr != nil {
 				assert.ErrorIs(t, err, test.WantErr)
 			} else {
@@ -250,6 +453,403 @@ func TestGetVersion(t *testing.T) {
 	}
 }
 
+func TestGetVersion_ChecksumFiles(t *testing.T) {
+	t.Parallel()
+
+	v := testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "rootfs.squashfs")
+	v.Create(t, t.TempDir())
+
+	checksumFiles := map[string]string{
+		"CHECKSUMS":      "sha-checksums lxd.tar.xz",
+		"SHA256SUMS.txt": "sha-txt lxd.tar.xz",
+	}
+
+	for name, content := range checksumFiles {
+		err := os.WriteFile(filepath.Join(v.AbsPath(), name), []byte(content), os.ModePerm)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		Name             string
+		ChecksumFiles    []string
+		WantChecksumFile string
+		WantChecksums    map[string]string
+	}{
+		{
+			Name:             "Default checksum file name does not exist",
+			ChecksumFiles:    nil,
+			WantChecksumFile: "",
+			WantChecksums:    nil,
+		},
+		{
+			Name:             "Single candidate",
+			ChecksumFiles:    []string{"CHECKSUMS"},
+			WantChecksumFile: "CHECKSUMS",
+			WantChecksums:    map[string]string{"lxd.tar.xz": "sha-checksums"},
+		},
+		{
+			Name:             "First configured candidate is preferred",
+			ChecksumFiles:    []string{stream.FileChecksumSHA256, "SHA256SUMS.txt", "CHECKSUMS"},
+			WantChecksumFile: "SHA256SUMS.txt",
+			WantChecksums:    map[string]string{"lxd.tar.xz": "sha-txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			version, err := stream.GetVersion(v.RootDir(), v.RelPath(), stream.WithChecksumFiles(test.ChecksumFiles...))
+			require.NoError(t, err)
+			assert.Equal(t, test.WantChecksumFile, version.ChecksumFile)
+			assert.Equal(t, test.WantChecksums, version.Checksums)
+		})
+	}
+}
+
+func TestGetVersion_IgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("1").WithFiles("lxd.tar.xz", "root.squashfs", "build.log.tar.xz", "extra.qcow2"))
+	p.Create(t, t.TempDir())
+
+	versionRelPath := filepath.Join(p.RelPath(), "1")
+
+	// Product ignore file applies to all versions.
+	err := os.WriteFile(filepath.Join(p.AbsPath(), stream.FileIgnore), []byte("*.log.tar.xz\n"), os.ModePerm)
+	require.NoError(t, err)
+
+	// Version ignore file applies only to the given version.
+	err = os.WriteFile(filepath.Join(p.AbsPath(), "1", stream.FileIgnore), []byte("# Comment\n\nextra.*\n"), os.ModePerm)
+	require.NoError(t, err)
+
+	version, err := stream.GetVersion(p.RootDir(), versionRelPath)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"lxd.tar.xz", "root.squashfs"}, shared.MapKeys(version.Items))
+
+	// Invalid pattern.
+	err = os.WriteFile(filepath.Join(p.AbsPath(), "1", stream.FileIgnore), []byte("[\n"), os.ModePerm)
+	require.NoError(t, err)
+
+	_, err = stream.GetVersion(p.RootDir(), versionRelPath)
+	require.ErrorIs(t, err, filepath.ErrBadPattern)
+}
+
+func TestGetVersion_ImageConfigFiles(t *testing.T) {
+	t.Parallel()
+
+	v := testutils.MockVersion("1.0").WithFiles("lxd.tar.xz", "rootfs.squashfs")
+	v.Create(t, t.TempDir())
+
+	configFiles := map[string]string{
+		"image.yml":  "yml",
+		"cloud.yaml": "cloud",
+	}
+
+	for name, distroName := range configFiles {
+		content := "simplestream:\n  distro_name: " + distroName + "\n"
+		err := os.WriteFile(filepath.Join(v.AbsPath(), name), []byte(content), os.ModePerm)
+		require.NoError(t, err)
+	}
+
+	err := shared.GZipFile(filepath.Join(v.AbsPath(), "image.yml"), filepath.Join(v.AbsPath(), "image.yml.gz"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name           string
+		ConfigFiles    []string
+		WantDistroName string
+	}{
+		{
+			Name:           "Default config file name does not exist",
+			ConfigFiles:    nil,
+			WantDistroName: "",
+		},
+		{
+			Name:           "Uncompressed candidate is preferred",
+			ConfigFiles:    []string{"image.yml"},
+			WantDistroName: "yml",
+		},
+		{
+			Name:           "First configured candidate is preferred",
+			ConfigFiles:    []string{stream.FileImageConfig, "cloud.yaml", "image.yml"},
+			WantDistroName: "cloud",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			version, err := stream.GetVersion(v.RootDir(), v.RelPath(), stream.WithImageConfigFiles(test.ConfigFiles...))
+			require.NoError(t, err)
+			assert.Equal(t, test.WantDistroName, version.ImageConfig.DistroName)
+		})
+	}
+}
+
+func TestVersionVerifyChecksums(t *testing.T) {
+	t.Parallel()
+
+	items := map[string]stream.Item{
+		"lxd.tar.xz":        {Path: "v/1.0/lxd.tar.xz", Ftype: stream.ItemTypeMetadata, SHA256: "sha-meta"},
+		"rootfs.squashfs":   {Path: "v/1.0/rootfs.squashfs", Ftype: stream.ItemTypeSquashfs, SHA256: "sha-squashfs"},
+		"rootfs.0.9.vcdiff": {Path: "v/1.0/rootfs.0.9.vcdiff", Ftype: stream.ItemTypeSquashfsDelta, SHA256: "sha-delta"},
+	}
+
+	tests := []struct {
+		Name      string
+		Checksums map[string]string
+		WantErrs  []string
+	}{
+		{
+			Name:      "No checksums",
+			Checksums: nil,
+		},
+		{
+			Name: "Matching checksums (delta without checksum)",
+			Checksums: map[string]string{
+				"lxd.tar.xz":      "sha-meta",
+				"rootfs.squashfs": "sha-squashfs",
+			},
+		},
+		{
+			Name: "Mismatched and missing checksums",
+			Checksums: map[string]string{
+				"rootfs.squashfs":   "invalid",
+				"rootfs.0.9.vcdiff": "invalid",
+			},
+			WantErrs: []string{
+				`Checksum mismatch: Item "lxd.tar.xz" in version "v/1.0": expected "", actual "sha-meta"`,
+				`Checksum mismatch: Item "rootfs.0.9.vcdiff" in version "v/1.0": expected "invalid", actual "sha-delta"`,
+				`Checksum mismatch: Item "rootfs.squashfs" in version "v/1.0": expected "invalid", actual "sha-squashfs"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			version := stream.Version{Items: items, Checksums: test.Checksums}
+
+			err := version.VerifyChecksums()
+			if len(test.WantErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorIs(t, err, stream.ErrChecksumMismatch)
+			assert.Equal(t, strings.Join(test.WantErrs, "\n"), err.Error())
+		})
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	cachePath := filepath.Join(rootDir, "streams", "v1", ".hashcache", "images.json")
+
+	filePath := filepath.Join(rootDir, "file")
+	err := os.WriteFile(filePath, []byte(testutils.ItemDefaultContent), os.ModePerm)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filePath)
+	require.NoError(t, err)
+
+	cache, err := stream.NewHashCache(cachePath)
+	require.NoError(t, err)
+
+	hash, err := cache.FileHash(rootDir, "file")
+	require.NoError(t, err)
+	require.Equal(t, testutils.ItemDefaultContentSHA, hash)
+
+	err = cache.Save(rootDir)
+	require.NoError(t, err)
+
+	// Modify content without changing the size and modification time.
+	err = os.WriteFile(filePath, []byte(strings.ToUpper(testutils.ItemDefaultContent)), os.ModePerm)
+	require.NoError(t, err)
+
+	err = os.Chtimes(filePath, info.ModTime(), info.ModTime())
+	require.NoError(t, err)
+
+	// Ensure cached hash is returned after reloading the cache.
+	cache, err = stream.NewHashCache(cachePath)
+	require.NoError(t, err)
+
+	hash, err = cache.FileHash(rootDir, "file")
+	require.NoError(t, err)
+	require.Equal(t, testutils.ItemDefaultContentSHA, hash)
+
+	// Ensure hash is recalculated when modification time changes.
+	err = os.Chtimes(filePath, info.ModTime(), info.ModTime().Add(time.Second))
+	require.NoError(t, err)
+
+	hash, err = cache.FileHash(rootDir, "file")
+	require.NoError(t, err)
+	require.NotEqual(t, testutils.ItemDefaultContentSHA, hash)
+
+	// Ensure nil cache always calculates the hash.
+	var nilCache *stream.HashCache
+	nilHash, err := nilCache.FileHash(rootDir, "file")
+	require.NoError(t, err)
+	require.Equal(t, hash, nilHash)
+}
+
+func TestHashCache_Roots(t *testing.T) {
+	t.Parallel()
+
+	sourceRoot := t.TempDir()
+	extraRoot := t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "images.json")
+
+	err := os.WriteFile(filepath.Join(extraRoot, "extra"), []byte(testutils.ItemDefaultContent), os.ModePerm)
+	require.NoError(t, err)
+
+	cache, err := stream.NewHashCache(cachePath)
+	require.NoError(t, err)
+
+	_, err = cache.FileHash(extraRoot, "extra")
+	require.NoError(t, err)
+
+	// Ensure entries of other roots are not removed when saving the cache.
+	err = cache.Save(sourceRoot)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"extra"`)
+
+	// Ensure a file with the same path within another root is not served
+	// from the cache.
+	filePath := filepath.Join(sourceRoot, "extra")
+	err = os.WriteFile(filePath, []byte(strings.ToUpper(testutils.ItemDefaultContent)), os.ModePerm)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(extraRoot, "extra"))
+	require.NoError(t, err)
+
+	err = os.Chtimes(filePath, info.ModTime(), info.ModTime())
+	require.NoError(t, err)
+
+	cache, err = stream.NewHashCache(cachePath)
+	require.NoError(t, err)
+
+	hash, err := cache.FileHash(sourceRoot, "extra")
+	require.NoError(t, err)
+	require.NotEqual(t, testutils.ItemDefaultContentSHA, hash)
+}
+
+func TestGetProduct_NormalizedPath(t *testing.T) {
+	t.Parallel()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	p.Create(t, t.TempDir())
+
+	// Ensure redundant separators are ignored.
+	for _, relPath := range []string{"images/ubuntu/noble/amd64/cloud/", "./images//ubuntu/noble/amd64/cloud"} {
+		product, err := stream.GetProduct(p.RootDir(), relPath)
+		require.NoError(t, err, relPath)
+		require.Equal(t, "ubuntu:noble:amd64:cloud", product.ID())
+		require.Contains(t, product.Versions, "2024_01_01")
+	}
+
+	// Ensure normalized path is included in the error.
+	_, err := stream.GetProduct(p.RootDir(), "images//ubuntu/noble/amd64/")
+	require.ErrorIs(t, err, stream.ErrProductInvalidPath)
+	require.ErrorContains(t, err, `normalized as "images/ubuntu/noble/amd64"`)
+}
+
+func TestGetProduct_StreamDefaults(t *testing.T) {
+	t.Parallel()
+
+	defaults := strings.Join([]string{
+		"simplestream:",
+		"  release_aliases:",
+		"    noble: 24.04,lts",
+		"    jammy: 22.04",
+		"  requirements:",
+		"  - requirements:",
+		"      secure_boot: false",
+		"      nesting: true",
+		"  - requirements:",
+		"      cdrom_agent: true",
+		"    types:",
+		"    - vm",
+	}, "\n")
+
+	tests := []struct {
+		Name                         string
+		ImageConfig                  []string
+		WantAliases                  string
+		WantRequirements             map[string]string
+		WantInstanceTypeRequirements map[string]map[string]string
+	}{
+		{
+			Name:             "Defaults only",
+			WantAliases:      "ubuntu/noble/cloud,ubuntu/24.04/cloud,ubuntu/lts/cloud",
+			WantRequirements: map[string]string{"secure_boot": "false", "nesting": "true"},
+			WantInstanceTypeRequirements: map[string]map[string]string{
+				"vm": {"cdrom_agent": "true"},
+			},
+		},
+		{
+			Name: "Image config overrides defaults",
+			ImageConfig: []string{
+				"simplestream:",
+				"  release_aliases:",
+				"    noble: 24.04",
+				"  requirements:",
+				"  - requirements:",
+				"      secure_boot: true",
+			},
+			WantAliases:      "ubuntu/noble/cloud,ubuntu/24.04/cloud",
+			WantRequirements: map[string]string{"secure_boot": "true", "nesting": "true"},
+			WantInstanceTypeRequirements: map[string]map[string]string{
+				"vm": {"cdrom_agent": "true"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			version := testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs")
+			if test.ImageConfig != nil {
+				version = version.SetImageConfig(test.ImageConfig...)
+			}
+
+			p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(version)
+			p.Create(t, t.TempDir())
+
+			err := os.WriteFile(filepath.Join(p.RootDir(), "images", stream.FileStreamDefaults), []byte(defaults), 0644)
+			require.NoError(t, err)
+
+			product, err := stream.GetProduct(p.RootDir(), p.RelPath())
+			require.NoError(t, err)
+			require.Equal(t, test.WantAliases, product.Aliases)
+			require.Equal(t, test.WantRequirements, product.Requirements)
+			require.Equal(t, test.WantInstanceTypeRequirements, product.InstanceTypeRequirements)
+		})
+	}
+
+	// Ensure invalid defaults are rejected, unless the config is lenient.
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs"))
+
+	p.Create(t, t.TempDir())
+
+	err := os.WriteFile(filepath.Join(p.RootDir(), "images", stream.FileStreamDefaults), []byte("invalid::defaults"), 0644)
+	require.NoError(t, err)
+
+	_, err = stream.GetProduct(p.RootDir(), p.RelPath())
+	require.ErrorContains(t, err, "Failed to read stream defaults")
+
+	product, err := stream.GetProduct(p.RootDir(), p.RelPath(), stream.WithLenientConfig(true), stream.WithWarningHandler(func(string, error) {}))
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu/noble/cloud", product.Aliases)
+}
+
 func TestGetProduct(t *testing.T) {
 	t.Parallel()
 
@@ -279,59 +879,227 @@ func TestGetProduct(t *testing.T) {
 			WantErr: stream.ErrVersionInvalidImageConfig,
 		},
 		{
-			Name: "Product with valid config (requirements)",
-			Mock: testutils.MockProduct("stream/distro/release/arch/config").AddVersions(
+			Name: "Product with unknown key in simplestream config",
+			Mock: testutils.MockProduct("stream/distro/release/arch/variant").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  requirement:",
+						"  - requirements:",
+						"      secure_boot: false",
+					)),
+			WantErr: shared.ErrDefinitionInvalidSimplestream,
+		},
+		{
+			Name: "Product with valid config (requirements)",
+			Mock: testutils.MockProduct("stream/distro/release/arch/config").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  requirements:",
+						"  - requirements:",
+						"      secure_boot: false",
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/config",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arch",
+				Variant:      "config",
+				Requirements: map[string]string{
+					"secure_boot": "false",
+				},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product with valid compressed config",
+			Mock: testutils.MockProduct("stream/distro/release/arch/variant").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  distro_name: Compressed Distro",
+					).
+					CompressImageConfig()),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/variant",
+				Distro:       "distro",
+				OS:           "Compressed Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arch",
+				Variant:      "variant",
+				Requirements: map[string]string{},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product with both plain and compressed config (plain preferred)",
+			Mock: testutils.MockProduct("stream/distro/release/arch/variant").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					AddItems(testutils.MockItem("image.yaml.gz").WithContent("invalid gzip")).
+					SetImageConfig(
+						"simplestream:",
+						"  distro_name: Plain Distro",
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/variant",
+				Distro:       "distro",
+				OS:           "Plain Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arch",
+				Variant:      "variant",
+				Requirements: map[string]string{},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product version with valid config (requirements and release aliases)",
+			Mock: testutils.MockProduct("stream/distro/myrel/arch/default").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  release_aliases:",
+						"    myrel: test,test2", // Note 2 aliases.
+						"    myrel2: invalid",   // Aliases for different release.
+						"  requirements:",
+						"  - requirements:",
+						"      secure_boot: true",
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/myrel/default,distro/myrel,distro/test/default,distro/test,distro/test2/default,distro/test2",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "myrel",
+				ReleaseTitle: "myrel",
+				Architecture: "arch",
+				Variant:      "default",
+				Requirements: map[string]string{
+					"secure_boot": "true",
+				},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product version with valid config (variant aliases)",
+			Mock: testutils.MockProduct("stream/distro/release/arch/cloud").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  variant_aliases:",
+						"    cloud: cloud-minimal,default", // Note 2 aliases.
+						"    desktop: invalid",             // Aliases for different variant.
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/cloud,distro/release/cloud-minimal,distro/release/default,distro/release",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arch",
+				Variant:      "cloud",
+				Requirements: map[string]string{},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product version with valid config (release and variant aliases)",
+			Mock: testutils.MockProduct("stream/distro/myrel/arch/cloud").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  release_aliases:",
+						"    myrel: test",
+						"  variant_aliases:",
+						"    cloud: cloud-minimal",
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/myrel/cloud,distro/test/cloud,distro/myrel/cloud-minimal,distro/test/cloud-minimal",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "myrel",
+				ReleaseTitle: "myrel",
+				Architecture: "arch",
+				Variant:      "cloud",
+				Requirements: map[string]string{},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {},
+				},
+			},
+		},
+		{
+			Name: "Product version with valid config (architecture aliases)",
+			Mock: testutils.MockProduct("stream/distro/myrel/arch/cloud").AddVersions(
 				testutils.MockVersion("2024_01_01").
 					WithFiles("lxd.tar.xz", "root.squashfs").
 					SetImageConfig(
 						"simplestream:",
-						"  requirements:",
-						"  - requirements:",
-						"      secure_boot: false",
+						"  arch_aliases: true",
+						"  release_aliases:",
+						"    myrel: test",
+						"  variant_aliases:",
+						"    cloud: cloud-minimal",
 					)),
 			IgnoreItems: true,
 			WantProduct: stream.Product{
-				Aliases:      "distro/release/config",
+				Aliases:      "distro/myrel/cloud,distro/test/cloud,distro/myrel/cloud-minimal,distro/test/cloud-minimal,distro/myrel/cloud/arch,distro/test/cloud/arch,distro/myrel/cloud-minimal/arch,distro/test/cloud-minimal/arch",
 				Distro:       "distro",
 				OS:           "Distro",
-				Release:      "release",
-				ReleaseTitle: "release",
+				Release:      "myrel",
+				ReleaseTitle: "myrel",
 				Architecture: "arch",
-				Variant:      "config",
-				Requirements: map[string]string{
-					"secure_boot": "false",
-				},
+				Variant:      "cloud",
+				Requirements: map[string]string{},
 				Versions: map[string]stream.Version{
 					"2024_01_01": {},
 				},
 			},
 		},
 		{
-			Name: "Product version with valid config (requirements and release aliases)",
-			Mock: testutils.MockProduct("stream/distro/myrel/arch/default").AddVersions(
+			Name: "Product version with valid config (architecture aliases of default variant)",
+			Mock: testutils.MockProduct("stream/distro/current/amd64/default").AddVersions(
 				testutils.MockVersion("2024_01_01").
 					WithFiles("lxd.tar.xz", "root.squashfs").
 					SetImageConfig(
 						"simplestream:",
-						"  release_aliases:",
-						"    myrel: test,test2", // Note 2 aliases.
-						"    myrel2: invalid",   // Aliases for different release.
-						"  requirements:",
-						"  - requirements:",
-						"      secure_boot: true",
+						"  arch_aliases: true",
 					)),
 			IgnoreItems: true,
 			WantProduct: stream.Product{
-				Aliases:      "distro/myrel/default,distro/myrel,distro/test/default,distro/test,distro/test2/default,distro/test2",
+				Aliases:      "distro/current/default,distro/default,distro/current,distro,distro/current/default/amd64",
 				Distro:       "distro",
 				OS:           "Distro",
-				Release:      "myrel",
-				ReleaseTitle: "myrel",
-				Architecture: "arch",
+				Release:      "current",
+				ReleaseTitle: "current",
+				Architecture: "amd64",
 				Variant:      "default",
-				Requirements: map[string]string{
-					"secure_boot": "true",
-				},
+				Requirements: map[string]string{},
 				Versions: map[string]stream.Version{
 					"2024_01_01": {},
 				},
@@ -423,6 +1191,64 @@ func TestGetProduct(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "Product version with instance type requirements",
+			Mock: testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+				testutils.MockVersion("1").
+					WithFiles("lxd.tar.xz", "disk.qcow2").
+					SetImageConfig(
+						"simplestream:",
+						"  requirements:",
+						"  - requirements:",
+						"      nesting: true",
+						"  - requirements:",
+						"      secure_boot: false",
+						"    types:",
+						"    - vm",
+						"  - requirements:",
+						"      privileged: false",
+						"    types:",
+						"    - container",
+						"  - requirements:",
+						"      cdrom_agent: true",
+						"    types:",
+						"    - container",
+						"    - vm",
+						"  - requirements:",
+						"      custom: true",
+						"    types:",
+						"    - vm",
+						"    architectures:",
+						"    - arm64",
+					),
+			),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "ubuntu/noble/cloud",
+				Distro:       "ubuntu",
+				OS:           "Ubuntu",
+				Release:      "noble",
+				ReleaseTitle: "noble",
+				Architecture: "amd64",
+				Variant:      "cloud",
+				Requirements: map[string]string{
+					"nesting": "true",
+				},
+				InstanceTypeRequirements: map[string]map[string]string{
+					"container": {
+						"privileged":  "false",
+						"cdrom_agent": "true",
+					},
+					"vm": {
+						"secure_boot": "false",
+						"cdrom_agent": "true",
+					},
+				},
+				Versions: map[string]stream.Version{
+					"1": {},
+				},
+			},
+		},
 		{
 			Name: "Product with no versions (empty)",
 			Mock: testutils.MockProduct("images/ubuntu/current/arm64/cloud"),
@@ -699,6 +1525,149 @@ func TestGetProducts(t *testing.T) {
 	}
 }
 
+func TestGetProducts_SkipErrors(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	mocks := []testutils.ProductMock{
+		testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+			testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs"),
+		),
+		testutils.MockProduct("images/ubuntu/noble/arm64/cloud").AddVersions(
+			testutils.MockVersion("2024_01_01").
+				WithFiles("lxd.tar.xz", "root.squashfs").
+				SetImageConfig("invalid::config"),
+		),
+	}
+
+	for _, m := range mocks {
+		m.Create(t, tmpDir)
+	}
+
+	// Ensure a single unreadable product aborts the traversal by default.
+	_, err := stream.GetProducts(tmpDir, "images")
+	require.ErrorIs(t, err, stream.ErrVersionInvalidImageConfig)
+
+	// Ensure unreadable product is skipped when errors are skipped.
+	products, err := stream.GetProducts(tmpDir, "images", stream.WithSkipErrors(true))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"ubuntu:noble:amd64:cloud"}, shared.MapKeys(products))
+
+	// Ensure errors of the traversal itself are still returned.
+	_, err = stream.GetProducts(tmpDir, "missing", stream.WithSkipErrors(true))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestGetProducts_IncompleteVersionHandler(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	mocks := []testutils.ProductMock{
+		testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs"),
+			testutils.MockVersion("v2").WithFiles("lxd.tar.xz"),
+			testutils.MockVersion(".v3").WithFiles("lxd.tar.xz", "root.squashfs")),
+		testutils.MockProduct("images/ubuntu/noble/arm64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz")),
+	}
+
+	for _, m := range mocks {
+		m.Create(t, tmpDir)
+	}
+
+	var got []string
+
+	handler := stream.WithIncompleteVersionHandler(func(p stream.Product, versionName string) {
+		got = append(got, p.ID()+"/"+versionName)
+	})
+
+	products, err := stream.GetProducts(tmpDir, "images", handler)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"ubuntu:noble:amd64:cloud"}, shared.MapKeys(products))
+
+	// Ensure incomplete and hidden versions are reported, including the
+	// ones of products without complete versions.
+	require.ElementsMatch(t, []string{
+		"ubuntu:noble:amd64:cloud/v2",
+		"ubuntu:noble:amd64:cloud/.v3",
+		"ubuntu:noble:arm64:cloud/v1",
+	}, got)
+
+	// Ensure the handler is not called when incomplete versions are included.
+	got = nil
+
+	_, err = stream.GetProducts(tmpDir, "images", handler, stream.WithIncompleteVersions(true))
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestGetProducts_Subtree(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	mocks := []testutils.ProductMock{
+		testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs")),
+		testutils.MockProduct("images/ubuntu/noble/arm64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs")),
+		testutils.MockProduct("images/ubuntu/jammy/amd64/cloud").AddVersions(
+			testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs")),
+	}
+
+	for _, m := range mocks {
+		m.Create(t, tmpDir)
+	}
+
+	tests := []struct {
+		Name         string
+		RelPath      string
+		WantProducts []string
+	}{
+		{
+			Name:         "Stream",
+			RelPath:      "images",
+			WantProducts: []string{"ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud", "ubuntu:jammy:amd64:cloud"},
+		},
+		{
+			Name:         "Release",
+			RelPath:      "images/ubuntu/noble",
+			WantProducts: []string{"ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud"},
+		},
+		{
+			Name:         "Architecture",
+			RelPath:      "images/ubuntu/noble/amd64/",
+			WantProducts: []string{"ubuntu:noble:amd64:cloud"},
+		},
+		{
+			Name:         "Product",
+			RelPath:      "images/ubuntu/jammy/amd64/cloud",
+			WantProducts: []string{"ubuntu:jammy:amd64:cloud"},
+		},
+		{
+			Name:         "Version",
+			RelPath:      "images/ubuntu/jammy/amd64/cloud/v1",
+			WantProducts: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			products, err := stream.GetProducts(tmpDir, test.RelPath)
+			require.NoError(t, err)
+			require.ElementsMatch(t, test.WantProducts, shared.MapKeys(products))
+
+			// Ensure product relative paths are unaffected by the subtree.
+			for id, p := range products {
+				require.Equal(t, strings.ReplaceAll(id, ":", "/"), filepath.ToSlash(p.RelPath()))
+				require.Contains(t, p.Versions, "v1")
+			}
+		})
+	}
+}
+
 func TestDoesNotExist(t *testing.T) {
 	t.Parallel()
 
@@ -823,6 +1792,100 @@ func TestReadChecksumFile(t *testing.T) {
 	}
 }
 
+func TestReadChecksumFileMulti(t *testing.T) {
+	t.Parallel()
+
+	sha256 := strings.Repeat("a", 64)
+	sha512 := strings.Repeat("b", 128)
+	md5 := strings.Repeat("c", 32)
+
+	entries := []string{
+		"SHA256 (file1) = " + sha256,
+		"MD5 (file1) = " + md5,
+		"SHA512 (file with spaces) = " + sha512,
+		"BLAKE2b (file2) = " + sha512,
+		md5 + "  file2",
+		sha512 + " *file3",
+		"SHA  file4",
+		"invalid",
+		"",
+	}
+
+	filePath := filepath.Join(t.TempDir(), "checksums")
+	err := os.WriteFile(filePath, []byte(strings.Join(entries, "\n")), 0644)
+	require.NoError(t, err)
+
+	checksums, err := stream.ReadChecksumFileMulti(filePath)
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[string]string{
+		"file1":            {"sha256": sha256, "md5": md5},
+		"file with spaces": {"sha512": sha512},
+		"file2":            {"blake2b": sha512, "md5": md5},
+		"file3":            {"sha512": sha512},
+		"file4":            {"sha256": "SHA"},
+	}, checksums)
+}
+
+func TestGetVersion_MixedChecksumFile(t *testing.T) {
+	t.Parallel()
+
+	h := sha512.Sum512([]byte(testutils.ItemDefaultContent))
+	contentSHA512 := hex.EncodeToString(h[:])
+
+	tests := []struct {
+		Name    string
+		Entries []string
+		WantErr bool
+	}{
+		{
+			Name: "Strongest matching digest is used",
+			Entries: []string{
+				"SHA256 (lxd.tar.xz) = invalid",
+				"SHA512 (lxd.tar.xz) = " + contentSHA512,
+				"MD5 (lxd.tar.xz) = invalid",
+				"SHA256 (root.squashfs) = " + testutils.ItemDefaultContentSHA,
+			},
+		},
+		{
+			Name: "Strongest mismatching digest is used",
+			Entries: []string{
+				"SHA256 (lxd.tar.xz) = " + testutils.ItemDefaultContentSHA,
+				"SHA512 (lxd.tar.xz) = invalid",
+				"SHA256 (root.squashfs) = " + testutils.ItemDefaultContentSHA,
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Unsupported digests are ignored",
+			Entries: []string{
+				"MD5 (lxd.tar.xz) = invalid",
+				"SHA256 (root.squashfs) = " + testutils.ItemDefaultContentSHA,
+			},
+			WantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			mock := testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "root.squashfs").SetChecksums(test.Entries...)
+			mock.Create(t, t.TempDir())
+
+			version, err := stream.GetVersion(mock.RootDir(), mock.RelPath(), stream.WithHashes(true))
+			require.NoError(t, err)
+
+			err = version.VerifyChecksums()
+			if test.WantErr {
+				require.ErrorIs(t, err, stream.ErrChecksumMismatch)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// Ensure verification digests are not recorded.
+			require.Empty(t, version.Items["lxd.tar.xz"].Digests)
+		})
+	}
+}
+
 func TestCreateAliases(t *testing.T) {
 	tests := []struct {
 		Name    string
@@ -868,9 +1931,37 @@ func TestCreateAliases(t *testing.T) {
 			Expect: []string{
 				"ubuntu/current/default",
 				"ubuntu/default",
+				"ubuntu/current",
 				"ubuntu",
 			},
 		},
+		{
+			Name:    "Release and variant are case sensitive",
+			Distro:  "ubuntu",
+			Release: "Current",
+			Variant: "Default",
+			Expect: []string{
+				"ubuntu/Current/Default",
+			},
+		},
+		{
+			Name:    "Release named default",
+			Distro:  "ubuntu",
+			Release: "default",
+			Variant: "cloud",
+			Expect: []string{
+				"ubuntu/default/cloud",
+			},
+		},
+		{
+			Name:    "Variant named current",
+			Distro:  "ubuntu",
+			Release: "noble",
+			Variant: "current",
+			Expect: []string{
+				"ubuntu/noble/current",
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -880,3 +1971,191 @@ func TestCreateAliases(t *testing.T) {
 		})
 	}
 }
+
+func TestIsVersionComplete(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name       string
+		Mock       testutils.VersionMock
+		Options    []stream.Option
+		WantResult bool
+	}{
+		{
+			Name:       "Incomplete version: missing rootfs",
+			Mock:       testutils.MockVersion("v1").WithFiles("lxd.tar.xz"),
+			WantResult: false,
+		},
+		{
+			Name:       "Incomplete version: hidden directory",
+			Mock:       testutils.MockVersion(".v1").WithFiles("lxd.tar.xz", "disk.qcow2"),
+			WantResult: false,
+		},
+		{
+			Name:       "Complete version",
+			Mock:       testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs"),
+			WantResult: true,
+		},
+		{
+			Name: "Complete version with invalid image config",
+			Mock: testutils.MockVersion("v1").
+				WithFiles("lxd.tar.xz", "rootfs.squashfs").
+				SetImageConfig("invalid::config"),
+			WantResult: true,
+		},
+		{
+			Name:       "Incomplete version: both rootfs required, missing VM rootfs",
+			Mock:       testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs"),
+			Options:    []stream.Option{stream.WithRequireBothRootfs(true)},
+			WantResult: false,
+		},
+		{
+			Name: "Incomplete version: both rootfs required by image config, missing container rootfs",
+			Mock: testutils.MockVersion("v1").
+				WithFiles("lxd.tar.xz", "disk.qcow2").
+				SetImageConfig(
+					"simplestream:",
+					"  require_both_rootfs: true",
+				),
+			WantResult: false,
+		},
+		{
+			Name:       "Complete version: both rootfs required",
+			Mock:       testutils.MockVersion("v1").WithFiles("lxd.tar.xz", "rootfs.squashfs", "disk.qcow2"),
+			Options:    []stream.Option{stream.WithRequireBothRootfs(true)},
+			WantResult: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			test.Mock.Create(t, t.TempDir())
+
+			complete, err := stream.IsVersionComplete(test.Mock.RootDir(), test.Mock.RelPath(), test.Options...)
+			require.NoError(t, err)
+			assert.Equal(t, test.WantResult, complete)
+		})
+	}
+
+	// Ensure missing version directory is reported as an error.
+	_, err := stream.IsVersionComplete(t.TempDir(), "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestIsVersionComplete_PrimaryItemTypes(t *testing.T) {
+	t.Parallel()
+
+	// Root file system files mapped to their item types.
+	files := map[string]string{
+		"rootfs.squashfs": stream.ItemTypeSquashfs,
+		"disk.qcow2":      stream.ItemTypeDiskKVM,
+		"root.tar.xz":     stream.ItemTypeRootTarXz,
+		"root.tar.zst":    stream.ItemTypeRootTarZst,
+		"root.img":        stream.ItemTypeRootImg,
+	}
+
+	for fileName, ftype := range files {
+		t.Run(fileName, func(t *testing.T) {
+			mock := testutils.MockVersion("v1").WithFiles("lxd.tar.xz", fileName)
+			mock.Create(t, t.TempDir())
+
+			// Ensure only primary item types make the version complete.
+			complete, err := stream.IsVersionComplete(mock.RootDir(), mock.RelPath())
+			require.NoError(t, err)
+			assert.Equal(t, stream.IsPrimaryItemType(ftype), complete)
+		})
+	}
+}
+
+func TestReadLocation(t *testing.T) {
+	t.Parallel()
+
+	catalog := `{"content_id":"images","products":{"ubuntu:noble:amd64:cloud":{}}}`
+
+	var gzCatalog bytes.Buffer
+	gz := gzip.NewWriter(&gzCatalog)
+	_, err := gz.Write([]byte(catalog))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "images.json"), []byte(catalog), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "images.json.gz"), gzCatalog.Bytes(), 0644)
+	require.NoError(t, err)
+
+	// Fail the first request to ensure it is retried.
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	for _, base := range []string{dir, server.URL} {
+		for _, name := range []string{"images.json", "images.json.gz"} {
+			location := stream.JoinLocation(base, name)
+
+			got, err := stream.ReadProductCatalog(ctx, location)
+			require.NoError(t, err, location)
+			require.Equal(t, "images", got.ContentID, location)
+			require.Contains(t, got.Products, "ubuntu:noble:amd64:cloud", location)
+		}
+
+		_, err := stream.ReadLocation(ctx, stream.JoinLocation(base, "missing.json"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		// Ensure downloaded files are not decompressed.
+		target := filepath.Join(t.TempDir(), "images.json.gz")
+
+		err = stream.DownloadLocation(ctx, stream.JoinLocation(base, "images.json.gz"), target)
+		require.NoError(t, err)
+
+		got, err := os.ReadFile(target)
+		require.NoError(t, err)
+		require.Equal(t, gzCatalog.Bytes(), got)
+
+		err = stream.DownloadLocation(ctx, stream.JoinLocation(base, "missing.json"), target)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	require.Equal(t, server.URL+"/streams/v1/index.json", stream.JoinLocation(server.URL+"/", "streams", "v1", "index.json"))
+	require.True(t, stream.IsRemoteLocation("https://images.example.com"))
+	require.False(t, stream.IsRemoteLocation("/srv/images"))
+}
+
+func TestReadLocation_Cancel(t *testing.T) {
+	t.Parallel()
+
+	// Respond only once the request is cancelled.
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Ensure fetching is not retried once the context deadline is exceeded.
+	start := time.Now()
+
+	_, err := stream.ReadLocation(ctx, stream.JoinLocation(server.URL, "images.json"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = stream.DownloadLocation(ctx, stream.JoinLocation(server.URL, "images.json"), filepath.Join(t.TempDir(), "images.json"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(1), requests.Load())
+}
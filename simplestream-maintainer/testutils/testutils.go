@@ -166,7 +166,8 @@ type VersionMock struct {
 	checksums string
 
 	// Image config.
-	imageConfig string
+	imageConfig         string
+	imageConfigCompress bool
 
 	// Files age will be modified once the version is created.
 	setAge time.Duration
@@ -211,6 +212,13 @@ func (v VersionMock) SetImageConfig(lines ...string) VersionMock {
 	return v
 }
 
+// CompressImageConfig ensures the image config is written as a compressed
+// file when a product version is created.
+func (v VersionMock) CompressImageConfig() VersionMock {
+	v.imageConfigCompress = true
+	return v
+}
+
 // Create creates the mocked version directory structure in the given directory.
 func (v *VersionMock) Create(t *testing.T, rootDir string) VersionMock {
 	v.setRootDir(t, rootDir)
@@ -236,6 +244,14 @@ func (v *VersionMock) Create(t *testing.T, rootDir string) VersionMock {
 		configPath := filepath.Join(v.AbsPath(), stream.FileImageConfig)
 		err = os.WriteFile(configPath, []byte(v.imageConfig), os.ModePerm)
 		require.NoError(t, err)
+
+		if v.imageConfigCompress {
+			err = shared.GZipFile(configPath, "")
+			require.NoError(t, err)
+
+			err = os.Remove(configPath)
+			require.NoError(t, err)
+		}
 	}
 
 	// Set files age.
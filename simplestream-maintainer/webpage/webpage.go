@@ -5,7 +5,6 @@ import (
 	"html/template"
 	"os"
 	"path/filepath"
-	"slices"
 	"time"
 
 	"github.com/canonical/lxd-imagebuilder/embed"
@@ -23,7 +22,67 @@ type WebPageImage struct {
 	VersionLastBuildDate string
 	SupportsContainer    bool
 	SupportsVM           bool
-	IsStale              bool
+
+	// IsStale indicates whether the newest product version is stale,
+	// which is the case for abandoned products.
+	IsStale bool
+
+	// HasContainer and HasVM indicate whether any product version (not
+	// only the last one) supports containers and VMs, respectively.
+	HasContainer bool
+	HasVM        bool
+
+	// ProductPath is the path of the product directory that lists all
+	// versions of the product.
+	ProductPath string
+
+	// Versions contains the most recent versions of the product sorted
+	// from the newest to the oldest.
+	Versions []WebPageVersion
+
+	// VersionCount is the total number of product versions, which may
+	// exceed the number of listed versions.
+	VersionCount int
+}
+
+// WebPageVersion represents a single product version listed on the webpage.
+type WebPageVersion struct {
+	Name      string
+	Path      string
+	BuildDate string
+	IsStale   bool
+}
+
+// RecentVersions is the number of the most recent versions listed for each
+// product, unless all versions are requested.
+const RecentVersions = 5
+
+// DefaultStaleDays is the default number of days after which a product
+// version is considered stale.
+const DefaultStaleDays = 8
+
+// Option modifies the webpage content.
+type Option func(*options)
+
+type options struct {
+	allVersions bool
+	staleDays   int
+}
+
+// WithAllVersions ensures that all product versions are listed on the
+// webpage instead of only the most recent ones.
+func WithAllVersions(val bool) Option {
+	return func(o *options) {
+		o.allVersions = val
+	}
+}
+
+// WithStaleDays sets the number of days after which a product version is
+// considered stale. Non-positive values result in DefaultStaleDays.
+func WithStaleDays(days int) Option {
+	return func(o *options) {
+		o.staleDays = days
+	}
 }
 
 // WebPage represents the data that will be used to populate the webpage template.
@@ -35,36 +94,57 @@ type WebPage struct {
 	FooterCopyright string
 	FooterUpdatedAt string
 
+	// StaleDays is the number of days after which a product version is
+	// considered stale.
+	StaleDays int
+
 	Images []WebPageImage
 }
 
 // NewWebPage creates initializes a webpage struct from the given product catalog.
-func NewWebPage(catalog stream.ProductCatalog) *WebPage {
+// The webpage is rendered solely from the catalog, meaning the image
+// directories are never read.
+func NewWebPage(catalog stream.ProductCatalog, opts ...Option) *WebPage {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.staleDays <= 0 {
+		o.staleDays = DefaultStaleDays
+	}
+
 	// This is hardcoded in case we ever decide to manage index.html
 	// using a configuration file. In such case, we just have to parse
 	// those values and the rest of the code will work as expected.
+	now := shared.Now()
+
 	page := WebPage{
 		Title:           "LXD Images",
 		FaviconURL:      "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/favicon.ico",
 		LogoURL:         "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/tag.png",
-		FooterCopyright: fmt.Sprintf("© %d Canonical Ltd.", time.Now().Year()),
-		FooterUpdatedAt: fmt.Sprintf("Last updated: %s UTC", time.Now().UTC().Format("02 Jan 2006 (15:04)")),
+		FooterCopyright: fmt.Sprintf("© %d Canonical Ltd.", now.Year()),
+		FooterUpdatedAt: fmt.Sprintf("Last updated: %s UTC", now.UTC().Format("02 Jan 2006 (15:04)")),
 		Paragraphs: []template.HTML{
 			template.HTML("Images hosted on this server are available in LXD through the predefined remote <code>images:</code>. For detailed instructions about LXD image management, please refer to our <a href='https://documentation.ubuntu.com/lxd/en/latest/howto/images_manage'>How to Manage Images</a> guide in the official documentation."),
 			template.HTML("Images are built daily and we retain the last 2 successful builds of each image for up to 15 days. Thus, if a particular build fails on any given day, the previous successful builds will remain accessible."),
 			template.HTML("If you encounter any issues with the images hosted on our server or have suggestions for improvement, please let us know by <a href='https://github.com/canonical/lxd/issues/new'>opening an issue</a> in the LXD repository."),
 		},
-		Images: []WebPageImage{},
+		StaleDays: o.staleDays,
+		Images:    []WebPageImage{},
 	}
 
+	// Version is considered stale if it was built before the threshold.
+	// Versions with unknown build date are considered stale as well.
+	staleBefore := now.AddDate(0, 0, -o.staleDays)
+
 	// Sort productIds by name.
-	productIds := shared.MapKeys(catalog.Products)
-	slices.Sort(productIds)
+	productIds := shared.MapKeysSorted(catalog.Products)
 
 	// Iterate over products and their versions to extract hosted images.
 	for _, id := range productIds {
 		product := catalog.Products[id]
-		versionIds := shared.MapKeys(product.Versions)
+		versionIds := shared.MapKeysSorted(product.Versions)
 
 		if len(versionIds) == 0 {
 			// Ignore empty products
@@ -76,9 +156,33 @@ func NewWebPage(catalog stream.ProductCatalog) *WebPage {
 			Release:      product.Release,
 			Architecture: product.Architecture,
 			Variant:      product.Variant,
+			ProductPath:  filepath.Join("/", catalog.ContentID, product.RelPath()),
+			VersionCount: len(versionIds),
+		}
+
+		// List the most recent versions, or all of them if requested.
+		for i := len(versionIds) - 1; i >= 0; i-- {
+			if !o.allVersions && len(image.Versions) >= RecentVersions {
+				break
+			}
+
+			name := versionIds[i]
+			version := WebPageVersion{
+				Name:      name,
+				Path:      filepath.Join(image.ProductPath, name),
+				BuildDate: name,
+			}
+
+			timestamp, err := time.Parse("20060102_1504", name)
+			if err == nil {
+				version.BuildDate = timestamp.UTC().Format("2006-01-02 (15:04)")
+			}
+
+			version.IsStale = timestamp.Before(staleBefore)
+
+			image.Versions = append(image.Versions, version)
 		}
 
-		slices.Sort(versionIds)
 		last := versionIds[len(versionIds)-1]
 		lastVersion := product.Versions[last]
 
@@ -92,21 +196,17 @@ func NewWebPage(catalog stream.ProductCatalog) *WebPage {
 			image.VersionPath = filepath.Join("/", catalog.ContentID, product.RelPath(), last)
 		}
 
-		// Image is considered stale if older than 8 days.
-		if timestamp.Before(time.Now().AddDate(0, 0, -8)) {
-			image.IsStale = true
-		}
+		// Product is considered stale if its newest version is stale.
+		image.IsStale = timestamp.Before(staleBefore)
 
-		// Iterate over version items and check if the image supports
-		// containers and/or VMs.
-		for _, item := range lastVersion.Items {
-			if item.Ftype == stream.ItemTypeSquashfs {
-				image.SupportsContainer = true
-			}
+		// Check if the last version supports containers and/or VMs.
+		image.SupportsContainer = lastVersion.HasItemType(stream.ItemTypeSquashfs)
+		image.SupportsVM = lastVersion.HasItemType(stream.ItemTypeDiskKVM)
 
-			if item.Ftype == stream.ItemTypeDiskKVM {
-				image.SupportsVM = true
-			}
+		// Check if any version supports containers and/or VMs.
+		for _, version := range product.Versions {
+			image.HasContainer = image.HasContainer || version.HasItemType(stream.ItemTypeSquashfs)
+			image.HasVM = image.HasVM || version.HasItemType(stream.ItemTypeDiskKVM)
 		}
 
 		page.Images = append(page.Images, image)
@@ -6,6 +6,7 @@ import (
 	"hash"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -13,13 +14,97 @@ import (
 	"strings"
 	"time"
 
-	lxdShared "github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/ioprogress"
 	"github.com/sirupsen/logrus"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/shared/version"
 )
 
+// downloadRateLimiter limits the combined download rate of all downloaders.
+// If nil, downloads are not limited.
+var downloadRateLimiter *shared.RateLimiter
+
+// SetDownloadRateLimit limits the combined download rate of all downloaders
+// to the given number of bytes per second. Zero or negative value removes
+// the limit. It must be called before downloaders are loaded.
+func SetDownloadRateLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		downloadRateLimiter = nil
+		return
+	}
+
+	downloadRateLimiter = shared.NewRateLimiter(bytesPerSecond)
+}
+
+// rateLimitedTransport limits the rate at which response bodies are read.
+type rateLimitedTransport struct {
+	http.RoundTripper
+
+	limiter *shared.RateLimiter
+}
+
+func (t rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = t.limiter.ReadCloser(resp.Body)
+	return resp, nil
+}
+
+// headerTransport sets the default User-Agent on each request, and the
+// configured headers on requests to the given host. Header values are never
+// logged, as they may contain credentials.
+type headerTransport struct {
+	http.RoundTripper
+
+	userAgent string
+	host      string
+	headers   http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The original request must not be modified.
+	req = req.Clone(req.Context())
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	// Limit the configured headers to the source host, so that credentials
+	// are not sent to other hosts (e.g. when redirected).
+	if t.host != "" && req.URL.Host == t.host {
+		for name, values := range t.headers {
+			req.Header[name] = values
+		}
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// newHeaderTransport returns a transport that applies the headers from the
+// source definition to the requests sent to the host of the source URL.
+func newHeaderTransport(transport http.RoundTripper, source shared.DefinitionSource) headerTransport {
+	t := headerTransport{
+		RoundTripper: transport,
+		userAgent:    fmt.Sprintf("lxd-imagebuilder/%s", version.Version),
+		headers:      make(http.Header, len(source.Headers)),
+	}
+
+	u, err := url.Parse(source.URL)
+	if err == nil {
+		t.host = u.Host
+	}
+
+	for name, value := range source.Headers {
+		t.headers.Set(name, value)
+	}
+
+	return t
+}
+
 type common struct {
 	logger     *logrus.Logger
 	definition shared.Definition
@@ -43,10 +128,27 @@ func (s *common) init(ctx context.Context, logger *logrus.Logger, definition sha
 	transport.TLSHandshakeTimeout = 60 * time.Second
 
 	s.client = &http.Client{
-		Transport: transport,
+		Transport: newHeaderTransport(transport, definition.Source),
+	}
+
+	if downloadRateLimiter != nil {
+		s.client.Transport = rateLimitedTransport{
+			RoundTripper: s.client.Transport,
+			limiter:      downloadRateLimiter,
+		}
 	}
 }
 
+// httpClient returns the source's HTTP client, which applies the configured
+// headers. If the source is not initialized, the default client is returned.
+func (s *common) httpClient() *http.Client {
+	if s.client == nil {
+		return http.DefaultClient
+	}
+
+	return s.client
+}
+
 func (s *common) getTargetDir() string {
 	dir := filepath.Join(s.sourcesDir, fmt.Sprintf("%s-%s-%s", s.definition.Image.Distribution, s.definition.Image.Release, s.definition.Image.ArchitectureMapped))
 	dir = strings.Replace(dir, " ", "", -1)
@@ -126,59 +228,59 @@ func (s *common) DownloadHash(def shared.DefinitionImage, file, checksum string,
 			}
 		}
 
-		return destDir, nil
-	}
+		err = s.recordSource(file, imagePath)
+		if err != nil {
+			return "", err
+		}
 
-	image, err := os.Create(imagePath)
-	if err != nil {
-		return "", err
+		return destDir, nil
 	}
 
-	defer image.Close()
+	// Download into a partial file first, which allows resuming the download
+	// if it gets interrupted.
+	partPath := imagePath + ".part"
 
 	progress := func(progress ioprogress.ProgressData) {
 		fmt.Printf("%s\r", progress.Text)
 	}
 
-	done := make(chan struct{})
-	defer close(done)
-
-	if checksum == "" {
-		err = shared.Retry(func() error {
-			_, err = lxdShared.DownloadFileHash(s.ctx, s.client, "lxd-imagebuilder", progress, nil, imagePath, file, "", nil, image)
-			if err != nil {
-				os.Remove(imagePath)
-			}
-
+	err = shared.Retry(func() error {
+		err := downloadFileResumable(s.ctx, s.client, file, partPath, progress)
+		if err != nil {
 			return err
-		}, 3)
-	} else {
-		// Check all file hashes in case multiple have been provided.
-		err = shared.Retry(func() error {
+		}
+
+		if checksum != "" && hashFunc != nil {
+			// Check all file hashes in case multiple have been provided.
 			for _, h := range hashes {
-				if hashFunc != nil {
-					hashFunc.Reset()
-				}
+				hashFunc.Reset()
 
-				_, err = lxdShared.DownloadFileHash(s.ctx, s.client, "lxd-imagebuilder", progress, nil, imagePath, file, h, hashFunc, image)
+				err = shared.VerifyChecksum(partPath, hashFunc, h)
 				if err == nil {
 					break
 				}
 			}
+
 			if err != nil {
-				os.Remove(imagePath)
+				// Corrupted file cannot be resumed.
+				os.Remove(partPath)
+				return err
 			}
+		}
 
-			return err
-		}, 3)
-	}
-
+		return os.Rename(partPath, imagePath)
+	}, 3)
 	if err != nil {
 		return "", err
 	}
 
 	fmt.Println("")
 
+	err = s.recordSource(file, imagePath)
+	if err != nil {
+		return "", err
+	}
+
 	return destDir, nil
 }
 
@@ -3,6 +3,8 @@ package sources
 import (
 	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -12,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/shared/version"
 )
 
 func TestVerifyFile(t *testing.T) {
@@ -140,3 +143,50 @@ func TestCreateGPGKeyring(t *testing.T) {
 	require.False(t, lxdShared.PathExists(keyring), "File should not exist")
 	os.RemoveAll(path.Dir(keyring))
 }
+
+func TestHeaderTransport(t *testing.T) {
+	var gotHeaders http.Header
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeaders = r.Header.Clone()
+	})
+
+	source := httptest.NewServer(handler)
+	defer source.Close()
+
+	other := httptest.NewServer(handler)
+	defer other.Close()
+
+	s := &common{}
+	s.init(context.Background(), nil, shared.Definition{
+		Source: shared.DefinitionSource{
+			URL: source.URL + "/images",
+			Headers: map[string]string{
+				"authorization": "Bearer secret",
+				"User-Agent":    "custom-agent",
+			},
+		},
+	}, "", "", "")
+
+	// Ensure configured headers are sent to the source host.
+	resp, err := s.httpClient().Get(source.URL + "/images/file")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, "Bearer secret", gotHeaders.Get("Authorization"))
+	require.Equal(t, "custom-agent", gotHeaders.Get("User-Agent"))
+
+	// Ensure resumable downloads do not override the configured User-Agent.
+	err = downloadFileResumable(context.Background(), s.httpClient(), source.URL+"/images/file", filepath.Join(t.TempDir(), "file.part"), nil)
+	require.NoError(t, err)
+
+	require.Equal(t, "custom-agent", gotHeaders.Get("User-Agent"))
+
+	// Ensure only the default User-Agent is sent to other hosts.
+	resp, err = s.httpClient().Get(other.URL + "/file")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Empty(t, gotHeaders.Get("Authorization"))
+	require.Equal(t, "lxd-imagebuilder/"+version.Version, gotHeaders.Get("User-Agent"))
+}
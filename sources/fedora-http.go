@@ -1,15 +1,24 @@
 package sources
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
@@ -24,9 +33,9 @@ func (s *fedora) Run() error {
 		s.definition.Source.URL)
 
 	// Get latest build
-	build, err := s.getLatestBuild(baseURL, s.definition.Image.Release)
+	build, err := s.getBuild(baseURL, s.definition.Image.Release, s.definition.Source.Build)
 	if err != nil {
-		return fmt.Errorf("Failed to get latest build: %w", err)
+		return fmt.Errorf("Failed to get build: %w", err)
 	}
 
 	fname := fmt.Sprintf("Fedora-Container-Base-%s-%s.%s.tar.xz",
@@ -130,14 +139,71 @@ func (s *fedora) unpackLayers(rootfsDir string) error {
 	return nil
 }
 
-func (s *fedora) getLatestBuild(URL, release string) (string, error) {
+// getBuild returns the given pinned build if it exists. If no build is pinned,
+// the latest available build is returned.
+func (s *fedora) getBuild(URL, release, pinned string) (string, error) {
+	builds, err := s.getBuilds(URL, release)
+	if err != nil {
+		return "", err
+	}
+
+	if pinned != "" {
+		if !slices.Contains(builds, pinned) {
+			return "", fmt.Errorf("Unable to find pinned build %q", pinned)
+		}
+
+		return pinned, nil
+	}
+
+	if len(builds) == 0 {
+		return "", errors.New("Unable to find latest build")
+	}
+
+	// Sort builds
+	slices.SortFunc(builds, compareFedoraBuilds)
+
+	// Return latest build
+	return builds[len(builds)-1], nil
+}
+
+// compareFedoraBuilds compares the builds by their date and build number.
+// Build numbers are compared numerically, as they may have multiple digits.
+// Builds that cannot be parsed are compared lexically.
+func compareFedoraBuilds(a string, b string) int {
+	dateA, numA, okA := parseFedoraBuild(a)
+	dateB, numB, okB := parseFedoraBuild(b)
+
+	if !okA || !okB {
+		return strings.Compare(a, b)
+	}
+
+	return cmp.Or(strings.Compare(dateA, dateB), cmp.Compare(numA, numB), strings.Compare(a, b))
+}
+
+// parseFedoraBuild returns the date and the build number of the given build.
+func parseFedoraBuild(build string) (string, int, bool) {
+	if !fedoraBuildDirRegex.MatchString(build) {
+		return "", 0, false
+	}
+
+	date, _, _ := strings.Cut(build, ".")
+	num, err := strconv.Atoi(build[strings.LastIndex(build, ".")+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return date, num, true
+}
+
+// getBuilds returns all builds available for the given release.
+func (s *fedora) getBuilds(URL, release string) ([]string, error) {
 	var (
 		resp *http.Response
 		err  error
 	)
 
 	err = shared.Retry(func() error {
-		resp, err = http.Get(fmt.Sprintf("%s/%s", URL, release))
+		resp, err = s.httpClient().Get(fmt.Sprintf("%s/%s", URL, release))
 		if err != nil {
 			return fmt.Errorf("Failed to GET %q: %w", fmt.Sprintf("%s/%s", URL, release), err)
 		}
@@ -145,31 +211,79 @@ func (s *fedora) getLatestBuild(URL, release string) (string, error) {
 		return nil
 	}, 3)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
 	content, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("Failed to read body: %w", err)
+		return nil, fmt.Errorf("Failed to read body: %w", err)
 	}
 
-	// Builds are formatted in one of two ways:
-	//   - <yyyy><mm><dd>.<build_number>
-	//   - <yyyy><mm><dd>.n.<build_number>
-	re := regexp.MustCompile(`\d{8}\.(n\.)?\d`)
+	return findFedoraBuilds(content), nil
+}
 
-	// Find all builds
-	matches := re.FindAllString(string(content), -1)
+// Builds are formatted in one of two ways:
+//   - <yyyy><mm><dd>.<build_number>
+//   - <yyyy><mm><dd>.n.<build_number>
+var fedoraBuildRegex = regexp.MustCompile(`\d{8}\.(n\.)?\d+`)
 
-	if len(matches) == 0 {
-		return "", errors.New("Unable to find latest build")
+// fedoraBuildDirRegex matches directory names that consist of a build only.
+var fedoraBuildDirRegex = regexp.MustCompile(`^\d{8}\.(n\.)?\d+$`)
+
+// findFedoraBuilds returns builds found in the given directory listing. The
+// content is parsed as HTML and builds are matched against the link targets.
+// If no build is found this way, the raw content is scanned for builds instead.
+func findFedoraBuilds(content []byte) []string {
+	var builds []string
+
+	for _, href := range htmlLinks(content) {
+		u, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+
+		build := path.Base(strings.TrimSuffix(u.Path, "/"))
+		if fedoraBuildDirRegex.MatchString(build) && !slices.Contains(builds, build) {
+			builds = append(builds, build)
+		}
 	}
 
-	// Sort builds
-	sort.Strings(matches)
+	if len(builds) > 0 {
+		return builds
+	}
 
-	// Return latest build
-	return matches[len(matches)-1], nil
+	// Fallback to scanning the raw content.
+	return fedoraBuildRegex.FindAllString(string(content), -1)
+}
+
+// htmlLinks returns targets of all links (href attributes of anchor elements)
+// within the given HTML document.
+func htmlLinks(content []byte) []string {
+	var links []string
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return links
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		if token.DataAtom != atom.A {
+			continue
+		}
+
+		for _, attr := range token.Attr {
+			if attr.Key == "href" {
+				links = append(links, attr.Val)
+			}
+		}
+	}
 }
@@ -0,0 +1,112 @@
+package sources
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFedoraHTTP_findFedoraBuilds(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			"Apache directory listing",
+			`<html><body><table>
+<tr><td><a href="?C=N;O=D">Name</a></td></tr>
+<tr><td><a href="/pub/fedora/">Parent Directory</a></td></tr>
+<tr><td><a href="20240101.0/">20240101.0/</a></td></tr>
+<tr><td><a href="20240102.n.1/">20240102.n.1/</a></td></tr>
+</table></body></html>`,
+			[]string{"20240101.0", "20240102.n.1"},
+		},
+		{
+			"Links with absolute paths and query strings",
+			`<ul>
+<li><a href='/Fedora-Container-Base/40/20240415.12/?sort=name'>latest</a></li>
+<li><A HREF="https://example.com/Fedora-Container-Base/40/20240416.n.0">build</A></li>
+<li><a href="20240415.12/">duplicate</a></li>
+</ul>`,
+			[]string{"20240415.12", "20240416.n.0"},
+		},
+		{
+			"Fallback to raw content",
+			`20240101.0 20240102.n.1`,
+			[]string{"20240101.0", "20240102.n.1"},
+		},
+		{
+			"No builds",
+			`<a href="images/">images/</a>`,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, findFedoraBuilds([]byte(tt.content)))
+		})
+	}
+}
+
+func TestFedoraHTTP_getBuild(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/41" {
+			_, _ = fmt.Fprint(w, `<a href="20240601.n.10/">20240601.n.10/</a> <a href="20240601.n.9/">20240601.n.9/</a> <a href="20240531.n.11/">20240531.n.11/</a>`)
+			return
+		}
+
+		_, _ = fmt.Fprint(w, `<a href="20240601.0/">20240601.0/</a> <a href="20240701.0/">20240701.0/</a>`)
+	}))
+	defer server.Close()
+
+	s := &fedora{}
+
+	tests := []struct {
+		name    string
+		release string
+		pinned  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Latest build",
+			release: "40",
+			want:    "20240701.0",
+		},
+		{
+			name:    "Latest build with multi-digit build number",
+			release: "41",
+			want:    "20240601.n.10",
+		},
+		{
+			name:    "Pinned build",
+			release: "40",
+			pinned:  "20240601.0",
+			want:    "20240601.0",
+		},
+		{
+			name:    "Missing pinned build",
+			release: "40",
+			pinned:  "20240501.0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			build, err := s.getBuild(server.URL, tt.release, tt.pinned)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, build)
+		})
+	}
+}
@@ -62,7 +62,7 @@ func (s *funtoo) Run() error {
 		)
 
 		err = shared.Retry(func() error {
-			resp, err = http.Head(tarball)
+			resp, err = s.httpClient().Head(tarball)
 			if err != nil {
 				return fmt.Errorf("Failed to call HEAD on %q: %w", tarball, err)
 			}
@@ -0,0 +1,146 @@
+package sources
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// LockFileName is the name of the file that records the provenance of
+// downloaded sources.
+const LockFileName = "sources.lock"
+
+// ErrLockMismatch is returned when a downloaded source does not match the
+// locked source.
+var ErrLockMismatch = errors.New("Source does not match the lock file")
+
+// LockSource represents a single downloaded source.
+type LockSource struct {
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// Lock records the resolved URL and checksum of each downloaded source.
+type Lock struct {
+	Sources []LockSource `yaml:"sources"`
+
+	mu sync.Mutex
+}
+
+// ReadLockFile reads the lock from the file on the given path.
+func ReadLockFile(path string) (*Lock, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{}
+
+	err = yaml.Unmarshal(content, lock)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse lock file %q: %w", path, err)
+	}
+
+	return lock, nil
+}
+
+// WriteFile writes the lock to the file on the given path.
+func (l *Lock) WriteFile(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	content, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0644)
+}
+
+// Find returns the locked source with the given URL.
+func (l *Lock) Find(URL string) (LockSource, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := slices.IndexFunc(l.Sources, func(s LockSource) bool { return s.URL == URL })
+	if i < 0 {
+		return LockSource{}, false
+	}
+
+	return l.Sources[i], true
+}
+
+// add adds the source to the lock, replacing the existing source with the
+// same URL.
+func (l *Lock) add(source LockSource) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := slices.IndexFunc(l.Sources, func(s LockSource) bool { return s.URL == source.URL })
+	if i < 0 {
+		l.Sources = append(l.Sources, source)
+		return
+	}
+
+	l.Sources[i] = source
+}
+
+var (
+	// downloadLock records downloaded sources. If nil, sources are not recorded.
+	downloadLock *Lock
+
+	// verifyLock is used to verify downloaded sources. If nil, sources are
+	// not verified.
+	verifyLock *Lock
+)
+
+// SetLock sets the lock that records downloaded sources. If locked is not nil,
+// downloaded sources are also verified against it and a download fails if its
+// URL is not locked or its checksum differs from the locked one. It must be
+// called before downloaders are run.
+func SetLock(lock *Lock, locked *Lock) {
+	downloadLock = lock
+	verifyLock = locked
+}
+
+// recordSource records the provenance of the source downloaded from the given
+// URL to the given path and verifies it against the locked source if needed.
+func (s *common) recordSource(URL string, path string) error {
+	if downloadLock == nil && verifyLock == nil {
+		return nil
+	}
+
+	hash, err := shared.FileHash(sha256.New(), path)
+	if err != nil {
+		return fmt.Errorf("Failed to calculate checksum of %q: %w", path, err)
+	}
+
+	source := LockSource{URL: URL, SHA256: hash}
+
+	if verifyLock != nil {
+		locked, ok := verifyLock.Find(URL)
+		if !ok {
+			return fmt.Errorf("%w: Source %q is not locked", ErrLockMismatch, URL)
+		}
+
+		if locked.SHA256 != source.SHA256 {
+			return fmt.Errorf("%w: Source %q: expected %q, actual %q", ErrLockMismatch, URL, locked.SHA256, source.SHA256)
+		}
+	}
+
+	if downloadLock != nil {
+		downloadLock.add(source)
+	}
+
+	s.logger.WithFields(logrus.Fields{"url": URL, "sha256": hash}).Debug("Recorded source")
+
+	return nil
+}
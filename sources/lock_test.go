@@ -0,0 +1,63 @@
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockRecordSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rootfs.tar.xz")
+
+	err := os.WriteFile(path, []byte("rootfs"), 0644)
+	require.NoError(t, err)
+
+	s := &common{logger: logrus.New()}
+	url := "https://example.com/rootfs.tar.xz"
+	sha := "4d42bd3b9c8e2cf1ec3fba6c7e3a5bffe29b19c5b54bf2a8b4e3c9a42b5e6fe7"
+
+	defer SetLock(nil, nil)
+
+	// Record source and write the lock file.
+	lock := &Lock{}
+	SetLock(lock, nil)
+
+	err = s.recordSource(url, path)
+	require.NoError(t, err)
+
+	source, ok := lock.Find(url)
+	require.True(t, ok)
+	require.Equal(t, url, source.URL)
+	require.Len(t, source.SHA256, 64)
+
+	lockPath := filepath.Join(dir, LockFileName)
+
+	err = lock.WriteFile(lockPath)
+	require.NoError(t, err)
+
+	locked, err := ReadLockFile(lockPath)
+	require.NoError(t, err)
+	require.Equal(t, lock.Sources, locked.Sources)
+
+	// Verify unchanged source.
+	SetLock(&Lock{}, locked)
+
+	err = s.recordSource(url, path)
+	require.NoError(t, err)
+
+	// Verify source with different checksum.
+	SetLock(&Lock{}, &Lock{Sources: []LockSource{{URL: url, SHA256: sha}}})
+
+	err = s.recordSource(url, path)
+	require.ErrorIs(t, err, ErrLockMismatch)
+
+	// Verify source that is not locked.
+	SetLock(&Lock{}, &Lock{})
+
+	err = s.recordSource(url, path)
+	require.ErrorIs(t, err, ErrLockMismatch)
+}
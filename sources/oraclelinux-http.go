@@ -64,7 +64,7 @@ func (s *oraclelinux) Run() error {
 			)
 
 			err = shared.Retry(func() error {
-				resp, err = http.Head(fullURL)
+				resp, err = s.httpClient().Head(fullURL)
 				if err != nil {
 					return errors.New("")
 				}
@@ -99,7 +99,7 @@ func (s *oraclelinux) Run() error {
 		)
 
 		err = shared.Retry(func() error {
-			resp, err = http.Head(fullURL)
+			resp, err = s.httpClient().Head(fullURL)
 			if err != nil {
 				return errors.New("")
 			}
@@ -242,7 +242,7 @@ func (s *oraclelinux) unpackISO(latestUpdate, filePath, rootfsDir string) error
 
 			defer f.Close()
 
-			_, err = lxdShared.DownloadFileHash(s.ctx, http.DefaultClient, "", nil, nil, elem[0], elem[1], "", nil, f)
+			_, err = lxdShared.DownloadFileHash(s.ctx, s.httpClient(), "", nil, nil, elem[0], elem[1], "", nil, f)
 			if err != nil {
 				return fmt.Errorf("Failed to download %q: %w", elem[1], err)
 			}
@@ -16,6 +16,8 @@ import (
 	"strings"
 
 	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/ioprogress"
+	"github.com/canonical/lxd/shared/units"
 )
 
 // downloadChecksum downloads or opens URL, and matches fname against the
@@ -46,7 +48,7 @@ func downloadChecksum(ctx context.Context, client *http.Client, targetDir string
 		done := make(chan struct{})
 		defer close(done)
 
-		_, err = lxdShared.DownloadFileHash(ctx, client, "lxd-imagebuilder", nil, nil, "", URL, "", hashFunc, tempFile)
+		_, err = lxdShared.DownloadFileHash(ctx, client, "", nil, nil, "", URL, "", hashFunc, tempFile)
 		// ignore hash mismatch
 		if err != nil && !strings.HasPrefix(err.Error(), "Hash mismatch") {
 			return nil, err
@@ -66,6 +68,145 @@ func downloadChecksum(ctx context.Context, client *http.Client, targetDir string
 	return nil, errors.New("Could not find checksum")
 }
 
+// downloadFileResumable downloads the file from the given URL into the given
+// partial file. If the partial file already exists (for example, from a
+// previously interrupted download), the download is resumed using an HTTP range
+// request conditioned on the validator (ETag or Last-Modified) of the response
+// that started the download. The validator is stored next to the partial file.
+// If there is no validator, the remote file has changed, or the server does not
+// support range requests, the file is downloaded from the beginning. On error,
+// the partial file is kept so that the next attempt can resume the download.
+func downloadFileResumable(ctx context.Context, client *http.Client, URL string, partPath string, progress func(ioprogress.ProgressData)) error {
+	validatorPath := partPath + ".validator"
+
+	var offset int64
+	var validator string
+
+	info, err := os.Stat(partPath)
+	if err == nil && info.Size() > 0 {
+		// Without a validator, there is no way to ensure the partial file
+		// is a prefix of the current remote file.
+		content, err := os.ReadFile(validatorPath)
+		if err == nil && len(content) > 0 {
+			offset = info.Size()
+			validator = string(content)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Ensure the server resumes the download at the requested offset.
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			_ = os.Remove(partPath)
+			return fmt.Errorf("Unexpected content range %q for %s", resp.Header.Get("Content-Range"), URL)
+		}
+
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// New download, changed remote file, or server without range
+		// support. Start from the beginning.
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Partial file is not a prefix of the remote file. Remove it,
+		// so that the next attempt starts from the beginning.
+		_ = os.Remove(partPath)
+		_ = os.Remove(validatorPath)
+		return fmt.Errorf("Unable to resume download of %s: %s", URL, resp.Status)
+	default:
+		return fmt.Errorf("Unable to fetch %s: %s", URL, resp.Status)
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	// Store the validator before downloading, so that an interrupted
+	// download can be resumed.
+	if resp.StatusCode == http.StatusOK {
+		validator = responseValidator(resp)
+		if validator != "" {
+			err = os.WriteFile(validatorPath, []byte(validator), 0644)
+		} else {
+			err = os.Remove(validatorPath)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to store download validator: %w", err)
+		}
+	}
+
+	body := resp.Body
+	if progress != nil {
+		filename := filepath.Base(strings.TrimSuffix(partPath, ".part"))
+
+		body = &ioprogress.ProgressReader{
+			ReadCloser: resp.Body,
+			Tracker: &ioprogress.ProgressTracker{
+				Length: resp.ContentLength,
+				Handler: func(percent int64, speed int64) {
+					progress(ioprogress.ProgressData{Text: fmt.Sprintf("%s: %d%% (%s/s)", filename, percent, units.GetByteSizeString(speed, 2))})
+				},
+			},
+		}
+	}
+
+	_, err = io.Copy(file, body)
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %w", URL, err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Download is complete, hence the validator is no longer needed.
+	err = os.Remove(validatorPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// responseValidator returns the validator that can be used in the If-Range
+// header to resume the download of the given response. Weak entity tags are
+// not allowed in If-Range, hence the Last-Modified header is used instead.
+// An empty string is returned if the response has no usable validator.
+func responseValidator(resp *http.Response) string {
+	etag := resp.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
 func getChecksum(fname string, hashLen int, r io.Reader) []string {
 	scanner := bufio.NewScanner(r)
 
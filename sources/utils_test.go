@@ -2,8 +2,16 @@ package sources
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -147,3 +155,118 @@ Z4iksZrx82g=
 		require.Equal(t, tt.want, got)
 	}
 }
+
+func Test_downloadFileResumable(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+
+	tests := []struct {
+		name          string
+		partial       string
+		validator     string
+		supportsRange bool
+		wantRange     string
+	}{
+		{
+			name:          "New download",
+			supportsRange: true,
+		},
+		{
+			name:          "Resume partial download",
+			partial:       content[:500],
+			validator:     `"v1"`,
+			supportsRange: true,
+			wantRange:     "bytes=500-",
+		},
+		{
+			name:          "Partial download without validator",
+			partial:       "garbage",
+			supportsRange: true,
+		},
+		{
+			name:          "Partial download of changed file",
+			partial:       "garbage",
+			validator:     `"v0"`,
+			supportsRange: true,
+			wantRange:     "bytes=7-",
+		},
+		{
+			name:          "Server without range support",
+			partial:       content[:500],
+			validator:     `"v1"`,
+			supportsRange: false,
+			wantRange:     "bytes=500-",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRange string
+			var gotIfRange string
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRange = r.Header.Get("Range")
+				gotIfRange = r.Header.Get("If-Range")
+
+				w.Header().Set("ETag", `"v1"`)
+
+				if !tt.supportsRange {
+					_, _ = w.Write([]byte(content))
+					return
+				}
+
+				http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+			}))
+			defer server.Close()
+
+			partPath := filepath.Join(t.TempDir(), "file.part")
+
+			if tt.partial != "" {
+				err := os.WriteFile(partPath, []byte(tt.partial), 0644)
+				require.NoError(t, err)
+			}
+
+			if tt.validator != "" {
+				err := os.WriteFile(partPath+".validator", []byte(tt.validator), 0644)
+				require.NoError(t, err)
+			}
+
+			err := downloadFileResumable(context.Background(), server.Client(), server.URL, partPath, nil)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.wantRange, gotRange)
+			require.Equal(t, tt.validator, gotIfRange)
+
+			got, err := os.ReadFile(partPath)
+			require.NoError(t, err)
+			require.Equal(t, content, string(got))
+
+			// Ensure the validator is removed once the download completes.
+			require.NoFileExists(t, partPath+".validator")
+		})
+	}
+}
+
+func Test_downloadFileResumable_Interrupted(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+
+		// Send only a part of the content and abort the connection.
+		_, _ = w.Write([]byte(content[:500]))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	partPath := filepath.Join(t.TempDir(), "file.part")
+
+	err := downloadFileResumable(context.Background(), server.Client(), server.URL, partPath, nil)
+	require.Error(t, err)
+
+	// Ensure the validator of the interrupted download is kept.
+	validator, err := os.ReadFile(partPath + ".validator")
+	require.NoError(t, err)
+	require.Equal(t, `"v1"`, string(validator))
+}